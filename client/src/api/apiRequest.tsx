@@ -30,21 +30,24 @@ export const apiRequest = async (
     const url = `${process.env.REACT_APP_API_URL}/api/${collection_name}${
       endpoint ? `/${endpoint}` : ""
     }`;
+    // Send the JWT stored at login so the server knows who is asking
+    const token = localStorage.getItem("token");
+    const headers = token ? { Authorization: `Bearer ${token}` } : {};
     let response: AxiosResponse;
 
     // Handle different HTTP methods
     switch (method) {
       case "GET":
-        response = await axios.get(url, { params: data });
+        response = await axios.get(url, { params: data, headers });
         break;
       case "POST":
-        response = await axios.post(url, data);
+        response = await axios.post(url, data, { headers });
         break;
       case "PUT":
-        response = await axios.put(url, data);
+        response = await axios.put(url, data, { headers });
         break;
       case "DELETE":
-        response = await axios.delete(url, { data });
+        response = await axios.delete(url, { data, headers });
         break;
       default:
         throw new Error("Invalid HTTP method");
@@ -43,10 +43,12 @@ function EditProfile() {
       email: formData.email,
     };
     try {
-      const response = await apiRequest("users", "PUT", `${user?.id}`, {
-        ...formattedFormData,
-        password: user?.password,
-      });
+      const response = await apiRequest(
+        "users",
+        "PUT",
+        `${user?.id}`,
+        formattedFormData
+      );
 
       if (response.success) {
         dispatch({ type: "UPDATE_USER", payload: response.data });
@@ -77,7 +79,7 @@ function EditProfile() {
 
   useEffect(() => {
     const fetchUserData = async () => {
-      const response = await apiRequest("get_user", "GET", `${user?.id}`);
+      const response = await apiRequest("users", "GET", "me");
       if (response.success) {
         dispatch({ type: "LOGIN", payload: response.data });
       }
@@ -155,7 +155,7 @@ const Forum: React.FC = () => {
 
   useEffect(() => {
     const fetchUserData = async () => {
-      const response = await apiRequest("get_user", "GET", `${user?.id}`);
+      const response = await apiRequest("users", "GET", "me");
       if (response.success) {
         dispatch({ type: "LOGIN", payload: response.data });
       } else {
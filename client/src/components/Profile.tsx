@@ -14,7 +14,7 @@ function Profile() {
 
   useEffect(() => {
     const fetchUserData = async () => {
-      const response = await apiRequest("get_user", "GET", `${user?.id}`);
+      const response = await apiRequest("users", "GET", "me");
       if (response.success) {
         dispatch({ type: "LOGIN", payload: response.data });
       } else {
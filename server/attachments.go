@@ -0,0 +1,571 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/damiancxliew/web-forum/blob"
+	"github.com/damiancxliew/web-forum/events"
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// attachmentURLExpiry is how long a signed download URL stays valid
+const attachmentURLExpiry = 15 * time.Minute
+
+// allowedAttachmentTypes are the sniffed content types accepted for upload
+var allowedAttachmentTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"text/plain":      true,
+	"application/pdf": true,
+	"application/zip": true,
+}
+
+// envBytes reads a positive size in bytes from the environment
+func envBytes(name string, fallback int64) int64 {
+	value, err := strconv.ParseInt(os.Getenv(name), 10, 64)
+	if err != nil || value < 1 {
+		return fallback
+	}
+	return value
+}
+
+// maxUploadSize caps a single upload; MAX_UPLOAD_SIZE overrides the 10 MB default
+func maxUploadSize() int64 {
+	return envBytes("MAX_UPLOAD_SIZE", 10<<20)
+}
+
+// attachmentQuota caps the total size of a user's uploads; ATTACHMENT_QUOTA
+// overrides the 100 MB default
+func attachmentQuota() int64 {
+	return envBytes("ATTACHMENT_QUOTA", 100<<20)
+}
+
+// newBlobStore picks where uploads are kept from BLOB_BACKEND: "local" (the
+// default, under BLOB_PATH) or "s3" for S3 and S3-compatible services
+func newBlobStore(ctx context.Context) (blob.Store, error) {
+	switch backend := os.Getenv("BLOB_BACKEND"); backend {
+	case "", "local":
+		path := os.Getenv("BLOB_PATH")
+		if path == "" {
+			path = "data/blobs"
+		}
+		return blob.NewLocalStore(path)
+	case "s3":
+		return blob.NewS3Store(ctx, blob.S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			UseSSL:    os.Getenv("S3_USE_SSL") != "false",
+		})
+	default:
+		return nil, fmt.Errorf("unknown BLOB_BACKEND %q", backend)
+	}
+}
+
+// sniffContentType detects the type of a file from its first bytes, ignoring
+// whatever the client claimed
+func sniffContentType(head []byte) string {
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return mediaType
+}
+
+// newStorageKey returns a random, unguessable key for a new blob
+func newStorageKey() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("attachments/%s/%s", time.Now().UTC().Format("2006/01"), hex.EncodeToString(random)), nil
+}
+
+// attachmentResponse is an attachment with a short-lived download URL
+type attachmentResponse struct {
+	models.Attachment
+	URL string `json:"url"`
+}
+
+// attachmentURL returns a signed download URL for the attachment. Stores that
+// presign their own URLs serve the download directly.
+func (r *Repository) attachmentURL(ctx context.Context, attachment models.Attachment) (string, error) {
+	if presigner, ok := r.Blobs.(blob.Presigner); ok {
+		return presigner.PresignedURL(ctx, attachment.StorageKey, attachment.Filename, attachment.ContentType, attachmentURLExpiry)
+	}
+	expires := time.Now().Add(attachmentURLExpiry).Unix()
+	signature := signPayload(fmt.Sprintf("attachment:%d:%d", attachment.ID, expires))
+	return fmt.Sprintf("%s/api/attachments/%d/download?expires=%d&signature=%s",
+		apiURL(), attachment.ID, expires, signature), nil
+}
+
+// withURLs adds download URLs to attachments and their variants. Attachments
+// still being processed have no URL yet.
+func (r *Repository) withURLs(ctx context.Context, attachments []models.Attachment) []attachmentResponse {
+	responses := make([]attachmentResponse, 0, len(attachments))
+	for _, attachment := range attachments {
+		url := ""
+		if attachment.Status == models.AttachmentReady {
+			var err error
+			if url, err = r.attachmentURL(ctx, attachment); err != nil {
+				log.Println("Attachment URL error:", err)
+			}
+		}
+		for i := range attachment.Variants {
+			attachment.Variants[i].URL = variantURL(attachment.ID, attachment.Variants[i])
+		}
+		responses = append(responses, attachmentResponse{Attachment: attachment, URL: url})
+	}
+	return responses
+}
+
+// errQuotaExceeded is returned when an upload would take its user over quota
+var errQuotaExceeded = errors.New("upload quota exceeded")
+
+// attachmentUsage returns the total size of the user's uploads
+func attachmentUsage(db *gorm.DB, userID uint) int64 {
+	var used int64
+	db.Model(&models.Attachment{}).Where("user_id = ?", userID).Select("COALESCE(SUM(size), 0)").Scan(&used)
+	return used
+}
+
+// formFile returns the "file" field of a multipart upload, enforcing the size
+// limit. It responds and returns false if there is no acceptable file.
+func formFile(c *gin.Context) (*multipart.FileHeader, bool) {
+	maxSize := maxUploadSize()
+	// Leave room for the other form fields around the file
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSize+64<<10)
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": fmt.Sprintf("Files can be at most %d bytes", maxSize)})
+			return nil, false
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"message": "No file uploaded"})
+		return nil, false
+	}
+	if header.Size > maxSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": fmt.Sprintf("Files can be at most %d bytes", maxSize)})
+		return nil, false
+	}
+	return header, true
+}
+
+// checkQuota responds and returns false if an upload of size bytes would take
+// the user over their quota. It turns away uploads early, before the file is
+// stored; storeUpload checks again as it saves the record.
+func (r *Repository) checkQuota(c *gin.Context, userID uint, size int64) bool {
+	if used := attachmentUsage(r.DB, userID); used+size > attachmentQuota() {
+		quotaExceeded(c, used)
+		return false
+	}
+	return true
+}
+
+func quotaExceeded(c *gin.Context, used int64) {
+	c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+		"message": "Upload quota exceeded",
+		"data":    gin.H{"used": used, "quota": attachmentQuota()},
+	})
+}
+
+// UploadAttachment stores a file on a thread or comment the user wrote. Send
+// it as multipart form data with a "file" field and either thread_id or comment_id.
+func (r *Repository) UploadAttachment(c *gin.Context) {
+	header, ok := formFile(c)
+	if !ok {
+		return
+	}
+
+	userID := currentUserID(c)
+	if r.isNewUser(userID) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "New users cannot upload attachments yet"})
+		return
+	}
+	attachment := models.Attachment{UserID: userID, Size: header.Size}
+	if !r.resolveAttachmentTarget(c, &attachment) {
+		return
+	}
+
+	if !r.checkQuota(c, userID, header.Size) {
+		return
+	}
+
+	file, contentType, ok := readUpload(c, header)
+	if !ok {
+		return
+	}
+	defer file.Close()
+
+	attachment.ContentType = contentType
+	if !allowedAttachmentTypes[attachment.ContentType] {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"message": fmt.Sprintf("Files of type %s are not allowed", attachment.ContentType)})
+		return
+	}
+
+	attachment.Filename = sanitizeFilename(header.Filename)
+	attachment.Purpose = models.PurposePost
+	if !r.storeUpload(c, &attachment, file) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "File uploaded successfully",
+		"data":    r.withURLs(c.Request.Context(), []models.Attachment{attachment})[0],
+	})
+}
+
+// storeUpload saves the file and its record, then queues images for
+// processing. It responds and returns false if either fails.
+func (r *Repository) storeUpload(c *gin.Context, attachment *models.Attachment, file io.Reader) bool {
+	attachment.Status = models.AttachmentReady
+	if isProcessedImage(attachment.ContentType) {
+		attachment.Status = models.AttachmentPending
+	}
+
+	key, err := newStorageKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not store file"})
+		return false
+	}
+	attachment.StorageKey = key
+
+	ctx := c.Request.Context()
+	if err := r.Blobs.Put(ctx, attachment.StorageKey, file, attachment.Size, attachment.ContentType); err != nil {
+		log.Println("Blob put error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not store file"})
+		return false
+	}
+	used := int64(0)
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		// Locking the user makes concurrent uploads take turns, so together
+		// they cannot go over the quota
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&models.User{}, attachment.UserID).Error
+		if err != nil {
+			return err
+		}
+		if used = attachmentUsage(tx, attachment.UserID); used+attachment.Size > attachmentQuota() {
+			return errQuotaExceeded
+		}
+		return tx.Create(attachment).Error
+	})
+	if err != nil {
+		r.Blobs.Delete(ctx, attachment.StorageKey)
+		if errors.Is(err, errQuotaExceeded) {
+			quotaExceeded(c, used)
+			return false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not save attachment"})
+		return false
+	}
+
+	if attachment.Status == models.AttachmentPending {
+		r.Events.Publish(events.Event{
+			Type:         events.AttachmentUploaded,
+			ThreadID:     attachment.ThreadID,
+			CategoryID:   r.threadCategoryID(attachment.ThreadID),
+			UserID:       attachment.UserID,
+			AttachmentID: attachment.ID,
+		})
+	}
+	return true
+}
+
+// readUpload opens an uploaded file and sniffs its type, responding and
+// returning false if it cannot be read
+func readUpload(c *gin.Context, header *multipart.FileHeader) (multipart.File, string, bool) {
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not read file"})
+		return nil, "", false
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		file.Close()
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not read file"})
+		return nil, "", false
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not read file"})
+		return nil, "", false
+	}
+	return file, sniffContentType(head[:n]), true
+}
+
+// resolveAttachmentTarget fills in the thread and comment an upload belongs to
+// from the form, checking the user may attach files there. It responds and
+// returns false otherwise.
+func (r *Repository) resolveAttachmentTarget(c *gin.Context, attachment *models.Attachment) bool {
+	threadID, _ := strconv.ParseUint(c.PostForm("thread_id"), 10, 64)
+	commentID, _ := strconv.ParseUint(c.PostForm("comment_id"), 10, 64)
+	if (threadID == 0) == (commentID == 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Provide either thread_id or comment_id"})
+		return false
+	}
+
+	authorID := uint(0)
+	if commentID != 0 {
+		comment := models.Comment{}
+		if err := r.DB.First(&comment, commentID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"message": "Comment not found"})
+			return false
+		}
+		id := comment.ID
+		attachment.CommentID = &id
+		attachment.ThreadID = comment.ThreadID
+		authorID = comment.UserID
+	} else {
+		thread := models.Thread{}
+		if err := r.DB.First(&thread, threadID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"message": "Thread not found"})
+			return false
+		}
+		attachment.ThreadID = thread.ID
+		authorID = thread.UserID
+	}
+
+	if authorID != attachment.UserID && !r.hasRole(attachment.UserID, models.RoleAdmin, models.RoleModerator) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "You can only attach files to your own posts"})
+		return false
+	}
+	return true
+}
+
+// sanitizeFilename keeps the base name of an uploaded file, without path or
+// control characters, for display and downloads
+func sanitizeFilename(name string) string {
+	name = name[strings.LastIndexAny(name, `/\`)+1:]
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	if name == "" || name == "." || name == ".." {
+		return "file"
+	}
+	return name
+}
+
+// loadAttachment fetches the attachment named by the :id param and checks the
+// current user can see the post it is on, responding if not. Avatars are on
+// no post and anyone can see them.
+func (r *Repository) loadAttachment(c *gin.Context) (*models.Attachment, bool) {
+	attachment := models.Attachment{}
+	if err := r.DB.Preload("Variants").First(&attachment, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Attachment not found"})
+		return nil, false
+	}
+	if attachment.Purpose != models.PurposePost {
+		return &attachment, true
+	}
+	if _, ok := r.checkThreadVisible(c, attachment.ThreadID); !ok {
+		return nil, false
+	}
+	if attachment.CommentID != nil {
+		if _, ok := r.checkAttachmentComment(c, *attachment.CommentID); !ok {
+			return nil, false
+		}
+	}
+	return &attachment, true
+}
+
+// checkAttachmentComment is checkThreadVisible for a comment, which it
+// returns: deleted ones show only to moderators and hidden ones to their
+// authors as well
+func (r *Repository) checkAttachmentComment(c *gin.Context, commentID uint) (models.Comment, bool) {
+	comment := models.Comment{}
+	if err := r.DB.Unscoped().First(&comment, commentID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Comment not found"})
+		return comment, false
+	}
+	userID := currentUserID(c)
+	if comment.DeletedAt.Valid && !r.hasRole(userID, models.RoleAdmin, models.RoleModerator) {
+		c.JSON(http.StatusGone, gin.H{"message": "Comment was deleted"})
+		return comment, false
+	}
+	if comment.Hidden && !r.canSeeHidden(userID, comment.UserID) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "Comment is hidden pending review"})
+		return comment, false
+	}
+	return comment, true
+}
+
+// GetAttachments lists the attachments of a thread (including its comments)
+// or of a single comment: ?thread_id=1 or ?comment_id=2
+func (r *Repository) GetAttachments(c *gin.Context) {
+	userID := currentUserID(c)
+	query := r.DB.Preload("Variants").Order("created_at")
+	threadID := uint(0)
+	if commentID, err := strconv.ParseUint(c.Query("comment_id"), 10, 64); err == nil {
+		comment, ok := r.checkAttachmentComment(c, uint(commentID))
+		if !ok {
+			return
+		}
+		threadID = comment.ThreadID
+		query = query.Where("comment_id = ?", commentID)
+	} else if id, err := strconv.ParseUint(c.Query("thread_id"), 10, 64); err == nil {
+		threadID = uint(id)
+		query = query.Where("thread_id = ?", threadID)
+		// Leave out files on comments the user cannot see
+		if !r.hasRole(userID, models.RoleAdmin, models.RoleModerator) {
+			query = query.Where("comment_id IS NULL OR comment_id IN (?)", r.DB.Model(&models.Comment{}).
+				Select("id").Where("thread_id = ? AND (hidden = ? OR user_id = ?)", threadID, false, userID))
+		}
+	} else {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Provide either thread_id or comment_id"})
+		return
+	}
+
+	if _, ok := r.checkThreadVisible(c, threadID); !ok {
+		return
+	}
+
+	attachments := []models.Attachment{}
+	if err := query.Find(&attachments).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get attachments"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": r.withURLs(c.Request.Context(), attachments)})
+}
+
+// GetAttachment returns an attachment with a fresh download URL
+func (r *Repository) GetAttachment(c *gin.Context) {
+	attachment, ok := r.loadAttachment(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": r.withURLs(c.Request.Context(), []models.Attachment{*attachment})[0]})
+}
+
+// DownloadAttachment serves a file through a signed URL from attachmentURL
+func (r *Repository) DownloadAttachment(c *gin.Context) {
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	payload := fmt.Sprintf("attachment:%s:%d", c.Param("id"), expires)
+	if err != nil || time.Now().Unix() > expires ||
+		!hmac.Equal([]byte(c.Query("signature")), []byte(signPayload(payload))) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "Download link is invalid or expired"})
+		return
+	}
+
+	attachment := models.Attachment{}
+	if err := r.DB.First(&attachment, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Attachment not found"})
+		return
+	}
+	if attachment.Status != models.AttachmentReady {
+		c.JSON(http.StatusConflict, gin.H{"message": "Attachment is not ready", "status": attachment.Status})
+		return
+	}
+	body, err := r.Blobs.Get(c.Request.Context(), attachment.StorageKey)
+	if err != nil {
+		log.Println("Blob get error:", err)
+		c.JSON(http.StatusNotFound, gin.H{"message": "Attachment not found"})
+		return
+	}
+	defer body.Close()
+
+	c.Header("Content-Disposition", blob.Disposition(attachment.Filename, attachment.ContentType))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", "default-src 'none'; sandbox")
+	c.Header("Cache-Control", "private, max-age=900")
+	c.DataFromReader(http.StatusOK, attachment.Size, attachment.ContentType, body, nil)
+}
+
+// DeleteAttachment lets the uploader or a moderator remove a file
+func (r *Repository) DeleteAttachment(c *gin.Context) {
+	attachment := models.Attachment{}
+	if err := r.DB.Preload("Variants").First(&attachment, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Attachment not found"})
+		return
+	}
+	userID := currentUserID(c)
+	if attachment.UserID != userID && !r.hasRole(userID, models.RoleAdmin, models.RoleModerator) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "You cannot delete this attachment"})
+		return
+	}
+
+	if err := r.deleteAttachments([]models.Attachment{attachment}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not delete attachment"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Attachment deleted successfully"})
+}
+
+// GetAttachmentQuota reports how much of their upload quota the user has used
+func (r *Repository) GetAttachmentQuota(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"used": attachmentUsage(r.DB, currentUserID(c)), "quota": attachmentQuota()})
+}
+
+// deleteAttachments removes the files and variants and then their records.
+// Attachments must be loaded with their variants.
+func (r *Repository) deleteAttachments(attachments []models.Attachment) error {
+	ctx := context.Background()
+	for _, attachment := range attachments {
+		for _, variant := range attachment.Variants {
+			if err := r.Blobs.Delete(ctx, variant.StorageKey); err != nil {
+				log.Println("Blob delete error:", err)
+				return err
+			}
+		}
+		if err := r.Blobs.Delete(ctx, attachment.StorageKey); err != nil {
+			log.Println("Blob delete error:", err)
+			return err
+		}
+		if err := r.DB.Where("attachment_id = ?", attachment.ID).Delete(&models.AttachmentVariant{}).Error; err != nil {
+			return err
+		}
+		if err := r.DB.Delete(&attachment).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SubscribeAttachments removes the attachments of purged threads, comments
+// and users. Deleted ones keep theirs while they sit in the trash.
+func (r *Repository) SubscribeAttachments() {
+	r.Events.Subscribe("attachments", func(event events.Event) {
+		attachments := []models.Attachment{}
+		switch event.Type {
+		case events.ThreadPurged:
+			r.DB.Preload("Variants").Where("thread_id = ? AND purpose = ?", event.ThreadID, models.PurposePost).Find(&attachments)
+		case events.CommentPurged:
+			r.DB.Preload("Variants").Where("comment_id = ?", event.CommentID).Find(&attachments)
+		case events.UserPurged:
+			r.DB.Preload("Variants").Where("user_id = ?", event.AuthorID).Find(&attachments)
+		}
+		if err := r.deleteAttachments(attachments); err != nil {
+			log.Printf("Attachment cleanup error on %s: %v", event.Type, err)
+		}
+	}, events.ThreadPurged, events.CommentPurged, events.UserPurged)
+}
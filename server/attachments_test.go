@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSniffContentType(t *testing.T) {
+	tests := []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), "image/png"},
+		{"jpeg", []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00"), "image/jpeg"},
+		{"gif", []byte("GIF89a\x01\x00\x01\x00"), "image/gif"},
+		{"webp", []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), "image/webp"},
+		{"pdf", []byte("%PDF-1.7\n"), "application/pdf"},
+		{"zip", []byte("PK\x03\x04\x14\x00"), "application/zip"},
+		{"text", []byte("just some notes\n"), "text/plain"},
+		{"html claimed as text", []byte("<!DOCTYPE html><script>alert(1)</script>"), "text/html"},
+		{"svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`), "text/plain"},
+		{"binary", bytes.Repeat([]byte{0x00, 0x01, 0xfe}, 20), "application/octet-stream"},
+		{"empty", nil, "text/plain"},
+	}
+	for _, test := range tests {
+		if got := sniffContentType(test.head); got != test.want {
+			t.Errorf("%s: sniffContentType = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSniffedTypesAllowed(t *testing.T) {
+	tests := map[string]bool{
+		"image/png":                true,
+		"application/pdf":          true,
+		"text/html":                false,
+		"image/svg+xml":            false,
+		"application/octet-stream": false,
+	}
+	for contentType, want := range tests {
+		if got := allowedAttachmentTypes[contentType]; got != want {
+			t.Errorf("allowedAttachmentTypes[%q] = %v, want %v", contentType, got, want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// validRequestID limits the request IDs accepted from clients and proxies
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// auditExportBatchSize is how many entries are loaded at a time for CSV export
+const auditExportBatchSize = 500
+
+// requestIDMiddleware gives every request an ID, reusing a valid X-Request-ID
+// from the client or a proxy, and echoes it back in the response
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader("X-Request-ID")
+		if !validRequestID.MatchString(requestID) {
+			buf := make([]byte, 16)
+			if _, err := rand.Read(buf); err == nil {
+				requestID = hex.EncodeToString(buf)
+			}
+		}
+		c.Set("request_id", requestID)
+		c.Header("X-Request-ID", requestID)
+		c.Next()
+	}
+}
+
+// snapshot encodes the state of a target for the audit log. A nil value is
+// stored as NULL.
+func snapshot(value interface{}) json.RawMessage {
+	if value == nil {
+		return nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		log.Println("Audit snapshot error:", err)
+		return nil
+	}
+	return encoded
+}
+
+// newAuditLog describes a privileged action taken in this request. c may be
+// nil for actions the server takes on its own.
+func newAuditLog(c *gin.Context, action, targetType string, targetID uint, before, after interface{}) models.AuditLog {
+	entry := models.AuditLog{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Before:     snapshot(before),
+		After:      snapshot(after),
+	}
+	if c != nil {
+		entry.ActorID = currentUserID(c)
+		entry.IP = c.ClientIP()
+		entry.UserAgent = c.Request.UserAgent()
+		entry.RequestID = c.GetString("request_id")
+	}
+	return entry
+}
+
+// audit records a privileged action after it succeeded. Failing to record it
+// does not undo the action, so the error is only logged.
+func (r *Repository) audit(c *gin.Context, action, targetType string, targetID uint, before, after interface{}) {
+	entry := newAuditLog(c, action, targetType, targetID, before, after)
+	if err := r.DB.Create(&entry).Error; err != nil {
+		log.Printf("Audit log error on %s %s %d: %v", action, targetType, targetID, err)
+	}
+}
+
+// auditQuery filters the audit log by ?actor_id=, ?action=, ?target_type=,
+// ?target_id=, ?request_id= and a ?from= / ?to= time range (RFC 3339)
+func (r *Repository) auditQuery(c *gin.Context) (*gorm.DB, bool) {
+	query := r.DB.Model(&models.AuditLog{})
+	for _, param := range []string{"actor_id", "target_id"} {
+		if raw := c.Query(param); raw != "" {
+			id, err := strconv.ParseUint(raw, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"message": param + " must be a number"})
+				return nil, false
+			}
+			query = query.Where(param+" = ?", id)
+		}
+	}
+	for _, param := range []string{"action", "target_type", "request_id"} {
+		if value := c.Query(param); value != "" {
+			query = query.Where(param+" = ?", value)
+		}
+	}
+	for param, condition := range map[string]string{"from": "created_at >= ?", "to": "created_at < ?"} {
+		if raw := c.Query(param); raw != "" {
+			at, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"message": param + " must be an RFC 3339 time"})
+				return nil, false
+			}
+			query = query.Where(condition, at)
+		}
+	}
+	return query.Session(&gorm.Session{}), true
+}
+
+// GetAuditLog lists audit log entries, newest first
+func (r *Repository) GetAuditLog(c *gin.Context) {
+	query, ok := r.auditQuery(c)
+	if !ok {
+		return
+	}
+	page, pageSize := pagination(c)
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get audit log"})
+		return
+	}
+	entries := []models.AuditLog{}
+	err := query.Order("created_at DESC, id DESC").Limit(pageSize).Offset((page - 1) * pageSize).Find(&entries).Error
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get audit log"})
+		return
+	}
+	c.JSON(http.StatusOK, paginated(entries, page, pageSize, total))
+}
+
+// ExportAuditLog streams the entries matching the same filters as
+// GetAuditLog as CSV, oldest first
+func (r *Repository) ExportAuditLog(c *gin.Context) {
+	query, ok := r.auditQuery(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="audit-log.csv"`)
+	writer := csv.NewWriter(c.Writer)
+	writer.Write([]string{"id", "created_at", "actor_id", "action", "target_type", "target_id",
+		"ip", "user_agent", "request_id", "before", "after"})
+
+	batch := []models.AuditLog{}
+	err := query.FindInBatches(&batch, auditExportBatchSize, func(tx *gorm.DB, _ int) error {
+		for _, entry := range batch {
+			writer.Write([]string{
+				strconv.FormatUint(uint64(entry.ID), 10),
+				entry.CreatedAt.UTC().Format(time.RFC3339),
+				strconv.FormatUint(uint64(entry.ActorID), 10),
+				entry.Action,
+				entry.TargetType,
+				strconv.FormatUint(uint64(entry.TargetID), 10),
+				entry.IP,
+				entry.UserAgent,
+				entry.RequestID,
+				string(entry.Before),
+				string(entry.After),
+			})
+		}
+		writer.Flush()
+		return writer.Error()
+	}).Error
+	if err != nil {
+		// The header is already sent, so the best we can do is cut the file short
+		log.Println("Audit log export error:", err)
+	}
+	writer.Flush()
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/damiancxliew/web-forum/events"
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// badgeCheckInterval is how often the batch job looks for users who earned
+// badges that no single event awards, such as membership anniversaries
+const badgeCheckInterval = time.Hour
+
+// badgeRule decides who has earned a badge. onEvent returns the users an event
+// may have qualified and is nil for rules only the batch job checks; batch
+// returns every qualifying user.
+type badgeRule struct {
+	events  []string
+	onEvent func(db *gorm.DB, event events.Event) []uint
+	batch   func(db *gorm.DB) []uint
+}
+
+// badgeRules are the built-in rules badges can refer to by name
+var badgeRules = map[string]badgeRule{
+	"first_post": {
+		events: []string{events.ThreadCreated, events.CommentCreated},
+		onEvent: func(db *gorm.DB, event events.Event) []uint {
+			return []uint{event.AuthorID}
+		},
+		batch: func(db *gorm.DB) []uint {
+			var userIDs []uint
+			db.Raw("SELECT user_id FROM threads WHERE deleted_at IS NULL UNION SELECT user_id FROM comments WHERE deleted_at IS NULL").Scan(&userIDs)
+			return userIDs
+		},
+	},
+	"comments_100": {
+		events: []string{events.CommentCreated},
+		onEvent: func(db *gorm.DB, event events.Event) []uint {
+			var count int64
+			db.Model(&models.Comment{}).Where("user_id = ?", event.AuthorID).Count(&count)
+			if count < 100 {
+				return nil
+			}
+			return []uint{event.AuthorID}
+		},
+		batch: func(db *gorm.DB) []uint {
+			var userIDs []uint
+			db.Model(&models.Comment{}).Group("user_id").Having("COUNT(*) >= ?", 100).Pluck("user_id", &userIDs)
+			return userIDs
+		},
+	},
+	"thread_50_replies": {
+		events: []string{events.CommentCreated},
+		onEvent: func(db *gorm.DB, event events.Event) []uint {
+			var count int64
+			db.Model(&models.Comment{}).Where("thread_id = ?", event.ThreadID).Count(&count)
+			if count < 50 {
+				return nil
+			}
+			thread := models.Thread{}
+			if err := db.Select("user_id").First(&thread, event.ThreadID).Error; err != nil {
+				return nil
+			}
+			return []uint{thread.UserID}
+		},
+		batch: func(db *gorm.DB) []uint {
+			var userIDs []uint
+			db.Model(&models.Thread{}).
+				Joins("JOIN comments ON comments.thread_id = threads.id AND comments.deleted_at IS NULL").
+				Group("threads.id, threads.user_id").
+				Having("COUNT(*) >= ?", 50).
+				Distinct().Pluck("threads.user_id", &userIDs)
+			return userIDs
+		},
+	},
+	"member_1_year": {
+		batch: func(db *gorm.DB) []uint {
+			var userIDs []uint
+			// Unknown join dates (NULL) are not evidence of a year's membership
+			db.Model(&models.User{}).Where("created_at IS NOT NULL AND created_at <= ?", time.Now().AddDate(-1, 0, 0)).Pluck("id", &userIDs)
+			return userIDs
+		},
+	},
+}
+
+// builtinBadges are kept in the database at startup so rules can award them
+var builtinBadges = []models.Badge{
+	{Slug: "first-post", Name: "First Post", Description: "Wrote a first thread or comment", Tier: models.BadgeBronze, Icon: "pencil", Rule: "first_post"},
+	{Slug: "conversationalist", Name: "Conversationalist", Description: "Wrote 100 comments", Tier: models.BadgeSilver, Icon: "chat", Rule: "comments_100"},
+	{Slug: "popular-thread", Name: "Popular Thread", Description: "Started a thread with 50 replies", Tier: models.BadgeGold, Icon: "flame", Rule: "thread_50_replies"},
+	{Slug: "one-year-member", Name: "One Year Member", Description: "Has been a member for a year", Tier: models.BadgeSilver, Icon: "cake", Rule: "member_1_year"},
+}
+
+func isValidTier(tier string) bool {
+	return tier == models.BadgeBronze || tier == models.BadgeSilver || tier == models.BadgeGold
+}
+
+// seedBadges creates the built-in badges or refreshes their definitions
+func seedBadges(db *gorm.DB) {
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "slug"}},
+		DoUpdates: clause.AssignmentColumns([]string{"name", "description", "tier", "icon", "rule"}),
+	}).Create(&builtinBadges).Error
+	if err != nil {
+		log.Println("Badge seed error:", err)
+	}
+}
+
+// awardBadge gives a user a badge unless they already hold it. Only the award
+// that actually creates the record announces it, so replicas racing on the
+// same award notify once.
+func (r *Repository) awardBadge(badge models.Badge, userID uint, awardedBy *uint, reason string) (bool, error) {
+	award := models.UserBadge{UserID: userID, BadgeID: badge.ID, AwardedBy: awardedBy, Reason: reason, AwardedAt: time.Now()}
+	result := r.DB.Omit("Badge").Clauses(clause.OnConflict{DoNothing: true}).Create(&award)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+
+	event := events.Event{
+		Type:       events.BadgeAwarded,
+		AuthorID:   userID,
+		Detail:     badge.Name,
+		Recipients: []uint{userID},
+	}
+	if awardedBy != nil {
+		event.UserID = *awardedBy
+	}
+	r.Events.Publish(event)
+	return true, nil
+}
+
+// ruleBadges returns the badges awarded by rules
+func (r *Repository) ruleBadges() []models.Badge {
+	badges := []models.Badge{}
+	if err := r.DB.Where("rule <> ''").Find(&badges).Error; err != nil {
+		log.Println("Badge lookup error:", err)
+	}
+	return badges
+}
+
+// SubscribeBadges evaluates badge rules as forum events happen
+func (r *Repository) SubscribeBadges() {
+	types := map[string]bool{}
+	for _, rule := range badgeRules {
+		for _, eventType := range rule.events {
+			types[eventType] = true
+		}
+	}
+	eventTypes := []string{}
+	for eventType := range types {
+		eventTypes = append(eventTypes, eventType)
+	}
+
+	r.Events.Subscribe("badges", func(event events.Event) {
+		for _, badge := range r.ruleBadges() {
+			rule, ok := badgeRules[badge.Rule]
+			if !ok || rule.onEvent == nil || !containsString(rule.events, event.Type) {
+				continue
+			}
+			for _, userID := range rule.onEvent(r.DB, event) {
+				if userID == 0 {
+					continue
+				}
+				if _, err := r.awardBadge(badge, userID, nil, ""); err != nil {
+					log.Printf("Badge award error for %s: %v", badge.Slug, err)
+				}
+			}
+		}
+	}, eventTypes...)
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// StartBadgeScheduler periodically runs every rule over all users, awarding
+// badges no event triggers and any an event missed
+func (r *Repository) StartBadgeScheduler(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(badgeCheckInterval)
+		defer ticker.Stop()
+		for {
+			r.awardBatchBadges()
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (r *Repository) awardBatchBadges() {
+	for _, badge := range r.ruleBadges() {
+		rule, ok := badgeRules[badge.Rule]
+		if !ok {
+			log.Printf("Badge %s refers to unknown rule %s", badge.Slug, badge.Rule)
+			continue
+		}
+
+		var holders []uint
+		r.DB.Model(&models.UserBadge{}).Where("badge_id = ?", badge.ID).Pluck("user_id", &holders)
+		held := make(map[uint]bool, len(holders))
+		for _, userID := range holders {
+			held[userID] = true
+		}
+
+		for _, userID := range rule.batch(r.DB) {
+			if userID == 0 || held[userID] {
+				continue
+			}
+			if _, err := r.awardBadge(badge, userID, nil, ""); err != nil {
+				log.Printf("Badge award error for %s: %v", badge.Slug, err)
+			}
+		}
+	}
+}
+
+// badgeSummary is a badge definition with how many users hold it
+type badgeSummary struct {
+	models.Badge
+	Holders int64 `json:"holders"`
+}
+
+func (r *Repository) GetBadges(c *gin.Context) {
+	badges := []models.Badge{}
+	if err := r.DB.Order("id").Find(&badges).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get badges"})
+		return
+	}
+
+	var counts []struct {
+		BadgeID uint
+		Holders int64
+	}
+	r.DB.Model(&models.UserBadge{}).Select("badge_id, COUNT(*) AS holders").Group("badge_id").Scan(&counts)
+	holders := map[uint]int64{}
+	for _, count := range counts {
+		holders[count.BadgeID] = count.Holders
+	}
+
+	summaries := make([]badgeSummary, len(badges))
+	for i, badge := range badges {
+		summaries[i] = badgeSummary{Badge: badge, Holders: holders[badge.ID]}
+	}
+	c.JSON(http.StatusOK, summaries)
+}
+
+// badgeHolder is one entry in the list of users holding a badge
+type badgeHolder struct {
+	UserID    uint      `json:"user_id"`
+	Username  string    `json:"username"`
+	AwardedAt time.Time `json:"awarded_at"`
+}
+
+// GetBadgeHolders lists who holds a badge, most recently awarded first
+func (r *Repository) GetBadgeHolders(c *gin.Context) {
+	badge := models.Badge{}
+	if err := r.DB.First(&badge, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Badge not found"})
+		return
+	}
+	page, pageSize := pagination(c)
+
+	query := r.DB.Table("user_badges").
+		Joins("JOIN users ON users.id = user_badges.user_id").
+		Where("user_badges.badge_id = ?", badge.ID).
+		Session(&gorm.Session{})
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get badge holders"})
+		return
+	}
+	holders := []badgeHolder{}
+	err := query.Select("user_badges.user_id, users.username, user_badges.awarded_at").
+		Order("user_badges.awarded_at DESC").
+		Offset((page - 1) * pageSize).Limit(pageSize).
+		Scan(&holders).Error
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get badge holders"})
+		return
+	}
+	c.JSON(http.StatusOK, paginated(holders, page, pageSize, total))
+}
+
+// GetUserBadges lists the badges a user holds, most recent first
+func (r *Repository) GetUserBadges(c *gin.Context) {
+	awards := []models.UserBadge{}
+	err := r.DB.Preload("Badge").Where("user_id = ?", c.Param("id")).Order("awarded_at DESC").Find(&awards).Error
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get badges"})
+		return
+	}
+	c.JSON(http.StatusOK, awards)
+}
+
+// CreateBadge defines a badge that admins award by hand
+func (r *Repository) CreateBadge(c *gin.Context) {
+	badge := models.Badge{}
+	if err := c.ShouldBindJSON(&badge); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Request failed"})
+		return
+	}
+	badge.ID = 0
+	badge.Rule = ""
+	badge.Slug = strings.ToLower(strings.TrimSpace(badge.Slug))
+	badge.Name = strings.TrimSpace(badge.Name)
+	if badge.Slug == "" || badge.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Badges need a slug and a name"})
+		return
+	}
+	if badge.Tier == "" {
+		badge.Tier = models.BadgeBronze
+	}
+	if !isValidTier(badge.Tier) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Tier must be bronze, silver or gold"})
+		return
+	}
+	if err := r.DB.Where("slug = ?", badge.Slug).First(&models.Badge{}).Error; err == nil {
+		c.JSON(http.StatusConflict, gin.H{"message": "A badge with this slug already exists"})
+		return
+	}
+
+	if err := r.DB.Create(&badge).Error; err != nil {
+		log.Println("DB Create Error:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not create badge"})
+		return
+	}
+	r.audit(c, models.AuditBadgeCreate, models.TargetBadge, badge.ID, nil, badge)
+	c.JSON(http.StatusOK, badge)
+}
+
+// AwardBadge lets an admin award any badge to a user: {"user_id": 1, "reason": "..."}
+func (r *Repository) AwardBadge(c *gin.Context) {
+	badge := models.Badge{}
+	if err := r.DB.First(&badge, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Badge not found"})
+		return
+	}
+	var awardRequest struct {
+		UserID uint   `json:"user_id"`
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&awardRequest); err != nil || awardRequest.UserID == 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Provide the user_id to award"})
+		return
+	}
+	if err := r.DB.First(&models.User{}, awardRequest.UserID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+
+	adminID := currentUserID(c)
+	awarded, err := r.awardBadge(badge, awardRequest.UserID, &adminID, strings.TrimSpace(awardRequest.Reason))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not award badge"})
+		return
+	}
+	if !awarded {
+		c.JSON(http.StatusConflict, gin.H{"message": "User already holds this badge"})
+		return
+	}
+	r.audit(c, models.AuditBadgeAward, models.TargetBadge, badge.ID, nil,
+		gin.H{"user_id": awardRequest.UserID, "reason": strings.TrimSpace(awardRequest.Reason)})
+	c.JSON(http.StatusOK, gin.H{"message": "Badge awarded successfully"})
+}
+
+// RevokeBadge takes a badge back from a user. Rule badges are awarded again
+// by the next batch run if the user still qualifies.
+func (r *Repository) RevokeBadge(c *gin.Context) {
+	award := models.UserBadge{}
+	r.DB.Where("badge_id = ? AND user_id = ?", c.Param("id"), c.Param("user_id")).First(&award)
+	result := r.DB.Where("badge_id = ? AND user_id = ?", c.Param("id"), c.Param("user_id")).Delete(&models.UserBadge{})
+	if result.Error != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not revoke badge"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User does not hold this badge"})
+		return
+	}
+	r.audit(c, models.AuditBadgeRevoke, models.TargetBadge, award.BadgeID, award, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Badge revoked successfully"})
+}
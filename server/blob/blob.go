@@ -0,0 +1,36 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when a key does not exist in the store
+var ErrNotFound = errors.New("blob not found")
+
+// Store keeps uploaded files. Keys are slash-separated paths chosen by the caller.
+type Store interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Presigner is implemented by stores that can hand out time-limited download
+// URLs of their own, so downloads skip this server entirely
+type Presigner interface {
+	PresignedURL(ctx context.Context, key, filename, contentType string, expiry time.Duration) (string, error)
+}
+
+// Disposition is the Content-Disposition a file is served with. Only images
+// display inline; everything else downloads, and nothing runs.
+func Disposition(filename, contentType string) string {
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") {
+		disposition = "inline"
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": filename})
+}
@@ -0,0 +1,199 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-memory stand-in for the parts of the S3 API the store uses
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]bool
+	objects map[string][]byte
+	types   map[string]string
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{buckets: map[string]bool{}, objects: map[string][]byte{}, types: map[string]string{}}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	if key == "" {
+		switch req.Method {
+		case http.MethodHead:
+			if !f.buckets[bucket] {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case http.MethodPut:
+			f.buckets[bucket] = true
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+		return
+	}
+
+	path := bucket + "/" + key
+	switch req.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(req.Body)
+		if strings.HasPrefix(req.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			body = decodeAWSChunked(body)
+		}
+		f.objects[path] = body
+		f.types[path] = req.Header.Get("Content-Type")
+		w.Header().Set("ETag", `"etag"`)
+	case http.MethodHead, http.MethodGet:
+		body, ok := f.objects[path]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if req.Method == http.MethodGet {
+				io.WriteString(w, `<Error><Code>NoSuchKey</Code><Message>Not found</Message></Error>`)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", f.types[path])
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"etag"`)
+		if req.Method == http.MethodGet {
+			w.Write(body)
+		}
+	case http.MethodDelete:
+		delete(f.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// decodeAWSChunked strips the chunk headers from a streaming signed upload
+func decodeAWSChunked(body []byte) []byte {
+	decoded := []byte{}
+	for len(body) > 0 {
+		header, rest, _ := strings.Cut(string(body), "\r\n")
+		sizeHex, _, _ := strings.Cut(header, ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil || size == 0 {
+			break
+		}
+		decoded = append(decoded, rest[:size]...)
+		body = []byte(rest[size+2:])
+	}
+	return decoded
+}
+
+func newTestS3Store(t *testing.T) (*S3Store, *fakeS3) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	store, err := NewS3Store(context.Background(), S3Config{
+		Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		Region:    "us-east-1",
+		Bucket:    "uploads",
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, fake
+}
+
+func TestStores(t *testing.T) {
+	local, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3, _ := newTestS3Store(t)
+
+	for name, store := range map[string]Store{"local": local, "s3": s3} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			key := "attachments/2024/01/abc"
+			content := "hello, blob"
+			if err := store.Put(ctx, key, strings.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+				t.Fatal(err)
+			}
+
+			body, err := store.Get(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(body)
+			body.Close()
+			if err != nil || string(got) != content {
+				t.Errorf("Get = %q, %v, want %q", got, err, content)
+			}
+
+			if err := store.Delete(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get after Delete = %v, want ErrNotFound", err)
+			}
+			if err := store.Delete(ctx, key); err != nil {
+				t.Errorf("Delete of a missing key = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestNewS3StoreCreatesBucket(t *testing.T) {
+	_, fake := newTestS3Store(t)
+	if !fake.buckets["uploads"] {
+		t.Error("bucket was not created")
+	}
+}
+
+func TestLocalStoreRejectsEscapingKeys(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"../outside", "a/../../outside", "", "/"} {
+		if err := store.Put(context.Background(), key, strings.NewReader("x"), 1, "text/plain"); err == nil {
+			t.Errorf("Put(%q) succeeded, want an error", key)
+		}
+	}
+}
+
+func TestPresignedURLDisposition(t *testing.T) {
+	store, _ := newTestS3Store(t)
+	tests := []struct {
+		filename    string
+		contentType string
+		want        string
+	}{
+		{"cat.png", "image/png", `inline; filename=cat.png`},
+		{"photo.jpg", "image/jpeg", `inline; filename=photo.jpg`},
+		{"paper.pdf", "application/pdf", `attachment; filename=paper.pdf`},
+		{"notes.txt", "text/plain", `attachment; filename=notes.txt`},
+	}
+	for _, test := range tests {
+		signed, err := store.PresignedURL(context.Background(), "attachments/key", test.filename, test.contentType, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := url.Parse(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := parsed.Query().Get("response-content-disposition"); got != test.want {
+			t.Errorf("disposition for %s = %q, want %q", test.contentType, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package blob
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Store keeps files in a bucket on S3 or any S3-compatible service such as MinIO
+type S3Store struct {
+	client *minio.Client
+	bucket string
+}
+
+// S3Config describes how to reach the bucket. Endpoint is a host[:port]
+// without scheme, e.g. "s3.amazonaws.com" or "localhost:9000".
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+}
+
+// NewS3Store connects to the bucket, creating it if it does not exist yet
+func NewS3Store(ctx context.Context, config S3Config) (*S3Store, error) {
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure: config.UseSSL,
+		Region: config.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := client.BucketExists(ctx, config.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, config.Bucket, minio.MakeBucketOptions{Region: config.Region}); err != nil {
+			return nil, err
+		}
+	}
+	return &S3Store{client: client, bucket: config.Bucket}, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, body, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	// Stat first: GetObject is lazy and only fails on the first read
+	if _, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{}); err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+// PresignedURL returns a URL that serves the object under the given filename
+// until it expires, with the same disposition as downloads through the server
+func (s *S3Store) PresignedURL(ctx context.Context, key, filename, contentType string, expiry time.Duration) (string, error) {
+	params := url.Values{}
+	params.Set("response-content-disposition", Disposition(filename, contentType))
+	signed, err := s.client.PresignedGetObject(ctx, s.bucket, key, expiry, params)
+	if err != nil {
+		return "", err
+	}
+	return signed.String(), nil
+}
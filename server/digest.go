@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/damiancxliew/web-forum/events"
+	"github.com/damiancxliew/web-forum/mailer"
+	"github.com/damiancxliew/web-forum/models"
+	"gorm.io/gorm/clause"
+)
+
+// digestCheckInterval is how often the scheduler looks for digests that are due
+const digestCheckInterval = 15 * time.Minute
+
+// digestItemLimit caps each section of a digest
+const digestItemLimit = 50
+
+var digestPeriods = map[string]time.Duration{
+	models.DeliveryDaily:  24 * time.Hour,
+	models.DeliveryWeekly: 7 * 24 * time.Hour,
+}
+
+// newMailer sends through SMTP when SMTP_HOST is set and logs emails otherwise
+func newMailer() mailer.Mailer {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return mailer.LogMailer{}
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	return &mailer.SMTPMailer{
+		Host:     host,
+		Port:     port,
+		Username: os.Getenv("SMTP_USER"),
+		Password: os.Getenv("SMTP_PASS"),
+		From:     os.Getenv("MAIL_FROM"),
+	}
+}
+
+func threadLink(threadID uint) string {
+	return fmt.Sprintf("%s/home?thread=%d", appURL(), threadID)
+}
+
+// SubscribeNotificationEmails emails notifications set to immediate email
+// delivery. Sending runs on its own subscriber, so a slow mail server only
+// delays other emails and never the notifications themselves.
+func (r *Repository) SubscribeNotificationEmails() {
+	r.Events.Subscribe("notification_emails", func(event events.Event) {
+		notification := models.Notification{}
+		if err := r.DB.First(&notification, event.NotificationID).Error; err != nil {
+			return
+		}
+		if r.deliveryFor(notification.UserID, notification.Type) == models.DeliveryEmail {
+			r.sendNotificationEmail(notification)
+		}
+	}, events.NotificationCreated)
+}
+
+// sendNotificationEmail emails a single notification straight away
+func (r *Repository) sendNotificationEmail(notification models.Notification) {
+	user := models.User{}
+	if err := r.DB.First(&user, notification.UserID).Error; err != nil {
+		return
+	}
+
+	data := mailer.NotificationData{
+		Username:       user.Username,
+		Message:        notification.Message,
+		SettingsURL:    appURL() + "/profile",
+		UnsubscribeURL: unsubscribeURL(user.ID, notification.Type),
+	}
+	if notification.ThreadID != nil {
+		data.Link = threadLink(*notification.ThreadID)
+	}
+
+	html, text, err := mailer.Render("notification", data)
+	if err != nil {
+		log.Println("Notification email render error:", err)
+		return
+	}
+	err = r.Mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: notification.Message,
+		HTML:    html,
+		Text:    text,
+		Headers: unsubscribeHeaders(data.UnsubscribeURL),
+	})
+	if err != nil {
+		log.Println("Notification email error:", err)
+	}
+}
+
+// unsubscribeHeaders enable one-click unsubscribe in mail clients (RFC 8058)
+func unsubscribeHeaders(url string) map[string]string {
+	return map[string]string{
+		"List-Unsubscribe":      "<" + url + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+}
+
+// StartDigestScheduler sends daily and weekly digests until ctx is cancelled.
+// Several replicas can run it at once: each digest is claimed with a
+// conditional update before it is sent.
+func (r *Repository) StartDigestScheduler(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(digestCheckInterval)
+		defer ticker.Stop()
+		for {
+			r.sendDueDigests()
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (r *Repository) sendDueDigests() {
+	for frequency, period := range digestPeriods {
+		var userIDs []uint
+		err := r.DB.Model(&models.NotificationPreference{}).
+			Where("delivery = ?", frequency).
+			Distinct("user_id").
+			Pluck("user_id", &userIDs).Error
+		if err != nil {
+			log.Println("Digest lookup error:", err)
+			continue
+		}
+
+		// Followed activity defaults to the daily digest
+		if frequency == defaultDeliveries[models.NotifyFollowedActivity] {
+			var followers []uint
+			r.DB.Model(&models.Follow{}).
+				Where("user_id NOT IN (?)", r.DB.Model(&models.NotificationPreference{}).
+					Select("user_id").Where("type = ?", models.NotifyFollowedActivity)).
+				Distinct("user_id").
+				Pluck("user_id", &followers)
+			userIDs = append(userIDs, followers...)
+		}
+
+		sent := map[uint]bool{}
+		for _, userID := range userIDs {
+			if sent[userID] {
+				continue
+			}
+			sent[userID] = true
+			if since, ok := r.claimDigest(userID, frequency, period); ok {
+				r.sendDigest(userID, frequency, since)
+			}
+		}
+	}
+}
+
+// claimDigest marks the user's digest as sent if it is due and returns when the
+// previous one went out. It fails if the digest is not due or another replica
+// claimed it first.
+func (r *Repository) claimDigest(userID uint, frequency string, period time.Duration) (time.Time, bool) {
+	now := time.Now()
+	state := models.DigestState{UserID: userID, Frequency: frequency, LastSentAt: now.Add(-period)}
+	r.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&state)
+
+	if err := r.DB.Where("user_id = ? AND frequency = ?", userID, frequency).First(&state).Error; err != nil {
+		return time.Time{}, false
+	}
+	if now.Sub(state.LastSentAt) < period {
+		return time.Time{}, false
+	}
+
+	result := r.DB.Model(&models.DigestState{}).
+		Where("user_id = ? AND frequency = ? AND last_sent_at = ?", userID, frequency, state.LastSentAt).
+		Update("last_sent_at", now)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return time.Time{}, false
+	}
+	return state.LastSentAt, true
+}
+
+// sendDigest compiles unread notifications and followed activity since the last
+// digest and emails them. Nothing is sent when there is nothing new.
+func (r *Repository) sendDigest(userID uint, frequency string, since time.Time) {
+	user := models.User{}
+	if err := r.DB.First(&user, userID).Error; err != nil {
+		return
+	}
+	preferences := r.preferencesFor(userID)
+
+	digestTypes := []string{}
+	for notificationType, delivery := range preferences {
+		if delivery == frequency && notificationType != models.NotifyFollowedActivity {
+			digestTypes = append(digestTypes, notificationType)
+		}
+	}
+
+	data := mailer.DigestData{
+		Username:       user.Username,
+		Period:         frequency,
+		SettingsURL:    appURL() + "/profile",
+		UnsubscribeURL: unsubscribeURL(userID, frequency),
+	}
+
+	if len(digestTypes) > 0 {
+		notifications := []models.Notification{}
+		r.DB.Where("user_id = ? AND read_at IS NULL AND created_at > ? AND type IN ?", userID, since, digestTypes).
+			Order("created_at DESC").Limit(digestItemLimit).Find(&notifications)
+		for _, notification := range notifications {
+			item := mailer.DigestItem{Message: notification.Message, At: notification.CreatedAt.Format(time.RFC1123)}
+			if notification.ThreadID != nil {
+				item.Link = threadLink(*notification.ThreadID)
+			}
+			data.Notifications = append(data.Notifications, item)
+		}
+	}
+
+	if preferences[models.NotifyFollowedActivity] == frequency {
+		data.Activity = r.followedActivity(userID, since)
+	}
+
+	if len(data.Notifications) == 0 && len(data.Activity) == 0 {
+		return
+	}
+
+	html, text, err := mailer.Render("digest", data)
+	if err != nil {
+		log.Println("Digest render error:", err)
+		return
+	}
+	err = r.Mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: fmt.Sprintf("Your %s Innersphere Forum digest", frequency),
+		HTML:    html,
+		Text:    text,
+		Headers: unsubscribeHeaders(data.UnsubscribeURL),
+	})
+	if err != nil {
+		log.Println("Digest email error:", err)
+	}
+}
+
+// followedActivity lists new threads in followed categories and new comments
+// in followed threads by other users since the given time, leaving out posts
+// hidden pending review
+func (r *Repository) followedActivity(userID uint, since time.Time) []mailer.DigestItem {
+	sinceStamp := since.UTC().Format(isoTimestamp)
+	denied := r.restrictedCategoryIDs(userID, "can_view")
+	items := []mailer.DigestItem{}
+
+	threads := []models.Thread{}
+	query := r.DB.Where("category_id IN (?)", r.DB.Model(&models.Follow{}).
+		Select("category_id").Where("user_id = ? AND category_id IS NOT NULL", userID)).
+		Where("user_id <> ? AND created_at > ? AND hidden = ?", userID, sinceStamp, false)
+	if len(denied) > 0 {
+		query = query.Where("category_id NOT IN ?", denied)
+	}
+	query.Order("created_at DESC").Limit(digestItemLimit).Find(&threads)
+	for _, thread := range threads {
+		items = append(items, mailer.DigestItem{
+			Message: fmt.Sprintf("New thread: %s", thread.Title),
+			Link:    threadLink(thread.ID),
+			At:      thread.CreatedAt,
+		})
+	}
+
+	type commentActivity struct {
+		ThreadID uint
+		Title    string
+		Count    int
+	}
+	activity := []commentActivity{}
+	query = r.DB.Model(&models.Comment{}).
+		Select("comments.thread_id, threads.title, count(*) AS count").
+		Joins("JOIN threads ON threads.id = comments.thread_id AND threads.deleted_at IS NULL AND threads.hidden = ?", false).
+		Where("comments.thread_id IN (?)", r.DB.Model(&models.Follow{}).
+			Select("thread_id").Where("user_id = ? AND thread_id IS NOT NULL", userID)).
+		Where("comments.user_id <> ? AND comments.created_at > ? AND comments.hidden = ?", userID, sinceStamp, false)
+	if len(denied) > 0 {
+		query = query.Where("threads.category_id NOT IN ?", denied)
+	}
+	query.Group("comments.thread_id, threads.title").Limit(digestItemLimit).Scan(&activity)
+	for _, thread := range activity {
+		items = append(items, mailer.DigestItem{
+			Message: fmt.Sprintf("%d new %s in %s", thread.Count, plural(thread.Count, "reply", "replies"), thread.Title),
+			Link:    threadLink(thread.ThreadID),
+		})
+	}
+	return items
+}
+
+func plural(count int, singular, pluralForm string) string {
+	if count == 1 {
+		return singular
+	}
+	return pluralForm
+}
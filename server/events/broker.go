@@ -0,0 +1,56 @@
+package events
+
+import (
+	"log"
+	"sync"
+)
+
+// Broker carries events between server replicas. Every replica publishes the
+// events it produces and receives the events of all replicas, its own included.
+type Broker interface {
+	Publish(event Event) error
+	Subscribe(handler Handler)
+	Close() error
+}
+
+// LocalBroker delivers events within a single process
+type LocalBroker struct {
+	mu       sync.RWMutex
+	handlers []Handler
+}
+
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{}
+}
+
+func (b *LocalBroker) Publish(event Event) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, handler := range b.handlers {
+		handler(event)
+	}
+	return nil
+}
+
+func (b *LocalBroker) Subscribe(handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+func (b *LocalBroker) Close() error {
+	return nil
+}
+
+// Forward logs every event on the bus and publishes it to the broker
+func Forward(bus *Bus, broker Broker, eventLog Log) {
+	bus.Subscribe("broker", func(event Event) {
+		event, err := eventLog.Append(event)
+		if err != nil {
+			log.Printf("Event log error on %s: %v", event.Type, err)
+		}
+		if err := broker.Publish(event); err != nil {
+			log.Printf("Broker publish error on %s: %v", event.Type, err)
+		}
+	})
+}
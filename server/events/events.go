@@ -0,0 +1,176 @@
+package events
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Forum lifecycle event types
+const (
+	ThreadCreated    = "thread.created"
+	ThreadUpdated    = "thread.updated"
+	ThreadDeleted    = "thread.deleted"
+	ThreadRestored   = "thread.restored"
+	ThreadPurged     = "thread.purged"
+	ThreadModerated  = "thread.moderated"
+	ThreadMoved      = "thread.moved"
+	ThreadMerged     = "thread.merged"
+	ThreadSplit      = "thread.split"
+	CommentCreated   = "comment.created"
+	CommentUpdated   = "comment.updated"
+	CommentDeleted   = "comment.deleted"
+	CommentRestored  = "comment.restored"
+	CommentPurged    = "comment.purged"
+	AnswerAccepted   = "answer.accepted"
+	AnswerUnaccepted = "answer.unaccepted"
+	PollVoted        = "poll.voted"
+	ContentHidden    = "content.hidden"
+	ContentUnhidden  = "content.unhidden"
+
+	UserRoleChanged     = "user.role_changed"
+	UserDeleted         = "user.deleted"
+	UserPurged          = "user.purged"
+	BadgeAwarded        = "badge.awarded"
+	NotificationCreated = "notification.created"
+
+	AttachmentUploaded  = "attachment.uploaded"
+	AttachmentProcessed = "attachment.processed"
+
+	ReactionAdded   = "reaction.added"
+	ReactionRemoved = "reaction.removed"
+
+	ReportCreated   = "report.created"
+	ReportResolved  = "report.resolved"
+	ReportDismissed = "report.dismissed"
+
+	UserSanctioned = "user.sanctioned"
+	SanctionLifted = "sanction.lifted"
+	AppealCreated  = "appeal.created"
+	AppealReviewed = "appeal.reviewed"
+)
+
+// Event describes something that happened to a thread or comment.
+// CommentID is zero for thread events. TargetThreadID is the thread a merge
+// went into or a split created.
+type Event struct {
+	// ID is the event's position in the event log, assigned when it is logged
+	ID         uint64 `json:"id,omitempty"`
+	Type       string `json:"type"`
+	ThreadID   uint   `json:"thread_id"`
+	CommentID  uint   `json:"comment_id,omitempty"`
+	CategoryID uint   `json:"category_id"`
+	// UserID is the user who caused the event
+	UserID uint `json:"user_id"`
+	// AuthorID owns the thread or comment the event is about, or is the user
+	// a user event is about
+	AuthorID       uint      `json:"author_id,omitempty"`
+	NotificationID uint      `json:"notification_id,omitempty"`
+	AttachmentID   uint      `json:"attachment_id,omitempty"`
+	TargetThreadID uint      `json:"target_thread_id,omitempty"`
+	Detail         string    `json:"detail,omitempty"`
+	At             time.Time `json:"at"`
+	// Recipients are users the event concerns personally, such as the author
+	// of a thread that got a reply
+	Recipients []uint `json:"recipients,omitempty"`
+}
+
+// Handler consumes events
+type Handler func(Event)
+
+// subscriberBacklog is how many events may wait for a slow subscriber.
+// Publish never waits on a subscriber, so events past the backlog are dropped
+// and logged rather than stalling the request that published them.
+const subscriberBacklog = 10000
+
+// Bus fans events out to subscribers. Every subscriber gets its own goroutine
+// and backlog, so handlers never run on the request path and each one sees
+// events in the order they were published.
+type Bus struct {
+	mu          sync.RWMutex
+	subscribers []*subscriber
+}
+
+type subscriber struct {
+	name  string
+	types map[string]bool // nil means every type
+
+	mu      sync.Mutex
+	pending []Event
+	wake    chan struct{} // signalled when pending goes from empty to not
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe registers a handler for events published from now on. When types
+// are given only events of those types are queued for the handler.
+func (b *Bus) Subscribe(name string, handler Handler, types ...string) {
+	sub := &subscriber{name: name, wake: make(chan struct{}, 1)}
+	if len(types) > 0 {
+		sub.types = map[string]bool{}
+		for _, eventType := range types {
+			sub.types[eventType] = true
+		}
+	}
+
+	go func() {
+		for range sub.wake {
+			for _, event := range sub.take() {
+				func() {
+					defer func() {
+						if err := recover(); err != nil {
+							log.Printf("Event subscriber %s panicked on %s: %v", name, event.Type, err)
+						}
+					}()
+					handler(event)
+				}()
+			}
+		}
+	}()
+
+	b.mu.Lock()
+	b.subscribers = append(b.subscribers, sub)
+	b.mu.Unlock()
+}
+
+// push adds an event to the backlog without waiting for the handler
+func (s *subscriber) push(event Event) {
+	s.mu.Lock()
+	if len(s.pending) >= subscriberBacklog {
+		s.mu.Unlock()
+		log.Printf("Event subscriber %s is %d events behind, dropping %s", s.name, subscriberBacklog, event.Type)
+		return
+	}
+	s.pending = append(s.pending, event)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take empties the backlog, returning the events in the order they came
+func (s *subscriber) take() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := s.pending
+	s.pending = nil
+	return events
+}
+
+// Publish queues the event for every interested subscriber. It never blocks
+// on a slow subscriber.
+func (b *Bus) Publish(event Event) {
+	if event.At.IsZero() {
+		event.At = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, sub := range b.subscribers {
+		if sub.types == nil || sub.types[event.Type] {
+			sub.push(event)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPublishDoesNotBlockOnSlowSubscriber(t *testing.T) {
+	bus := NewBus()
+	release := make(chan struct{})
+	received := make(chan uint, 1000)
+	bus.Subscribe("slow", func(event Event) {
+		<-release
+		received <- event.ThreadID
+	})
+
+	published := make(chan struct{})
+	go func() {
+		for i := uint(1); i <= 1000; i++ {
+			bus.Publish(Event{Type: ThreadCreated, ThreadID: i})
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish blocked on a subscriber that is not keeping up")
+	}
+
+	close(release)
+	for want := uint(1); want <= 1000; want++ {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("received thread %d, want %d", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for thread %d", want)
+		}
+	}
+}
+
+func TestSubscribeFiltersTypes(t *testing.T) {
+	bus := NewBus()
+	received := make(chan string, 3)
+	bus.Subscribe("comments", func(event Event) { received <- event.Type }, CommentCreated)
+
+	bus.Publish(Event{Type: ThreadCreated})
+	bus.Publish(Event{Type: CommentCreated})
+	select {
+	case got := <-received:
+		if got != CommentCreated {
+			t.Errorf("received %s, want %s", got, CommentCreated)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the comment event")
+	}
+}
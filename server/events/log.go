@@ -0,0 +1,84 @@
+package events
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/damiancxliew/web-forum/models"
+	"gorm.io/gorm"
+)
+
+// Log assigns events their sequence number and keeps the most recent ones so
+// clients that reconnect can resume where they left off
+type Log interface {
+	// Append stores the event and returns it with its ID set
+	Append(event Event) (Event, error)
+	// Since returns up to limit events logged after the given ID, oldest first.
+	// complete is false when events after that ID have already been pruned.
+	Since(id uint64, limit int) (logged []Event, complete bool, err error)
+}
+
+// pruneInterval is how many appends happen between prunes of the log
+const pruneInterval = 100
+
+// DBLog keeps the event log in the database so every replica shares the same
+// sequence of event IDs. Only the newest size events are retained.
+type DBLog struct {
+	db   *gorm.DB
+	size uint64
+
+	mu      sync.Mutex
+	appends int
+}
+
+func NewDBLog(db *gorm.DB, size int) *DBLog {
+	return &DBLog{db: db, size: uint64(size)}
+}
+
+func (l *DBLog) Append(event Event) (Event, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return event, err
+	}
+	entry := models.EventLog{Type: event.Type, Payload: string(payload), CreatedAt: event.At}
+	if err := l.db.Create(&entry).Error; err != nil {
+		return event, err
+	}
+	event.ID = entry.ID
+
+	l.mu.Lock()
+	l.appends++
+	prune := l.appends%pruneInterval == 0
+	l.mu.Unlock()
+	if prune && entry.ID > l.size {
+		l.db.Where("id <= ?", entry.ID-l.size).Delete(&models.EventLog{})
+	}
+	return event, nil
+}
+
+func (l *DBLog) Since(id uint64, limit int) ([]Event, bool, error) {
+	entries := []models.EventLog{}
+	if err := l.db.Where("id > ?", id).Order("id").Limit(limit).Find(&entries).Error; err != nil {
+		return nil, false, err
+	}
+
+	// The log is complete when the event right after id is still there, or
+	// when nothing newer than id has happened yet
+	complete := true
+	if len(entries) > 0 && entries[0].ID != id+1 {
+		var count int64
+		l.db.Model(&models.EventLog{}).Where("id <= ?", id).Count(&count)
+		complete = count > 0
+	}
+
+	logged := make([]Event, 0, len(entries))
+	for _, entry := range entries {
+		var event Event
+		if err := json.Unmarshal([]byte(entry.Payload), &event); err != nil {
+			continue
+		}
+		event.ID = entry.ID
+		logged = append(logged, event)
+	}
+	return logged, complete, nil
+}
@@ -0,0 +1,105 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+)
+
+// postgresChannel is the LISTEN/NOTIFY channel events travel on
+const postgresChannel = "forum_events"
+
+// PostgresBroker shares events between replicas with Postgres LISTEN/NOTIFY.
+// Publishing goes through the regular connection pool; listening holds one
+// dedicated connection that is re-established if it drops.
+type PostgresBroker struct {
+	db     *gorm.DB
+	dsn    string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.RWMutex
+	handlers []Handler
+}
+
+func NewPostgresBroker(db *gorm.DB, dsn string) *PostgresBroker {
+	ctx, cancel := context.WithCancel(context.Background())
+	broker := &PostgresBroker{db: db, dsn: dsn, ctx: ctx, cancel: cancel}
+	go broker.listen()
+	return broker
+}
+
+func (b *PostgresBroker) Publish(event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return b.db.Exec("SELECT pg_notify(?, ?)", postgresChannel, string(payload)).Error
+}
+
+func (b *PostgresBroker) Subscribe(handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+func (b *PostgresBroker) Close() error {
+	b.cancel()
+	return nil
+}
+
+// listen keeps a LISTEN connection open until the broker is closed
+func (b *PostgresBroker) listen() {
+	backoff := time.Second
+	for b.ctx.Err() == nil {
+		err := b.listenOnce()
+		if b.ctx.Err() != nil {
+			return
+		}
+		log.Printf("Postgres broker disconnected: %v; retrying in %s", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-b.ctx.Done():
+			return
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (b *PostgresBroker) listenOnce() error {
+	conn, err := pgx.Connect(b.ctx, b.dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(b.ctx, "LISTEN "+postgresChannel); err != nil {
+		return err
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(b.ctx)
+		if err != nil {
+			return err
+		}
+
+		var event Event
+		if err := json.Unmarshal([]byte(notification.Payload), &event); err != nil {
+			log.Println("Postgres broker received a malformed event:", err)
+			continue
+		}
+
+		b.mu.RLock()
+		for _, handler := range b.handlers {
+			handler(event)
+		}
+		b.mu.RUnlock()
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const maxFilterPattern = 200
+
+// filterMatcher is a filter rule compiled for matching
+type filterMatcher struct {
+	rule models.FilterRule
+	re   *regexp.Regexp
+	// wholeWords drops matches that are only part of a longer word
+	wholeWords bool
+}
+
+// compileFilterRule turns a rule into a case-insensitive matcher
+func compileFilterRule(rule models.FilterRule) (filterMatcher, error) {
+	pattern := strings.TrimSpace(rule.Pattern)
+	if pattern == "" || utf8.RuneCountInString(pattern) > maxFilterPattern {
+		return filterMatcher{}, errors.New("pattern must be between 1 and 200 characters")
+	}
+
+	var expr string
+	switch rule.Kind {
+	case models.FilterLiteral:
+		expr = regexp.QuoteMeta(pattern)
+	case models.FilterWildcard:
+		var b strings.Builder
+		for _, char := range pattern {
+			switch char {
+			case '*':
+				b.WriteString(`[\p{L}\p{N}_]*`)
+			case '?':
+				b.WriteString(`[\p{L}\p{N}_]`)
+			default:
+				b.WriteString(regexp.QuoteMeta(string(char)))
+			}
+		}
+		expr = b.String()
+	case models.FilterRegex:
+		expr = pattern
+	default:
+		return filterMatcher{}, errors.New("kind must be literal, wildcard or regex")
+	}
+
+	re, err := regexp.Compile("(?i)" + expr)
+	if err != nil {
+		return filterMatcher{}, fmt.Errorf("invalid pattern: %v", err)
+	}
+	return filterMatcher{rule: rule, re: re, wholeWords: rule.Kind != models.FilterRegex}, nil
+}
+
+func isWordRune(char rune) bool {
+	return unicode.IsLetter(char) || unicode.IsDigit(char) || char == '_'
+}
+
+// find returns the byte spans of the rule's matches in text. Empty matches,
+// such as a regex like "x*" finds everywhere, never count.
+func (m filterMatcher) find(text string) [][]int {
+	spans := m.re.FindAllStringIndex(text, -1)
+	whole := spans[:0]
+	for _, span := range spans {
+		if span[0] == span[1] {
+			continue
+		}
+		if !m.wholeWords {
+			whole = append(whole, span)
+			continue
+		}
+		// A side only needs a boundary if the match itself starts or ends
+		// with a letter, so patterns like "$$$" still match
+		first, _ := utf8.DecodeRuneInString(text[span[0]:])
+		before, _ := utf8.DecodeLastRuneInString(text[:span[0]])
+		if span[0] > 0 && isWordRune(first) && isWordRune(before) {
+			continue
+		}
+		last, _ := utf8.DecodeLastRuneInString(text[:span[1]])
+		after, _ := utf8.DecodeRuneInString(text[span[1]:])
+		if span[1] < len(text) && isWordRune(last) && isWordRune(after) {
+			continue
+		}
+		whole = append(whole, span)
+	}
+	return whole
+}
+
+// filterMatch is one rule that matched a post
+type filterMatch struct {
+	RuleID  uint     `json:"rule_id"`
+	Pattern string   `json:"pattern"`
+	Kind    string   `json:"kind"`
+	Action  string   `json:"action"`
+	Matches []string `json:"matches"`
+}
+
+// filterResult is what the filter rules made of a post
+type filterResult struct {
+	Blocked bool          `json:"blocked"`
+	Held    bool          `json:"held"`
+	Flagged bool          `json:"flagged"`
+	Matches []filterMatch `json:"matches"`
+}
+
+// queued reports whether the post needs a moderator's attention
+func (result filterResult) queued() bool {
+	return result.Held || result.Flagged
+}
+
+// detail describes the matched rules for the moderation queue
+func (result filterResult) detail() string {
+	parts := make([]string, len(result.Matches))
+	for i, match := range result.Matches {
+		parts[i] = fmt.Sprintf("filter rule %d (%s)", match.RuleID, match.Action)
+	}
+	return "Matched " + strings.Join(parts, ", ")
+}
+
+// maskRune replaces each character of a masked word. Unlike an asterisk it
+// means nothing in Markdown, so masking cannot turn text into a rule or emphasis.
+const maskRune = "•"
+
+// applyFilters runs every matcher over the texts, masking the matches of
+// replace rules in place
+func applyFilters(matchers []filterMatcher, texts ...*string) filterResult {
+	result := filterResult{Matches: []filterMatch{}}
+	for _, matcher := range matchers {
+		match := filterMatch{
+			RuleID:  matcher.rule.ID,
+			Pattern: matcher.rule.Pattern,
+			Kind:    matcher.rule.Kind,
+			Action:  matcher.rule.Action,
+			Matches: []string{},
+		}
+		for _, text := range texts {
+			spans := matcher.find(*text)
+			if len(spans) == 0 {
+				continue
+			}
+			var masked strings.Builder
+			last := 0
+			for _, span := range spans {
+				found := (*text)[span[0]:span[1]]
+				match.Matches = append(match.Matches, found)
+				masked.WriteString((*text)[last:span[0]])
+				masked.WriteString(strings.Repeat(maskRune, utf8.RuneCountInString(found)))
+				last = span[1]
+			}
+			masked.WriteString((*text)[last:])
+			if matcher.rule.Action == models.FilterReplace {
+				*text = masked.String()
+			}
+		}
+		if len(match.Matches) == 0 {
+			continue
+		}
+
+		result.Matches = append(result.Matches, match)
+		switch matcher.rule.Action {
+		case models.FilterBlock:
+			result.Blocked = true
+		case models.FilterHold:
+			result.Held = true
+		case models.FilterFlag:
+			result.Flagged = true
+		}
+	}
+	return result
+}
+
+// filterMatchers loads and compiles the enabled filter rules. Rules that no
+// longer compile are skipped.
+func (r *Repository) filterMatchers() []filterMatcher {
+	rules := []models.FilterRule{}
+	if err := r.DB.Where("enabled = ?", true).Order("id").Find(&rules).Error; err != nil {
+		log.Println("Filter rules load error:", err)
+		return nil
+	}
+	matchers := make([]filterMatcher, 0, len(rules))
+	for _, rule := range rules {
+		matcher, err := compileFilterRule(rule)
+		if err != nil {
+			log.Printf("Filter rule %d skipped: %v", rule.ID, err)
+			continue
+		}
+		matchers = append(matchers, matcher)
+	}
+	return matchers
+}
+
+// screenPost runs the filter rules over a post's texts and counts the hits.
+// Replaced words are masked in place. It responds and returns false if a rule
+// blocks the post.
+func (r *Repository) screenPost(c *gin.Context, texts ...*string) (filterResult, bool) {
+	result := applyFilters(r.filterMatchers(), texts...)
+	if len(result.Matches) > 0 {
+		ids := make([]uint, len(result.Matches))
+		for i, match := range result.Matches {
+			ids[i] = match.RuleID
+		}
+		err := r.DB.Model(&models.FilterRule{}).Where("id IN ?", ids).
+			Updates(map[string]interface{}{"hits": gorm.Expr("hits + 1"), "last_hit_at": time.Now()}).Error
+		if err != nil {
+			log.Println("Filter hit count error:", err)
+		}
+	}
+	if result.Blocked {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Your post contains words or phrases that are not allowed"})
+		return result, false
+	}
+	return result, true
+}
+
+// queueFiltered puts a held or flagged post in the moderation queue
+func queueFiltered(tx *gorm.DB, targetType string, targetID uint, result filterResult) error {
+	if !result.queued() {
+		return nil
+	}
+	return queueForReview(tx, targetType, targetID, models.QueueSourceFilter, result.detail())
+}
+
+// filterRuleRequest is the body of filter rule create and update requests.
+// Omitted fields are left unchanged on update.
+type filterRuleRequest struct {
+	Pattern *string `json:"pattern"`
+	Kind    *string `json:"kind"`
+	Action  *string `json:"action"`
+	Enabled *bool   `json:"enabled"`
+	Note    *string `json:"note"`
+}
+
+// apply copies the request onto rule and checks the result
+func (request filterRuleRequest) apply(rule *models.FilterRule) error {
+	if request.Pattern != nil {
+		rule.Pattern = strings.TrimSpace(*request.Pattern)
+	}
+	if request.Kind != nil {
+		rule.Kind = *request.Kind
+	}
+	if request.Action != nil {
+		rule.Action = *request.Action
+	}
+	if request.Enabled != nil {
+		rule.Enabled = *request.Enabled
+	}
+	if request.Note != nil {
+		rule.Note = strings.TrimSpace(*request.Note)
+	}
+	switch rule.Action {
+	case models.FilterBlock, models.FilterHold, models.FilterReplace, models.FilterFlag:
+	default:
+		return errors.New("action must be block, hold, replace or flag")
+	}
+	_, err := compileFilterRule(*rule)
+	return err
+}
+
+// GetFilterRules lists every filter rule with its hit count, oldest first or
+// most matched first with ?sort=hits
+func (r *Repository) GetFilterRules(c *gin.Context) {
+	order := "id"
+	if c.Query("sort") == "hits" {
+		order = "hits DESC, id"
+	}
+	rules := []models.FilterRule{}
+	if err := r.DB.Order(order).Find(&rules).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get filter rules"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": rules})
+}
+
+// CreateFilterRule adds a filter rule:
+// {"pattern": "spam*", "kind": "wildcard", "action": "hold", "note": "..."}
+func (r *Repository) CreateFilterRule(c *gin.Context) {
+	var ruleRequest filterRuleRequest
+	if err := c.ShouldBindJSON(&ruleRequest); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Request failed"})
+		return
+	}
+	rule := models.FilterRule{Kind: models.FilterLiteral, Enabled: true, CreatedBy: currentUserID(c)}
+	if err := ruleRequest.apply(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if err := r.DB.Create(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not create filter rule"})
+		return
+	}
+	r.audit(c, models.AuditFilterCreate, models.TargetFilter, rule.ID, nil, rule)
+	c.JSON(http.StatusOK, gin.H{"message": "Filter rule created successfully", "data": rule})
+}
+
+// UpdateFilterRule changes a filter rule's pattern, kind, action, note or
+// whether it is enabled
+func (r *Repository) UpdateFilterRule(c *gin.Context) {
+	rule := models.FilterRule{}
+	if err := r.DB.First(&rule, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Filter rule not found"})
+		return
+	}
+	var ruleRequest filterRuleRequest
+	if err := c.ShouldBindJSON(&ruleRequest); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Request failed"})
+		return
+	}
+	before := rule
+	if err := ruleRequest.apply(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	err := r.DB.Model(&rule).Select("pattern", "kind", "action", "enabled", "note", "updated_at").Updates(&rule).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not update filter rule"})
+		return
+	}
+	r.audit(c, models.AuditFilterUpdate, models.TargetFilter, rule.ID, before, rule)
+	c.JSON(http.StatusOK, gin.H{"message": "Filter rule updated successfully", "data": rule})
+}
+
+// DeleteFilterRule removes a filter rule
+func (r *Repository) DeleteFilterRule(c *gin.Context) {
+	rule := models.FilterRule{}
+	if err := r.DB.First(&rule, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Filter rule not found"})
+		return
+	}
+	if err := r.DB.Delete(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not delete filter rule"})
+		return
+	}
+	r.audit(c, models.AuditFilterDelete, models.TargetFilter, rule.ID, rule, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Filter rule deleted successfully"})
+}
+
+// TestFilterRules is a dry run: it shows what the enabled rules would do to
+// {"title": "...", "content": "..."} without counting hits. Send a "rule"
+// ({"pattern": "...", "kind": "...", "action": "..."}) to try an unsaved rule
+// on its own instead.
+func (r *Repository) TestFilterRules(c *gin.Context) {
+	var testRequest struct {
+		Title   string             `json:"title"`
+		Content string             `json:"content"`
+		Rule    *filterRuleRequest `json:"rule"`
+	}
+	if err := c.ShouldBindJSON(&testRequest); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Request failed"})
+		return
+	}
+
+	var matchers []filterMatcher
+	if testRequest.Rule != nil {
+		rule := models.FilterRule{Kind: models.FilterLiteral, Enabled: true}
+		if err := testRequest.Rule.apply(&rule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		matcher, _ := compileFilterRule(rule)
+		matchers = []filterMatcher{matcher}
+	} else {
+		matchers = r.filterMatchers()
+	}
+
+	result := applyFilters(matchers, &testRequest.Title, &testRequest.Content)
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{
+		"result":  result,
+		"title":   testRequest.Title,
+		"content": testRequest.Content,
+	}})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/damiancxliew/web-forum/markup"
+	"github.com/damiancxliew/web-forum/models"
+)
+
+func TestCompileFilterRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		kind    string
+		wantErr bool
+	}{
+		{"literal", "darn", models.FilterLiteral, false},
+		{"literal with regex syntax", "(a+)", models.FilterLiteral, false},
+		{"wildcard", "buy*now", models.FilterWildcard, false},
+		{"regex", `c[a@]sino`, models.FilterRegex, false},
+		{"empty", "   ", models.FilterLiteral, true},
+		{"invalid regex", "(", models.FilterRegex, true},
+		{"unknown kind", "darn", "glob", true},
+	}
+	for _, test := range tests {
+		_, err := compileFilterRule(models.FilterRule{Pattern: test.pattern, Kind: test.kind, Action: models.FilterFlag})
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: compileFilterRule(%q) error = %v, want error %v", test.name, test.pattern, err, test.wantErr)
+		}
+	}
+}
+
+func TestApplyFilters(t *testing.T) {
+	tests := []struct {
+		name        string
+		pattern     string
+		kind        string
+		action      string
+		text        string
+		wantText    string
+		wantMatches []string
+	}{
+		{"literal ignores case", "darn", models.FilterLiteral, models.FilterReplace, "Darn it", "•••• it", []string{"Darn"}},
+		{"literal whole word", "darn", models.FilterLiteral, models.FilterReplace, "darned darn_it", "darned darn_it", nil},
+		{"literal regex syntax", "a.b", models.FilterLiteral, models.FilterReplace, "axb a.b", "axb •••", []string{"a.b"}},
+		{"literal symbols", "$$$", models.FilterLiteral, models.FilterReplace, "win$$$now", "win•••now", []string{"$$$"}},
+		{"literal unicode", "café", models.FilterLiteral, models.FilterReplace, "Café! cafés", "••••! cafés", []string{"Café"}},
+		{"wildcard star", "buy*now", models.FilterWildcard, models.FilterReplace, "BUYITNOW buynow", "•••••••• ••••••", []string{"BUYITNOW", "buynow"}},
+		{"wildcard stays in one word", "buy*now", models.FilterWildcard, models.FilterReplace, "buy it now", "buy it now", nil},
+		{"wildcard whole word", "buy*now", models.FilterWildcard, models.FilterReplace, "buyitnowz", "buyitnowz", nil},
+		{"wildcard question mark", "c?t", models.FilterWildcard, models.FilterReplace, "cat ct cart cut", "••• ct cart •••", []string{"cat", "cut"}},
+		{"wildcard alone", "*", models.FilterWildcard, models.FilterFlag, "a, b!", "a, b!", []string{"a", "b"}},
+		{"regex inside words", "cas+ino", models.FilterRegex, models.FilterReplace, "casinos", "••••••s", []string{"casino"}},
+		{"regex empty matches", "x*", models.FilterRegex, models.FilterBlock, "hello", "hello", nil},
+		{"regex empty and real matches", "x*", models.FilterRegex, models.FilterReplace, "axxb", "a••b", []string{"xx"}},
+		{"flag leaves text", "darn", models.FilterLiteral, models.FilterFlag, "darn", "darn", []string{"darn"}},
+	}
+	for _, test := range tests {
+		matcher, err := compileFilterRule(models.FilterRule{ID: 1, Pattern: test.pattern, Kind: test.kind, Action: test.action})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		text := test.text
+		result := applyFilters([]filterMatcher{matcher}, &text)
+		if text != test.wantText {
+			t.Errorf("%s: text = %q, want %q", test.name, text, test.wantText)
+		}
+		var matches []string
+		for _, match := range result.Matches {
+			matches = append(matches, match.Matches...)
+		}
+		if !reflect.DeepEqual(matches, test.wantMatches) {
+			t.Errorf("%s: matches = %q, want %q", test.name, matches, test.wantMatches)
+		}
+	}
+}
+
+func TestApplyFiltersActions(t *testing.T) {
+	rules := []models.FilterRule{
+		{ID: 1, Pattern: "blocked", Kind: models.FilterLiteral, Action: models.FilterBlock},
+		{ID: 2, Pattern: "held", Kind: models.FilterLiteral, Action: models.FilterHold},
+		{ID: 3, Pattern: "flagged", Kind: models.FilterLiteral, Action: models.FilterFlag},
+		{ID: 4, Pattern: "masked", Kind: models.FilterLiteral, Action: models.FilterReplace},
+	}
+	matchers := []filterMatcher{}
+	for _, rule := range rules {
+		matcher, err := compileFilterRule(rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	tests := []struct {
+		title, content         string
+		blocked, held, flagged bool
+		queued                 bool
+	}{
+		{"nothing", "to see", false, false, false, false},
+		{"masked", "words", false, false, false, false},
+		{"blocked", "post", true, false, false, false},
+		{"title", "is held", false, true, false, true},
+		{"flagged", "and held", false, true, true, true},
+	}
+	for _, test := range tests {
+		title, content := test.title, test.content
+		result := applyFilters(matchers, &title, &content)
+		if result.Blocked != test.blocked || result.Held != test.held || result.Flagged != test.flagged || result.queued() != test.queued {
+			t.Errorf("applyFilters(%q, %q) = %+v, want blocked %v, held %v, flagged %v", test.title, test.content, result, test.blocked, test.held, test.flagged)
+		}
+	}
+}
+
+func TestMaskedPostsRenderAsText(t *testing.T) {
+	matcher, err := compileFilterRule(models.FilterRule{ID: 1, Pattern: "darn", Kind: models.FilterLiteral, Action: models.FilterReplace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"alone on a line", "darn", "<p>••••</p>"},
+		{"between paragraphs", "one\n\ndarn\n\ntwo", "<p>one</p>\n<p>••••</p>\n<p>two</p>"},
+		{"next to emphasis markers", "a *b darn c* d", "<p>a <em>b •••• c</em> d</p>"},
+		{"at the start of a line", "darn it\n", "<p>•••• it</p>"},
+	}
+	for _, test := range tests {
+		content := test.content
+		applyFilters([]filterMatcher{matcher}, &content)
+		html, err := markup.Render(content)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := strings.TrimSpace(html); got != test.want {
+			t.Errorf("%s: rendered %q, want %q", test.name, got, test.want)
+		}
+	}
+}
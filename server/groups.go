@@ -0,0 +1,610 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Group names double as mention handles, so they are restricted to
+// lowercase letters, digits, dashes and underscores
+var groupNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{1,49}$`)
+
+// mentionRegex matches @handle mentions that are not part of an email address
+var mentionRegex = regexp.MustCompile(`(?:^|[^A-Za-z0-9_.])@([A-Za-z0-9][A-Za-z0-9_-]*)`)
+
+func isValidJoinPolicy(policy string) bool {
+	switch policy {
+	case models.JoinPolicyOpen, models.JoinPolicyRequest, models.JoinPolicyInvite:
+		return true
+	}
+	return false
+}
+
+// loadGroup fetches the group named by the :id param, responding with 404 if it is missing
+func (r *Repository) loadGroup(c *gin.Context) (*models.Group, bool) {
+	group := &models.Group{}
+	if err := r.DB.First(group, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Group not found"})
+		return nil, false
+	}
+	return group, true
+}
+
+func (r *Repository) groupMembership(groupID, userID uint) (*models.GroupMember, bool) {
+	member := &models.GroupMember{}
+	err := r.DB.Where("group_id = ? AND user_id = ?", groupID, userID).First(member).Error
+	if err != nil {
+		return nil, false
+	}
+	return member, true
+}
+
+// isGroupOwner reports whether the user owns the group. Admins manage every group.
+func (r *Repository) isGroupOwner(groupID, userID uint) bool {
+	if r.hasRole(userID, models.RoleAdmin) {
+		return true
+	}
+	member, ok := r.groupMembership(groupID, userID)
+	return ok && member.Status == models.MemberStatusActive && member.Role == models.GroupRoleOwner
+}
+
+// requireGroupOwner loads the group and checks the current user may manage it
+func (r *Repository) requireGroupOwner(c *gin.Context) (*models.Group, bool) {
+	group, ok := r.loadGroup(c)
+	if !ok {
+		return nil, false
+	}
+	if !r.isGroupOwner(group.ID, currentUserID(c)) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "Only group owners can do this"})
+		return nil, false
+	}
+	return group, true
+}
+
+func (r *Repository) CreateGroup(c *gin.Context) {
+	group := models.Group{}
+	if err := c.ShouldBindJSON(&group); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Request failed"})
+		return
+	}
+
+	group.ID = 0
+	group.Name = strings.ToLower(strings.TrimSpace(group.Name))
+	if !groupNameRegex.MatchString(group.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Group name must be 2-50 lowercase letters, digits, dashes or underscores"})
+		return
+	}
+	if group.JoinPolicy == "" {
+		group.JoinPolicy = models.JoinPolicyOpen
+	}
+	if !isValidJoinPolicy(group.JoinPolicy) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Join policy must be open, request or invite"})
+		return
+	}
+
+	// Groups share the mention namespace with users
+	if r.usernameTaken(group.Name, 0) {
+		c.JSON(http.StatusConflict, gin.H{"message": "Name is already taken by a user"})
+		return
+	}
+
+	group.CreatedBy = currentUserID(c)
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&group).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.GroupMember{
+			GroupID: group.ID,
+			UserID:  group.CreatedBy,
+			Role:    models.GroupRoleOwner,
+			Status:  models.MemberStatusActive,
+		}).Error
+	})
+	if err != nil {
+		log.Println("DB Create Error:", err)
+		c.JSON(http.StatusConflict, gin.H{"message": "Could not create group"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Group created successfully", "data": group})
+}
+
+func (r *Repository) GetGroups(c *gin.Context) {
+	groups := &[]models.Group{}
+	if err := r.DB.Order("name").Find(groups).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get groups"})
+		return
+	}
+	c.JSON(http.StatusOK, groups)
+}
+
+func (r *Repository) GetGroupByID(c *gin.Context) {
+	group, ok := r.loadGroup(c)
+	if !ok {
+		return
+	}
+
+	members := []models.GroupMember{}
+	query := r.DB.Where("group_id = ?", group.ID)
+	// Pending requests and invitations are only visible to owners
+	if !r.isGroupOwner(group.ID, currentUserID(c)) {
+		query = query.Where("status = ?", models.MemberStatusActive)
+	}
+	if err := query.Order("created_at").Find(&members).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get group members"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Group fetched successfully",
+		"data":    gin.H{"group": group, "members": members},
+	})
+}
+
+func (r *Repository) UpdateGroup(c *gin.Context) {
+	group, ok := r.requireGroupOwner(c)
+	if !ok {
+		return
+	}
+
+	var updateRequest struct {
+		Description *string `json:"description"`
+		JoinPolicy  string  `json:"join_policy"`
+	}
+	if err := c.ShouldBindJSON(&updateRequest); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Request failed"})
+		return
+	}
+
+	if updateRequest.Description != nil {
+		group.Description = *updateRequest.Description
+	}
+	if updateRequest.JoinPolicy != "" {
+		if !isValidJoinPolicy(updateRequest.JoinPolicy) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Join policy must be open, request or invite"})
+			return
+		}
+		group.JoinPolicy = updateRequest.JoinPolicy
+	}
+
+	if err := r.DB.Save(group).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to update group"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Group updated successfully", "data": group})
+}
+
+func (r *Repository) DeleteGroup(c *gin.Context) {
+	group, ok := r.requireGroupOwner(c)
+	if !ok {
+		return
+	}
+
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("group_id = ?", group.ID).Delete(&models.GroupMember{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("group_id = ?", group.ID).Delete(&models.CategoryPermission{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("group_id = ?", group.ID).Delete(&models.GroupMention{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(group).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not delete group"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Group deleted successfully"})
+}
+
+// JoinGroup adds the current user to an open group, files a join request for
+// request-only groups, and accepts a pending invitation for invite-only groups
+func (r *Repository) JoinGroup(c *gin.Context) {
+	group, ok := r.loadGroup(c)
+	if !ok {
+		return
+	}
+	userID := currentUserID(c)
+
+	if member, ok := r.groupMembership(group.ID, userID); ok {
+		switch member.Status {
+		case models.MemberStatusActive:
+			c.JSON(http.StatusConflict, gin.H{"message": "Already a member"})
+		case models.MemberStatusPending:
+			c.JSON(http.StatusConflict, gin.H{"message": "Join request is already pending"})
+		case models.MemberStatusInvited:
+			member.Status = models.MemberStatusActive
+			if err := r.DB.Save(member).Error; err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not join group"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"message": "Invitation accepted", "data": member})
+		}
+		return
+	}
+
+	member := models.GroupMember{GroupID: group.ID, UserID: userID, Role: models.GroupRoleMember}
+	switch group.JoinPolicy {
+	case models.JoinPolicyOpen:
+		member.Status = models.MemberStatusActive
+	case models.JoinPolicyRequest:
+		member.Status = models.MemberStatusPending
+	default:
+		c.JSON(http.StatusForbidden, gin.H{"message": "This group is invite-only"})
+		return
+	}
+
+	if err := r.DB.Create(&member).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not join group"})
+		return
+	}
+
+	message := "Joined group successfully"
+	if member.Status == models.MemberStatusPending {
+		message = "Join request sent"
+	}
+	c.JSON(http.StatusOK, gin.H{"message": message, "data": member})
+}
+
+// LeaveGroup removes the current user's membership, request or invitation
+func (r *Repository) LeaveGroup(c *gin.Context) {
+	group, ok := r.loadGroup(c)
+	if !ok {
+		return
+	}
+	userID := currentUserID(c)
+
+	member, ok := r.groupMembership(group.ID, userID)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Not a member of this group"})
+		return
+	}
+	if member.Role == models.GroupRoleOwner && r.countOwners(group.ID) <= 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "The last owner cannot leave the group"})
+		return
+	}
+
+	if err := r.DB.Where("group_id = ? AND user_id = ?", group.ID, userID).Delete(&models.GroupMember{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not leave group"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Left group successfully"})
+}
+
+func (r *Repository) countOwners(groupID uint) int64 {
+	var count int64
+	r.DB.Model(&models.GroupMember{}).
+		Where("group_id = ? AND role = ? AND status = ?", groupID, models.GroupRoleOwner, models.MemberStatusActive).
+		Count(&count)
+	return count
+}
+
+// InviteToGroup lets an owner invite a user, or approve them directly if they
+// already asked to join
+func (r *Repository) InviteToGroup(c *gin.Context) {
+	group, ok := r.requireGroupOwner(c)
+	if !ok {
+		return
+	}
+
+	var inviteRequest struct {
+		UserID uint `json:"user_id"`
+	}
+	if err := c.ShouldBindJSON(&inviteRequest); err != nil || inviteRequest.UserID == 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Request failed"})
+		return
+	}
+	if err := r.DB.First(&models.User{}, inviteRequest.UserID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+
+	if member, ok := r.groupMembership(group.ID, inviteRequest.UserID); ok {
+		if member.Status != models.MemberStatusPending {
+			c.JSON(http.StatusConflict, gin.H{"message": "User is already a member or invited"})
+			return
+		}
+		r.setMemberStatus(c, member, models.MemberStatusActive, "Join request approved")
+		return
+	}
+
+	member := models.GroupMember{
+		GroupID: group.ID,
+		UserID:  inviteRequest.UserID,
+		Role:    models.GroupRoleMember,
+		Status:  models.MemberStatusInvited,
+	}
+	if err := r.DB.Create(&member).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not invite user"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User invited successfully", "data": member})
+}
+
+// ApproveMember accepts a pending join request
+func (r *Repository) ApproveMember(c *gin.Context) {
+	group, ok := r.requireGroupOwner(c)
+	if !ok {
+		return
+	}
+
+	member, ok := r.memberFromParam(c, group.ID)
+	if !ok {
+		return
+	}
+	if member.Status != models.MemberStatusPending {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "No pending request for this user"})
+		return
+	}
+	r.setMemberStatus(c, member, models.MemberStatusActive, "Join request approved")
+}
+
+// RemoveMember removes a member, rejects a join request or revokes an invitation
+func (r *Repository) RemoveMember(c *gin.Context) {
+	group, ok := r.requireGroupOwner(c)
+	if !ok {
+		return
+	}
+
+	member, ok := r.memberFromParam(c, group.ID)
+	if !ok {
+		return
+	}
+	if member.Role == models.GroupRoleOwner && r.countOwners(group.ID) <= 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "The last owner cannot be removed"})
+		return
+	}
+
+	if err := r.DB.Where("group_id = ? AND user_id = ?", group.ID, member.UserID).Delete(&models.GroupMember{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not remove member"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed successfully"})
+}
+
+// SetMemberRole promotes a member to owner or demotes an owner to member
+func (r *Repository) SetMemberRole(c *gin.Context) {
+	group, ok := r.requireGroupOwner(c)
+	if !ok {
+		return
+	}
+
+	var roleRequest struct {
+		Role string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&roleRequest); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Request failed"})
+		return
+	}
+	if roleRequest.Role != models.GroupRoleOwner && roleRequest.Role != models.GroupRoleMember {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Role must be owner or member"})
+		return
+	}
+
+	member, ok := r.memberFromParam(c, group.ID)
+	if !ok {
+		return
+	}
+	if member.Status != models.MemberStatusActive {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Only active members can change role"})
+		return
+	}
+	if member.Role == models.GroupRoleOwner && roleRequest.Role == models.GroupRoleMember && r.countOwners(group.ID) <= 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "A group needs at least one owner"})
+		return
+	}
+
+	member.Role = roleRequest.Role
+	if err := r.DB.Save(member).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not update member"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Member updated successfully", "data": member})
+}
+
+func (r *Repository) memberFromParam(c *gin.Context, groupID uint) (*models.GroupMember, bool) {
+	member := &models.GroupMember{}
+	err := r.DB.Where("group_id = ? AND user_id = ?", groupID, c.Param("user_id")).First(member).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Member not found"})
+		return nil, false
+	}
+	return member, true
+}
+
+func (r *Repository) setMemberStatus(c *gin.Context, member *models.GroupMember, status, message string) {
+	member.Status = status
+	if err := r.DB.Save(member).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not update member"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": message, "data": member})
+}
+
+// Category permissions
+
+// SetCategoryPermission grants a group view and/or post access to a category.
+// Once a category has any permission rows, only members of those groups can use it.
+func (r *Repository) SetCategoryPermission(c *gin.Context) {
+	permission := models.CategoryPermission{}
+	if err := c.ShouldBindJSON(&permission); err != nil || permission.CategoryID == 0 || permission.GroupID == 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Request failed"})
+		return
+	}
+	if err := r.DB.First(&models.Category{}, permission.CategoryID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Category not found"})
+		return
+	}
+	if err := r.DB.First(&models.Group{}, permission.GroupID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Group not found"})
+		return
+	}
+
+	var before interface{}
+	existing := models.CategoryPermission{}
+	if r.DB.Where("category_id = ? AND group_id = ?", permission.CategoryID, permission.GroupID).First(&existing).Error == nil {
+		before = existing
+	}
+	if err := r.DB.Save(&permission).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not save permission"})
+		return
+	}
+	r.audit(c, models.AuditPermissionSet, models.TargetCategory, permission.CategoryID, before, permission)
+	c.JSON(http.StatusOK, gin.H{"message": "Permission saved successfully", "data": permission})
+}
+
+func (r *Repository) DeleteCategoryPermission(c *gin.Context) {
+	permission := models.CategoryPermission{}
+	if err := r.DB.Where("category_id = ? AND group_id = ?", c.Param("category_id"), c.Param("group_id")).First(&permission).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Permission not found"})
+		return
+	}
+	err := r.DB.Where("category_id = ? AND group_id = ?", permission.CategoryID, permission.GroupID).
+		Delete(&models.CategoryPermission{}).Error
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not delete permission"})
+		return
+	}
+	r.audit(c, models.AuditPermissionDrop, models.TargetCategory, permission.CategoryID, permission, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Permission deleted successfully"})
+}
+
+func (r *Repository) GetCategoryPermissions(c *gin.Context) {
+	permissions := &[]models.CategoryPermission{}
+	if err := r.DB.Where("category_id = ?", c.Param("id")).Find(permissions).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get permissions"})
+		return
+	}
+	c.JSON(http.StatusOK, permissions)
+}
+
+// restrictedCategoryIDs returns the categories the user may not access for the
+// given permission column ("can_view" or "can_post")
+func (r *Repository) restrictedCategoryIDs(userID uint, column string) []uint {
+	if r.hasRole(userID, models.RoleAdmin, models.RoleModerator) {
+		return nil
+	}
+
+	var restricted []uint
+	r.DB.Model(&models.CategoryPermission{}).Distinct("category_id").Pluck("category_id", &restricted)
+	if len(restricted) == 0 {
+		return nil
+	}
+
+	var allowed []uint
+	r.DB.Model(&models.CategoryPermission{}).
+		Joins("JOIN group_members ON group_members.group_id = category_permissions.group_id").
+		Where("group_members.user_id = ? AND group_members.status = ?", userID, models.MemberStatusActive).
+		Where("category_permissions."+column+" = ?", true).
+		Distinct("category_permissions.category_id").
+		Pluck("category_permissions.category_id", &allowed)
+
+	allowedSet := make(map[uint]bool, len(allowed))
+	for _, id := range allowed {
+		allowedSet[id] = true
+	}
+	denied := []uint{}
+	for _, id := range restricted {
+		if !allowedSet[id] {
+			denied = append(denied, id)
+		}
+	}
+	return denied
+}
+
+func (r *Repository) canAccessCategory(userID, categoryID uint, column string) bool {
+	for _, id := range r.restrictedCategoryIDs(userID, column) {
+		if id == categoryID {
+			return false
+		}
+	}
+	return true
+}
+
+// Group mentions
+
+// usernameTaken reports whether a user other than exceptID has the name as
+// their username, ignoring case like @mentions do
+func (r *Repository) usernameTaken(name string, exceptID uint) bool {
+	var count int64
+	r.DB.Unscoped().Model(&models.User{}).Where("LOWER(username) = ? AND id <> ?", strings.ToLower(name), exceptID).Count(&count)
+	return count > 0
+}
+
+// groupNameTaken reports whether a group has the name, so no user can take a
+// handle that @mentions would also match to a group
+func (r *Repository) groupNameTaken(name string) bool {
+	var count int64
+	r.DB.Model(&models.Group{}).Where("name = ?", strings.ToLower(name)).Count(&count)
+	return count > 0
+}
+
+// parseMentions returns the distinct lowercase handles mentioned in content
+func parseMentions(content string) []string {
+	seen := map[string]bool{}
+	handles := []string{}
+	for _, match := range mentionRegex.FindAllStringSubmatch(content, -1) {
+		handle := strings.ToLower(match[1])
+		if !seen[handle] {
+			seen[handle] = true
+			handles = append(handles, handle)
+		}
+	}
+	return handles
+}
+
+// recordGroupMentions stores a mention for every group named in content so each
+// member sees it in their mention feed
+func (r *Repository) recordGroupMentions(content string, threadID uint, commentID *uint, authorID uint) {
+	handles := parseMentions(content)
+	if len(handles) == 0 {
+		return
+	}
+
+	groups := []models.Group{}
+	if err := r.DB.Where("name IN ?", handles).Find(&groups).Error; err != nil {
+		log.Println("Group mention lookup error:", err)
+		return
+	}
+	for _, group := range groups {
+		mention := models.GroupMention{
+			GroupID:   group.ID,
+			ThreadID:  threadID,
+			CommentID: commentID,
+			AuthorID:  authorID,
+		}
+		if err := r.DB.Create(&mention).Error; err != nil {
+			log.Println("Group mention create error:", err)
+		}
+	}
+}
+
+// GetGroupMentions lists mentions of every group the current user is an active member of
+func (r *Repository) GetGroupMentions(c *gin.Context) {
+	mentions := &[]models.GroupMention{}
+	query := r.DB
+	// Mentions in categories the user cannot view are left out
+	if denied := r.restrictedCategoryIDs(currentUserID(c), "can_view"); len(denied) > 0 {
+		query = query.Where("group_mentions.thread_id NOT IN (?)", r.DB.Unscoped().Model(&models.Thread{}).Select("id").Where("category_id IN ?", denied))
+	}
+	err := query.
+		Joins("JOIN group_members ON group_members.group_id = group_mentions.group_id").
+		Where("group_members.user_id = ? AND group_members.status = ?", currentUserID(c), models.MemberStatusActive).
+		Where("group_mentions.author_id <> ?", currentUserID(c)).
+		Order("group_mentions.created_at DESC").
+		Limit(100).
+		Find(mentions).Error
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get mentions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Mentions fetched successfully", "data": mentions})
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/damiancxliew/web-forum/events"
+	"github.com/damiancxliew/web-forum/media"
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// imageSizes are the variants generated for each purpose
+var imageSizes = map[string][]media.Size{
+	models.PurposePost: {
+		{Name: "thumb", Width: 320},
+		{Name: "large", Width: 1280},
+	},
+	models.PurposeAvatar: {
+		{Name: "small", Width: 64, Square: true},
+		{Name: "medium", Width: 128, Square: true},
+		{Name: "large", Width: 256, Square: true},
+	},
+}
+
+// staleProcessingAfter is how long an image may sit in processing before it is
+// assumed abandoned by a replica that stopped and is queued again
+const staleProcessingAfter = 10 * time.Minute
+
+var formatExtensions = map[string]string{"jpeg": "jpg", "png": "png", "webp": "webp"}
+
+// isProcessedImage reports whether uploads of this type go through the image pipeline
+func isProcessedImage(contentType string) bool {
+	switch contentType {
+	case "image/png", "image/jpeg", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+// variantURL is the stable URL of an image variant, suitable for img tags
+func variantURL(attachmentID uint, variant models.AttachmentVariant) string {
+	return fmt.Sprintf("%s/api/attachments/%d/variants/%s.%s",
+		apiURL(), attachmentID, variant.Name, formatExtensions[variant.Format])
+}
+
+// SubscribeImages processes uploaded images on the event bus, off the request
+// path. Images left pending by an earlier run are queued again at startup.
+func (r *Repository) SubscribeImages() {
+	r.Events.Subscribe("images", func(event events.Event) {
+		r.processImage(event.AttachmentID)
+	}, events.AttachmentUploaded)
+
+	r.DB.Model(&models.Attachment{}).
+		Where("status = ? AND updated_at < ?", models.AttachmentProcessing, time.Now().Add(-staleProcessingAfter)).
+		Update("status", models.AttachmentPending)
+
+	var pending []uint
+	r.DB.Model(&models.Attachment{}).Where("status = ?", models.AttachmentPending).Pluck("id", &pending)
+	for _, id := range pending {
+		r.Events.Publish(events.Event{Type: events.AttachmentUploaded, AttachmentID: id})
+	}
+}
+
+// processImage re-encodes a pending image and generates its variants. Each
+// image is claimed first so only one replica processes it.
+func (r *Repository) processImage(attachmentID uint) {
+	claim := r.DB.Model(&models.Attachment{}).
+		Where("id = ? AND status = ?", attachmentID, models.AttachmentPending).
+		Update("status", models.AttachmentProcessing)
+	if claim.Error != nil || claim.RowsAffected == 0 {
+		return
+	}
+
+	attachment := models.Attachment{}
+	if err := r.DB.First(&attachment, attachmentID).Error; err != nil {
+		return
+	}
+
+	err := r.renderImage(&attachment)
+	if err != nil {
+		log.Printf("Image processing error on attachment %d: %v", attachment.ID, err)
+		message := "Could not process image"
+		if errors.Is(err, media.ErrTooLarge) || errors.Is(err, media.ErrUnsupported) {
+			message = err.Error()
+		}
+		// The original may be hostile, so it is not kept
+		r.Blobs.Delete(context.Background(), attachment.StorageKey)
+		r.DB.Model(&attachment).Updates(map[string]interface{}{
+			"status": models.AttachmentFailed,
+			"error":  message,
+		})
+		attachment.Status = models.AttachmentFailed
+	}
+
+	r.Events.Publish(events.Event{
+		Type:         events.AttachmentProcessed,
+		ThreadID:     attachment.ThreadID,
+		CategoryID:   r.threadCategoryID(attachment.ThreadID),
+		UserID:       attachment.UserID,
+		AttachmentID: attachment.ID,
+		Detail:       attachment.Status,
+		Recipients:   []uint{attachment.UserID},
+	})
+}
+
+// renderImage replaces the stored original with a clean re-encode and stores
+// each variant, then marks the attachment ready
+func (r *Repository) renderImage(attachment *models.Attachment) error {
+	ctx := context.Background()
+	body, err := r.Blobs.Get(ctx, attachment.StorageKey)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxUploadSize()+1))
+	body.Close()
+	if err != nil {
+		return err
+	}
+
+	original, outputs, err := media.Process(data, imageSizes[attachment.Purpose], media.DefaultLimits)
+	if err != nil {
+		return err
+	}
+
+	variants := []models.AttachmentVariant{}
+	for _, output := range outputs {
+		variant := models.AttachmentVariant{
+			AttachmentID: attachment.ID,
+			Name:         output.Name,
+			Format:       output.Format,
+			ContentType:  output.ContentType,
+			Width:        output.Width,
+			Height:       output.Height,
+			Size:         int64(len(output.Data)),
+			StorageKey:   fmt.Sprintf("%s-%s.%s", attachment.StorageKey, output.Name, formatExtensions[output.Format]),
+		}
+		if err := r.Blobs.Put(ctx, variant.StorageKey, bytes.NewReader(output.Data), variant.Size, variant.ContentType); err != nil {
+			return err
+		}
+		variants = append(variants, variant)
+	}
+	if err := r.Blobs.Put(ctx, attachment.StorageKey, bytes.NewReader(original.Data), int64(len(original.Data)), original.ContentType); err != nil {
+		return err
+	}
+
+	filename := strings.TrimSuffix(attachment.Filename, filepath.Ext(attachment.Filename)) + "." + formatExtensions[original.Format]
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("attachment_id = ?", attachment.ID).Delete(&models.AttachmentVariant{}).Error; err != nil {
+			return err
+		}
+		if len(variants) > 0 {
+			if err := tx.Create(&variants).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(attachment).Updates(map[string]interface{}{
+			"status":       models.AttachmentReady,
+			"error":        "",
+			"filename":     filename,
+			"content_type": original.ContentType,
+			"size":         int64(len(original.Data)),
+			"width":        original.Width,
+			"height":       original.Height,
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+	attachment.Status = models.AttachmentReady
+	return nil
+}
+
+// GetAttachmentVariant serves an image variant such as thumb.webp. Unlike
+// originals these have stable URLs so they can be embedded.
+func (r *Repository) GetAttachmentVariant(c *gin.Context) {
+	attachment, ok := r.loadAttachment(c)
+	if !ok {
+		return
+	}
+
+	name, extension, _ := strings.Cut(c.Param("variant"), ".")
+	var variant *models.AttachmentVariant
+	for i, candidate := range attachment.Variants {
+		if candidate.Name == name && formatExtensions[candidate.Format] == extension {
+			variant = &attachment.Variants[i]
+		}
+	}
+	if variant == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Variant not found"})
+		return
+	}
+
+	body, err := r.Blobs.Get(c.Request.Context(), variant.StorageKey)
+	if err != nil {
+		log.Println("Blob get error:", err)
+		c.JSON(http.StatusNotFound, gin.H{"message": "Variant not found"})
+		return
+	}
+	defer body.Close()
+
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", "default-src 'none'; sandbox")
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.DataFromReader(http.StatusOK, variant.Size, variant.ContentType, body, nil)
+}
+
+// UploadAvatar sets the user's avatar from an uploaded image. The previous
+// avatar is removed once the new one is stored.
+func (r *Repository) UploadAvatar(c *gin.Context) {
+	user := models.User{}
+	if err := r.DB.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+	userID := currentUserID(c)
+	if user.ID != userID && !r.hasRole(userID, models.RoleAdmin) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "You cannot change this avatar"})
+		return
+	}
+
+	header, ok := formFile(c)
+	if !ok {
+		return
+	}
+	if !r.checkQuota(c, user.ID, header.Size) {
+		return
+	}
+	file, contentType, ok := readUpload(c, header)
+	if !ok {
+		return
+	}
+	defer file.Close()
+	if !isProcessedImage(contentType) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"message": "Avatars must be PNG, JPEG, GIF or WebP images"})
+		return
+	}
+
+	attachment := models.Attachment{
+		UserID:      user.ID,
+		Purpose:     models.PurposeAvatar,
+		Filename:    sanitizeFilename(header.Filename),
+		ContentType: contentType,
+		Size:        header.Size,
+	}
+	if !r.storeUpload(c, &attachment, file) {
+		return
+	}
+
+	previous := user.AvatarID
+	if err := r.DB.Model(&user).Update("avatar_id", attachment.ID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not update avatar"})
+		return
+	}
+	if previous != nil {
+		old := []models.Attachment{}
+		r.DB.Preload("Variants").Where("id = ? AND purpose = ?", *previous, models.PurposeAvatar).Find(&old)
+		if err := r.deleteAttachments(old); err != nil {
+			log.Println("Old avatar cleanup error:", err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Avatar uploaded successfully",
+		"data":    r.withURLs(c.Request.Context(), []models.Attachment{attachment})[0],
+	})
+}
@@ -0,0 +1,102 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Message is a single email with both an HTML and a plain-text body
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+	Headers map[string]string
+}
+
+// Mailer sends email
+type Mailer interface {
+	Send(message Message) error
+}
+
+// LogMailer writes emails to the log instead of sending them, for development
+type LogMailer struct{}
+
+func (LogMailer) Send(message Message) error {
+	log.Printf("Email to %s: %s\n%s", message.To, message.Subject, message.Text)
+	return nil
+}
+
+// SMTPMailer sends email through an SMTP server
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(message Message) error {
+	body, err := m.build(message)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	return smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{message.To}, body)
+}
+
+// build assembles a multipart/alternative MIME message
+func (m *SMTPMailer) build(message Message) ([]byte, error) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+
+	headers := map[string]string{
+		"From":         m.From,
+		"To":           message.To,
+		"Subject":      mime.QEncoding.Encode("utf-8", message.Subject),
+		"Date":         time.Now().Format(time.RFC1123Z),
+		"MIME-Version": "1.0",
+		"Content-Type": fmt.Sprintf("multipart/alternative; boundary=%q", parts.Boundary()),
+	}
+	for name, value := range message.Headers {
+		headers[name] = value
+	}
+
+	var out bytes.Buffer
+	for name, value := range headers {
+		// Header values must never smuggle in extra headers
+		value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+		fmt.Fprintf(&out, "%s: %s\r\n", name, value)
+	}
+	out.WriteString("\r\n")
+
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", message.Text},
+		{"text/html; charset=utf-8", message.HTML},
+	} {
+		writer, err := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType}})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := writer.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	out.Write(body.Bytes())
+	return out.Bytes(), nil
+}
@@ -0,0 +1,54 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	htmltemplate "html/template"
+	texttemplate "text/template"
+)
+
+//go:embed templates
+var templateFiles embed.FS
+
+var (
+	htmlTemplates = htmltemplate.Must(htmltemplate.ParseFS(templateFiles, "templates/*.html"))
+	textTemplates = texttemplate.Must(texttemplate.ParseFS(templateFiles, "templates/*.txt"))
+)
+
+// DigestItem is one line of activity in a digest
+type DigestItem struct {
+	Message string
+	Link    string
+	At      string
+}
+
+// DigestData fills the digest templates
+type DigestData struct {
+	Username       string
+	Period         string // "daily" or "weekly"
+	Notifications  []DigestItem
+	Activity       []DigestItem
+	SettingsURL    string
+	UnsubscribeURL string
+}
+
+// NotificationData fills the single-notification templates
+type NotificationData struct {
+	Username       string
+	Message        string
+	Link           string
+	SettingsURL    string
+	UnsubscribeURL string
+}
+
+// Render executes the named template pair (name.html and name.txt) into a message body
+func Render(name string, data interface{}) (html, text string, err error) {
+	var htmlOut, textOut bytes.Buffer
+	if err := htmlTemplates.ExecuteTemplate(&htmlOut, name+".html", data); err != nil {
+		return "", "", err
+	}
+	if err := textTemplates.ExecuteTemplate(&textOut, name+".txt", data); err != nil {
+		return "", "", err
+	}
+	return htmlOut.String(), textOut.String(), nil
+}
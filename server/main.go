@@ -1,16 +1,24 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"regexp"
+	"strconv"
 
 	"strings"
 	"time"
 
+	"github.com/damiancxliew/web-forum/blob"
+	"github.com/damiancxliew/web-forum/events"
+	"github.com/damiancxliew/web-forum/mailer"
+	"github.com/damiancxliew/web-forum/markup"
 	"github.com/damiancxliew/web-forum/models"
+	"github.com/damiancxliew/web-forum/realtime"
+	"github.com/damiancxliew/web-forum/search"
 	"github.com/damiancxliew/web-forum/storage"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
@@ -24,7 +32,13 @@ type User struct {
 	Password  string `json:"-"` // Omit from JSON responses for security
 }
 type Repository struct {
-	DB *gorm.DB
+	DB       *gorm.DB
+	Events   *events.Bus
+	Index    search.Indexer
+	Hub      *realtime.Hub
+	EventLog events.Log
+	Mailer   mailer.Mailer
+	Blobs    blob.Store
 }
 
 // Threads
@@ -37,18 +51,105 @@ func (r *Repository) CreateThread(c *gin.Context) {
 		return
 	}
 
-	// Create the thread in the database
-	if err := r.DB.Create(&thread).Error; err != nil {
+	// Threads are always posted as the token's user, whatever the body says
+	thread.UserID = currentUserID(c)
+	// Scores only move through votes, while answers and moderation states
+	// have their own endpoints
+	thread.Score = 0
+	thread.AcceptedCommentID = nil
+	thread.Pin, thread.PinnedAt = "", nil
+	thread.Locked, thread.Archived = false, false
+	thread.Announcement, thread.AnnouncementExpiresAt = false, nil
+	thread.MergedIntoID = nil
+	thread.Hidden = false
+	// Timestamps come from the server, since rate limits and spam checks
+	// look back by creation time
+	thread.CreatedAt = time.Now().UTC().Format(isoTimestamp)
+	thread.UpdatedAt = thread.CreatedAt
+
+	if message := r.postingBlocked(thread.UserID); message != "" {
+		c.JSON(http.StatusForbidden, gin.H{"message": message})
+		return
+	}
+	// Restricted categories only accept threads from permitted groups
+	if !r.canAccessCategory(thread.UserID, thread.CategoryID, "can_post") {
+		c.JSON(http.StatusForbidden, gin.H{"message": "you cannot post in this category"})
+		return
+	}
+	// Word filters may mask words, hold the thread for review or block it
+	filtered, ok := r.screenPost(c, &thread.Title, &thread.Content)
+	if !ok {
+		return
+	}
+	spam, ok := r.screenSpam(c, spamPost{UserID: thread.UserID, Title: thread.Title, Content: thread.Content}, true)
+	if !ok {
+		return
+	}
+	thread.Hidden = filtered.Held || spam.Held
+
+	html, err := markup.Render(thread.Content)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "could not render content"})
+		return
+	}
+	thread.ContentHTML = html
+
+	if thread.Poll != nil {
+		if message := preparePoll(thread.Poll); message != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"message": message})
+			return
+		}
+	}
+
+	// Create the thread in the database, along with its poll
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&thread).Error; err != nil {
+			return err
+		}
+		if err := queueFiltered(tx, models.TargetThread, thread.ID, filtered); err != nil {
+			return err
+		}
+		if err := queueSpam(tx, models.TargetThread, thread.ID, spam); err != nil {
+			return err
+		}
+		if thread.Poll == nil {
+			return nil
+		}
+		thread.Poll.ThreadID = thread.ID
+		return tx.Create(thread.Poll).Error
+	})
+	if err != nil {
 		log.Println("DB Create Error:", err)
 		c.JSON(http.StatusBadRequest, gin.H{"message": "could not create thread"})
 		return
 	}
 
+	thread.Mentions = r.recordMentions(thread.Content, thread.ID, nil, thread.UserID)
+	thread.Reactions, thread.MyReactions = map[string]int{}, []string{}
+	thread.Question = r.isQACategory(thread.CategoryID)
+	if thread.Poll != nil {
+		r.pollForViewer(thread.Poll, thread.UserID)
+	}
+	r.recordGroupMentions(thread.Content, thread.ID, nil, thread.UserID)
+	// Held threads are not announced, so nobody is notified about a thread
+	// they cannot see
+	if !thread.Hidden {
+		r.Events.Publish(events.Event{
+			Type:       events.ThreadCreated,
+			ThreadID:   thread.ID,
+			CategoryID: thread.CategoryID,
+			UserID:     thread.UserID,
+			AuthorID:   thread.UserID,
+		})
+	}
+
 	// Respond with the created thread
 	c.JSON(http.StatusOK, thread)
 }
 
 
+// DeleteThread moves a thread and its comments to the trash. An optional
+// ?reason= is kept with them and shown to moderators.
 func (r *Repository) DeleteThread(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
@@ -58,29 +159,182 @@ func (r *Repository) DeleteThread(c *gin.Context) {
 		return
 	}
 
-	err := r.DB.Delete(&models.Thread{}, id).Error
+	thread := models.Thread{}
+	if err := r.DB.First(&thread, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "thread not found",
+		})
+		return
+	}
+
+	// Only the author or a moderator may trash a thread
+	userID, reason := currentUserID(c), c.Query("reason")
+	if thread.UserID != userID && !r.hasRole(userID, models.RoleAdmin, models.RoleModerator) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "you cannot delete this thread"})
+		return
+	}
+	fields := trashFields(userID, reason, time.Now())
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		return trashThreads(tx, []uint{thread.ID}, fields)
+	})
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"message": "could not delete thread",
 		})
 		return
 	}
+	r.audit(c, models.AuditThreadDelete, models.TargetThread, thread.ID, thread, fields)
+
+	r.Events.Publish(events.Event{
+		Type:       events.ThreadDeleted,
+		ThreadID:   thread.ID,
+		CategoryID: thread.CategoryID,
+		UserID:     userID,
+		AuthorID:   thread.UserID,
+		Detail:     reason,
+	})
 	c.JSON(http.StatusOK, gin.H{
 		"message": "thread deleted successfully",
 	})
 }
 
+// UpdateThread lets the author, a moderator or a user whose reputation unlocked
+// editing change a thread's title and content
+func (r *Repository) UpdateThread(c *gin.Context) {
+	thread := models.Thread{}
+	if err := r.DB.First(&thread, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "thread not found"})
+		return
+	}
+
+	userID := currentUserID(c)
+	if thread.UserID != userID && !r.hasRole(userID, models.RoleAdmin, models.RoleModerator) &&
+		!r.hasPrivilege(userID, models.PrivilegeEditPosts) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "you cannot edit this thread"})
+		return
+	}
+	if thread.Archived {
+		c.JSON(http.StatusForbidden, gin.H{"message": "this thread is archived"})
+		return
+	}
+
+	var updateRequest struct {
+		Title   string `json:"title"`
+		Content string `json:"content"`
+	}
+	if err := c.ShouldBindJSON(&updateRequest); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "request failed"})
+		return
+	}
+
+	filtered, ok := r.screenPost(c, &updateRequest.Title, &updateRequest.Content)
+	if !ok {
+		return
+	}
+
+	before := thread
+	if updateRequest.Title != "" {
+		thread.Title = updateRequest.Title
+	}
+	if updateRequest.Content != "" {
+		html, err := markup.Render(updateRequest.Content)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "could not render content"})
+			return
+		}
+		thread.Content = updateRequest.Content
+		thread.ContentHTML = html
+	}
+	thread.UpdatedAt = time.Now().UTC().Format(isoTimestamp)
+	spam, ok := r.screenSpam(c, spamPost{UserID: userID, ThreadID: thread.ID, Title: thread.Title, Content: thread.Content}, false)
+	if !ok {
+		return
+	}
+	held := filtered.Held || spam.Held
+
+	// Only the edited fields are written, so concurrent votes and moderation
+	// are not overwritten
+	columns := []interface{}{"content", "content_html", "updated_at"}
+	if held {
+		thread.Hidden = true
+		columns = append(columns, "hidden")
+	}
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&thread).Select("title", columns...).Updates(&thread).Error; err != nil {
+			return err
+		}
+		if err := queueFiltered(tx, models.TargetThread, thread.ID, filtered); err != nil {
+			return err
+		}
+		return queueSpam(tx, models.TargetThread, thread.ID, spam)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "could not update thread"})
+		return
+	}
+	if thread.UserID != userID {
+		r.audit(c, models.AuditThreadEdit, models.TargetThread, thread.ID, before, thread)
+	}
+	thread.Mentions = r.recordMentions(thread.Content, thread.ID, nil, thread.UserID)
+	threads := []models.Thread{thread}
+	r.attachThreadReactions(threads, userID)
+	r.attachQuestionState(threads)
+	thread = threads[0]
+
+	r.Events.Publish(events.Event{
+		Type:       events.ThreadUpdated,
+		ThreadID:   thread.ID,
+		CategoryID: thread.CategoryID,
+		UserID:     userID,
+		AuthorID:   thread.UserID,
+	})
+	if held && !before.Hidden {
+		r.publishHidden(reactionTarget{
+			Type:       models.TargetThread,
+			ID:         thread.ID,
+			ThreadID:   thread.ID,
+			CategoryID: thread.CategoryID,
+			AuthorID:   thread.UserID,
+		}, true, 0)
+	}
+	c.JSON(http.StatusOK, thread)
+}
+
 
 func (r *Repository) GetThreads(c *gin.Context) {
 	threads := &[]models.Thread{}
 
-	err := r.DB.Find(threads).Error
+	// Merged threads live on only as redirects
+	query := r.DB.Where("merged_into_id IS NULL")
+	if denied := r.restrictedCategoryIDs(currentUserID(c), "can_view"); len(denied) > 0 {
+		query = query.Where("category_id NOT IN ?", denied)
+	}
+	// Hidden threads stay visible to their authors and moderators
+	if !r.hasRole(currentUserID(c), models.RoleAdmin, models.RoleModerator) {
+		query = query.Where("hidden = ? OR user_id = ?", false, currentUserID(c))
+	}
+	// ?category_id= lists one category, with its pinned threads first
+	categoryID := c.Query("category_id")
+	if categoryID != "" {
+		query = query.Where("category_id = ?", categoryID)
+	}
+	query = pinOrder(query, categoryID != "")
+	// ?unsolved=true lists questions still waiting for an accepted answer
+	if c.Query("unsolved") == "true" {
+		query = query.Where("category_id IN ? AND (accepted_comment_id IS NULL OR accepted_comment_id NOT IN (?))",
+			r.qaCategoryIDs(), liveAnswers(r.DB))
+	}
+
+	err := query.Find(threads).Error
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"message": "could not get threads",
 		})
 		return
 	}
+	r.attachThreadMentions(*threads)
+	r.attachThreadReactions(*threads, currentUserID(c))
+	r.attachQuestionState(*threads)
 
 	c.JSON(http.StatusOK, threads)
 }
@@ -95,7 +349,7 @@ func (r *Repository) GetThreadByID(c *gin.Context) {
 		return
 	}
 
-	err := r.DB.Where("thread_id = ?", id).First(thread).Error
+	err := r.DB.Unscoped().Where("id = ?", id).First(thread).Error
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"message": "could not get the thread",
@@ -103,6 +357,42 @@ func (r *Repository) GetThreadByID(c *gin.Context) {
 		return
 	}
 
+	if !r.canAccessCategory(currentUserID(c), thread.CategoryID, "can_view") {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "you cannot view this thread",
+		})
+		return
+	}
+	// Moderators can still read deleted threads, everyone else gets a tombstone
+	if thread.DeletedAt.Valid && !r.hasRole(currentUserID(c), models.RoleAdmin, models.RoleModerator) {
+		c.JSON(http.StatusGone, gin.H{
+			"message": "thread was deleted",
+			"data":    threadTombstone(*thread),
+		})
+		return
+	}
+	if thread.Hidden && !r.canSeeHidden(currentUserID(c), thread.UserID) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "thread is hidden pending review",
+		})
+		return
+	}
+	// Merged threads redirect to the thread their comments went to
+	if thread.MergedIntoID != nil {
+		c.Header("Location", fmt.Sprintf("/api/get_thread/%d", *thread.MergedIntoID))
+		c.JSON(http.StatusMovedPermanently, gin.H{
+			"message":     "thread was merged",
+			"redirect_to": *thread.MergedIntoID,
+		})
+		return
+	}
+	thread.Mentions = r.mentionsOfThread(thread.ID)
+	threads := []models.Thread{*thread}
+	r.attachThreadReactions(threads, currentUserID(c))
+	r.attachQuestionState(threads)
+	thread = &threads[0]
+	thread.Poll = r.threadPoll(thread.ID, currentUserID(c))
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "thread fetched successfully",
 		"data":    thread,
@@ -116,17 +406,27 @@ var jwtSecret = []byte("your_secret_key")
 
 // SignUp handles user registration
 func (r *Repository) SignUp(c *gin.Context) {
-    user := models.User{}
+    // The password is never bound straight into models.User, which does
+    // not deserialize it
+    var signUpRequest struct {
+        Username string `json:"username"`
+        Email    string `json:"email"`
+        Password string `json:"password"`
+    }
 
     // Parse user input
-    if err := c.ShouldBindJSON(&user); err != nil {
+    if err := c.ShouldBindJSON(&signUpRequest); err != nil {
         fmt.Printf("BodyParser Error: %v\n", err)
         c.JSON(http.StatusUnprocessableEntity, gin.H{
             "message": "Invalid request",
         })
         return
     }
-    fmt.Printf("Parsed User: %+v\n", user)
+    user := models.User{
+        Username: signUpRequest.Username,
+        Email:    signUpRequest.Email,
+        Password: signUpRequest.Password,
+    }
 
     // Check for missing fields
     if user.Username == "" || user.Email == "" || user.Password == "" {
@@ -167,6 +467,13 @@ func (r *Repository) SignUp(c *gin.Context) {
         })
         return
     }
+    // Users share the mention namespace with groups
+    if r.groupNameTaken(user.Username) {
+        c.JSON(http.StatusConflict, gin.H{
+            "message": "Username is already taken by a group",
+        })
+        return
+    }
 
     // Hash the password
     hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
@@ -178,6 +485,9 @@ func (r *Repository) SignUp(c *gin.Context) {
     }
     user.Password = string(hashedPassword)
 
+    // Roles are only ever granted by an admin
+    user.Role = models.RoleUser
+
     // Save user to database
     if err := r.DB.Create(&user).Error; err != nil {
         fmt.Printf("Database Error: %v\n", err)
@@ -187,7 +497,7 @@ func (r *Repository) SignUp(c *gin.Context) {
         return
     }
 
-    fmt.Printf("Created User: %+v\n", user)
+    fmt.Printf("Created User: %d %s\n", user.ID, user.Username)
 
     // Respond with created user details (excluding the password)
     c.JSON(http.StatusOK, gin.H{
@@ -262,6 +572,15 @@ func (r *Repository) Login(c *gin.Context) {
         return
     }
 
+    // Banned and suspended users are told why and until when
+    if sanction, found := r.activeSanction(user.ID, loginSanctions...); found {
+        c.JSON(http.StatusForbidden, gin.H{
+            "message":  sanctionMessage(sanction),
+            "sanction": sanction,
+        })
+        return
+    }
+
     // Generate JWT token
     token, err := generateJWT(user)
     if err != nil {
@@ -291,13 +610,11 @@ func (r *Repository) UpdateUser(c *gin.Context) {
 
     var updateRequest UpdateUserRequest
     if err := c.ShouldBindJSON(&updateRequest); err != nil {
-        fmt.Println("Error parsing body:", err)
         c.JSON(http.StatusUnprocessableEntity, gin.H{
             "message": "Invalid request",
         })
         return
     }
-    fmt.Printf("Parsed Body: %+v\n", updateRequest)
 
     // Validate user ID
     if id == "" {
@@ -316,24 +633,61 @@ func (r *Repository) UpdateUser(c *gin.Context) {
         return
     }
 
+    // Only the owner or an admin may change an account
+    if userID := currentUserID(c); user.ID != userID && !r.hasRole(userID, models.RoleAdmin) {
+        c.JSON(http.StatusForbidden, gin.H{
+            "message": "You cannot update this user",
+        })
+        return
+    }
+
     // Update user fields only if they are provided
-    if updateRequest.Username != "" {
+    before := user
+    if updateRequest.Username != "" && updateRequest.Username != user.Username {
+        // Users share the mention namespace with groups
+        if r.groupNameTaken(updateRequest.Username) {
+            c.JSON(http.StatusConflict, gin.H{
+                "message": "Username is already taken by a group",
+            })
+            return
+        }
         user.Username = updateRequest.Username
     }
     if updateRequest.Email != "" {
         user.Email = updateRequest.Email
     }
+    if updateRequest.Password != "" {
+        // Same rule as at sign up
+        if len(updateRequest.Password) < 8 {
+            c.JSON(http.StatusBadRequest, gin.H{
+                "message": "Password must be at least 8 characters long",
+            })
+            return
+        }
+        hashedPassword, err := bcrypt.GenerateFromPassword([]byte(updateRequest.Password), bcrypt.DefaultCost)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{
+                "message": "Failed to hash password",
+            })
+            return
+        }
+        user.Password = string(hashedPassword)
+    }
 
     // Save the updated user
-    if err := r.DB.Save(&user).Error; err != nil {
+    // Reputation only moves through the ledger, and deletion through the trash
+    if err := r.DB.Omit("reputation", "deleted_at", "deleted_by", "delete_reason").Save(&user).Error; err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{
             "message": "Failed to update user",
         })
         return
     }
+    if user.ID != currentUserID(c) {
+        r.audit(c, models.AuditUserEdit, models.TargetUser, user.ID, before, user)
+    }
 
-    // Respond with the updated user
-    c.JSON(http.StatusOK, user)
+    // Respond with the owner's view of the updated user
+    c.JSON(http.StatusOK, r.privateProfile(user))
 }
 
 func (r *Repository) GetUserByID(c *gin.Context) {
@@ -357,8 +711,8 @@ func (r *Repository) GetUserByID(c *gin.Context) {
         return
     }
 
-    // Respond with the fetched user details
-    c.JSON(http.StatusOK, user)
+    // Respond with the public profile only
+    c.JSON(http.StatusOK, r.publicProfile(*user))
 }
 
 
@@ -373,11 +727,13 @@ func (r *Repository) GetUsers(c *gin.Context) {
         return
     }
 
-    // Return the list of users
-    c.JSON(http.StatusOK, users)
+    // Return the public profile of each user
+    c.JSON(http.StatusOK, r.publicProfiles(*users))
 }
 
 
+// DeleteUser moves a user to the trash along with their threads and comments,
+// keeping an optional ?reason=
 func (r *Repository) DeleteUser(c *gin.Context) {
     id := c.Param("id") // Get the user ID from URL parameters
     if id == "" {
@@ -387,38 +743,64 @@ func (r *Repository) DeleteUser(c *gin.Context) {
         return
     }
 
-    // Start a transaction
-    tx := r.DB.Begin()
-
-    // Delete comments by user
-    if err := tx.Where("user_id = ?", id).Delete(&models.Comment{}).Error; err != nil {
-        tx.Rollback()
-        c.JSON(http.StatusBadRequest, gin.H{
-            "message": "Could not delete comments",
+    user := models.User{}
+    if err := r.DB.First(&user, id).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{
+            "message": "User not found",
         })
         return
     }
 
-    // Delete threads by user
-    if err := tx.Where("user_id = ?", id).Delete(&models.Thread{}).Error; err != nil {
-        tx.Rollback()
-        c.JSON(http.StatusBadRequest, gin.H{
-            "message": "Could not delete threads",
+    // Users may delete their own account, and only admins anyone else's
+    if user.ID != currentUserID(c) && !r.hasRole(currentUserID(c), models.RoleAdmin) {
+        c.JSON(http.StatusForbidden, gin.H{
+            "message": "You cannot delete this user",
         })
         return
     }
 
-    // Delete the user
-    if err := tx.Delete(&models.User{}, id).Error; err != nil {
-        tx.Rollback()
+    // Remember what is about to go so subscribers can drop it too
+    var threadIDs, commentIDs []uint
+    r.DB.Model(&models.Thread{}).Where("user_id = ?", user.ID).Pluck("id", &threadIDs)
+    r.DB.Model(&models.Comment{}).Where("user_id = ?", user.ID).Pluck("id", &commentIDs)
+
+    // Everything goes to the trash at the same moment, which is how restoring
+    // the user finds it again
+    fields := trashFields(currentUserID(c), c.Query("reason"), time.Now())
+    err := r.DB.Transaction(func(tx *gorm.DB) error {
+        // Trash comments by user, and with them any accepted answers
+        if err := tx.Model(&models.Comment{}).Where("user_id = ?", user.ID).Updates(fields).Error; err != nil {
+            return err
+        }
+        if err := unacceptAnswers(tx, commentIDs); err != nil {
+            return err
+        }
+        // Trash threads by user, with every comment in them
+        if err := trashThreads(tx, threadIDs, fields); err != nil {
+            return err
+        }
+        // Trash the user
+        return tx.Model(&user).Updates(fields).Error
+    })
+    if err != nil {
         c.JSON(http.StatusBadRequest, gin.H{
             "message": "Could not delete user",
         })
         return
     }
+    r.audit(c, models.AuditUserDelete, models.TargetUser, user.ID, user, gin.H{
+        "trash":       fields,
+        "thread_ids":  threadIDs,
+        "comment_ids": commentIDs,
+    })
 
-    // Commit the transaction
-    tx.Commit()
+    for _, commentID := range commentIDs {
+        r.Events.Publish(events.Event{Type: events.CommentDeleted, CommentID: commentID})
+    }
+    for _, threadID := range threadIDs {
+        r.Events.Publish(events.Event{Type: events.ThreadDeleted, ThreadID: threadID})
+    }
+    r.Events.Publish(events.Event{Type: events.UserDeleted, UserID: currentUserID(c), AuthorID: user.ID})
 
     // Respond with success
     c.JSON(http.StatusOK, gin.H{
@@ -428,29 +810,57 @@ func (r *Repository) DeleteUser(c *gin.Context) {
 
 
 
-// JWTMiddleware validates the JWT token
-func JWTMiddleware(c *gin.Context) {
-    // Get the token from the Authorization header
+// parseToken validates the bearer token on the request and returns its claims
+func parseToken(c *gin.Context) (jwt.MapClaims, error) {
     authHeader := c.GetHeader("Authorization")
     if !strings.HasPrefix(authHeader, "Bearer ") {
-        c.JSON(http.StatusUnauthorized, gin.H{
-            "message": "Missing or invalid token",
-        })
-        c.Abort() // Ensure that the next handlers are not executed
-        return
+        return nil, fmt.Errorf("missing bearer token")
     }
 
     tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 
-    // Parse and validate the token
     token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
         if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
             return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
         }
         return jwtSecret, nil
     })
-
     if err != nil || !token.Valid {
+        return nil, fmt.Errorf("invalid token")
+    }
+
+    claims, ok := token.Claims.(jwt.MapClaims)
+    if !ok {
+        return nil, fmt.Errorf("invalid token claims")
+    }
+    return claims, nil
+}
+
+// setClaims stores the authenticated user on the request context
+func setClaims(c *gin.Context, claims jwt.MapClaims) {
+    if id, ok := claims["user_id"].(float64); ok {
+        c.Set("user_id", uint(id))
+    }
+    if username, ok := claims["username"].(string); ok {
+        c.Set("username", username)
+    }
+}
+
+// JWTMiddleware validates the JWT token and rejects users who were deleted,
+// banned or suspended since it was issued
+func (r *Repository) JWTMiddleware(c *gin.Context) {
+    // Get the token from the Authorization header
+    if !strings.HasPrefix(c.GetHeader("Authorization"), "Bearer ") {
+        c.JSON(http.StatusUnauthorized, gin.H{
+            "message": "Missing or invalid token",
+        })
+        c.Abort() // Ensure that the next handlers are not executed
+        return
+    }
+
+    // Parse and validate the token
+    claims, err := parseToken(c)
+    if err != nil {
         c.JSON(http.StatusUnauthorized, gin.H{
             "message": "Invalid token",
         })
@@ -459,9 +869,116 @@ func JWTMiddleware(c *gin.Context) {
     }
 
     // Token is valid; proceed to the next handler
+    setClaims(c, claims)
+    if !r.checkAccount(c) {
+        return
+    }
+    c.Next()
+}
+
+// OptionalJWTMiddleware identifies the user when a valid token is sent but
+// lets anonymous requests through
+func (r *Repository) OptionalJWTMiddleware(c *gin.Context) {
+    if claims, err := parseToken(c); err == nil {
+        setClaims(c, claims)
+        if !r.checkAccount(c) {
+            return
+        }
+    }
     c.Next()
 }
 
+// currentUserID returns the authenticated user's ID, or 0 for anonymous requests
+func currentUserID(c *gin.Context) uint {
+    if id, ok := c.Get("user_id"); ok {
+        return id.(uint)
+    }
+    return 0
+}
+
+// hasRole reports whether the user holds one of the given roles
+func (r *Repository) hasRole(userID uint, roles ...string) bool {
+    if userID == 0 {
+        return false
+    }
+    var user models.User
+    if err := r.DB.Select("role").First(&user, userID).Error; err != nil {
+        return false
+    }
+    for _, role := range roles {
+        if user.Role == role {
+            return true
+        }
+    }
+    return false
+}
+
+// RequireRole only lets through authenticated users holding one of the given roles.
+// It must run after JWTMiddleware.
+func (r *Repository) RequireRole(roles ...string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if !r.hasRole(currentUserID(c), roles...) {
+            c.JSON(http.StatusForbidden, gin.H{
+                "message": "You do not have permission to perform this action",
+            })
+            c.Abort()
+            return
+        }
+        c.Next()
+    }
+}
+
+// SetUserRole lets an admin change another user's role
+func (r *Repository) SetUserRole(c *gin.Context) {
+    id := c.Param("id")
+
+    var roleRequest struct {
+        Role string `json:"role"`
+    }
+    if err := c.ShouldBindJSON(&roleRequest); err != nil {
+        c.JSON(http.StatusUnprocessableEntity, gin.H{
+            "message": "Invalid request",
+        })
+        return
+    }
+
+    switch roleRequest.Role {
+    case models.RoleUser, models.RoleModerator, models.RoleAdmin:
+    default:
+        c.JSON(http.StatusBadRequest, gin.H{
+            "message": "Unknown role",
+        })
+        return
+    }
+
+    var user models.User
+    if err := r.DB.First(&user, id).Error; err != nil {
+        c.JSON(http.StatusNotFound, gin.H{
+            "message": "User not found",
+        })
+        return
+    }
+
+    if err := r.DB.Model(&user).Update("role", roleRequest.Role).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{
+            "message": "Failed to update role",
+        })
+        return
+    }
+    r.audit(c, models.AuditUserRole, models.TargetUser, user.ID, gin.H{"role": user.Role}, gin.H{"role": roleRequest.Role})
+
+    r.Events.Publish(events.Event{
+        Type:     events.UserRoleChanged,
+        UserID:   currentUserID(c),
+        AuthorID: user.ID,
+        Detail:   roleRequest.Role,
+    })
+
+    c.JSON(http.StatusOK, gin.H{
+        "message": "Role updated successfully",
+        "data":    gin.H{"id": user.ID, "role": roleRequest.Role},
+    })
+}
 
 
 
@@ -475,23 +992,112 @@ func (r *Repository) CreateComment(c *gin.Context) {
 		return
 	}
 
-	if err := r.DB.Create(&comment).Error; err != nil {
+	// Comments are always posted as the token's user, whatever the body says
+	comment.UserID = currentUserID(c)
+	// Scores only move through votes, and only the thread's author marks replies helpful
+	comment.Score = 0
+	comment.Helpful = false
+	comment.Hidden = false
+	// As with threads, the server sets the timestamps
+	comment.CreatedAt = time.Now().UTC().Format(isoTimestamp)
+	comment.UpdatedAt = comment.CreatedAt
+
+	thread := models.Thread{}
+	if err := r.DB.First(&thread, comment.ThreadID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Thread not found"})
+		return
+	}
+	if !r.canAccessCategory(comment.UserID, thread.CategoryID, "can_post") {
+		c.JSON(http.StatusForbidden, gin.H{"message": "You cannot post in this category"})
+		return
+	}
+	if message := r.postingBlocked(comment.UserID); message != "" {
+		c.JSON(http.StatusForbidden, gin.H{"message": message})
+		return
+	}
+	if message := r.replyBlocked(thread, comment.UserID); message != "" {
+		c.JSON(http.StatusForbidden, gin.H{"message": message})
+		return
+	}
+
+	// Replies must stay within the thread of the comment they answer
+	if comment.ParentID != nil {
+		parent := models.Comment{}
+		if err := r.DB.First(&parent, *comment.ParentID).Error; err != nil || parent.ThreadID != comment.ThreadID {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Parent comment not found in this thread"})
+			return
+		}
+	}
+
+	filtered, ok := r.screenPost(c, &comment.Content)
+	if !ok {
+		return
+	}
+	spam, ok := r.screenSpam(c, spamPost{UserID: comment.UserID, ThreadID: comment.ThreadID, Content: comment.Content}, true)
+	if !ok {
+		return
+	}
+	comment.Hidden = filtered.Held || spam.Held
+
+	html, err := markup.Render(comment.Content)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not render content"})
+		return
+	}
+	comment.ContentHTML = html
+
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&comment).Error; err != nil {
+			return err
+		}
+		if err := queueFiltered(tx, models.TargetComment, comment.ID, filtered); err != nil {
+			return err
+		}
+		return queueSpam(tx, models.TargetComment, comment.ID, spam)
+	})
+	if err != nil {
 		log.Println("DB Create Error:", err)
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not create comment"})
 		return
 	}
 
+	comment.Mentions = r.recordMentions(comment.Content, comment.ThreadID, &comment.ID, comment.UserID)
+	comment.Reactions, comment.MyReactions = map[string]int{}, []string{}
+	r.recordGroupMentions(comment.Content, comment.ThreadID, &comment.ID, comment.UserID)
+	// Held comments are not announced, so nobody is notified about a reply
+	// they cannot see
+	if !comment.Hidden {
+		r.Events.Publish(events.Event{
+			Type:       events.CommentCreated,
+			ThreadID:   comment.ThreadID,
+			CommentID:  comment.ID,
+			CategoryID: thread.CategoryID,
+			UserID:     comment.UserID,
+			AuthorID:   comment.UserID,
+		})
+	}
+
 	c.JSON(http.StatusOK, comment)
 }
 
 func (r *Repository) GetComments(c *gin.Context) {
 	comments := &[]models.Comment{}
 
-	err := r.DB.Find(comments).Error
+	query := r.DB
+	if denied := r.restrictedCategoryIDs(currentUserID(c), "can_view"); len(denied) > 0 {
+		query = query.Where("thread_id NOT IN (?)", r.DB.Model(&models.Thread{}).Select("id").Where("category_id IN ?", denied))
+	}
+	if !r.hasRole(currentUserID(c), models.RoleAdmin, models.RoleModerator) {
+		query = query.Where("hidden = ? OR user_id = ?", false, currentUserID(c))
+	}
+
+	err := query.Find(comments).Error
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get comments"})
 		return
 	}
+	r.attachCommentMentions(*comments)
+	r.attachCommentReactions(*comments, currentUserID(c))
 
 	c.JSON(http.StatusOK, comments)
 }
@@ -500,11 +1106,45 @@ func (r *Repository) GetCommentsByThreadID(c *gin.Context) {
 	threadID := c.Param("thread_id")
 	comments := &[]models.Comment{}
 
-	err := r.DB.Where("thread_id = ?", threadID).Find(comments).Error
+	thread := models.Thread{}
+	if err := r.DB.Unscoped().First(&thread, threadID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Thread not found"})
+		return
+	}
+	if !r.canAccessCategory(currentUserID(c), thread.CategoryID, "can_view") {
+		c.JSON(http.StatusForbidden, gin.H{"message": "You cannot view this thread"})
+		return
+	}
+	moderator := r.hasRole(currentUserID(c), models.RoleAdmin, models.RoleModerator)
+	if thread.DeletedAt.Valid && !moderator {
+		c.JSON(http.StatusGone, gin.H{"message": "Thread was deleted"})
+		return
+	}
+	if thread.Hidden && !r.canSeeHidden(currentUserID(c), thread.UserID) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "Thread is hidden pending review"})
+		return
+	}
+
+	// Deleted comments stay in place so replies to them keep their context
+	err := r.DB.Unscoped().Where("thread_id = ?", threadID).Find(comments).Error
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get comments"})
 		return
 	}
+	r.attachCommentMentions(*comments)
+	r.attachCommentReactions(*comments, currentUserID(c))
+	if !moderator {
+		for i, comment := range *comments {
+			// Hidden comments show only to their authors until reviewed
+			if comment.DeletedAt.Valid || (comment.Hidden && comment.UserID != currentUserID(c)) {
+				(*comments)[i] = commentTombstone(comment)
+			}
+		}
+	}
+	// The accepted answer to a question is pinned at the top
+	if r.isQACategory(thread.CategoryID) {
+		*comments = acceptedFirst(*comments, thread.AcceptedCommentID)
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Comments fetched successfully",
@@ -512,6 +1152,8 @@ func (r *Repository) GetCommentsByThreadID(c *gin.Context) {
 	})
 }
 
+// DeleteComment moves a comment to the trash, keeping an optional ?reason=.
+// Threads show it as a tombstone until it is restored or purged.
 func (r *Repository) DeleteComment(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
@@ -519,35 +1161,236 @@ func (r *Repository) DeleteComment(c *gin.Context) {
 		return
 	}
 
-	if err := r.DB.Delete(&models.Comment{}, id).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not delete comment"})
+	comment := models.Comment{}
+	if err := r.DB.First(&comment, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Comment not found"})
 		return
 	}
 
+	// Only the author or a moderator may trash a comment
+	userID, reason := currentUserID(c), c.Query("reason")
+	if comment.UserID != userID && !r.hasRole(userID, models.RoleAdmin, models.RoleModerator) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "You cannot delete this comment"})
+		return
+	}
+	before, fields := comment, trashFields(userID, reason, time.Now())
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&comment).Updates(fields).Error; err != nil {
+			return err
+		}
+		return unacceptAnswers(tx, []uint{comment.ID})
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not delete comment"})
+		return
+	}
+	r.audit(c, models.AuditCommentDelete, models.TargetComment, comment.ID, before, fields)
+
+	r.Events.Publish(events.Event{
+		Type:       events.CommentDeleted,
+		ThreadID:   comment.ThreadID,
+		CommentID:  comment.ID,
+		CategoryID: r.threadCategoryID(comment.ThreadID),
+		UserID:     userID,
+		AuthorID:   comment.UserID,
+		Detail:     reason,
+	})
 	c.JSON(http.StatusOK, gin.H{"message": "Comment deleted successfully"})
 }
 
+// checkThreadVisible loads a thread and responds and returns false unless the
+// current user can see it, with the same checks as reading its comments
+func (r *Repository) checkThreadVisible(c *gin.Context, threadID uint) (models.Thread, bool) {
+	thread := models.Thread{}
+	if err := r.DB.Unscoped().First(&thread, threadID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Thread not found"})
+		return thread, false
+	}
+	userID := currentUserID(c)
+	if !r.canAccessCategory(userID, thread.CategoryID, "can_view") {
+		c.JSON(http.StatusForbidden, gin.H{"message": "You cannot view this thread"})
+		return thread, false
+	}
+	if thread.DeletedAt.Valid && !r.hasRole(userID, models.RoleAdmin, models.RoleModerator) {
+		c.JSON(http.StatusGone, gin.H{"message": "Thread was deleted"})
+		return thread, false
+	}
+	if thread.Hidden && !r.canSeeHidden(userID, thread.UserID) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "Thread is hidden pending review"})
+		return thread, false
+	}
+	return thread, true
+}
 
-// Categories
-func (r *Repository) CreateCategory(c *gin.Context) {
-	category := models.Category{}
+// threadCategoryID returns the category a thread belongs to, or 0 if it is gone
+func (r *Repository) threadCategoryID(threadID uint) uint {
+	thread := models.Thread{}
+	if err := r.DB.Select("category_id").First(&thread, threadID).Error; err != nil {
+		return 0
+	}
+	return thread.CategoryID
+}
 
-	err := c.BindJSON(&category)
+// UpdateComment lets the author, a moderator or a user whose reputation
+// unlocked editing change a comment
+func (r *Repository) UpdateComment(c *gin.Context) {
+	comment := models.Comment{}
+	if err := r.DB.First(&comment, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Comment not found"})
+		return
+	}
+
+	userID := currentUserID(c)
+	if comment.UserID != userID && !r.hasRole(userID, models.RoleAdmin, models.RoleModerator) &&
+		!r.hasPrivilege(userID, models.PrivilegeEditPosts) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "You cannot edit this comment"})
+		return
+	}
+	if r.isArchived(comment.ThreadID) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "This thread is archived"})
+		return
+	}
+
+	var updateRequest struct {
+		Content string `json:"content"`
+	}
+	if err := c.ShouldBindJSON(&updateRequest); err != nil || updateRequest.Content == "" {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Request failed"})
+		return
+	}
+
+	filtered, ok := r.screenPost(c, &updateRequest.Content)
+	if !ok {
+		return
+	}
+	spam, ok := r.screenSpam(c, spamPost{UserID: userID, ThreadID: comment.ThreadID, Content: updateRequest.Content}, false)
+	if !ok {
+		return
+	}
+	held := filtered.Held || spam.Held
+	html, err := markup.Render(updateRequest.Content)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not render content"})
+		return
+	}
+	before := comment
+	comment.Content = updateRequest.Content
+	comment.ContentHTML = html
+	comment.UpdatedAt = time.Now().UTC().Format(isoTimestamp)
+	// Only the edited fields are written, so concurrent votes, helpful marks
+	// and deletion are not overwritten
+	columns := []interface{}{"content_html", "updated_at"}
+	if held {
+		comment.Hidden = true
+		columns = append(columns, "hidden")
+	}
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&comment).Select("content", columns...).Updates(&comment).Error; err != nil {
+			return err
+		}
+		if held {
+			if err := unacceptAnswers(tx, []uint{comment.ID}); err != nil {
+				return err
+			}
+		}
+		if err := queueFiltered(tx, models.TargetComment, comment.ID, filtered); err != nil {
+			return err
+		}
+		return queueSpam(tx, models.TargetComment, comment.ID, spam)
+	})
 	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not update comment"})
+		return
+	}
+	if comment.UserID != userID {
+		r.audit(c, models.AuditCommentEdit, models.TargetComment, comment.ID, before, comment)
+	}
+	comment.Mentions = r.recordMentions(comment.Content, comment.ThreadID, &comment.ID, comment.UserID)
+	comments := []models.Comment{comment}
+	r.attachCommentReactions(comments, userID)
+	comment = comments[0]
+
+	categoryID := r.threadCategoryID(comment.ThreadID)
+	r.Events.Publish(events.Event{
+		Type:       events.CommentUpdated,
+		ThreadID:   comment.ThreadID,
+		CommentID:  comment.ID,
+		CategoryID: categoryID,
+		UserID:     userID,
+		AuthorID:   comment.UserID,
+	})
+	if held && !before.Hidden {
+		r.publishHidden(reactionTarget{
+			Type:       models.TargetComment,
+			ID:         comment.ID,
+			ThreadID:   comment.ThreadID,
+			CategoryID: categoryID,
+			AuthorID:   comment.UserID,
+		}, true, 0)
+	}
+	c.JSON(http.StatusOK, comment)
+}
+
+
+// Categories
+func (r *Repository) CreateCategory(c *gin.Context) {
+	var createRequest struct {
+		Name string `json:"name"`
+		QA   bool   `json:"qa"`
+	}
+	if err := c.ShouldBindJSON(&createRequest); err != nil || strings.TrimSpace(createRequest.Name) == "" {
 		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Request failed"})
 		return
 	}
+	category := models.Category{
+		Name:      strings.TrimSpace(createRequest.Name),
+		QA:        createRequest.QA,
+		CreatedAt: time.Now().UTC().Format(isoTimestamp),
+	}
 
 	if err := r.DB.Create(&category).Error; err != nil {
 		log.Println("DB Create Error:", err)
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not create category"})
 		return
 	}
+	r.audit(c, models.AuditCategoryCreate, models.TargetCategory, category.ID, nil, category)
 
 	c.JSON(http.StatusOK, category)
 }
 
 
+// UpdateCategory renames a category or turns Q&A mode on or off
+func (r *Repository) UpdateCategory(c *gin.Context) {
+	category := models.Category{}
+	if err := r.DB.First(&category, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Category not found"})
+		return
+	}
+
+	var updateRequest struct {
+		Name *string `json:"name"`
+		QA   *bool   `json:"qa"`
+	}
+	if err := c.ShouldBindJSON(&updateRequest); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Request failed"})
+		return
+	}
+	before := category
+	if updateRequest.Name != nil && strings.TrimSpace(*updateRequest.Name) != "" {
+		category.Name = strings.TrimSpace(*updateRequest.Name)
+	}
+	if updateRequest.QA != nil {
+		category.QA = *updateRequest.QA
+	}
+
+	if err := r.DB.Save(&category).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not update category"})
+		return
+	}
+	r.audit(c, models.AuditCategoryUpdate, models.TargetCategory, category.ID, before, category)
+	c.JSON(http.StatusOK, category)
+}
+
 func (r *Repository) GetCategories(c *gin.Context) {
 	categories := &[]models.Category{}
 
@@ -560,73 +1403,255 @@ func (r *Repository) GetCategories(c *gin.Context) {
 	c.JSON(http.StatusOK, categories)
 }
 
+// Tags
+// CreateTag is open to moderators and to users whose reputation unlocked it
+func (r *Repository) CreateTag(c *gin.Context) {
+	userID := currentUserID(c)
+	if !r.hasRole(userID, models.RoleAdmin, models.RoleModerator) && !r.hasPrivilege(userID, models.PrivilegeCreateTags) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "You do not have enough reputation to create tags"})
+		return
+	}
+
+	tag := models.Tag{}
+	if err := c.ShouldBindJSON(&tag); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Request failed"})
+		return
+	}
+	tag.ID = 0
+	tag.Name = strings.ToLower(strings.TrimSpace(tag.Name))
+	if tag.Name == "" || len(tag.Name) > 32 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Tag names must be 1 to 32 characters"})
+		return
+	}
+	if err := r.DB.Where("name = ?", tag.Name).First(&models.Tag{}).Error; err == nil {
+		c.JSON(http.StatusConflict, gin.H{"message": "Tag already exists"})
+		return
+	}
+
+	if err := r.DB.Create(&tag).Error; err != nil {
+		log.Println("DB Create Error:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not create tag"})
+		return
+	}
+	c.JSON(http.StatusOK, tag)
+}
+
+func (r *Repository) GetTags(c *gin.Context) {
+	tags := []models.Tag{}
+	if err := r.DB.Order("name").Find(&tags).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get tags"})
+		return
+	}
+	c.JSON(http.StatusOK, tags)
+}
+
 func (r *Repository) SetupRoutes(router *gin.Engine) {
 	api := router.Group("/api")
 	// Thread routes
-	api.POST("/create_thread", r.CreateThread)
-	api.DELETE("/delete_thread/:id", r.DeleteThread)
-	api.GET("/get_threads", r.GetThreads)
-	api.GET("/get_thread/:id", r.GetThreadByID)
+	api.POST("/create_thread", r.JWTMiddleware, r.CreateThread)
+	api.DELETE("/delete_thread/:id", r.JWTMiddleware, r.DeleteThread)
+	api.GET("/get_threads", r.OptionalJWTMiddleware, r.GetThreads)
+	api.GET("/get_thread/:id", r.OptionalJWTMiddleware, r.GetThreadByID)
+	api.PUT("/threads/:id", r.JWTMiddleware, r.NotSilenced, r.UpdateThread)
+	api.PUT("/threads/:id/moderation", r.JWTMiddleware, r.RequireRole(models.RoleAdmin, models.RoleModerator), r.ModerateThread)
+	api.PUT("/threads/:id/move", r.JWTMiddleware, r.RequireRole(models.RoleAdmin, models.RoleModerator), r.MoveThread)
+	api.POST("/threads/:id/merge", r.JWTMiddleware, r.RequireRole(models.RoleAdmin, models.RoleModerator), r.MergeThread)
+	api.POST("/threads/:id/split", r.JWTMiddleware, r.RequireRole(models.RoleAdmin, models.RoleModerator), r.SplitThread)
+	api.GET("/admin/audit_log", r.JWTMiddleware, r.RequireRole(models.RoleAdmin), r.GetAuditLog)
+	api.GET("/admin/audit_log/export", r.JWTMiddleware, r.RequireRole(models.RoleAdmin), r.ExportAuditLog)
+	api.GET("/admin/filters", r.JWTMiddleware, r.RequireRole(models.RoleAdmin), r.GetFilterRules)
+	api.POST("/admin/filters", r.JWTMiddleware, r.RequireRole(models.RoleAdmin), r.CreateFilterRule)
+	api.POST("/admin/filters/test", r.JWTMiddleware, r.RequireRole(models.RoleAdmin), r.TestFilterRules)
+	api.PUT("/admin/filters/:id", r.JWTMiddleware, r.RequireRole(models.RoleAdmin), r.UpdateFilterRule)
+	api.DELETE("/admin/filters/:id", r.JWTMiddleware, r.RequireRole(models.RoleAdmin), r.DeleteFilterRule)
+	api.GET("/moderation_log", r.JWTMiddleware, r.RequireRole(models.RoleAdmin, models.RoleModerator), r.GetModerationLog)
+	api.PUT("/threads/:id/restore", r.JWTMiddleware, r.RequireRole(models.RoleAdmin, models.RoleModerator), r.RestoreThread)
+	api.GET("/announcements", r.OptionalJWTMiddleware, r.GetAnnouncements)
+	api.PUT("/threads/:id/accepted_answer", r.JWTMiddleware, r.AcceptAnswer)
+	api.DELETE("/threads/:id/accepted_answer", r.JWTMiddleware, r.UnacceptAnswer)
 	// User routes
 	api.POST("/signup", r.SignUp)
 	api.POST("/login", r.Login)    // Add a route for `Login`
 	api.GET("/get_users", r.GetUsers) // Protect `GetUsers` with JWTMiddleware
 	api.GET("/get_user/:id", r.GetUserByID)
-	api.PUT("/users/:id", r.UpdateUser)
-	api.DELETE("/delete_user/:id", r.DeleteUser)
+	api.GET("/users/me", r.JWTMiddleware, r.GetMe)
+	api.PUT("/users/me/profile", r.JWTMiddleware, r.NotSilenced, r.UpdateMyProfile)
+	api.GET("/profiles/:username", r.GetProfileByUsername)
+	api.PUT("/users/:id", r.JWTMiddleware, r.UpdateUser)
+	api.DELETE("/delete_user/:id", r.JWTMiddleware, r.DeleteUser)
+	api.PUT("/users/:id/restore", r.JWTMiddleware, r.RequireRole(models.RoleAdmin), r.RestoreUser)
+	api.GET("/blocks", r.JWTMiddleware, r.GetBlocks)
+	api.PUT("/users/:id/avatar", r.JWTMiddleware, r.NotSilenced, r.UploadAvatar)
+	api.POST("/users/:id/block", r.JWTMiddleware, r.BlockUser)
+	api.DELETE("/users/:id/block", r.JWTMiddleware, r.UnblockUser)
+	api.PUT("/users/:id/role", r.JWTMiddleware, r.RequireRole(models.RoleAdmin), r.SetUserRole)
+	api.GET("/users/:id/reputation", r.GetReputation)
+	api.GET("/users/:id/badges", r.GetUserBadges)
+	api.GET("/users/me/sanctions", r.JWTMiddleware, r.GetMySanctions)
+	api.GET("/users/:id/sanctions", r.JWTMiddleware, r.RequireRole(models.RoleAdmin, models.RoleModerator), r.GetUserSanctions)
+	api.POST("/users/:id/sanctions", r.JWTMiddleware, r.RequireRole(models.RoleAdmin, models.RoleModerator), r.SanctionUser)
+	api.DELETE("/sanctions/:id", r.JWTMiddleware, r.RequireRole(models.RoleAdmin, models.RoleModerator), r.LiftSanction)
+	api.POST("/appeals", r.CreateAppeal)
+	api.GET("/appeals", r.JWTMiddleware, r.RequireRole(models.RoleAdmin, models.RoleModerator), r.GetAppeals)
+	api.PUT("/appeals/:id", r.JWTMiddleware, r.RequireRole(models.RoleAdmin, models.RoleModerator), r.ReviewAppeal)
+	api.POST("/admin/reputation/recompute", r.JWTMiddleware, r.RequireRole(models.RoleAdmin), r.RecomputeReputation)
 
 
 	// Comment routes
-	api.POST("/create_comment", r.CreateComment)
-	api.GET("/get_comments", r.GetComments)
-	api.GET("/get_comments/:thread_id", r.GetCommentsByThreadID)
-	api.DELETE("/delete_comment/:id", r.DeleteComment)
+	api.POST("/create_comment", r.JWTMiddleware, r.CreateComment)
+	api.GET("/get_comments", r.OptionalJWTMiddleware, r.GetComments)
+	api.GET("/get_comments/:thread_id", r.OptionalJWTMiddleware, r.GetCommentsByThreadID)
+	api.DELETE("/delete_comment/:id", r.JWTMiddleware, r.DeleteComment)
+	api.PUT("/comments/:id", r.JWTMiddleware, r.NotSilenced, r.UpdateComment)
+	api.PUT("/comments/:id/helpful", r.JWTMiddleware, r.MarkHelpful)
+	api.DELETE("/comments/:id/helpful", r.JWTMiddleware, r.UnmarkHelpful)
+	api.PUT("/comments/:id/restore", r.JWTMiddleware, r.RequireRole(models.RoleAdmin, models.RoleModerator), r.RestoreComment)
+
+	// Trash routes
+	api.GET("/trash/threads", r.JWTMiddleware, r.RequireRole(models.RoleAdmin, models.RoleModerator), r.GetTrashedThreads)
+	api.GET("/trash/comments", r.JWTMiddleware, r.RequireRole(models.RoleAdmin, models.RoleModerator), r.GetTrashedComments)
+	api.GET("/trash/users", r.JWTMiddleware, r.RequireRole(models.RoleAdmin), r.GetTrashedUsers)
+	api.POST("/admin/trash/purge", r.JWTMiddleware, r.RequireRole(models.RoleAdmin), r.PurgeTrash)
+
+	// Report and moderation queue routes
+	api.POST("/threads/:id/report", r.JWTMiddleware, r.Report(models.TargetThread))
+	api.POST("/comments/:id/report", r.JWTMiddleware, r.Report(models.TargetComment))
+	api.POST("/users/:id/report", r.JWTMiddleware, r.Report(models.TargetUser))
+	api.GET("/moderation/queue", r.JWTMiddleware, r.RequireRole(models.RoleAdmin, models.RoleModerator), r.GetQueue)
+	api.GET("/moderation/queue/:id", r.JWTMiddleware, r.RequireRole(models.RoleAdmin, models.RoleModerator), r.GetQueueItem)
+	api.PUT("/moderation/queue/:id/claim", r.JWTMiddleware, r.RequireRole(models.RoleAdmin, models.RoleModerator), r.ClaimQueueItem)
+	api.DELETE("/moderation/queue/:id/claim", r.JWTMiddleware, r.RequireRole(models.RoleAdmin, models.RoleModerator), r.UnclaimQueueItem)
+	api.PUT("/moderation/queue/:id/resolve", r.JWTMiddleware, r.RequireRole(models.RoleAdmin, models.RoleModerator), r.ResolveQueueItem)
+	api.PUT("/moderation/queue/:id/dismiss", r.JWTMiddleware, r.RequireRole(models.RoleAdmin, models.RoleModerator), r.DismissQueueItem)
+
+	// Reaction routes
+	api.GET("/reactions/types", r.GetReactionTypes)
+	api.GET("/threads/:id/reactions", r.OptionalJWTMiddleware, r.GetReactions(models.TargetThread))
+	api.PUT("/threads/:id/reactions/:type", r.JWTMiddleware, r.NotSilenced, r.AddReaction(models.TargetThread))
+	api.DELETE("/threads/:id/reactions/:type", r.JWTMiddleware, r.RemoveReaction(models.TargetThread))
+	api.GET("/comments/:id/reactions", r.OptionalJWTMiddleware, r.GetReactions(models.TargetComment))
+	api.PUT("/comments/:id/reactions/:type", r.JWTMiddleware, r.NotSilenced, r.AddReaction(models.TargetComment))
+	api.DELETE("/comments/:id/reactions/:type", r.JWTMiddleware, r.RemoveReaction(models.TargetComment))
+
+	// Poll routes
+	api.GET("/polls/:id", r.OptionalJWTMiddleware, r.GetPoll)
+	api.GET("/polls/:id/voters", r.OptionalJWTMiddleware, r.GetPollVoters)
+	api.PUT("/polls/:id/vote", r.JWTMiddleware, r.NotSilenced, r.Vote)
+	api.DELETE("/polls/:id/vote", r.JWTMiddleware, r.Unvote)
 
 	// Category routes
-	api.POST("/create_category", r.CreateCategory)
+	api.POST("/create_category", r.JWTMiddleware, r.RequireRole(models.RoleAdmin), r.CreateCategory)
 	api.GET("/get_categories", r.GetCategories)
+	api.PUT("/categories/:id", r.JWTMiddleware, r.RequireRole(models.RoleAdmin), r.UpdateCategory)
+
+	// Badge routes
+	api.GET("/badges", r.GetBadges)
+	api.GET("/badges/:id/holders", r.GetBadgeHolders)
+	api.POST("/badges", r.JWTMiddleware, r.RequireRole(models.RoleAdmin), r.CreateBadge)
+	api.POST("/badges/:id/holders", r.JWTMiddleware, r.RequireRole(models.RoleAdmin), r.AwardBadge)
+	api.DELETE("/badges/:id/holders/:user_id", r.JWTMiddleware, r.RequireRole(models.RoleAdmin), r.RevokeBadge)
+
+	// Tag routes
+	api.GET("/tags", r.GetTags)
+	api.POST("/tags", r.JWTMiddleware, r.NotSilenced, r.CreateTag)
+	api.GET("/get_category_permissions/:id", r.GetCategoryPermissions)
+	api.PUT("/category_permissions", r.JWTMiddleware, r.RequireRole(models.RoleAdmin), r.SetCategoryPermission)
+	api.DELETE("/category_permissions/:category_id/:group_id", r.JWTMiddleware, r.RequireRole(models.RoleAdmin), r.DeleteCategoryPermission)
+
+	// Attachment routes
+	api.POST("/attachments", r.JWTMiddleware, r.NotSilenced, r.UploadAttachment)
+	api.GET("/attachments", r.OptionalJWTMiddleware, r.GetAttachments)
+	api.GET("/attachments/quota", r.JWTMiddleware, r.GetAttachmentQuota)
+	api.GET("/attachments/:id", r.OptionalJWTMiddleware, r.GetAttachment)
+	api.GET("/attachments/:id/download", r.DownloadAttachment)
+	api.GET("/attachments/:id/variants/:variant", r.OptionalJWTMiddleware, r.GetAttachmentVariant)
+	api.DELETE("/attachments/:id", r.JWTMiddleware, r.DeleteAttachment)
+
+	// Markdown routes
+	api.POST("/markdown/preview", r.PreviewMarkdown)
+
+	// Search routes
+	api.GET("/search", r.OptionalJWTMiddleware, r.Search)
+	api.POST("/admin/search/reindex", r.JWTMiddleware, r.RequireRole(models.RoleAdmin), r.ReindexSearch)
+
+	// Group routes
+	api.POST("/create_group", r.JWTMiddleware, r.NotSilenced, r.CreateGroup)
+	api.GET("/get_groups", r.GetGroups)
+	api.GET("/get_group/:id", r.OptionalJWTMiddleware, r.GetGroupByID)
+	api.PUT("/groups/:id", r.JWTMiddleware, r.UpdateGroup)
+	api.DELETE("/delete_group/:id", r.JWTMiddleware, r.DeleteGroup)
+	api.POST("/groups/:id/join", r.JWTMiddleware, r.JoinGroup)
+	api.POST("/groups/:id/leave", r.JWTMiddleware, r.LeaveGroup)
+	api.POST("/groups/:id/invite", r.JWTMiddleware, r.InviteToGroup)
+	api.POST("/groups/:id/members/:user_id/approve", r.JWTMiddleware, r.ApproveMember)
+	api.PUT("/groups/:id/members/:user_id", r.JWTMiddleware, r.SetMemberRole)
+	api.DELETE("/groups/:id/members/:user_id", r.JWTMiddleware, r.RemoveMember)
+	api.GET("/group_mentions", r.JWTMiddleware, r.GetGroupMentions)
+
+	// Notification routes
+	api.GET("/notifications", r.JWTMiddleware, r.GetNotifications)
+	api.GET("/notifications/unread_count", r.JWTMiddleware, r.GetUnreadNotificationCount)
+	api.PUT("/notifications/read_all", r.JWTMiddleware, r.MarkAllNotificationsRead)
+	api.PUT("/notifications/:id/read", r.JWTMiddleware, r.MarkNotificationRead)
+	api.PUT("/notifications/:id/unread", r.JWTMiddleware, r.MarkNotificationUnread)
+
+	// Notification preference and follow routes
+	api.GET("/notification_preferences", r.JWTMiddleware, r.GetNotificationPreferences)
+	api.PUT("/notification_preferences", r.JWTMiddleware, r.UpdateNotificationPreferences)
+	api.GET("/follows", r.JWTMiddleware, r.GetFollows)
+	api.POST("/follows", r.JWTMiddleware, r.CreateFollow)
+	api.DELETE("/follows/:id", r.JWTMiddleware, r.DeleteFollow)
+	api.GET("/unsubscribe", r.UnsubscribePage)
+	api.POST("/unsubscribe", r.Unsubscribe)
+
+	// Real-time routes
+	api.GET("/ws", r.ServeWebSocket)
+	api.GET("/events/stream", r.StreamEvents)
 
 	// Middleware
-	api.GET("/protected/", JWTMiddleware, func(c *gin.Context) {
+	api.GET("/protected/", r.JWTMiddleware, func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
 			"message": "You have access to this protected route!",
 		})
 	})
 }
 
-// CORS middleware function definition
-func corsMiddleware() gin.HandlerFunc {
-	// Define allowed origins as a comma-separated string
-	originsString := "http://localhost:3000,https://innersphereforum.netlify.app"
-	var allowedOrigins []string
-	if originsString != "" {
-	 // Split the originsString into individual origins and store them in allowedOrigins slice
-		for _, origin := range strings.Split(originsString, ",") {
-			allowedOrigins = append(allowedOrigins, strings.TrimSpace(origin))
+// Define allowed origins as a comma-separated string
+const originsString = "http://localhost:3000,https://innersphereforum.netlify.app"
+
+// Split the originsString into individual origins and store them in allowedOrigins slice
+var allowedOrigins = func() []string {
+	var origins []string
+	for _, origin := range strings.Split(originsString, ",") {
+		origins = append(origins, strings.TrimSpace(origin))
+	}
+	return origins
+}()
+
+// isOriginAllowed checks if a given origin is allowed
+func isOriginAllowed(origin string) bool {
+	for _, allowedOrigin := range allowedOrigins {
+		if origin == allowedOrigin {
+			return true
 		}
 	}
-   
+	return false
+}
+
+// CORS middleware function definition
+func corsMiddleware() gin.HandlerFunc {
 	// Return the actual middleware handler function
 	return func(c *gin.Context) {
-	 // Function to check if a given origin is allowed
-	 isOriginAllowed := func(origin string, allowedOrigins []string) bool {
-	  for _, allowedOrigin := range allowedOrigins {
-	   if origin == allowedOrigin {
-		return true
-	   }
-	  }
-	  return false
-	 }
    
 	 // Get the Origin header from the request
 	 origin := c.Request.Header.Get("Origin")
    
 	 // Check if the origin is allowed
-	 if isOriginAllowed(origin, allowedOrigins) {
+	 if isOriginAllowed(origin) {
 	  // If the origin is allowed, set CORS headers in the response
 	  c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
 	  c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-	  c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
+	  c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, X-Request-ID")
 	  c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
 	 }
    
@@ -650,12 +1675,13 @@ func main() {
 	
 	// Declare db variable here so it is in the scope of the entire main function
 	var db *gorm.DB
+	var config *storage.Config
 	
 	// Check the environment and set up the database config accordingly
 	if os.Getenv("ENV") == "PROD" {
 		// Parse the production DATABASE_URL
 		// config, err := storage.ParseURL(os.Getenv("DATABASE_URL"))
-		config := &storage.Config{
+		config = &storage.Config{
 			Host:     os.Getenv("DB_HOST"),
 			Port:     os.Getenv("DB_PORT"),
 			Password: os.Getenv("DB_PASS"),
@@ -675,7 +1701,7 @@ func main() {
 	
 	} else {
 		// Development or other environment configuration
-		config := &storage.Config{
+		config = &storage.Config{
 			Host:     os.Getenv("DB_HOST"),
 			Port:     os.Getenv("DB_PORT"),
 			Password: os.Getenv("DB_PASS"),
@@ -696,17 +1722,75 @@ func main() {
 	if err != nil {
 		log.Fatal("could not migrate db")
 	}
+	backfillContentHTML(db)
+	seedBadges(db)
+
+	// Set up the search backend
+	indexer, err := newSearchIndexer(db)
+	if err != nil {
+		log.Fatal("could not set up search:", err)
+	}
+	defer indexer.Close()
+
+	// `main reindex` rebuilds the search index from the database and exits
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		threads, comments, err := search.Rebuild(db, indexer)
+		if err != nil {
+			log.Fatal("could not rebuild search index:", err)
+		}
+		log.Printf("search index rebuilt: %d threads, %d comments", threads, comments)
+		return
+	}
+
+	// Set up the store for uploaded files
+	blobs, err := newBlobStore(context.Background())
+	if err != nil {
+		log.Fatal("could not set up file storage:", err)
+	}
+
+	// Set up the pub/sub that carries events between replicas
+	broker, err := newBroker(db, config.DSN())
+	if err != nil {
+		log.Fatal("could not set up pub/sub:", err)
+	}
+	defer broker.Close()
+
+	// Keep the last EVENT_LOG_SIZE events for clients that reconnect
+	eventLogSize, err := strconv.Atoi(os.Getenv("EVENT_LOG_SIZE"))
+	if err != nil || eventLogSize < 1 {
+		eventLogSize = 1000
+	}
 
 	// Set up the repository
 	r := Repository{
-		DB: db,
+		DB:       db,
+		Events:   events.NewBus(),
+		Index:    indexer,
+		Hub:      realtime.NewHub(),
+		EventLog: events.NewDBLog(db, eventLogSize),
+		Mailer:   newMailer(),
+		Blobs:    blobs,
 	}
+	search.Subscribe(r.Events, db, indexer)
+	r.SubscribeNotifications()
+	r.SubscribeNotificationEmails()
+	r.SubscribeAttachments()
+	r.SubscribeImages()
+	r.SubscribeReputation()
+	r.SubscribeBadges()
+	events.Forward(r.Events, broker, r.EventLog)
+	broker.Subscribe(r.dispatchRealtime)
+	r.StartDigestScheduler(context.Background())
+	r.StartBadgeScheduler(context.Background())
+	r.StartTrustScheduler(context.Background())
+	r.StartTrashPurger(context.Background())
 
 	// Create a new Gin app
 	router := gin.Default()
 
 	// Enable CORS
     router.Use(corsMiddleware())
+	router.Use(requestIDMiddleware())
 	
 	// Set up routes
 	r.SetupRoutes(router)
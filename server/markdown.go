@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/damiancxliew/web-forum/markup"
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// maxPreviewLength caps the Markdown accepted by the preview endpoint
+const maxPreviewLength = 64 * 1024
+
+// PreviewMarkdown renders Markdown the same way saved content is rendered, so
+// editors can show a preview before posting
+func (r *Repository) PreviewMarkdown(c *gin.Context) {
+	var previewRequest struct {
+		Content string `json:"content"`
+	}
+	if err := c.ShouldBindJSON(&previewRequest); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Request failed"})
+		return
+	}
+	if len(previewRequest.Content) > maxPreviewLength {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": "Content is too long to preview"})
+		return
+	}
+
+	html, err := markup.Render(previewRequest.Content)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not render content"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"html": html})
+}
+
+// backfillContentHTML renders threads and comments saved before content was
+// rendered on the server
+func backfillContentHTML(db *gorm.DB) {
+	threads := []models.Thread{}
+	db.Where("(content_html IS NULL OR content_html = '') AND content <> ''").FindInBatches(&threads, 500, func(tx *gorm.DB, _ int) error {
+		for _, thread := range threads {
+			html, err := markup.Render(thread.Content)
+			if err != nil {
+				log.Println("Render error on thread", thread.ID, err)
+				continue
+			}
+			db.Model(&thread).UpdateColumn("content_html", html)
+		}
+		return nil
+	})
+
+	comments := []models.Comment{}
+	db.Where("(content_html IS NULL OR content_html = '') AND content <> ''").FindInBatches(&comments, 500, func(tx *gorm.DB, _ int) error {
+		for _, comment := range comments {
+			html, err := markup.Render(comment.Content)
+			if err != nil {
+				log.Println("Render error on comment", comment.ID, err)
+				continue
+			}
+			db.Model(&comment).UpdateColumn("content_html", html)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,66 @@
+package markup
+
+import (
+	"bytes"
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// markdown renders CommonMark with the GFM extensions. Raw HTML in the source
+// is dropped rather than passed through.
+var markdown = goldmark.New(
+	goldmark.WithExtensions(
+		extension.Table,
+		extension.TaskList,
+		extension.Strikethrough,
+		extension.Linkify,
+	),
+)
+
+// policy is the allowlist every rendered document passes through
+var policy = newPolicy()
+
+func newPolicy() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+
+	p.AllowElements(
+		"p", "br", "hr", "blockquote",
+		"h1", "h2", "h3", "h4", "h5", "h6",
+		"ul", "ol", "li",
+		"strong", "em", "del", "code", "pre",
+		"table", "thead", "tbody", "tr", "th", "td",
+	)
+	p.AllowAttrs("start").Matching(bluemonday.Integer).OnElements("ol")
+	p.AllowStyles("text-align").MatchingEnum("left", "center", "right").OnElements("th", "td")
+
+	// Fenced code keeps its language for client-side highlighting
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[A-Za-z0-9_+#-]+$`)).OnElements("code")
+
+	// Task list items render as disabled checkboxes
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").Matching(regexp.MustCompile(`^$|^checked$|^disabled$`)).OnElements("input")
+
+	p.AllowAttrs("href").OnElements("a")
+	p.AllowAttrs("title").OnElements("a", "img")
+	p.AllowAttrs("src", "alt").OnElements("img")
+	p.AllowURLSchemes("http", "https", "mailto")
+	p.AllowRelativeURLs(true)
+	p.RequireParseableURLs(true)
+	p.RequireNoFollowOnLinks(true)
+	p.RequireNoReferrerOnLinks(true)
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+
+	return p
+}
+
+// Render converts Markdown source to sanitized HTML
+func Render(source string) (string, error) {
+	var out bytes.Buffer
+	if err := markdown.Convert([]byte(source), &out); err != nil {
+		return "", err
+	}
+	return policy.Sanitize(out.String()), nil
+}
@@ -0,0 +1,55 @@
+package markup
+
+import "testing"
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"raw script", "<script>alert(1)</script>", "\n"},
+		{"raw event handler", "hi <img src=x onerror=alert(1)>", "<p>hi </p>\n"},
+		{"raw link", `<a href="https://x" onclick="y">z</a>`, "<p>z</p>\n"},
+		{"javascript link", "[x](javascript:alert(1))", "<p>x</p>\n"},
+		{"mixed case scheme", "[x](JaVaScRiPt:alert(1))", "<p>x</p>\n"},
+		{"data image", "![a](data:image/png;base64,AAA)", "<p><img alt=\"a\"></p>\n"},
+		{"escaped text", "a & b < c", "<p>a &amp; b &lt; c</p>\n"},
+		{
+			"link",
+			"[x](https://example.com)",
+			"<p><a href=\"https://example.com\" rel=\"nofollow noreferrer noopener\" target=\"_blank\">x</a></p>\n",
+		},
+		{
+			"linkify",
+			"https://example.com/path",
+			"<p><a href=\"https://example.com/path\" rel=\"nofollow noreferrer noopener\" target=\"_blank\">https://example.com/path</a></p>\n",
+		},
+		{
+			"fenced code",
+			"```go\nfmt.Println(\"<b>\")\n```",
+			"<pre><code class=\"language-go\">fmt.Println(&#34;&lt;b&gt;&#34;)\n</code></pre>\n",
+		},
+		{"bad code language", "```\"><script>\n```", "<pre><code></code></pre>\n"},
+		{
+			"task list",
+			"- [x] done",
+			"<ul>\n<li><input checked=\"\" disabled=\"\" type=\"checkbox\"> done</li>\n</ul>\n",
+		},
+		{
+			"aligned table",
+			"| a |\n|:-:|\n| b |",
+			"<table>\n<thead>\n<tr>\n<th style=\"text-align: center\">a</th>\n</tr>\n</thead>\n<tbody>\n<tr>\n<td style=\"text-align: center\">b</td>\n</tr>\n</tbody>\n</table>\n",
+		},
+	}
+	for _, test := range tests {
+		got, err := Render(test.source)
+		if err != nil {
+			t.Errorf("%s: Render(%q) failed: %v", test.name, test.source, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: Render(%q) = %q, want %q", test.name, test.source, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+
+	"github.com/HugoSmits86/nativewebp"
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // register the WebP decoder
+)
+
+// ErrTooLarge is returned for images whose dimensions exceed the limits, which
+// guards against decompression bombs
+var ErrTooLarge = errors.New("image dimensions are too large")
+
+// ErrUnsupported is returned for data that is not a supported image
+var ErrUnsupported = errors.New("unsupported image format")
+
+// Limits bound the images Process is willing to decode
+type Limits struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int
+}
+
+// DefaultLimits allow images up to 10000 px on a side and 50 megapixels
+var DefaultLimits = Limits{MaxWidth: 10000, MaxHeight: 10000, MaxPixels: 50_000_000}
+
+// Size is a variant to generate. Square variants are cropped to fill Width x
+// Width; others fit within Width x Width keeping their aspect ratio. Variants
+// larger than the original are skipped.
+type Size struct {
+	Name   string
+	Width  int
+	Square bool
+}
+
+// Output is one encoded image
+type Output struct {
+	Name        string
+	Format      string
+	ContentType string
+	Width       int
+	Height      int
+	Data        []byte
+}
+
+// Process decodes an image, applies its EXIF orientation and re-encodes it
+// without any metadata, producing a cleaned original plus each size in the
+// original's format and as WebP. Re-encoding from pixels also discards
+// anything smuggled alongside the image data.
+func Process(data []byte, sizes []Size, limits Limits) (original Output, variants []Output, err error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Output{}, nil, ErrUnsupported
+	}
+	if config.Width < 1 || config.Height < 1 ||
+		config.Width > limits.MaxWidth || config.Height > limits.MaxHeight ||
+		config.Width*config.Height > limits.MaxPixels {
+		return Output{}, nil, ErrTooLarge
+	}
+
+	var img image.Image
+	switch format {
+	case "gif":
+		// Only the first frame is kept
+		img, err = gif.Decode(bytes.NewReader(data))
+	case "jpeg", "png", "webp":
+		img, _, err = image.Decode(bytes.NewReader(data))
+	default:
+		return Output{}, nil, ErrUnsupported
+	}
+	if err != nil {
+		return Output{}, nil, fmt.Errorf("decode %s: %w", format, err)
+	}
+
+	pixels := toNRGBA(img)
+	if format == "jpeg" {
+		pixels = applyOrientation(pixels, jpegOrientation(data))
+	}
+
+	// Photos stay JPEG; everything else becomes PNG to keep transparency
+	outputFormat := "png"
+	if format == "jpeg" {
+		outputFormat = "jpeg"
+	}
+
+	original, err = encode("original", outputFormat, pixels)
+	if err != nil {
+		return Output{}, nil, err
+	}
+
+	bounds := pixels.Bounds()
+	for _, size := range sizes {
+		if size.Width >= bounds.Dx() && size.Width >= bounds.Dy() && !size.Square {
+			continue
+		}
+		resized := resize(pixels, size)
+		for _, variantFormat := range []string{outputFormat, "webp"} {
+			output, err := encode(size.Name, variantFormat, resized)
+			if err != nil {
+				return Output{}, nil, err
+			}
+			variants = append(variants, output)
+		}
+	}
+	return original, variants, nil
+}
+
+func toNRGBA(img image.Image) *image.NRGBA {
+	if nrgba, ok := img.(*image.NRGBA); ok && nrgba.Bounds().Min == (image.Point{}) {
+		return nrgba
+	}
+	bounds := img.Bounds()
+	out := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(out, out.Bounds(), img, bounds.Min, draw.Src)
+	return out
+}
+
+// resize scales to fit a size, cropping the centre first for square sizes
+func resize(src *image.NRGBA, size Size) *image.NRGBA {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	if size.Square {
+		side := min(width, height)
+		crop := image.Rect((width-side)/2, (height-side)/2, (width-side)/2+side, (height-side)/2+side)
+		target := min(size.Width, side)
+		out := image.NewNRGBA(image.Rect(0, 0, target, target))
+		xdraw.CatmullRom.Scale(out, out.Bounds(), src, crop, xdraw.Src, nil)
+		return out
+	}
+
+	targetWidth, targetHeight := size.Width, height*size.Width/width
+	if height > width {
+		targetWidth, targetHeight = width*size.Width/height, size.Width
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, max(targetWidth, 1), max(targetHeight, 1)))
+	xdraw.CatmullRom.Scale(out, out.Bounds(), src, bounds, xdraw.Src, nil)
+	return out
+}
+
+func encode(name, format string, img *image.NRGBA) (Output, error) {
+	var buf bytes.Buffer
+	var err error
+	contentType := "image/" + format
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	case "png":
+		err = png.Encode(&buf, img)
+	case "webp":
+		err = nativewebp.Encode(&buf, img, nil)
+	default:
+		err = ErrUnsupported
+	}
+	if err != nil {
+		return Output{}, fmt.Errorf("encode %s: %w", format, err)
+	}
+	bounds := img.Bounds()
+	return Output{
+		Name:        name,
+		Format:      format,
+		ContentType: contentType,
+		Width:       bounds.Dx(),
+		Height:      bounds.Dy(),
+		Data:        buf.Bytes(),
+	}, nil
+}
@@ -0,0 +1,123 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The fixtures in testdata are 24 x 16 images with a red 8 x 8 block in the
+// top-left corner on blue. The JPEGs carry EXIF orientation 1-8 and, like
+// text.png, a comment that must not survive processing. bomb.png is only a
+// header claiming 50000 x 50000 pixels.
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestProcessLimits(t *testing.T) {
+	tests := []struct {
+		fixture string
+		limits  Limits
+		want    error
+	}{
+		{"bomb.png", DefaultLimits, ErrTooLarge},
+		{"text.png", DefaultLimits, nil},
+		{"text.png", Limits{MaxWidth: 24, MaxHeight: 16, MaxPixels: 384}, nil},
+		{"text.png", Limits{MaxWidth: 23, MaxHeight: 16, MaxPixels: 384}, ErrTooLarge},
+		{"text.png", Limits{MaxWidth: 24, MaxHeight: 15, MaxPixels: 384}, ErrTooLarge},
+		{"text.png", Limits{MaxWidth: 24, MaxHeight: 16, MaxPixels: 383}, ErrTooLarge},
+		{"orientation-6.jpg", Limits{MaxWidth: 24, MaxHeight: 16, MaxPixels: 384}, nil},
+		{"orientation-6.jpg", Limits{MaxWidth: 16, MaxHeight: 24, MaxPixels: 384}, ErrTooLarge},
+	}
+	for _, test := range tests {
+		_, _, err := Process(readFixture(t, test.fixture), nil, test.limits)
+		if !errors.Is(err, test.want) {
+			t.Errorf("Process(%s, %+v) error = %v, want %v", test.fixture, test.limits, err, test.want)
+		}
+	}
+}
+
+func TestProcessUnsupported(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("not an image"), []byte("%PDF-1.7\n")} {
+		if _, _, err := Process(data, nil, DefaultLimits); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("Process(%q) error = %v, want ErrUnsupported", data, err)
+		}
+	}
+}
+
+func TestProcessOrientation(t *testing.T) {
+	tests := []struct {
+		orientation   int
+		width, height int
+		red           image.Point // the centre of the red block once upright
+	}{
+		{1, 24, 16, image.Pt(4, 4)},
+		{2, 24, 16, image.Pt(19, 4)},
+		{3, 24, 16, image.Pt(19, 11)},
+		{4, 24, 16, image.Pt(4, 11)},
+		{5, 16, 24, image.Pt(4, 4)},
+		{6, 16, 24, image.Pt(11, 4)},
+		{7, 16, 24, image.Pt(11, 19)},
+		{8, 16, 24, image.Pt(4, 19)},
+	}
+	for _, test := range tests {
+		fixture := fmt.Sprintf("orientation-%d.jpg", test.orientation)
+		data := readFixture(t, fixture)
+		if got := jpegOrientation(data); got != test.orientation {
+			t.Errorf("%s: jpegOrientation = %d, want %d", fixture, got, test.orientation)
+		}
+
+		original, _, err := Process(data, nil, DefaultLimits)
+		if err != nil {
+			t.Fatalf("%s: %v", fixture, err)
+		}
+		if original.Width != test.width || original.Height != test.height {
+			t.Errorf("%s: size = %dx%d, want %dx%d", fixture, original.Width, original.Height, test.width, test.height)
+		}
+		img, _, err := image.Decode(bytes.NewReader(original.Data))
+		if err != nil {
+			t.Fatalf("%s: decode output: %v", fixture, err)
+		}
+		for _, corner := range []image.Point{{4, 4}, {test.width - 5, 4}, {test.width - 5, test.height - 5}, {4, test.height - 5}} {
+			r, _, b, _ := img.At(corner.X, corner.Y).RGBA()
+			if isRed := r > b; isRed != (corner == test.red) {
+				t.Errorf("%s: pixel at %v red = %v, want %v", fixture, corner, isRed, corner == test.red)
+			}
+		}
+	}
+}
+
+func TestProcessStripsMetadata(t *testing.T) {
+	sizes := []Size{{Name: "thumb", Width: 8, Square: true}, {Name: "small", Width: 12}}
+	for _, fixture := range []string{"orientation-6.jpg", "text.png"} {
+		data := readFixture(t, fixture)
+		if !bytes.Contains(data, []byte("taken at home")) {
+			t.Fatalf("%s: fixture has no metadata to strip", fixture)
+		}
+
+		original, variants, err := Process(data, sizes, DefaultLimits)
+		if err != nil {
+			t.Fatalf("%s: %v", fixture, err)
+		}
+		if len(variants) != 2*len(sizes) {
+			t.Errorf("%s: %d variants, want %d", fixture, len(variants), 2*len(sizes))
+		}
+		for _, output := range append([]Output{original}, variants...) {
+			for _, leak := range []string{"taken at home", "GPS", "Exif", "tEXt"} {
+				if bytes.Contains(output.Data, []byte(leak)) {
+					t.Errorf("%s: %s %s output still contains %q", fixture, output.Name, output.Format, leak)
+				}
+			}
+		}
+	}
+}
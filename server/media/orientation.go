@@ -0,0 +1,107 @@
+package media
+
+import (
+	"encoding/binary"
+	"image"
+)
+
+// jpegOrientation reads the EXIF orientation (1-8) of a JPEG, returning 1 when
+// there is none. The tag has to be applied by hand because re-encoding drops
+// the EXIF data that would otherwise tell viewers to rotate the image.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			return 1
+		}
+		marker := data[pos+1]
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if marker == 0xDA || length < 2 || pos+2+length > len(data) {
+			// Image data starts; metadata always comes before it
+			return 1
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return exifOrientation(segment[6:])
+		}
+		pos += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation finds the orientation tag in the first IFD of a TIFF header
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			value := int(order.Uint16(tiff[entry+8:]))
+			if value < 1 || value > 8 {
+				return 1
+			}
+			return value
+		}
+	}
+	return 1
+}
+
+// applyOrientation rotates and flips pixels so the image displays upright
+func applyOrientation(src *image.NRGBA, orientation int) *image.NRGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	outWidth, outHeight := width, height
+	if orientation >= 5 {
+		outWidth, outHeight = height, width
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, outWidth, outHeight))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = width-1-x, y
+			case 3: // rotated 180
+				dx, dy = width-1-x, height-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, height-1-y
+			case 5: // mirrored along the top-left diagonal
+				dx, dy = y, x
+			case 6: // rotated 90 clockwise
+				dx, dy = height-1-y, x
+			case 7: // mirrored along the top-right diagonal
+				dx, dy = height-1-y, width-1-x
+			case 8: // rotated 90 counter-clockwise
+				dx, dy = y, width-1-x
+			}
+			s := src.PixOffset(x, y)
+			d := out.PixOffset(dx, dy)
+			copy(out.Pix[d:d+4], src.Pix[s:s+4])
+		}
+	}
+	return out
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// utf16Length returns the length of s in UTF-16 code units
+func utf16Length(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// userMentionSpans finds every @username in content that names an existing user
+func (r *Repository) userMentionSpans(content string) []models.Mention {
+	handles := parseMentions(content)
+	if len(handles) == 0 {
+		return nil
+	}
+
+	users := []models.User{}
+	if err := r.DB.Select("id", "username").Where("LOWER(username) IN ?", handles).Find(&users).Error; err != nil {
+		log.Println("Mention lookup error:", err)
+		return nil
+	}
+	byHandle := make(map[string]models.User, len(users))
+	for _, user := range users {
+		byHandle[strings.ToLower(user.Username)] = user
+	}
+
+	spans := []models.Mention{}
+	offset, position := 0, 0
+	for _, match := range mentionRegex.FindAllStringSubmatchIndex(content, -1) {
+		// match[2] is where the handle starts, just after the @
+		user, ok := byHandle[strings.ToLower(content[match[2]:match[3]])]
+		if !ok {
+			continue
+		}
+		offset += utf16Length(content[position : match[2]-1])
+		position = match[2] - 1
+		length := utf16Length(content[position:match[3]])
+		spans = append(spans, models.Mention{
+			UserID:   user.ID,
+			Username: user.Username,
+			Start:    offset,
+			End:      offset + length,
+		})
+	}
+	return spans
+}
+
+// recordMentions replaces the stored mentions of a thread (commentID nil) or a
+// comment with those found in content and returns them
+func (r *Repository) recordMentions(content string, threadID uint, commentID *uint, authorID uint) []models.Mention {
+	spans := r.userMentionSpans(content)
+	for i := range spans {
+		spans[i].ThreadID = threadID
+		spans[i].CommentID = commentID
+		spans[i].AuthorID = authorID
+	}
+
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := mentionTarget(tx, threadID, commentID).Delete(&models.Mention{}).Error; err != nil {
+			return err
+		}
+		if len(spans) == 0 {
+			return nil
+		}
+		return tx.Create(&spans).Error
+	})
+	if err != nil {
+		log.Println("Mention record error:", err)
+	}
+	if spans == nil {
+		spans = []models.Mention{}
+	}
+	return spans
+}
+
+// mentionTarget scopes a query to the mentions of a thread or one of its comments
+func mentionTarget(db *gorm.DB, threadID uint, commentID *uint) *gorm.DB {
+	if commentID != nil {
+		return db.Where("comment_id = ?", *commentID)
+	}
+	return db.Where("thread_id = ? AND comment_id IS NULL", threadID)
+}
+
+// attachThreadMentions fills in the mention spans of each thread
+func (r *Repository) attachThreadMentions(threads []models.Thread) {
+	if len(threads) == 0 {
+		return
+	}
+	ids := make([]uint, len(threads))
+	for i, thread := range threads {
+		ids[i] = thread.ID
+	}
+
+	mentions := []models.Mention{}
+	r.DB.Where("thread_id IN ? AND comment_id IS NULL", ids).Order("start_offset").Find(&mentions)
+	byThread := map[uint][]models.Mention{}
+	for _, mention := range mentions {
+		byThread[mention.ThreadID] = append(byThread[mention.ThreadID], mention)
+	}
+	for i := range threads {
+		threads[i].Mentions = byThread[threads[i].ID]
+		if threads[i].Mentions == nil {
+			threads[i].Mentions = []models.Mention{}
+		}
+	}
+}
+
+// mentionsOfThread returns the mention spans in a thread's own content
+func (r *Repository) mentionsOfThread(threadID uint) []models.Mention {
+	threads := []models.Thread{{ID: threadID}}
+	r.attachThreadMentions(threads)
+	return threads[0].Mentions
+}
+
+// attachCommentMentions fills in the mention spans of each comment
+func (r *Repository) attachCommentMentions(comments []models.Comment) {
+	if len(comments) == 0 {
+		return
+	}
+	ids := make([]uint, len(comments))
+	for i, comment := range comments {
+		ids[i] = comment.ID
+	}
+
+	mentions := []models.Mention{}
+	r.DB.Where("comment_id IN ?", ids).Order("start_offset").Find(&mentions)
+	byComment := map[uint][]models.Mention{}
+	for _, mention := range mentions {
+		byComment[*mention.CommentID] = append(byComment[*mention.CommentID], mention)
+	}
+	for i := range comments {
+		comments[i].Mentions = byComment[comments[i].ID]
+		if comments[i].Mentions == nil {
+			comments[i].Mentions = []models.Mention{}
+		}
+	}
+}
+
+// hasBlocked reports whether userID has blocked otherID
+func (r *Repository) hasBlocked(userID, otherID uint) bool {
+	var count int64
+	r.DB.Model(&models.UserBlock{}).Where("user_id = ? AND blocked_id = ?", userID, otherID).Count(&count)
+	return count > 0
+}
+
+// User blocks
+
+func (r *Repository) GetBlocks(c *gin.Context) {
+	blocks := []models.UserBlock{}
+	if err := r.DB.Where("user_id = ?", currentUserID(c)).Order("created_at DESC").Find(&blocks).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get blocked users"})
+		return
+	}
+	c.JSON(http.StatusOK, blocks)
+}
+
+func (r *Repository) BlockUser(c *gin.Context) {
+	blockedID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid user ID"})
+		return
+	}
+	userID := currentUserID(c)
+	if uint(blockedID) == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "You cannot block yourself"})
+		return
+	}
+	if err := r.DB.First(&models.User{}, blockedID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+
+	block := models.UserBlock{UserID: userID, BlockedID: uint(blockedID)}
+	if err := r.DB.FirstOrCreate(&block, block).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not block user"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User blocked successfully", "data": block})
+}
+
+func (r *Repository) UnblockUser(c *gin.Context) {
+	result := r.DB.Where("user_id = ? AND blocked_id = ?", currentUserID(c), c.Param("id")).Delete(&models.UserBlock{})
+	if result.Error != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not unblock user"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User is not blocked"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User unblocked successfully"})
+}
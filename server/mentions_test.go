@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	tests := []struct {
+		content string
+		want    []string
+	}{
+		{"", []string{}},
+		{"hi @Alice and @bob", []string{"alice", "bob"}},
+		{"@alice then @ALICE again", []string{"alice"}},
+		{"mail bob@example.com", []string{}},
+		{"first.@eve", []string{}},
+		{"(@carol), @dave!", []string{"carol", "dave"}},
+		{"@frank-smith_2.", []string{"frank-smith_2"}},
+		{"@amy@bob", []string{"amy"}},
+		{"@_hidden @ lone", []string{}},
+		{"line\n@start", []string{"start"}},
+	}
+	for _, test := range tests {
+		if got := parseMentions(test.content); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseMentions(%q) = %q, want %q", test.content, got, test.want)
+		}
+	}
+}
+
+func TestUTF16Length(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"@bob", 4},
+		{"héllo", 5},
+		{"👋 @bob", 7},
+	}
+	for _, test := range tests {
+		if got := utf16Length(test.s); got != test.want {
+			t.Errorf("utf16Length(%q) = %d, want %d", test.s, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Attachment purposes
+const (
+	PurposePost   = "post"
+	PurposeAvatar = "avatar"
+)
+
+// Attachment processing statuses. Images are re-encoded in the background and
+// cannot be downloaded until they are ready; other files are ready at once.
+const (
+	AttachmentPending    = "pending"
+	AttachmentProcessing = "processing"
+	AttachmentReady      = "ready"
+	AttachmentFailed     = "failed"
+)
+
+// Attachments are files uploaded to a thread or comment, or a user's avatar
+// (ThreadID 0). ContentType is sniffed from the file itself; StorageKey
+// locates it in the blob store.
+type Attachment struct {
+	ID          uint                `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID      uint                `gorm:"index" json:"user_id"`
+	ThreadID    uint                `gorm:"index" json:"thread_id"`
+	CommentID   *uint               `gorm:"index" json:"comment_id"`
+	Purpose     string              `gorm:"default:post" json:"purpose"`
+	Filename    string              `json:"filename"`
+	ContentType string              `json:"content_type"`
+	Size        int64               `json:"size"`
+	Width       int                 `json:"width,omitempty"`
+	Height      int                 `json:"height,omitempty"`
+	Status      string              `gorm:"default:ready;index" json:"status"`
+	Error       string              `json:"error,omitempty"`
+	StorageKey  string              `json:"-"`
+	Variants    []AttachmentVariant `json:"variants"`
+	CreatedAt   time.Time           `json:"created_at"`
+	UpdatedAt   time.Time           `json:"updated_at"`
+}
+
+func MigrateAttachments(db *gorm.DB) error {
+	return db.AutoMigrate(&Attachment{})
+}
+
+// AttachmentVariants are resized or re-encoded copies of an image attachment,
+// e.g. the "thumb" size as WebP
+type AttachmentVariant struct {
+	ID           uint   `gorm:"primaryKey;autoIncrement" json:"-"`
+	AttachmentID uint   `gorm:"index" json:"-"`
+	Name         string `json:"name"`
+	Format       string `json:"format"`
+	ContentType  string `json:"content_type"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	Size         int64  `json:"size"`
+	StorageKey   string `json:"-"`
+	URL          string `gorm:"-" json:"url"`
+}
+
+func MigrateAttachmentVariants(db *gorm.DB) error {
+	return db.AutoMigrate(&AttachmentVariant{})
+}
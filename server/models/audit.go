@@ -0,0 +1,91 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Audited actions
+const (
+	AuditThreadDelete   = "thread.delete"
+	AuditThreadRestore  = "thread.restore"
+	AuditThreadEdit     = "thread.edit"     // edited by someone other than its author
+	AuditThreadModerate = "thread.moderate" // pin, lock, archive or announcement changed
+	AuditThreadMove     = "thread.move"
+	AuditThreadMerge    = "thread.merge"
+	AuditThreadSplit    = "thread.split"
+	AuditCommentDelete  = "comment.delete"
+	AuditCommentRestore = "comment.restore"
+	AuditCommentEdit    = "comment.edit" // edited by someone other than its author
+	AuditUserDelete     = "user.delete"
+	AuditUserRestore    = "user.restore"
+	AuditUserEdit       = "user.edit" // edited by someone other than the user
+	AuditUserRole       = "user.role"
+	AuditUserSanction   = "user.sanction"
+	AuditSanctionLift   = "sanction.lift"
+	AuditAppealReview   = "appeal.review"
+	AuditCategoryCreate = "category.create"
+	AuditCategoryUpdate = "category.update"
+	AuditPermissionSet  = "category_permission.set"
+	AuditPermissionDrop = "category_permission.delete"
+	AuditReportResolve  = "report.resolve"
+	AuditReportDismiss  = "report.dismiss"
+	AuditBadgeCreate    = "badge.create"
+	AuditBadgeAward     = "badge.award"
+	AuditBadgeRevoke    = "badge.revoke"
+	AuditFilterCreate   = "filter_rule.create"
+	AuditFilterUpdate   = "filter_rule.update"
+	AuditFilterDelete   = "filter_rule.delete"
+	AuditTrashPurge     = "trash.purge"
+	AuditReputation     = "reputation.recompute"
+	AuditSearchReindex  = "search.reindex"
+)
+
+// Audit target types besides TargetThread, TargetComment and TargetUser
+const (
+	TargetCategory  = "category"
+	TargetSanction  = "sanction"
+	TargetAppeal    = "appeal"
+	TargetQueueItem = "queue_item"
+	TargetBadge     = "badge"
+	TargetFilter    = "filter_rule"
+	TargetSystem    = "system" // maintenance jobs with no single target
+)
+
+// ErrAuditAppendOnly is returned when something tries to change or remove an
+// audit log entry
+var ErrAuditAppendOnly = errors.New("audit log entries cannot be changed")
+
+// AuditLogs record every privileged action: who did what to which target,
+// what it looked like before and after, and the request it came from. ActorID
+// is 0 for actions taken by the server itself, such as the trash purge.
+type AuditLog struct {
+	ID         uint            `gorm:"primaryKey;autoIncrement" json:"id"`
+	ActorID    uint            `gorm:"index" json:"actor_id"`
+	Action     string          `gorm:"index" json:"action"`
+	TargetType string          `gorm:"index:idx_audit_target" json:"target_type"`
+	TargetID   uint            `gorm:"index:idx_audit_target" json:"target_id"`
+	Before     json.RawMessage `gorm:"type:jsonb" json:"before"`
+	After      json.RawMessage `gorm:"type:jsonb" json:"after"`
+	IP         string          `json:"ip"`
+	UserAgent  string          `json:"user_agent"`
+	RequestID  string          `gorm:"index" json:"request_id"`
+	CreatedAt  time.Time       `gorm:"index" json:"created_at"`
+}
+
+// BeforeUpdate keeps the audit log append-only
+func (AuditLog) BeforeUpdate(*gorm.DB) error {
+	return ErrAuditAppendOnly
+}
+
+// BeforeDelete keeps the audit log append-only
+func (AuditLog) BeforeDelete(*gorm.DB) error {
+	return ErrAuditAppendOnly
+}
+
+func MigrateAuditLogs(db *gorm.DB) error {
+	return db.AutoMigrate(&AuditLog{})
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Badge tiers
+const (
+	BadgeBronze = "bronze"
+	BadgeSilver = "silver"
+	BadgeGold   = "gold"
+)
+
+// Badges are achievements users can earn. Rule names the built-in rule that
+// awards the badge automatically; badges without one are only awarded by admins.
+type Badge struct {
+	ID          uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	Slug        string    `gorm:"unique" json:"slug"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Tier        string    `json:"tier"`
+	Icon        string    `json:"icon"`
+	Rule        string    `json:"rule"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func MigrateBadges(db *gorm.DB) error {
+	return db.AutoMigrate(&Badge{})
+}
+
+// UserBadges record when a user was awarded a badge. AwardedBy is the admin
+// who awarded it by hand, or nil when a rule did.
+type UserBadge struct {
+	ID        uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID    uint      `gorm:"uniqueIndex:idx_user_badge" json:"user_id"`
+	BadgeID   uint      `gorm:"uniqueIndex:idx_user_badge;index" json:"badge_id"`
+	Badge     Badge     `gorm:"foreignKey:BadgeID" json:"badge"`
+	AwardedBy *uint     `json:"awarded_by"`
+	Reason    string    `json:"reason"`
+	AwardedAt time.Time `json:"awarded_at"`
+}
+
+func MigrateUserBadges(db *gorm.DB) error {
+	return db.AutoMigrate(&UserBadge{})
+}
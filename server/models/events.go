@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// EventLog keeps the most recent forum events, in order, so real-time clients
+// can catch up on what they missed while disconnected
+type EventLog struct {
+	ID        uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
+	Type      string    `json:"type"`
+	Payload   string    `gorm:"type:jsonb" json:"payload"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func MigrateEventLogs(db *gorm.DB) error {
+	return db.AutoMigrate(&EventLog{})
+}
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Filter rule kinds
+const (
+	FilterLiteral  = "literal"  // a word or phrase
+	FilterWildcard = "wildcard" // a word or phrase where * matches any letters and ? one
+	FilterRegex    = "regex"    // a regular expression
+)
+
+// Filter rule actions, from most to least severe
+const (
+	FilterBlock   = "block"   // reject the post
+	FilterHold    = "hold"    // hide the post until a moderator approves it
+	FilterReplace = "replace" // mask the match with bullets
+	FilterFlag    = "flag"    // publish the post but queue it for review
+)
+
+// FilterRules are checked against every new or edited thread and comment.
+// Matching ignores case, and literal and wildcard rules only match whole
+// words.
+type FilterRule struct {
+	ID        uint       `gorm:"primaryKey;autoIncrement" json:"id"`
+	Pattern   string     `json:"pattern"`
+	Kind      string     `gorm:"default:literal" json:"kind"`
+	Action    string     `json:"action"`
+	Enabled   bool       `json:"enabled"`
+	Note      string     `json:"note"`
+	Hits      int64      `gorm:"default:0" json:"hits"` // posts the rule matched
+	LastHitAt *time.Time `json:"last_hit_at"`
+	CreatedBy uint       `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+func MigrateFilterRules(db *gorm.DB) error {
+	return db.AutoMigrate(&FilterRule{})
+}
@@ -1,23 +1,89 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// User roles
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Thread pins
+const (
+	PinCategory = "category" // first in its category's listing
+	PinGlobal   = "global"   // first in every listing
+)
 
 // Users
 type User struct {
 	ID        uint   `gorm:"primaryKey;autoIncrement" json:"id"`
 	Username  string `gorm:"unique" json:"username"`
 	Email     string `gorm:"unique" json:"email"`
-	Password  string `json:"password"`
+	Password  string `json:"-"` // bcrypt hash, never serialized
+	Role      string `gorm:"default:user" json:"role"`
+	AvatarID  *uint  `json:"avatar_id"`
+	Reputation int   `gorm:"default:0" json:"reputation"` // sum of the user's reputation ledger
+	TrustLevel int   `gorm:"default:0" json:"trust_level"` // rises with account age and activity
+	CreatedAt *time.Time `json:"created_at"` // nil when the join date is unknown
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"deleted_at"`
+	DeletedBy *uint  `json:"deleted_by"`
+	DeleteReason string `json:"delete_reason"`
 }
 
 func MigrateUsers(db *gorm.DB) error {
 	return db.AutoMigrate(&User{})
 }
 
+// joinDatesStamped reports whether users.created_at still defaults to the
+// current time. The column was added with that default, which gave every
+// existing account the time of the migration as its join date.
+func joinDatesStamped(db *gorm.DB) bool {
+	var defaults []string
+	db.Raw(`SELECT column_default FROM information_schema.columns
+		WHERE table_name = 'users' AND column_name = 'created_at' AND column_default IS NOT NULL`).Scan(&defaults)
+	return len(defaults) > 0
+}
+
+// BackfillJoinDates replaces the join dates stamped by the old column default.
+// The accounts that existed when the column was added share the earliest join
+// date; they get the time of their first thread or comment, or no join date
+// at all if they never posted. Anyone whose first post predates their join
+// date gets that instead.
+func BackfillJoinDates(db *gorm.DB) error {
+	firstPosts := `WITH first_posts AS (
+		SELECT user_id, MIN(created_at::timestamptz) AS first_post FROM (
+			SELECT user_id, created_at FROM threads WHERE created_at ~ '^\d{4}-\d{2}-\d{2}T'
+			UNION ALL
+			SELECT user_id, created_at FROM comments WHERE created_at ~ '^\d{4}-\d{2}-\d{2}T'
+		) posts GROUP BY user_id
+	) `
+	statements := []string{
+		`ALTER TABLE users ALTER COLUMN created_at DROP DEFAULT, ALTER COLUMN created_at DROP NOT NULL`,
+		firstPosts + `UPDATE users SET created_at = (SELECT first_post FROM first_posts WHERE first_posts.user_id = users.id)
+			WHERE created_at = (SELECT MIN(created_at) FROM users)`,
+		firstPosts + `UPDATE users SET created_at = first_posts.first_post FROM first_posts
+			WHERE first_posts.user_id = users.id AND first_posts.first_post < users.created_at`,
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, statement := range statements {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // Categories
 type Category struct {
 	ID        uint   `gorm:"primaryKey;autoIncrement" json:"id"`
 	Name      string `gorm:"unique" json:"name"`
+	QA        bool   `gorm:"default:false" json:"qa"` // threads are questions that can have an accepted answer
 	CreatedAt string `json:"created_at"`
 }
 
@@ -30,10 +96,30 @@ type Thread struct {
 	ID         uint   `gorm:"primaryKey;autoIncrement" json:"id"`
 	Title      string `json:"title"`
 	Content	   string `json:"content"`
+	ContentHTML string `json:"content_html"` // sanitized render of Content
 	UserID     uint   `json:"user_id"`
 	CategoryID uint   `json:"category_id"`
 	CreatedAt  string `json:"created_at"`
 	UpdatedAt  string `json:"updated_at"`
+	Score      int    `gorm:"default:0" json:"score"` // upvotes minus downvotes
+	AcceptedCommentID *uint `json:"accepted_comment_id"` // answer accepted in a Q&A category
+	Pin        string `gorm:"default:''" json:"pin"` // "", PinCategory or PinGlobal
+	PinnedAt   *time.Time `json:"pinned_at"`
+	Locked     bool   `gorm:"default:false" json:"locked"`   // no new replies except from moderators
+	Archived   bool   `gorm:"default:false" json:"archived"` // read-only for everyone
+	Announcement bool `gorm:"default:false" json:"announcement"` // shown site-wide until it expires
+	AnnouncementExpiresAt *time.Time `json:"announcement_expires_at"`
+	MergedIntoID *uint    `gorm:"index" json:"merged_into_id"` // the thread this one's comments were merged into
+	DeletedAt  gorm.DeletedAt `gorm:"index" json:"deleted_at"` // in the trash until purged
+	DeletedBy  *uint  `json:"deleted_by"`
+	DeleteReason string `json:"delete_reason"`
+	Hidden     bool   `gorm:"default:false" json:"hidden"` // held for review, visible only to its author and moderators
+	Question   bool   `gorm:"-" json:"question"` // posted in a Q&A category
+	Solved     bool   `gorm:"-" json:"solved"`   // a question with an accepted answer
+	Poll       *Poll  `gorm:"-" json:"poll,omitempty"`
+	Mentions   []Mention `gorm:"-" json:"mentions"`
+	Reactions  map[string]int `gorm:"-" json:"reactions"`
+	MyReactions []string `gorm:"-" json:"my_reactions"`
 }
 
 func MigrateThreads(db *gorm.DB) error {
@@ -65,9 +151,21 @@ type Comment struct {
 	ID        uint   `gorm:"primaryKey;autoIncrement" json:"id"`
 	ThreadID  uint   `json:"thread_id"`
 	UserID    uint   `json:"user_id"`
+	ParentID  *uint  `json:"parent_id"`
+	Helpful   bool   `gorm:"default:false" json:"helpful"` // marked helpful by the thread author
 	Content   string `json:"content"`
+	ContentHTML string `json:"content_html"` // sanitized render of Content
 	CreatedAt string `json:"created_at"`
 	UpdatedAt string `json:"updated_at"`
+	Score     int    `gorm:"default:0" json:"score"` // upvotes minus downvotes
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"deleted_at"` // in the trash until purged
+	DeletedBy *uint  `json:"deleted_by"`
+	DeleteReason string `json:"delete_reason"`
+	Hidden    bool   `gorm:"default:false" json:"hidden"` // held for review, visible only to its author and moderators
+	Accepted  bool   `gorm:"-" json:"accepted"` // the accepted answer to its thread
+	Mentions  []Mention `gorm:"-" json:"mentions"`
+	Reactions map[string]int `gorm:"-" json:"reactions"`
+	MyReactions []string `gorm:"-" json:"my_reactions"`
 }
 
 func MigrateComments(db *gorm.DB) error {
@@ -76,6 +174,8 @@ func MigrateComments(db *gorm.DB) error {
 
 // Consolidated migration function
 func Migrate(db *gorm.DB) error {
+	// Checked before the users table is migrated, which may drop the default
+	stamped := joinDatesStamped(db)
 	if err := MigrateUsers(db); err != nil {
 		return err
 	}
@@ -94,5 +194,100 @@ func Migrate(db *gorm.DB) error {
 	if err := MigrateComments(db); err != nil {
 		return err
 	}
+	if stamped {
+		if err := BackfillJoinDates(db); err != nil {
+			return err
+		}
+	}
+	if err := MigrateGroups(db); err != nil {
+		return err
+	}
+	if err := MigrateGroupMembers(db); err != nil {
+		return err
+	}
+	if err := MigrateCategoryPermissions(db); err != nil {
+		return err
+	}
+	if err := MigrateGroupMentions(db); err != nil {
+		return err
+	}
+	if err := MigrateSearch(db); err != nil {
+		return err
+	}
+	if err := MigrateEventLogs(db); err != nil {
+		return err
+	}
+	if err := MigrateNotifications(db); err != nil {
+		return err
+	}
+	if err := MigrateNotificationPreferences(db); err != nil {
+		return err
+	}
+	if err := MigrateFollows(db); err != nil {
+		return err
+	}
+	if err := MigrateDigestStates(db); err != nil {
+		return err
+	}
+	if err := MigrateMentions(db); err != nil {
+		return err
+	}
+	if err := MigrateUserBlocks(db); err != nil {
+		return err
+	}
+	if err := MigrateAttachments(db); err != nil {
+		return err
+	}
+	if err := MigrateAttachmentVariants(db); err != nil {
+		return err
+	}
+	if err := MigrateProfiles(db); err != nil {
+		return err
+	}
+	if err := MigrateReactions(db); err != nil {
+		return err
+	}
+	if err := MigrateReactionCounts(db); err != nil {
+		return err
+	}
+	if err := MigrateReputationEvents(db); err != nil {
+		return err
+	}
+	if err := MigrateBadges(db); err != nil {
+		return err
+	}
+	if err := MigrateUserBadges(db); err != nil {
+		return err
+	}
+	if err := MigratePolls(db); err != nil {
+		return err
+	}
+	if err := MigratePollOptions(db); err != nil {
+		return err
+	}
+	if err := MigratePollVotes(db); err != nil {
+		return err
+	}
+	if err := MigrateModerationLogs(db); err != nil {
+		return err
+	}
+	if err := MigrateQueueItems(db); err != nil {
+		return err
+	}
+	if err := MigrateReports(db); err != nil {
+		return err
+	}
+	if err := MigrateSanctions(db); err != nil {
+		return err
+	}
+	if err := MigrateAppeals(db); err != nil {
+		return err
+	}
+	if err := MigrateAuditLogs(db); err != nil {
+		return err
+	}
+	if err := MigrateFilterRules(db); err != nil {
+		return err
+	}
 	return nil
 }
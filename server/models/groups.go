@@ -0,0 +1,78 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Group join policies
+const (
+	JoinPolicyOpen    = "open"
+	JoinPolicyRequest = "request"
+	JoinPolicyInvite  = "invite"
+)
+
+// Group member roles and statuses
+const (
+	GroupRoleOwner  = "owner"
+	GroupRoleMember = "member"
+
+	MemberStatusActive  = "active"
+	MemberStatusPending = "pending"
+	MemberStatusInvited = "invited"
+)
+
+// Groups
+type Group struct {
+	ID          uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	Name        string    `gorm:"unique" json:"name"`
+	Description string    `json:"description"`
+	JoinPolicy  string    `gorm:"default:open" json:"join_policy"`
+	CreatedBy   uint      `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func MigrateGroups(db *gorm.DB) error {
+	return db.AutoMigrate(&Group{})
+}
+
+// GroupMembers
+type GroupMember struct {
+	GroupID   uint      `gorm:"primaryKey" json:"group_id"`
+	UserID    uint      `gorm:"primaryKey;index" json:"user_id"`
+	Role      string    `gorm:"default:member" json:"role"`
+	Status    string    `gorm:"default:active" json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func MigrateGroupMembers(db *gorm.DB) error {
+	return db.AutoMigrate(&GroupMember{})
+}
+
+// CategoryPermissions restrict a category to the members of one or more groups.
+// A category without any rows is open to everyone.
+type CategoryPermission struct {
+	CategoryID uint `gorm:"primaryKey" json:"category_id"`
+	GroupID    uint `gorm:"primaryKey" json:"group_id"`
+	CanView    bool `json:"can_view"`
+	CanPost    bool `json:"can_post"`
+}
+
+func MigrateCategoryPermissions(db *gorm.DB) error {
+	return db.AutoMigrate(&CategoryPermission{})
+}
+
+// GroupMentions record an @group mention in a thread or comment
+type GroupMention struct {
+	ID        uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	GroupID   uint      `gorm:"index" json:"group_id"`
+	ThreadID  uint      `gorm:"index" json:"thread_id"`
+	CommentID *uint     `json:"comment_id"`
+	AuthorID  uint      `json:"author_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func MigrateGroupMentions(db *gorm.DB) error {
+	return db.AutoMigrate(&GroupMention{})
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Mentions record an @username mention in a thread or comment. Start and End
+// locate the mention in the content in UTF-16 code units, matching JavaScript
+// string indexing, so clients can link the span directly.
+type Mention struct {
+	ID        uint      `gorm:"primaryKey;autoIncrement" json:"-"`
+	ThreadID  uint      `gorm:"index" json:"-"`
+	CommentID *uint     `gorm:"index" json:"-"`
+	UserID    uint      `gorm:"index" json:"user_id"`
+	AuthorID  uint      `json:"-"`
+	Username  string    `json:"username"`
+	Start     int       `gorm:"column:start_offset" json:"start"`
+	End       int       `gorm:"column:end_offset" json:"end"`
+	CreatedAt time.Time `json:"-"`
+}
+
+func MigrateMentions(db *gorm.DB) error {
+	return db.AutoMigrate(&Mention{})
+}
+
+// UserBlocks stop the blocked user from notifying the blocker
+type UserBlock struct {
+	UserID    uint      `gorm:"primaryKey" json:"user_id"`
+	BlockedID uint      `gorm:"primaryKey" json:"blocked_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func MigrateUserBlocks(db *gorm.DB) error {
+	return db.AutoMigrate(&UserBlock{})
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Moderation actions
+const (
+	ModerationMove  = "move"  // a thread moved to another category
+	ModerationMerge = "merge" // a thread's comments moved into another thread
+	ModerationSplit = "split" // some comments moved out into a new thread
+	ModerationState = "state" // a thread's pin, lock, archive or announcement changed
+)
+
+// ModerationLogs record who reorganised which thread. TargetThreadID is the
+// thread a merge went into or a split created.
+type ModerationLog struct {
+	ID             uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	ModeratorID    uint      `gorm:"index" json:"moderator_id"`
+	Action         string    `gorm:"index" json:"action"`
+	ThreadID       uint      `gorm:"index" json:"thread_id"`
+	TargetThreadID *uint     `json:"target_thread_id"`
+	Detail         string    `json:"detail"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func MigrateModerationLogs(db *gorm.DB) error {
+	return db.AutoMigrate(&ModerationLog{})
+}
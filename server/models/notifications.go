@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Notification types
+const (
+	NotifyThreadReply  = "thread_reply"
+	NotifyCommentReply = "comment_reply"
+	NotifyMention      = "mention"
+	NotifyModeration   = "moderation"
+	NotifyRoleChange   = "role_change"
+	NotifyBadge        = "badge"
+	NotifyAnswer       = "answer_accepted"
+	NotifyReport       = "report"
+	NotifySanction     = "sanction"
+)
+
+// Notifications
+type Notification struct {
+	ID        uint       `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID    uint       `gorm:"index:idx_notifications_user_read" json:"user_id"`
+	Type      string     `json:"type"`
+	ActorID   uint       `json:"actor_id"`
+	ThreadID  *uint      `json:"thread_id"`
+	CommentID *uint      `json:"comment_id"`
+	Message   string     `json:"message"`
+	ReadAt    *time.Time `gorm:"index:idx_notifications_user_read" json:"read_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func MigrateNotifications(db *gorm.DB) error {
+	return db.AutoMigrate(&Notification{})
+}
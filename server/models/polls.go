@@ -0,0 +1,56 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Polls are attached to a thread when it is created. Voters and each
+// option's Votes are kept as counters, moved in the same transaction as the
+// votes themselves.
+type Poll struct {
+	ID                uint         `gorm:"primaryKey;autoIncrement" json:"id"`
+	ThreadID          uint         `gorm:"unique" json:"thread_id"`
+	Question          string       `json:"question"`
+	Multiple          bool         `gorm:"default:false" json:"multiple"`            // voters may pick more than one option
+	Anonymous         bool         `gorm:"default:false" json:"anonymous"`           // who voted for what is never shown
+	ResultsBeforeVote bool         `gorm:"default:false" json:"results_before_vote"` // counts are shown to users who have not voted
+	ClosesAt          *time.Time   `json:"closes_at"`
+	Voters            int          `gorm:"default:0" json:"voters"`
+	Options           []PollOption `gorm:"foreignKey:PollID" json:"options"`
+	CreatedAt         time.Time    `json:"created_at"`
+
+	Closed         bool   `gorm:"-" json:"closed"`
+	ResultsVisible bool   `gorm:"-" json:"results_visible"` // counts are zero while false
+	MyVotes        []uint `gorm:"-" json:"my_votes"`
+}
+
+func MigratePolls(db *gorm.DB) error {
+	return db.AutoMigrate(&Poll{})
+}
+
+type PollOption struct {
+	ID       uint   `gorm:"primaryKey;autoIncrement" json:"id"`
+	PollID   uint   `gorm:"index" json:"poll_id"`
+	Text     string `json:"text"`
+	Position int    `json:"position"`
+	Votes    int    `gorm:"default:0" json:"votes"`
+}
+
+func MigratePollOptions(db *gorm.DB) error {
+	return db.AutoMigrate(&PollOption{})
+}
+
+// PollVotes record one user's vote for one option
+type PollVote struct {
+	ID        uint      `gorm:"primaryKey;autoIncrement" json:"-"`
+	PollID    uint      `gorm:"uniqueIndex:idx_poll_vote" json:"poll_id"`
+	UserID    uint      `gorm:"uniqueIndex:idx_poll_vote" json:"user_id"`
+	OptionID  uint      `gorm:"uniqueIndex:idx_poll_vote" json:"option_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func MigratePollVotes(db *gorm.DB) error {
+	return db.AutoMigrate(&PollVote{})
+}
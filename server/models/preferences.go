@@ -0,0 +1,56 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Notification delivery options
+const (
+	DeliveryInApp  = "in_app"
+	DeliveryEmail  = "email"
+	DeliveryDaily  = "daily"
+	DeliveryWeekly = "weekly"
+	DeliveryOff    = "off"
+)
+
+// NotifyFollowedActivity is the preference type for new threads and comments
+// in followed threads and categories. It is only ever delivered in digests.
+const NotifyFollowedActivity = "followed_activity"
+
+// NotificationPreferences store how a user wants each notification type
+// delivered. Types without a row use the default delivery.
+type NotificationPreference struct {
+	UserID   uint   `gorm:"primaryKey" json:"user_id"`
+	Type     string `gorm:"primaryKey" json:"type"`
+	Delivery string `json:"delivery"`
+}
+
+func MigrateNotificationPreferences(db *gorm.DB) error {
+	return db.AutoMigrate(&NotificationPreference{})
+}
+
+// Follows subscribe a user to a thread or a whole category
+type Follow struct {
+	ID         uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID     uint      `gorm:"uniqueIndex:idx_follows_target" json:"user_id"`
+	ThreadID   *uint     `gorm:"uniqueIndex:idx_follows_target" json:"thread_id"`
+	CategoryID *uint     `gorm:"uniqueIndex:idx_follows_target" json:"category_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func MigrateFollows(db *gorm.DB) error {
+	return db.AutoMigrate(&Follow{})
+}
+
+// DigestStates remember when each user last got each kind of digest
+type DigestState struct {
+	UserID     uint      `gorm:"primaryKey" json:"user_id"`
+	Frequency  string    `gorm:"primaryKey" json:"frequency"`
+	LastSentAt time.Time `json:"last_sent_at"`
+}
+
+func MigrateDigestStates(db *gorm.DB) error {
+	return db.AutoMigrate(&DigestState{})
+}
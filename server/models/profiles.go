@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Profiles hold the public, user-editable details of a user. Users without a
+// row have an empty profile.
+type Profile struct {
+	UserID      uint      `gorm:"primaryKey" json:"user_id"`
+	DisplayName string    `json:"display_name"`
+	Bio         string    `json:"bio"`
+	Location    string    `json:"location"`
+	Website     string    `json:"website"`
+	Pronouns    string    `json:"pronouns"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func MigrateProfiles(db *gorm.DB) error {
+	return db.AutoMigrate(&Profile{})
+}
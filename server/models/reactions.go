@@ -0,0 +1,46 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Reaction targets
+const (
+	TargetThread  = "thread"
+	TargetComment = "comment"
+)
+
+// Votes are reactions too, but a user holds at most one of the two on a post
+const (
+	ReactionUpvote   = "upvote"
+	ReactionDownvote = "downvote"
+)
+
+// Reactions record one user's reaction of one type to a thread or comment
+type Reaction struct {
+	ID         uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID     uint      `gorm:"uniqueIndex:idx_reaction_unique" json:"user_id"`
+	TargetType string    `gorm:"uniqueIndex:idx_reaction_unique;index:idx_reaction_target" json:"target_type"`
+	TargetID   uint      `gorm:"uniqueIndex:idx_reaction_unique;index:idx_reaction_target" json:"target_id"`
+	Type       string    `gorm:"uniqueIndex:idx_reaction_unique" json:"type"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func MigrateReactions(db *gorm.DB) error {
+	return db.AutoMigrate(&Reaction{})
+}
+
+// ReactionCounts keep the number of reactions of each type on a post, so
+// listings do not have to count reaction rows
+type ReactionCount struct {
+	TargetType string `gorm:"primaryKey" json:"-"`
+	TargetID   uint   `gorm:"primaryKey" json:"-"`
+	Type       string `gorm:"primaryKey" json:"type"`
+	Count      int    `json:"count"`
+}
+
+func MigrateReactionCounts(db *gorm.DB) error {
+	return db.AutoMigrate(&ReactionCount{})
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// TargetUser is reported like a post, alongside TargetThread and TargetComment
+const TargetUser = "user"
+
+// Report reasons
+const (
+	ReportSpam          = "spam"
+	ReportHarassment    = "harassment"
+	ReportHate          = "hate"
+	ReportInappropriate = "inappropriate"
+	ReportOffTopic      = "off_topic"
+	ReportOther         = "other"
+)
+
+// Queue item states. Pending and claimed items are open: a target has at most
+// one open item, which collects every new report about it.
+const (
+	QueuePending   = "pending"
+	QueueClaimed   = "claimed"
+	QueueResolved  = "resolved"  // a moderator acted on the reports
+	QueueDismissed = "dismissed" // a moderator found nothing wrong
+)
+
+// Queue item sources: why a target entered the queue
+const (
+	QueueSourceReport = "report" // users reported it
+	QueueSourceFilter = "filter" // a word filter held or flagged it
+	QueueSourceSpam   = "spam"   // the spam heuristics held it
+)
+
+// QueueItems are entries in the moderation queue, one per reported or held
+// target until a moderator closes it
+type QueueItem struct {
+	ID         uint       `gorm:"primaryKey;autoIncrement" json:"id"`
+	TargetType string     `gorm:"uniqueIndex:idx_queue_open,where:status <> 'resolved' AND status <> 'dismissed'" json:"target_type"`
+	TargetID   uint       `gorm:"uniqueIndex:idx_queue_open" json:"target_id"`
+	Status     string     `gorm:"index;default:pending" json:"status"`
+	Reports    int        `gorm:"default:0" json:"reports"`
+	Source     string     `gorm:"default:report" json:"source"`
+	Detail     string     `json:"detail"` // why an automatic check queued it
+	ClaimedBy  *uint      `json:"claimed_by"`
+	ClaimedAt  *time.Time `json:"claimed_at"`
+	ResolvedBy *uint      `json:"resolved_by"`
+	ResolvedAt *time.Time `json:"resolved_at"`
+	Note       string     `json:"note"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+
+	Reasons map[string]int `gorm:"-" json:"reasons"` // how many reports gave each reason
+}
+
+func MigrateQueueItems(db *gorm.DB) error {
+	return db.AutoMigrate(&QueueItem{})
+}
+
+// Reports are one user's report about a thread, comment or user. Each user
+// reports a target at most once per queue item.
+type Report struct {
+	ID          uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	QueueItemID uint      `gorm:"uniqueIndex:idx_report_unique" json:"queue_item_id"`
+	ReporterID  uint      `gorm:"uniqueIndex:idx_report_unique" json:"reporter_id"`
+	TargetType  string    `gorm:"index:idx_report_target" json:"target_type"`
+	TargetID    uint      `gorm:"index:idx_report_target" json:"target_id"`
+	Reason      string    `json:"reason"`
+	Details     string    `json:"details"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func MigrateReports(db *gorm.DB) error {
+	return db.AutoMigrate(&Report{})
+}
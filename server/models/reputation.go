@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Reputation reasons
+const (
+	ReputationHelpful    = "helpful"            // a reply was marked helpful by the thread author
+	ReputationReply      = "reply"              // someone else replied to the user's thread
+	ReputationModeration = "moderation_penalty" // a moderator deleted the user's post
+)
+
+// Privileges unlocked by reputation
+const (
+	PrivilegeCreateTags = "create_tags"
+	PrivilegeEditPosts  = "edit_posts"
+)
+
+// ReputationEvents are the ledger behind each user's reputation. Entries are
+// never changed except to reweigh them: taking points back adds an entry with
+// Units -1. Points is Units times the reason's weight when last computed, and
+// User.Reputation is the sum of Points.
+type ReputationEvent struct {
+	ID        uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID    uint      `gorm:"index" json:"user_id"`
+	Reason    string    `gorm:"index" json:"reason"`
+	Units     int       `json:"units"`
+	Points    int       `json:"points"`
+	ActorID   uint      `json:"actor_id"`
+	ThreadID  uint      `json:"thread_id"`
+	CommentID *uint     `gorm:"index" json:"comment_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func MigrateReputationEvents(db *gorm.DB) error {
+	return db.AutoMigrate(&ReputationEvent{})
+}
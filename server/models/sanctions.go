@@ -0,0 +1,57 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Sanction types
+const (
+	SanctionBan        = "ban"        // login blocked for good
+	SanctionSuspension = "suspension" // login blocked until it expires
+	SanctionSilence    = "silence"    // can log in and read, but not post
+)
+
+// Appeal states
+const (
+	AppealPending  = "pending"
+	AppealAccepted = "accepted" // the sanction was lifted
+	AppealRejected = "rejected"
+)
+
+// Sanctions restrict what a user may do. A sanction is active until it
+// expires or is lifted; bans never expire.
+type Sanction struct {
+	ID        uint       `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID    uint       `gorm:"index" json:"user_id"`
+	Type      string     `json:"type"`
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	IssuedBy  uint       `json:"issued_by"`
+	LiftedAt  *time.Time `json:"lifted_at"`
+	LiftedBy  *uint      `json:"lifted_by"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func MigrateSanctions(db *gorm.DB) error {
+	return db.AutoMigrate(&Sanction{})
+}
+
+// Appeals ask for a sanction to be lifted. A sanction has at most one pending
+// appeal at a time.
+type Appeal struct {
+	ID         uint       `gorm:"primaryKey;autoIncrement" json:"id"`
+	SanctionID uint       `gorm:"uniqueIndex:idx_appeal_pending,where:status = 'pending'" json:"sanction_id"`
+	UserID     uint       `gorm:"index" json:"user_id"`
+	Message    string     `json:"message"`
+	Status     string     `gorm:"index;default:pending" json:"status"`
+	ReviewedBy *uint      `json:"reviewed_by"`
+	ReviewedAt *time.Time `json:"reviewed_at"`
+	Response   string     `json:"response"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func MigrateAppeals(db *gorm.DB) error {
+	return db.AutoMigrate(&Appeal{})
+}
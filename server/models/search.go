@@ -0,0 +1,26 @@
+package models
+
+import "gorm.io/gorm"
+
+// MigrateSearch adds the full-text search columns and indexes. The tsvector
+// columns are generated by Postgres, so they stay current on every insert,
+// update and delete without any application code.
+func MigrateSearch(db *gorm.DB) error {
+	statements := []string{
+		`ALTER TABLE threads ADD COLUMN IF NOT EXISTS search_vector tsvector
+			GENERATED ALWAYS AS (
+				setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+				setweight(to_tsvector('english', coalesce(content, '')), 'B')
+			) STORED`,
+		`CREATE INDEX IF NOT EXISTS idx_threads_search_vector ON threads USING GIN (search_vector)`,
+		`ALTER TABLE comments ADD COLUMN IF NOT EXISTS search_vector tsvector
+			GENERATED ALWAYS AS (to_tsvector('english', coalesce(content, ''))) STORED`,
+		`CREATE INDEX IF NOT EXISTS idx_comments_search_vector ON comments USING GIN (search_vector)`,
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
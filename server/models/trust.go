@@ -0,0 +1,9 @@
+package models
+
+// Trust levels rise automatically as an account ages and posts, and never
+// fall on their own
+const (
+	TrustNew    = 0 // limited in links, posts per hour and attachments
+	TrustBasic  = 1
+	TrustMember = 2 // no longer checked by the spam heuristics
+)
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/damiancxliew/web-forum/events"
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// pendingNotification is a notification waiting to be stored. Only the first
+// one per recipient is kept for any single event.
+type pendingNotification struct {
+	userID  uint
+	kind    string
+	message string
+}
+
+// SubscribeNotifications generates notifications from forum events. It runs on
+// its own event queue, so handlers never wait for it.
+func (r *Repository) SubscribeNotifications() {
+	r.Events.Subscribe("notifications", func(event events.Event) {
+		var pending []pendingNotification
+		switch event.Type {
+		case events.ThreadCreated:
+			pending = r.threadNotifications(event)
+		case events.CommentCreated:
+			pending = r.commentNotifications(event)
+		case events.ThreadUpdated, events.CommentUpdated:
+			pending = append(r.moderationNotifications(event), r.editMentionNotifications(event)...)
+		case events.ThreadDeleted, events.CommentDeleted, events.ThreadRestored, events.CommentRestored:
+			pending = r.moderationNotifications(event)
+		case events.UserRoleChanged:
+			pending = []pendingNotification{{
+				userID:  event.AuthorID,
+				kind:    models.NotifyRoleChange,
+				message: fmt.Sprintf("Your role was changed to %s", event.Detail),
+			}}
+		case events.AnswerAccepted:
+			pending = []pendingNotification{{
+				userID:  event.AuthorID,
+				kind:    models.NotifyAnswer,
+				message: fmt.Sprintf("%s accepted your answer", r.username(event.UserID)),
+			}}
+		case events.ReportResolved, events.ReportDismissed:
+			message := "A moderator reviewed your report and took action"
+			if event.Type == events.ReportDismissed {
+				message = "A moderator reviewed your report and found no problem"
+			}
+			for _, reporterID := range event.Recipients {
+				pending = append(pending, pendingNotification{userID: reporterID, kind: models.NotifyReport, message: message})
+			}
+		case events.UserSanctioned, events.SanctionLifted, events.AppealReviewed:
+			pending = []pendingNotification{{userID: event.AuthorID, kind: models.NotifySanction, message: event.Detail}}
+		case events.BadgeAwarded:
+			pending = []pendingNotification{{
+				userID:  event.AuthorID,
+				kind:    models.NotifyBadge,
+				message: fmt.Sprintf("You earned the %s badge", event.Detail),
+			}}
+		}
+		r.storeNotifications(event, pending)
+	}, events.ThreadCreated, events.CommentCreated, events.ThreadUpdated, events.ThreadDeleted,
+		events.CommentUpdated, events.CommentDeleted, events.UserRoleChanged, events.BadgeAwarded,
+		events.AnswerAccepted, events.ThreadRestored, events.CommentRestored,
+		events.ReportResolved, events.ReportDismissed,
+		events.UserSanctioned, events.SanctionLifted, events.AppealReviewed)
+}
+
+func (r *Repository) username(userID uint) string {
+	user := models.User{}
+	if err := r.DB.Select("username").First(&user, userID).Error; err != nil || user.Username == "" {
+		return "Someone"
+	}
+	return user.Username
+}
+
+func (r *Repository) threadNotifications(event events.Event) []pendingNotification {
+	thread := models.Thread{}
+	if err := r.DB.First(&thread, event.ThreadID).Error; err != nil {
+		return nil
+	}
+	actor := r.username(event.UserID)
+	pending := r.userMentionNotifications(event, thread, thread.UserID,
+		fmt.Sprintf("%s mentioned you in %q", actor, thread.Title))
+	return append(pending, r.groupMentionNotifications(event, thread, thread.UserID,
+		fmt.Sprintf("%s mentioned your group in %q", actor, thread.Title))...)
+}
+
+func (r *Repository) commentNotifications(event events.Event) []pendingNotification {
+	comment := models.Comment{}
+	if err := r.DB.First(&comment, event.CommentID).Error; err != nil {
+		return nil
+	}
+	thread := models.Thread{}
+	if err := r.DB.First(&thread, comment.ThreadID).Error; err != nil {
+		return nil
+	}
+	actor := r.username(comment.UserID)
+
+	pending := r.userMentionNotifications(event, thread, comment.UserID,
+		fmt.Sprintf("%s mentioned you in %q", actor, thread.Title))
+	if comment.ParentID != nil {
+		parent := models.Comment{}
+		if err := r.DB.First(&parent, *comment.ParentID).Error; err == nil {
+			pending = append(pending, pendingNotification{
+				userID:  parent.UserID,
+				kind:    models.NotifyCommentReply,
+				message: fmt.Sprintf("%s replied to your comment in %q", actor, thread.Title),
+			})
+		}
+	}
+	pending = append(pending, pendingNotification{
+		userID:  thread.UserID,
+		kind:    models.NotifyThreadReply,
+		message: fmt.Sprintf("%s replied to your thread %q", actor, thread.Title),
+	})
+	return append(pending, r.groupMentionNotifications(event, thread, comment.UserID,
+		fmt.Sprintf("%s mentioned your group in %q", actor, thread.Title))...)
+}
+
+// userMentionNotifications notifies every user @mentioned by the event's thread
+// or comment, unless they blocked the author or cannot see the thread
+func (r *Repository) userMentionNotifications(event events.Event, thread models.Thread, authorID uint, message string) []pendingNotification {
+	var commentID *uint
+	if event.CommentID != 0 {
+		commentID = &event.CommentID
+	}
+	var userIDs []uint
+	mentionTarget(r.DB.Model(&models.Mention{}), event.ThreadID, commentID).
+		Distinct("user_id").Pluck("user_id", &userIDs)
+
+	pending := []pendingNotification{}
+	for _, userID := range userIDs {
+		if r.hasBlocked(userID, authorID) || !r.canAccessCategory(userID, thread.CategoryID, "can_view") {
+			continue
+		}
+		pending = append(pending, pendingNotification{userID: userID, kind: models.NotifyMention, message: message})
+	}
+	return pending
+}
+
+// editMentionNotifications notifies users newly @mentioned by an edit. Users
+// already notified of a mention in the same thread or comment are skipped.
+func (r *Repository) editMentionNotifications(event events.Event) []pendingNotification {
+	thread := models.Thread{}
+	if err := r.DB.First(&thread, event.ThreadID).Error; err != nil {
+		return nil
+	}
+	pending := r.userMentionNotifications(event, thread, event.AuthorID,
+		fmt.Sprintf("%s mentioned you in %q", r.username(event.UserID), thread.Title))
+
+	var notified []uint
+	query := r.DB.Model(&models.Notification{}).
+		Where("type = ? AND thread_id = ?", models.NotifyMention, event.ThreadID)
+	if event.CommentID != 0 {
+		query = query.Where("comment_id = ?", event.CommentID)
+	} else {
+		query = query.Where("comment_id IS NULL")
+	}
+	query.Pluck("user_id", &notified)
+
+	already := map[uint]bool{}
+	for _, userID := range notified {
+		already[userID] = true
+	}
+	fresh := []pendingNotification{}
+	for _, p := range pending {
+		if !already[p.userID] {
+			fresh = append(fresh, p)
+		}
+	}
+	return fresh
+}
+
+// groupMentionNotifications notifies the members of every group mentioned by
+// the event's thread or comment, unless they blocked the author or cannot see
+// the thread
+func (r *Repository) groupMentionNotifications(event events.Event, thread models.Thread, authorID uint, message string) []pendingNotification {
+	query := r.DB.Model(&models.GroupMember{}).
+		Joins("JOIN group_mentions ON group_mentions.group_id = group_members.group_id").
+		Where("group_members.status = ?", models.MemberStatusActive).
+		Where("group_mentions.thread_id = ?", event.ThreadID)
+	if event.CommentID != 0 {
+		query = query.Where("group_mentions.comment_id = ?", event.CommentID)
+	} else {
+		query = query.Where("group_mentions.comment_id IS NULL")
+	}
+
+	var memberIDs []uint
+	query.Distinct("group_members.user_id").Pluck("group_members.user_id", &memberIDs)
+
+	pending := []pendingNotification{}
+	for _, memberID := range memberIDs {
+		if r.hasBlocked(memberID, authorID) || !r.canAccessCategory(memberID, thread.CategoryID, "can_view") {
+			continue
+		}
+		pending = append(pending, pendingNotification{userID: memberID, kind: models.NotifyMention, message: message})
+	}
+	return pending
+}
+
+// moderationNotifications tells authors when someone else edited, deleted or
+// restored their content. Trusted users may edit too, so edits name the editor.
+func (r *Repository) moderationNotifications(event events.Event) []pendingNotification {
+	if event.UserID == 0 || event.AuthorID == 0 || event.UserID == event.AuthorID {
+		return nil
+	}
+
+	var message string
+	switch event.Type {
+	case events.ThreadUpdated:
+		message = fmt.Sprintf("%s edited your thread", r.username(event.UserID))
+	case events.ThreadDeleted:
+		message = "A moderator deleted your thread"
+	case events.ThreadRestored:
+		message = "A moderator restored your thread"
+	case events.CommentUpdated:
+		message = fmt.Sprintf("%s edited your comment", r.username(event.UserID))
+	case events.CommentDeleted:
+		message = "A moderator deleted your comment"
+	case events.CommentRestored:
+		message = "A moderator restored your comment"
+	}
+	if (event.Type == events.ThreadDeleted || event.Type == events.CommentDeleted) && event.Detail != "" {
+		message += ": " + event.Detail
+	}
+	return []pendingNotification{{userID: event.AuthorID, kind: models.NotifyModeration, message: message}}
+}
+
+// storeNotifications saves the pending notifications, skipping the actor,
+// duplicate recipients and types the recipient switched off, and announces each
+// one on the recipient's channel. SubscribeNotificationEmails sends the emails.
+func (r *Repository) storeNotifications(event events.Event, pending []pendingNotification) {
+	notified := map[uint]bool{event.UserID: true}
+	for _, p := range pending {
+		if p.userID == 0 || notified[p.userID] {
+			continue
+		}
+		notified[p.userID] = true
+
+		delivery := r.deliveryFor(p.userID, p.kind)
+		if delivery == models.DeliveryOff {
+			continue
+		}
+
+		notification := models.Notification{
+			UserID:  p.userID,
+			Type:    p.kind,
+			ActorID: event.UserID,
+			Message: p.message,
+		}
+		// Deleted content has nothing left to link to
+		if event.Type != events.ThreadDeleted && event.Type != events.CommentDeleted {
+			if event.ThreadID != 0 {
+				threadID := event.ThreadID
+				notification.ThreadID = &threadID
+			}
+			if event.CommentID != 0 {
+				commentID := event.CommentID
+				notification.CommentID = &commentID
+			}
+		}
+
+		if err := r.DB.Create(&notification).Error; err != nil {
+			log.Println("Notification create error:", err)
+			continue
+		}
+		r.Events.Publish(events.Event{
+			Type:           events.NotificationCreated,
+			UserID:         event.UserID,
+			NotificationID: notification.ID,
+			Detail:         notification.Type,
+			Recipients:     []uint{notification.UserID},
+		})
+	}
+}
+
+// GetNotifications lists the current user's notifications, newest first.
+// Pass unread=true to only list unread ones.
+func (r *Repository) GetNotifications(c *gin.Context) {
+	page, pageSize := pagination(c)
+	query := r.DB.Model(&models.Notification{}).Where("user_id = ?", currentUserID(c))
+	if c.Query("unread") == "true" {
+		query = query.Where("read_at IS NULL")
+	}
+	// Reuse the same conditions for the count and the page
+	query = query.Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get notifications"})
+		return
+	}
+
+	notifications := []models.Notification{}
+	err := query.Order("created_at DESC").Limit(pageSize).Offset((page - 1) * pageSize).Find(&notifications).Error
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get notifications"})
+		return
+	}
+	c.JSON(http.StatusOK, paginated(notifications, page, pageSize, total))
+}
+
+func (r *Repository) GetUnreadNotificationCount(c *gin.Context) {
+	var count int64
+	err := r.DB.Model(&models.Notification{}).
+		Where("user_id = ? AND read_at IS NULL", currentUserID(c)).
+		Count(&count).Error
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not count notifications"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"unread": count})
+}
+
+func (r *Repository) MarkNotificationRead(c *gin.Context) {
+	r.setNotificationRead(c, true)
+}
+
+func (r *Repository) MarkNotificationUnread(c *gin.Context) {
+	r.setNotificationRead(c, false)
+}
+
+func (r *Repository) setNotificationRead(c *gin.Context, read bool) {
+	notification := models.Notification{}
+	err := r.DB.Where("id = ? AND user_id = ?", c.Param("id"), currentUserID(c)).First(&notification).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Notification not found"})
+		return
+	}
+
+	var readAt *time.Time
+	if read {
+		now := time.Now()
+		readAt = &now
+	}
+	if err := r.DB.Model(&notification).Update("read_at", readAt).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not update notification"})
+		return
+	}
+	c.JSON(http.StatusOK, notification)
+}
+
+func (r *Repository) MarkAllNotificationsRead(c *gin.Context) {
+	result := r.DB.Model(&models.Notification{}).
+		Where("user_id = ? AND read_at IS NULL", currentUserID(c)).
+		Update("read_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not update notifications"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Notifications marked as read", "updated": result.RowsAffected})
+}
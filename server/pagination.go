@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// pagination reads the page and page_size query params, clamping them to sane values
+func pagination(c *gin.Context) (page, pageSize int) {
+	page, err := strconv.Atoi(c.Query("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err = strconv.Atoi(c.Query("page_size"))
+	if err != nil || pageSize < 1 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	return page, pageSize
+}
+
+// paginated wraps a page of results with the paging metadata clients need
+func paginated(data interface{}, page, pageSize int, total int64) gin.H {
+	return gin.H{
+		"data":      data,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/damiancxliew/web-forum/events"
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Poll limits
+const (
+	maxPollQuestion   = 300
+	maxPollOptionText = 200
+	minPollOptions    = 2
+	maxPollOptions    = 20
+)
+
+var (
+	errPollClosed       = errors.New("poll is closed")
+	errPollThreadClosed = errors.New("poll's thread no longer takes votes")
+)
+
+// preparePoll validates a poll submitted with a new thread and clears
+// anything clients may not set
+func preparePoll(poll *models.Poll) string {
+	poll.ID, poll.ThreadID, poll.Voters = 0, 0, 0
+	poll.Question = strings.TrimSpace(poll.Question)
+	if poll.Question == "" || utf8.RuneCountInString(poll.Question) > maxPollQuestion {
+		return "Poll questions must be 1 to 300 characters"
+	}
+	if len(poll.Options) < minPollOptions || len(poll.Options) > maxPollOptions {
+		return "Polls need 2 to 20 options"
+	}
+	if poll.ClosesAt != nil && !poll.ClosesAt.After(time.Now()) {
+		return "A poll's closing time must be in the future"
+	}
+	for i := range poll.Options {
+		option := &poll.Options[i]
+		option.ID, option.PollID, option.Votes = 0, 0, 0
+		option.Position = i
+		option.Text = strings.TrimSpace(option.Text)
+		if option.Text == "" || utf8.RuneCountInString(option.Text) > maxPollOptionText {
+			return "Poll options must be 1 to 200 characters"
+		}
+	}
+	return ""
+}
+
+// pollForViewer fills in what a user may see of a poll: whether it is
+// closed, their own votes and, once visible to them, the results
+func (r *Repository) pollForViewer(poll *models.Poll, userID uint) {
+	poll.Closed = poll.ClosesAt != nil && !poll.ClosesAt.After(time.Now())
+	poll.MyVotes = []uint{}
+	if userID != 0 {
+		r.DB.Model(&models.PollVote{}).Where("poll_id = ? AND user_id = ?", poll.ID, userID).
+			Order("option_id").Pluck("option_id", &poll.MyVotes)
+	}
+
+	poll.ResultsVisible = poll.ResultsBeforeVote || poll.Closed || len(poll.MyVotes) > 0
+	if !poll.ResultsVisible {
+		poll.Voters = 0
+		for i := range poll.Options {
+			poll.Options[i].Votes = 0
+		}
+	}
+}
+
+// threadPoll returns the poll of a thread as userID sees it, or nil
+func (r *Repository) threadPoll(threadID, userID uint) *models.Poll {
+	poll := models.Poll{}
+	err := r.DB.Preload("Options", func(db *gorm.DB) *gorm.DB {
+		return db.Order("position")
+	}).Where("thread_id = ?", threadID).First(&poll).Error
+	if err != nil {
+		return nil
+	}
+	r.pollForViewer(&poll, userID)
+	return &poll
+}
+
+// deletePolls removes the polls of the given threads along with their votes
+func deletePolls(tx *gorm.DB, threadIDs []uint) error {
+	var pollIDs []uint
+	if err := tx.Model(&models.Poll{}).Where("thread_id IN ?", threadIDs).Pluck("id", &pollIDs).Error; err != nil {
+		return err
+	}
+	if len(pollIDs) == 0 {
+		return nil
+	}
+	if err := tx.Where("poll_id IN ?", pollIDs).Delete(&models.PollVote{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("poll_id IN ?", pollIDs).Delete(&models.PollOption{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("id IN ?", pollIDs).Delete(&models.Poll{}).Error
+}
+
+// loadPoll finds the poll named by the :id param and checks the current user
+// may see its thread. Polls stay behind when their thread is merged away, so
+// they are gone with it.
+func (r *Repository) loadPoll(c *gin.Context) (models.Poll, bool) {
+	poll := models.Poll{}
+	if err := r.DB.First(&poll, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Poll not found"})
+		return poll, false
+	}
+	thread, ok := r.checkThreadVisible(c, poll.ThreadID)
+	if !ok {
+		return poll, false
+	}
+	if thread.MergedIntoID != nil {
+		c.JSON(http.StatusGone, gin.H{"message": "Thread was merged", "redirect_to": *thread.MergedIntoID})
+		return poll, false
+	}
+	return poll, true
+}
+
+func (r *Repository) GetPoll(c *gin.Context) {
+	poll, ok := r.loadPoll(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": r.threadPoll(poll.ThreadID, currentUserID(c))})
+}
+
+// Vote casts or changes the current user's vote: {"option_ids": [1]}. The
+// options given replace any the user voted for before.
+func (r *Repository) Vote(c *gin.Context) {
+	poll, ok := r.loadPoll(c)
+	if !ok {
+		return
+	}
+	var voteRequest struct {
+		OptionIDs []uint `json:"option_ids"`
+	}
+	if err := c.ShouldBindJSON(&voteRequest); err != nil || len(voteRequest.OptionIDs) == 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Provide the option_ids to vote for"})
+		return
+	}
+	chosen := map[uint]bool{}
+	for _, optionID := range voteRequest.OptionIDs {
+		chosen[optionID] = true
+	}
+	if len(chosen) > 1 && !poll.Multiple {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "This poll allows only one choice"})
+		return
+	}
+	var count int64
+	r.DB.Model(&models.PollOption{}).Where("poll_id = ? AND id IN ?", poll.ID, voteRequest.OptionIDs).Count(&count)
+	if int(count) != len(chosen) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Option not found in this poll"})
+		return
+	}
+
+	r.castVotes(c, poll, chosen)
+}
+
+// Unvote takes back the current user's vote
+func (r *Repository) Unvote(c *gin.Context) {
+	poll, ok := r.loadPoll(c)
+	if !ok {
+		return
+	}
+	r.castVotes(c, poll, map[uint]bool{})
+}
+
+// castVotes replaces the current user's votes with chosen. The poll row is
+// locked first, so a user's concurrent requests apply one after another and
+// the counters always match the vote rows. Only polls on live threads take
+// votes: not deleted, hidden, merged away or archived.
+func (r *Repository) castVotes(c *gin.Context, poll models.Poll, chosen map[uint]bool) {
+	userID := currentUserID(c)
+	changed := false
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		locked := models.Poll{}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&locked, poll.ID).Error; err != nil {
+			return err
+		}
+		if locked.ClosesAt != nil && !locked.ClosesAt.After(time.Now()) {
+			return errPollClosed
+		}
+		var live int64
+		err := tx.Model(&models.Thread{}).
+			Where("id = ? AND hidden = ? AND merged_into_id IS NULL AND archived = ?", poll.ThreadID, false, false).
+			Count(&live).Error
+		if err != nil {
+			return err
+		}
+		if live == 0 {
+			return errPollThreadClosed
+		}
+
+		var previous []uint
+		if err := tx.Model(&models.PollVote{}).Where("poll_id = ? AND user_id = ?", poll.ID, userID).Pluck("option_id", &previous).Error; err != nil {
+			return err
+		}
+		had := map[uint]bool{}
+		removed := []uint{}
+		for _, optionID := range previous {
+			had[optionID] = true
+			if !chosen[optionID] {
+				removed = append(removed, optionID)
+			}
+		}
+		added := []models.PollVote{}
+		for optionID := range chosen {
+			if !had[optionID] {
+				added = append(added, models.PollVote{PollID: poll.ID, UserID: userID, OptionID: optionID})
+			}
+		}
+		if len(removed) == 0 && len(added) == 0 {
+			return nil
+		}
+		changed = true
+
+		if len(removed) > 0 {
+			err := tx.Where("poll_id = ? AND user_id = ? AND option_id IN ?", poll.ID, userID, removed).Delete(&models.PollVote{}).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Model(&models.PollOption{}).Where("id IN ?", removed).Update("votes", gorm.Expr("votes - 1")).Error
+			if err != nil {
+				return err
+			}
+		}
+		if len(added) > 0 {
+			if err := tx.Create(&added).Error; err != nil {
+				return err
+			}
+			ids := make([]uint, len(added))
+			for i, vote := range added {
+				ids[i] = vote.OptionID
+			}
+			err := tx.Model(&models.PollOption{}).Where("id IN ?", ids).Update("votes", gorm.Expr("votes + 1")).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		voters := 0
+		if len(previous) == 0 {
+			voters = 1
+		} else if len(chosen) == 0 {
+			voters = -1
+		}
+		if voters != 0 {
+			return tx.Model(&models.Poll{}).Where("id = ?", poll.ID).Update("voters", gorm.Expr("voters + ?", voters)).Error
+		}
+		return nil
+	})
+	if errors.Is(err, errPollClosed) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "This poll is closed"})
+		return
+	}
+	if errors.Is(err, errPollThreadClosed) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "This thread no longer takes votes"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not record vote"})
+		return
+	}
+
+	if changed {
+		event := events.Event{
+			Type:       events.PollVoted,
+			ThreadID:   poll.ThreadID,
+			CategoryID: r.threadCategoryID(poll.ThreadID),
+		}
+		// Anonymous polls do not say who voted, even in real time
+		if !poll.Anonymous {
+			event.UserID = userID
+		}
+		r.Events.Publish(event)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Vote recorded successfully", "data": r.threadPoll(poll.ThreadID, userID)})
+}
+
+// pollVoter is one entry in the list of who voted for an option
+type pollVoter struct {
+	UserID    uint      `json:"user_id"`
+	Username  string    `json:"username"`
+	OptionID  uint      `json:"option_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GetPollVoters lists who voted in a public poll, optionally for one
+// ?option_id=, once the results are visible to the current user
+func (r *Repository) GetPollVoters(c *gin.Context) {
+	poll, ok := r.loadPoll(c)
+	if !ok {
+		return
+	}
+	if poll.Anonymous {
+		c.JSON(http.StatusForbidden, gin.H{"message": "Votes in this poll are anonymous"})
+		return
+	}
+	r.pollForViewer(&poll, currentUserID(c))
+	if !poll.ResultsVisible {
+		c.JSON(http.StatusForbidden, gin.H{"message": "Vote to see the results of this poll"})
+		return
+	}
+	page, pageSize := pagination(c)
+
+	query := r.DB.Table("poll_votes").
+		Joins("JOIN users ON users.id = poll_votes.user_id").
+		Where("poll_votes.poll_id = ?", poll.ID)
+	if optionID := c.Query("option_id"); optionID != "" {
+		query = query.Where("poll_votes.option_id = ?", optionID)
+	}
+	// Reuse the same conditions for the count and the page
+	query = query.Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get voters"})
+		return
+	}
+	voters := []pollVoter{}
+	err := query.Select("poll_votes.user_id, users.username, poll_votes.option_id, poll_votes.created_at").
+		Order("poll_votes.created_at DESC").
+		Offset((page - 1) * pageSize).Limit(pageSize).
+		Scan(&voters).Error
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get voters"})
+		return
+	}
+	c.JSON(http.StatusOK, paginated(voters, page, pageSize, total))
+}
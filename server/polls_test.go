@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/damiancxliew/web-forum/events"
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testDB connects to the Postgres database in TEST_DATABASE_URL and migrates
+// it, skipping the test when none is configured
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := models.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// putVote calls Vote as userID, or Unvote when optionIDs is empty, and
+// returns the response status
+func putVote(r *Repository, pollID, userID uint, optionIDs []uint) int {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	body, _ := json.Marshal(gin.H{"option_ids": optionIDs})
+	c.Request = httptest.NewRequest(http.MethodPut, "/", bytes.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Params = gin.Params{{Key: "id", Value: strconv.FormatUint(uint64(pollID), 10)}}
+	c.Set("user_id", userID)
+	if len(optionIDs) == 0 {
+		r.Unvote(c)
+	} else {
+		r.Vote(c)
+	}
+	return recorder.Code
+}
+
+func TestConcurrentVotesKeepCountsExact(t *testing.T) {
+	db := testDB(t)
+	r := &Repository{DB: db, Events: events.NewBus()}
+	suffix := time.Now().UnixNano()
+
+	users := make([]models.User, 10)
+	for i := range users {
+		users[i] = models.User{Username: fmt.Sprintf("voter-%d-%d", suffix, i), Email: fmt.Sprintf("voter-%d-%d@example.com", suffix, i)}
+	}
+	category := models.Category{Name: fmt.Sprintf("polls-%d", suffix)}
+	if err := db.Create(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&category).Error; err != nil {
+		t.Fatal(err)
+	}
+	thread := models.Thread{Title: "Poll", UserID: users[0].ID, CategoryID: category.ID}
+	if err := db.Create(&thread).Error; err != nil {
+		t.Fatal(err)
+	}
+	poll := models.Poll{ThreadID: thread.ID, Question: "Which?", Options: []models.PollOption{{Text: "A"}, {Text: "B", Position: 1}}}
+	if err := db.Create(&poll).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		deletePolls(db, []uint{thread.ID})
+		db.Unscoped().Delete(&thread)
+		db.Unscoped().Delete(&category)
+		db.Unscoped().Delete(&users)
+	})
+
+	// Every user votes, switches and takes votes back many times at once
+	choices := [][]uint{{poll.Options[0].ID}, {poll.Options[1].ID}, {}}
+	var wg sync.WaitGroup
+	for _, user := range users {
+		for worker := 0; worker < 3; worker++ {
+			wg.Add(1)
+			go func(userID uint, worker int) {
+				defer wg.Done()
+				for i := 0; i < 10; i++ {
+					if code := putVote(r, poll.ID, userID, choices[(worker+i)%len(choices)]); code != http.StatusOK {
+						t.Errorf("vote by user %d returned %d", userID, code)
+					}
+				}
+			}(user.ID, worker)
+		}
+	}
+	wg.Wait()
+
+	// Whatever order the votes landed in, the counters match the vote rows
+	for _, option := range poll.Options {
+		stored := models.PollOption{}
+		db.First(&stored, option.ID)
+		var rows int64
+		db.Model(&models.PollVote{}).Where("option_id = ?", option.ID).Count(&rows)
+		if int64(stored.Votes) != rows {
+			t.Errorf("option %s counts %d votes, but has %d vote rows", option.Text, stored.Votes, rows)
+		}
+	}
+	stored := models.Poll{}
+	db.First(&stored, poll.ID)
+	var voters int64
+	db.Model(&models.PollVote{}).Where("poll_id = ?", poll.ID).Distinct("user_id").Count(&voters)
+	if int64(stored.Voters) != voters {
+		t.Errorf("poll counts %d voters, but %d users have votes", stored.Voters, voters)
+	}
+}
+
+func TestVotesRefusedOnClosedThreads(t *testing.T) {
+	db := testDB(t)
+	r := &Repository{DB: db, Events: events.NewBus()}
+	suffix := time.Now().UnixNano()
+
+	user := models.User{Username: fmt.Sprintf("voter-%d", suffix), Email: fmt.Sprintf("voter-%d@example.com", suffix)}
+	category := models.Category{Name: fmt.Sprintf("polls-%d", suffix)}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&category).Error; err != nil {
+		t.Fatal(err)
+	}
+	target := models.Thread{Title: "Target", UserID: user.ID, CategoryID: category.ID}
+	if err := db.Create(&target).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		update map[string]interface{}
+		want   int
+	}{
+		{"live", nil, http.StatusOK},
+		{"hidden", map[string]interface{}{"hidden": true}, http.StatusForbidden},
+		{"archived", map[string]interface{}{"archived": true}, http.StatusForbidden},
+		{"merged", map[string]interface{}{"merged_into_id": target.ID}, http.StatusGone},
+		{"deleted", map[string]interface{}{"deleted_at": time.Now()}, http.StatusGone},
+	}
+	for _, test := range tests {
+		thread := models.Thread{Title: test.name, UserID: target.UserID + 1, CategoryID: category.ID}
+		if err := db.Create(&thread).Error; err != nil {
+			t.Fatal(err)
+		}
+		poll := models.Poll{ThreadID: thread.ID, Question: "Which?", Options: []models.PollOption{{Text: "A"}, {Text: "B", Position: 1}}}
+		if err := db.Create(&poll).Error; err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			deletePolls(db, []uint{thread.ID})
+			db.Unscoped().Delete(&thread)
+		})
+		if test.update != nil {
+			db.Model(&models.Thread{}).Where("id = ?", thread.ID).Updates(test.update)
+		}
+
+		if got := putVote(r, poll.ID, user.ID, []uint{poll.Options[0].ID}); got != test.want {
+			t.Errorf("%s: vote returned %d, want %d", test.name, got, test.want)
+		}
+	}
+	t.Cleanup(func() {
+		db.Unscoped().Delete(&target)
+		db.Unscoped().Delete(&category)
+		db.Unscoped().Delete(&user)
+	})
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// defaultDeliveries lists every configurable notification type and how it is
+// delivered until the user says otherwise
+var defaultDeliveries = map[string]string{
+	models.NotifyThreadReply:      models.DeliveryInApp,
+	models.NotifyCommentReply:     models.DeliveryInApp,
+	models.NotifyMention:          models.DeliveryInApp,
+	models.NotifyModeration:       models.DeliveryInApp,
+	models.NotifyRoleChange:       models.DeliveryInApp,
+	models.NotifyBadge:            models.DeliveryInApp,
+	models.NotifyAnswer:           models.DeliveryInApp,
+	models.NotifyReport:           models.DeliveryInApp,
+	models.NotifySanction:         models.DeliveryEmail, // banned users cannot log in to read them
+	models.NotifyFollowedActivity: models.DeliveryDaily,
+}
+
+func isValidDelivery(notificationType, delivery string) bool {
+	switch delivery {
+	case models.DeliveryDaily, models.DeliveryWeekly, models.DeliveryOff:
+		return true
+	case models.DeliveryInApp, models.DeliveryEmail:
+		// Followed activity is too noisy to deliver one by one
+		return notificationType != models.NotifyFollowedActivity
+	}
+	return false
+}
+
+// deliveryFor returns how the user wants notifications of this type delivered
+func (r *Repository) deliveryFor(userID uint, notificationType string) string {
+	preference := models.NotificationPreference{}
+	err := r.DB.Where("user_id = ? AND type = ?", userID, notificationType).First(&preference).Error
+	if err != nil {
+		return defaultDeliveries[notificationType]
+	}
+	return preference.Delivery
+}
+
+// preferencesFor returns the effective delivery of every notification type
+func (r *Repository) preferencesFor(userID uint) map[string]string {
+	preferences := map[string]string{}
+	for notificationType, delivery := range defaultDeliveries {
+		preferences[notificationType] = delivery
+	}
+	stored := []models.NotificationPreference{}
+	r.DB.Where("user_id = ?", userID).Find(&stored)
+	for _, preference := range stored {
+		preferences[preference.Type] = preference.Delivery
+	}
+	return preferences
+}
+
+func (r *Repository) GetNotificationPreferences(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"data": r.preferencesFor(currentUserID(c))})
+}
+
+// UpdateNotificationPreferences takes a map of notification type to delivery,
+// e.g. {"mention": "email", "followed_activity": "weekly"}
+func (r *Repository) UpdateNotificationPreferences(c *gin.Context) {
+	updates := map[string]string{}
+	if err := c.ShouldBindJSON(&updates); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Request failed"})
+		return
+	}
+
+	userID := currentUserID(c)
+	preferences := []models.NotificationPreference{}
+	for notificationType, delivery := range updates {
+		if _, ok := defaultDeliveries[notificationType]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Unknown notification type %s", notificationType)})
+			return
+		}
+		if !isValidDelivery(notificationType, delivery) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Delivery %s is not available for %s", delivery, notificationType)})
+			return
+		}
+		preferences = append(preferences, models.NotificationPreference{UserID: userID, Type: notificationType, Delivery: delivery})
+	}
+
+	if len(preferences) > 0 {
+		err := r.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(&preferences).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not save preferences"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Preferences saved successfully", "data": r.preferencesFor(userID)})
+}
+
+// Follows
+
+func (r *Repository) GetFollows(c *gin.Context) {
+	follows := []models.Follow{}
+	if err := r.DB.Where("user_id = ?", currentUserID(c)).Order("created_at DESC").Find(&follows).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get follows"})
+		return
+	}
+	c.JSON(http.StatusOK, follows)
+}
+
+// CreateFollow follows a thread or a category: {"thread_id": 1} or {"category_id": 2}
+func (r *Repository) CreateFollow(c *gin.Context) {
+	follow := models.Follow{}
+	if err := c.ShouldBindJSON(&follow); err != nil || (follow.ThreadID == nil) == (follow.CategoryID == nil) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Provide either thread_id or category_id"})
+		return
+	}
+	follow.ID = 0
+	follow.UserID = currentUserID(c)
+
+	categoryID := uint(0)
+	if follow.ThreadID != nil {
+		thread := models.Thread{}
+		if err := r.DB.First(&thread, *follow.ThreadID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"message": "Thread not found"})
+			return
+		}
+		categoryID = thread.CategoryID
+	} else {
+		if err := r.DB.First(&models.Category{}, *follow.CategoryID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"message": "Category not found"})
+			return
+		}
+		categoryID = *follow.CategoryID
+	}
+	if !r.canAccessCategory(follow.UserID, categoryID, "can_view") {
+		c.JSON(http.StatusForbidden, gin.H{"message": "You cannot follow this"})
+		return
+	}
+
+	existing := r.DB.Where("user_id = ?", follow.UserID)
+	if follow.ThreadID != nil {
+		existing = existing.Where("thread_id = ?", *follow.ThreadID)
+	} else {
+		existing = existing.Where("category_id = ?", *follow.CategoryID)
+	}
+	if err := existing.First(&models.Follow{}).Error; err == nil {
+		c.JSON(http.StatusConflict, gin.H{"message": "Already following"})
+		return
+	}
+
+	if err := r.DB.Create(&follow).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not follow"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Followed successfully", "data": follow})
+}
+
+func (r *Repository) DeleteFollow(c *gin.Context) {
+	result := r.DB.Where("id = ? AND user_id = ?", c.Param("id"), currentUserID(c)).Delete(&models.Follow{})
+	if result.Error != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not unfollow"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Follow not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Unfollowed successfully"})
+}
+
+// Unsubscribe links
+
+// unsubscribeToken signs a user ID and scope so unsubscribe links work
+// without logging in. The scope is a notification type or a digest frequency.
+func unsubscribeToken(userID uint, scope string) string {
+	payload := fmt.Sprintf("%d:%s", userID, scope)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + signPayload(payload)
+}
+
+// signPayload returns a URL-safe HMAC of payload keyed with the server secret
+func signPayload(payload string) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func parseUnsubscribeToken(token string) (uint, string, bool) {
+	encoded, signature, found := strings.Cut(token, ".")
+	if !found {
+		return 0, "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return 0, "", false
+	}
+	if !hmac.Equal([]byte(signature), []byte(signPayload(string(payload)))) {
+		return 0, "", false
+	}
+
+	rawID, scope, found := strings.Cut(string(payload), ":")
+	userID, err := strconv.ParseUint(rawID, 10, 64)
+	if !found || err != nil {
+		return 0, "", false
+	}
+	return uint(userID), scope, true
+}
+
+func unsubscribeURL(userID uint, scope string) string {
+	return apiURL() + "/api/unsubscribe?token=" + unsubscribeToken(userID, scope)
+}
+
+// apiURL is the public base URL of this server, used in emails and download links
+func apiURL() string {
+	if url := os.Getenv("API_URL"); url != "" {
+		return strings.TrimRight(url, "/")
+	}
+	return "http://localhost:8080"
+}
+
+// appURL is the public base URL of the client, used in emails
+func appURL() string {
+	if url := os.Getenv("APP_URL"); url != "" {
+		return strings.TrimRight(url, "/")
+	}
+	return "http://localhost:3000"
+}
+
+// UnsubscribePage is where unsubscribe links from emails land. It only asks
+// for confirmation, since mail scanners and link previews follow links too.
+func (r *Repository) UnsubscribePage(c *gin.Context) {
+	userID, scope, ok := parseUnsubscribeToken(c.Query("token"))
+	if !ok {
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8", []byte("<p>This unsubscribe link is not valid.</p>"))
+		return
+	}
+	page := fmt.Sprintf(`<form method="post" action="%s">
+<p>Stop these emails? You can change this any time in your notification settings.</p>
+<button type="submit">Unsubscribe</button>
+</form>`, html.EscapeString(unsubscribeURL(userID, scope)))
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(page))
+}
+
+// Unsubscribe applies an unsubscribe link, either confirmed on UnsubscribePage
+// or posted by a mail client's one-click unsubscribe (RFC 8058). A digest scope
+// moves everything delivered in that digest back to the inbox (followed
+// activity is switched off); a notification type scope stops emails for that type.
+func (r *Repository) Unsubscribe(c *gin.Context) {
+	userID, scope, ok := parseUnsubscribeToken(c.Query("token"))
+	if !ok {
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8", []byte("<p>This unsubscribe link is not valid.</p>"))
+		return
+	}
+
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		for notificationType, delivery := range r.preferencesFor(userID) {
+			unsubscribe := notificationType == scope
+			if scope == models.DeliveryDaily || scope == models.DeliveryWeekly {
+				unsubscribe = delivery == scope
+			}
+			if !unsubscribe || delivery == models.DeliveryOff || delivery == models.DeliveryInApp {
+				continue
+			}
+
+			replacement := models.DeliveryInApp
+			if notificationType == models.NotifyFollowedActivity {
+				replacement = models.DeliveryOff
+			}
+			preference := models.NotificationPreference{UserID: userID, Type: notificationType, Delivery: replacement}
+			if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&preference).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.Data(http.StatusInternalServerError, "text/html; charset=utf-8", []byte("<p>Something went wrong, please try again.</p>"))
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte("<p>You have been unsubscribed. You can change this any time in your notification settings.</p>"))
+}
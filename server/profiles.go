@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+)
+
+// PublicProfile is what anyone may see about a user. It never carries the
+// email address or password hash.
+type PublicProfile struct {
+	ID          uint       `json:"id"`
+	Username    string     `json:"username"`
+	DisplayName string     `json:"display_name"`
+	Bio         string     `json:"bio"`
+	Location    string     `json:"location"`
+	Website     string     `json:"website"`
+	Pronouns    string     `json:"pronouns"`
+	Role        string     `json:"role"`
+	AvatarID    *uint      `json:"avatar_id"`
+	AvatarURL   string     `json:"avatar_url"`
+	Reputation  int        `json:"reputation"`
+	TrustLevel  int        `json:"trust_level"`
+	JoinedAt    *time.Time `json:"joined_at"` // null when unknown
+}
+
+// PrivateProfile is the owner's own view of their account
+type PrivateProfile struct {
+	PublicProfile
+	Email      string   `json:"email"`
+	Privileges []string `json:"privileges"` // unlocked by reputation
+}
+
+// profileLimits caps the length in characters of each free-text profile field
+var profileLimits = map[string]int{
+	"display_name": 50,
+	"bio":          500,
+	"location":     100,
+	"website":      200,
+	"pronouns":     30,
+}
+
+// publicProfiles builds the public profile of each user, loading profiles and
+// avatars in bulk
+func (r *Repository) publicProfiles(users []models.User) []PublicProfile {
+	userIDs := make([]uint, 0, len(users))
+	avatarIDs := []uint{}
+	for _, user := range users {
+		userIDs = append(userIDs, user.ID)
+		if user.AvatarID != nil {
+			avatarIDs = append(avatarIDs, *user.AvatarID)
+		}
+	}
+
+	profiles := []models.Profile{}
+	byUser := map[uint]models.Profile{}
+	if len(userIDs) > 0 {
+		r.DB.Where("user_id IN ?", userIDs).Find(&profiles)
+	}
+	for _, profile := range profiles {
+		byUser[profile.UserID] = profile
+	}
+
+	avatars := []models.Attachment{}
+	avatarURLs := map[uint]string{}
+	if len(avatarIDs) > 0 {
+		r.DB.Preload("Variants").Where("id IN ? AND status = ?", avatarIDs, models.AttachmentReady).Find(&avatars)
+	}
+	for _, avatar := range avatars {
+		for _, variant := range avatar.Variants {
+			if variant.Name == "medium" && variant.Format == "webp" {
+				avatarURLs[avatar.ID] = variantURL(avatar.ID, variant)
+			}
+		}
+	}
+
+	result := make([]PublicProfile, 0, len(users))
+	for _, user := range users {
+		profile := byUser[user.ID]
+		public := PublicProfile{
+			ID:          user.ID,
+			Username:    user.Username,
+			DisplayName: profile.DisplayName,
+			Bio:         profile.Bio,
+			Location:    profile.Location,
+			Website:     profile.Website,
+			Pronouns:    profile.Pronouns,
+			Role:        user.Role,
+			AvatarID:    user.AvatarID,
+			Reputation:  user.Reputation,
+			TrustLevel:  user.TrustLevel,
+			JoinedAt:    user.CreatedAt,
+		}
+		if user.AvatarID != nil {
+			public.AvatarURL = avatarURLs[*user.AvatarID]
+		}
+		if public.DisplayName == "" {
+			public.DisplayName = user.Username
+		}
+		result = append(result, public)
+	}
+	return result
+}
+
+func (r *Repository) publicProfile(user models.User) PublicProfile {
+	return r.publicProfiles([]models.User{user})[0]
+}
+
+func (r *Repository) privateProfile(user models.User) PrivateProfile {
+	return PrivateProfile{
+		PublicProfile: r.publicProfile(user),
+		Email:         user.Email,
+		Privileges:    privilegesOf(user.Reputation),
+	}
+}
+
+// GetMe returns the current user's own profile, including private fields
+func (r *Repository) GetMe(c *gin.Context) {
+	user := models.User{}
+	if err := r.DB.First(&user, currentUserID(c)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+	c.JSON(http.StatusOK, r.privateProfile(user))
+}
+
+// GetProfileByUsername looks a public profile up by username, e.g. to resolve
+// an @mention
+func (r *Repository) GetProfileByUsername(c *gin.Context) {
+	user := models.User{}
+	if err := r.DB.Where("LOWER(username) = ?", strings.ToLower(c.Param("username"))).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+	c.JSON(http.StatusOK, r.publicProfile(user))
+}
+
+// UpdateMyProfile updates the current user's profile. Omitted fields are left
+// unchanged; send an empty string to clear one.
+func (r *Repository) UpdateMyProfile(c *gin.Context) {
+	var updateRequest struct {
+		DisplayName *string `json:"display_name"`
+		Bio         *string `json:"bio"`
+		Location    *string `json:"location"`
+		Website     *string `json:"website"`
+		Pronouns    *string `json:"pronouns"`
+	}
+	if err := c.ShouldBindJSON(&updateRequest); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Invalid request"})
+		return
+	}
+
+	userID := currentUserID(c)
+	user := models.User{}
+	if err := r.DB.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+	profile := models.Profile{UserID: userID}
+	r.DB.Where("user_id = ?", userID).First(&profile)
+
+	fields := map[string]struct {
+		value  *string
+		target *string
+	}{
+		"display_name": {updateRequest.DisplayName, &profile.DisplayName},
+		"bio":          {updateRequest.Bio, &profile.Bio},
+		"location":     {updateRequest.Location, &profile.Location},
+		"website":      {updateRequest.Website, &profile.Website},
+		"pronouns":     {updateRequest.Pronouns, &profile.Pronouns},
+	}
+	for name, field := range fields {
+		if field.value == nil {
+			continue
+		}
+		value := strings.TrimSpace(*field.value)
+		if utf8.RuneCountInString(value) > profileLimits[name] {
+			c.JSON(http.StatusBadRequest, gin.H{"message": name + " is too long"})
+			return
+		}
+		*field.target = value
+	}
+	if profile.Website != "" && !isValidWebsite(profile.Website) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Website must be an http or https URL"})
+		return
+	}
+
+	if err := r.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(&profile).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to update profile"})
+		return
+	}
+	c.JSON(http.StatusOK, r.privateProfile(user))
+}
+
+func isValidWebsite(website string) bool {
+	parsed, err := url.Parse(website)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
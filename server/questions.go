@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/damiancxliew/web-forum/events"
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// qaCategoryIDs lists the categories whose threads are questions
+func (r *Repository) qaCategoryIDs() []uint {
+	var ids []uint
+	r.DB.Model(&models.Category{}).Where("qa = ?", true).Pluck("id", &ids)
+	return ids
+}
+
+func (r *Repository) isQACategory(categoryID uint) bool {
+	category := models.Category{}
+	return r.DB.Select("qa").First(&category, categoryID).Error == nil && category.QA
+}
+
+// liveAnswers is the subquery of comments that can stand as accepted answers:
+// those neither deleted nor hidden
+func liveAnswers(db *gorm.DB) *gorm.DB {
+	return db.Model(&models.Comment{}).Select("id").Where("hidden = ?", false)
+}
+
+// unacceptAnswers clears the accepted answer of questions whose answer is
+// among commentIDs, a list or subquery, when those are trashed or hidden.
+// Trashed threads keep theirs to come back with them when restored.
+func unacceptAnswers(tx *gorm.DB, commentIDs interface{}) error {
+	return tx.Model(&models.Thread{}).Where("accepted_comment_id IN (?)", commentIDs).
+		Update("accepted_comment_id", nil).Error
+}
+
+// attachQuestionState marks which threads are questions and which are solved.
+// Only a live answer solves a question.
+func (r *Repository) attachQuestionState(threads []models.Thread) {
+	qa := map[uint]bool{}
+	for _, id := range r.qaCategoryIDs() {
+		qa[id] = true
+	}
+	acceptedIDs := []uint{}
+	for _, thread := range threads {
+		if thread.AcceptedCommentID != nil {
+			acceptedIDs = append(acceptedIDs, *thread.AcceptedCommentID)
+		}
+	}
+	live := map[uint]bool{}
+	if len(acceptedIDs) > 0 {
+		var liveIDs []uint
+		liveAnswers(r.DB).Where("id IN ?", acceptedIDs).Pluck("id", &liveIDs)
+		for _, id := range liveIDs {
+			live[id] = true
+		}
+	}
+	for i := range threads {
+		threads[i].Question = qa[threads[i].CategoryID]
+		threads[i].Solved = threads[i].Question && threads[i].AcceptedCommentID != nil && live[*threads[i].AcceptedCommentID]
+	}
+}
+
+// acceptedFirst moves a thread's accepted answer to the front of its comments,
+// unless it was deleted or hidden
+func acceptedFirst(comments []models.Comment, acceptedID *uint) []models.Comment {
+	if acceptedID == nil {
+		return comments
+	}
+	for i, comment := range comments {
+		if comment.ID != *acceptedID {
+			continue
+		}
+		if comment.DeletedAt.Valid || comment.Hidden {
+			return comments
+		}
+		comment.Accepted = true
+		ordered := append([]models.Comment{comment}, comments[:i]...)
+		return append(ordered, comments[i+1:]...)
+	}
+	return comments
+}
+
+// loadQuestion finds the thread named by the :id param and checks it is a
+// question the current user may settle: its author or a moderator
+func (r *Repository) loadQuestion(c *gin.Context) (models.Thread, bool) {
+	thread := models.Thread{}
+	if err := r.DB.First(&thread, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Thread not found"})
+		return thread, false
+	}
+	category := models.Category{}
+	if err := r.DB.First(&category, thread.CategoryID).Error; err != nil || !category.QA {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Only threads in Q&A categories have accepted answers"})
+		return thread, false
+	}
+	userID := currentUserID(c)
+	if thread.UserID != userID && !r.hasRole(userID, models.RoleAdmin, models.RoleModerator) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "Only the thread's author or a moderator can accept an answer"})
+		return thread, false
+	}
+	if thread.Archived {
+		c.JSON(http.StatusForbidden, gin.H{"message": "This thread is archived"})
+		return thread, false
+	}
+	return thread, true
+}
+
+// AcceptAnswer marks one comment as the answer to a question, replacing any
+// earlier choice: {"comment_id": 1}
+func (r *Repository) AcceptAnswer(c *gin.Context) {
+	thread, ok := r.loadQuestion(c)
+	if !ok {
+		return
+	}
+	var acceptRequest struct {
+		CommentID uint `json:"comment_id"`
+	}
+	if err := c.ShouldBindJSON(&acceptRequest); err != nil || acceptRequest.CommentID == 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Provide the comment_id to accept"})
+		return
+	}
+	comment := models.Comment{}
+	if err := r.DB.First(&comment, acceptRequest.CommentID).Error; err != nil || comment.ThreadID != thread.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Comment not found in this thread"})
+		return
+	}
+	if comment.Hidden {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Hidden comments cannot be accepted until they are reviewed"})
+		return
+	}
+
+	if err := r.DB.Model(&thread).Update("accepted_comment_id", comment.ID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not accept answer"})
+		return
+	}
+	thread.AcceptedCommentID = &comment.ID
+
+	r.Events.Publish(events.Event{
+		Type:       events.AnswerAccepted,
+		ThreadID:   thread.ID,
+		CommentID:  comment.ID,
+		CategoryID: thread.CategoryID,
+		UserID:     currentUserID(c),
+		AuthorID:   comment.UserID,
+	})
+	threads := []models.Thread{thread}
+	r.attachQuestionState(threads)
+	c.JSON(http.StatusOK, gin.H{"message": "Answer accepted successfully", "data": threads[0]})
+}
+
+// UnacceptAnswer marks a question unsolved again
+func (r *Repository) UnacceptAnswer(c *gin.Context) {
+	thread, ok := r.loadQuestion(c)
+	if !ok {
+		return
+	}
+	if thread.AcceptedCommentID == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "This question has no accepted answer"})
+		return
+	}
+	if err := r.DB.Model(&thread).Update("accepted_comment_id", nil).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not unaccept answer"})
+		return
+	}
+	thread.AcceptedCommentID = nil
+
+	r.Events.Publish(events.Event{
+		Type:       events.AnswerUnaccepted,
+		ThreadID:   thread.ID,
+		CategoryID: thread.CategoryID,
+		UserID:     currentUserID(c),
+		AuthorID:   thread.UserID,
+	})
+	threads := []models.Thread{thread}
+	r.attachQuestionState(threads)
+	c.JSON(http.StatusOK, gin.H{"message": "Answer unaccepted successfully", "data": threads[0]})
+}
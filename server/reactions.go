@@ -0,0 +1,424 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/damiancxliew/web-forum/events"
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// defaultReactionTypes is the emoji set offered when REACTION_TYPES is unset.
+// Clients map each name to its emoji.
+var defaultReactionTypes = []string{"like", "love", "laugh", "hooray", "confused", "eyes"}
+
+// reactionTypes returns the configured emoji reactions; REACTION_TYPES takes a
+// comma separated list of names
+func reactionTypes() []string {
+	types := []string{}
+	for _, name := range strings.Split(os.Getenv("REACTION_TYPES"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" && !isVote(name) {
+			types = append(types, name)
+		}
+	}
+	if len(types) == 0 {
+		return defaultReactionTypes
+	}
+	return types
+}
+
+func isVote(reactionType string) bool {
+	return reactionType == models.ReactionUpvote || reactionType == models.ReactionDownvote
+}
+
+func isValidReaction(reactionType string) bool {
+	if isVote(reactionType) {
+		return true
+	}
+	for _, name := range reactionTypes() {
+		if name == reactionType {
+			return true
+		}
+	}
+	return false
+}
+
+// allowSelfVote reports whether users may vote on their own posts; set
+// ALLOW_SELF_VOTE=true to allow it. Emoji reactions are always allowed.
+func allowSelfVote() bool {
+	allowed, _ := strconv.ParseBool(os.Getenv("ALLOW_SELF_VOTE"))
+	return allowed
+}
+
+// scoreDelta is how much a reaction of this type adds to a post's score
+func scoreDelta(reactionType string) int {
+	switch reactionType {
+	case models.ReactionUpvote:
+		return 1
+	case models.ReactionDownvote:
+		return -1
+	}
+	return 0
+}
+
+// oppositeVote returns the vote a new vote replaces
+func oppositeVote(reactionType string) string {
+	if reactionType == models.ReactionUpvote {
+		return models.ReactionDownvote
+	}
+	return models.ReactionUpvote
+}
+
+// reactionTarget is the thread or comment a reaction is about
+type reactionTarget struct {
+	Type       string
+	ID         uint
+	ThreadID   uint
+	CategoryID uint
+	AuthorID   uint
+}
+
+// table is where the target and its score live
+func (target reactionTarget) table() string {
+	if target.Type == models.TargetComment {
+		return "comments"
+	}
+	return "threads"
+}
+
+// loadReactionTarget finds the post named by the :id param and checks the
+// current user may see it
+func (r *Repository) loadReactionTarget(c *gin.Context, targetType string) (reactionTarget, bool) {
+	target := reactionTarget{Type: targetType}
+	if targetType == models.TargetComment {
+		comment := models.Comment{}
+		if err := r.DB.First(&comment, c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"message": "Comment not found"})
+			return target, false
+		}
+		target.ID, target.ThreadID, target.AuthorID = comment.ID, comment.ThreadID, comment.UserID
+		target.CategoryID = r.threadCategoryID(comment.ThreadID)
+	} else {
+		thread := models.Thread{}
+		if err := r.DB.First(&thread, c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"message": "Thread not found"})
+			return target, false
+		}
+		target.ID, target.ThreadID, target.AuthorID = thread.ID, thread.ID, thread.UserID
+		target.CategoryID = thread.CategoryID
+	}
+
+	if !r.canAccessCategory(currentUserID(c), target.CategoryID, "can_view") {
+		c.JSON(http.StatusForbidden, gin.H{"message": "You cannot view this " + targetType})
+		return target, false
+	}
+	return target, true
+}
+
+// adjustReactionCount moves the denormalized counter of one reaction type on
+// a post, dropping counters that reach zero
+func adjustReactionCount(tx *gorm.DB, target reactionTarget, reactionType string, delta int) error {
+	count := models.ReactionCount{TargetType: target.Type, TargetID: target.ID, Type: reactionType, Count: delta}
+	err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "target_type"}, {Name: "target_id"}, {Name: "type"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"count": gorm.Expr("reaction_counts.count + ?", delta)}),
+	}).Create(&count).Error
+	if err != nil {
+		return err
+	}
+	return tx.Where("target_type = ? AND target_id = ? AND type = ? AND count <= 0", target.Type, target.ID, reactionType).
+		Delete(&models.ReactionCount{}).Error
+}
+
+// adjustScore moves a post's score. It is called after the post row has been
+// locked, so concurrent votes on the same post apply one at a time.
+func adjustScore(tx *gorm.DB, target reactionTarget, delta int) error {
+	if delta == 0 {
+		return nil
+	}
+	return tx.Table(target.table()).Where("id = ?", target.ID).Update("score", gorm.Expr("score + ?", delta)).Error
+}
+
+// lockTarget locks the post row for the rest of the transaction
+func lockTarget(tx *gorm.DB, target reactionTarget) error {
+	var id uint
+	return tx.Table(target.table()).Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ?", target.ID).Select("id").Scan(&id).Error
+}
+
+// reactionSummaries returns the reaction counts of each post and which types
+// userID has used on it
+func (r *Repository) reactionSummaries(targetType string, ids []uint, userID uint) (map[uint]map[string]int, map[uint][]string) {
+	counts := map[uint]map[string]int{}
+	mine := map[uint][]string{}
+	if len(ids) == 0 {
+		return counts, mine
+	}
+
+	rows := []models.ReactionCount{}
+	r.DB.Where("target_type = ? AND target_id IN ?", targetType, ids).Find(&rows)
+	for _, row := range rows {
+		if counts[row.TargetID] == nil {
+			counts[row.TargetID] = map[string]int{}
+		}
+		counts[row.TargetID][row.Type] = row.Count
+	}
+
+	if userID != 0 {
+		reactions := []models.Reaction{}
+		r.DB.Where("user_id = ? AND target_type = ? AND target_id IN ?", userID, targetType, ids).Order("id").Find(&reactions)
+		for _, reaction := range reactions {
+			mine[reaction.TargetID] = append(mine[reaction.TargetID], reaction.Type)
+		}
+	}
+	return counts, mine
+}
+
+// attachThreadReactions fills in the reaction counts of each thread
+func (r *Repository) attachThreadReactions(threads []models.Thread, userID uint) {
+	ids := make([]uint, len(threads))
+	for i, thread := range threads {
+		ids[i] = thread.ID
+	}
+	counts, mine := r.reactionSummaries(models.TargetThread, ids, userID)
+	for i := range threads {
+		threads[i].Reactions = counts[threads[i].ID]
+		if threads[i].Reactions == nil {
+			threads[i].Reactions = map[string]int{}
+		}
+		threads[i].MyReactions = mine[threads[i].ID]
+		if threads[i].MyReactions == nil {
+			threads[i].MyReactions = []string{}
+		}
+	}
+}
+
+// attachCommentReactions fills in the reaction counts of each comment
+func (r *Repository) attachCommentReactions(comments []models.Comment, userID uint) {
+	ids := make([]uint, len(comments))
+	for i, comment := range comments {
+		ids[i] = comment.ID
+	}
+	counts, mine := r.reactionSummaries(models.TargetComment, ids, userID)
+	for i := range comments {
+		comments[i].Reactions = counts[comments[i].ID]
+		if comments[i].Reactions == nil {
+			comments[i].Reactions = map[string]int{}
+		}
+		comments[i].MyReactions = mine[comments[i].ID]
+		if comments[i].MyReactions == nil {
+			comments[i].MyReactions = []string{}
+		}
+	}
+}
+
+// deleteReactions removes every reaction on the given posts along with their counters
+func deleteReactions(tx *gorm.DB, targetType string, targetIDs []uint) error {
+	if err := tx.Where("target_type = ? AND target_id IN ?", targetType, targetIDs).Delete(&models.Reaction{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("target_type = ? AND target_id IN ?", targetType, targetIDs).Delete(&models.ReactionCount{}).Error
+}
+
+// reactionState is returned after a change so clients can update in place
+func (r *Repository) reactionState(target reactionTarget, userID uint) gin.H {
+	counts, mine := r.reactionSummaries(target.Type, []uint{target.ID}, userID)
+	var score int
+	r.DB.Table(target.table()).Where("id = ?", target.ID).Select("score").Scan(&score)
+	state := gin.H{"reactions": counts[target.ID], "my_reactions": mine[target.ID], "score": score}
+	if counts[target.ID] == nil {
+		state["reactions"] = map[string]int{}
+	}
+	if mine[target.ID] == nil {
+		state["my_reactions"] = []string{}
+	}
+	return state
+}
+
+func (r *Repository) publishReaction(eventType string, target reactionTarget, userID uint, reactionType string) {
+	event := events.Event{
+		Type:       eventType,
+		ThreadID:   target.ThreadID,
+		CategoryID: target.CategoryID,
+		UserID:     userID,
+		AuthorID:   target.AuthorID,
+		Detail:     reactionType,
+	}
+	if target.Type == models.TargetComment {
+		event.CommentID = target.ID
+	}
+	r.Events.Publish(event)
+}
+
+// GetReactionTypes lists the reactions clients should offer
+func (r *Repository) GetReactionTypes(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"reactions":       reactionTypes(),
+		"votes":           []string{models.ReactionUpvote, models.ReactionDownvote},
+		"allow_self_vote": allowSelfVote(),
+	})
+}
+
+// AddReaction adds the current user's reaction of the :type param to a
+// thread or comment. Adding a reaction twice is a no-op, and a vote replaces
+// the user's opposite vote.
+func (r *Repository) AddReaction(targetType string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		reactionType := c.Param("type")
+		if !isValidReaction(reactionType) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Unknown reaction " + reactionType})
+			return
+		}
+		target, ok := r.loadReactionTarget(c, targetType)
+		if !ok {
+			return
+		}
+		if r.isArchived(target.ThreadID) {
+			c.JSON(http.StatusForbidden, gin.H{"message": "This thread is archived"})
+			return
+		}
+		userID := currentUserID(c)
+		if isVote(reactionType) && target.AuthorID == userID && !allowSelfVote() {
+			c.JSON(http.StatusForbidden, gin.H{"message": "You cannot vote on your own " + targetType})
+			return
+		}
+
+		added := false
+		err := r.DB.Transaction(func(tx *gorm.DB) error {
+			if err := lockTarget(tx, target); err != nil {
+				return err
+			}
+			reaction := models.Reaction{UserID: userID, TargetType: target.Type, TargetID: target.ID, Type: reactionType}
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&reaction)
+			if result.Error != nil || result.RowsAffected == 0 {
+				return result.Error
+			}
+			added = true
+			if err := adjustReactionCount(tx, target, reactionType, 1); err != nil {
+				return err
+			}
+			delta := scoreDelta(reactionType)
+
+			if isVote(reactionType) {
+				opposite := oppositeVote(reactionType)
+				removed := tx.Where("user_id = ? AND target_type = ? AND target_id = ? AND type = ?", userID, target.Type, target.ID, opposite).
+					Delete(&models.Reaction{})
+				if removed.Error != nil {
+					return removed.Error
+				}
+				if removed.RowsAffected > 0 {
+					if err := adjustReactionCount(tx, target, opposite, -1); err != nil {
+						return err
+					}
+					delta -= scoreDelta(opposite)
+				}
+			}
+			return adjustScore(tx, target, delta)
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not add reaction"})
+			return
+		}
+
+		if added {
+			r.publishReaction(events.ReactionAdded, target, userID, reactionType)
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Reaction added successfully", "data": r.reactionState(target, userID)})
+	}
+}
+
+// RemoveReaction takes back the current user's reaction of the :type param
+func (r *Repository) RemoveReaction(targetType string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		reactionType := c.Param("type")
+		target, ok := r.loadReactionTarget(c, targetType)
+		if !ok {
+			return
+		}
+		if r.isArchived(target.ThreadID) {
+			c.JSON(http.StatusForbidden, gin.H{"message": "This thread is archived"})
+			return
+		}
+		userID := currentUserID(c)
+
+		removed := false
+		err := r.DB.Transaction(func(tx *gorm.DB) error {
+			if err := lockTarget(tx, target); err != nil {
+				return err
+			}
+			result := tx.Where("user_id = ? AND target_type = ? AND target_id = ? AND type = ?", userID, target.Type, target.ID, reactionType).
+				Delete(&models.Reaction{})
+			if result.Error != nil || result.RowsAffected == 0 {
+				return result.Error
+			}
+			removed = true
+			if err := adjustReactionCount(tx, target, reactionType, -1); err != nil {
+				return err
+			}
+			return adjustScore(tx, target, -scoreDelta(reactionType))
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not remove reaction"})
+			return
+		}
+		if !removed {
+			c.JSON(http.StatusNotFound, gin.H{"message": "Reaction not found"})
+			return
+		}
+
+		r.publishReaction(events.ReactionRemoved, target, userID, reactionType)
+		c.JSON(http.StatusOK, gin.H{"message": "Reaction removed successfully", "data": r.reactionState(target, userID)})
+	}
+}
+
+// reactor is one entry in the list of who reacted to a post
+type reactor struct {
+	UserID    uint      `json:"user_id"`
+	Username  string    `json:"username"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GetReactions lists who reacted to a thread or comment, newest first,
+// optionally filtered with ?type=
+func (r *Repository) GetReactions(targetType string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		target, ok := r.loadReactionTarget(c, targetType)
+		if !ok {
+			return
+		}
+		page, pageSize := pagination(c)
+
+		query := r.DB.Table("reactions").
+			Joins("JOIN users ON users.id = reactions.user_id").
+			Where("reactions.target_type = ? AND reactions.target_id = ?", target.Type, target.ID)
+		if reactionType := c.Query("type"); reactionType != "" {
+			query = query.Where("reactions.type = ?", reactionType)
+		}
+		// Reuse the same conditions for the count and the page
+		query = query.Session(&gorm.Session{})
+
+		var total int64
+		if err := query.Count(&total).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get reactions"})
+			return
+		}
+		reactors := []reactor{}
+		err := query.Select("reactions.user_id, users.username, reactions.type, reactions.created_at").
+			Order("reactions.created_at DESC").
+			Offset((page - 1) * pageSize).Limit(pageSize).
+			Scan(&reactors).Error
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get reactions"})
+			return
+		}
+		c.JSON(http.StatusOK, paginated(reactors, page, pageSize, total))
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/damiancxliew/web-forum/events"
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/damiancxliew/web-forum/realtime"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// Browsers always send an Origin; other clients authenticate with the token alone
+	CheckOrigin: func(req *http.Request) bool {
+		origin := req.Header.Get("Origin")
+		return origin == "" || isOriginAllowed(origin)
+	},
+}
+
+// ServeWebSocket upgrades the request to a WebSocket streaming forum events.
+// Browsers cannot set headers on WebSocket requests, so the JWT may also be
+// passed as the token query param.
+func (r *Repository) ServeWebSocket(c *gin.Context) {
+	if token := c.Query("token"); token != "" && c.GetHeader("Authorization") == "" {
+		c.Request.Header.Set("Authorization", "Bearer "+token)
+	}
+	claims, err := parseToken(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Invalid token"})
+		return
+	}
+	setClaims(c, claims)
+	if !r.checkAccount(c) {
+		return
+	}
+	userID := currentUserID(c)
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Println("WebSocket upgrade error:", err)
+		return
+	}
+	r.Hub.Serve(conn, userID, r.channelAuthorizer(userID))
+}
+
+// dispatchRealtime passes events on to connected clients, then disconnects
+// users who were just deleted or banned so they stop receiving events with a
+// session they could no longer open
+func (r *Repository) dispatchRealtime(event events.Event) {
+	r.Hub.Dispatch(event)
+	switch event.Type {
+	case events.UserDeleted:
+		r.Hub.Disconnect(event.AuthorID)
+	case events.UserSanctioned:
+		if _, found := r.activeSanction(event.AuthorID, loginSanctions...); found {
+			r.Hub.Disconnect(event.AuthorID)
+		}
+	}
+}
+
+// channelAuthorizer only allows subscriptions to threads and categories the
+// user can view, and to their own notifications
+func (r *Repository) channelAuthorizer(userID uint) realtime.Authorizer {
+	return func(channel string) bool {
+		kind, rawID, found := strings.Cut(channel, ":")
+		if !found {
+			return false
+		}
+		id, err := strconv.ParseUint(rawID, 10, 64)
+		if err != nil {
+			return false
+		}
+
+		switch kind {
+		case "thread":
+			thread := models.Thread{}
+			if err := r.DB.First(&thread, id).Error; err != nil {
+				return false
+			}
+			return r.canAccessCategory(userID, thread.CategoryID, "can_view")
+		case "category":
+			return r.canAccessCategory(userID, uint(id), "can_view")
+		case "user":
+			return uint(id) == userID
+		}
+		return false
+	}
+}
+
+// newBroker picks how events reach other replicas from PUBSUB_BACKEND:
+// "local" (the default) for a single node or "postgres" for LISTEN/NOTIFY
+func newBroker(db *gorm.DB, dsn string) (events.Broker, error) {
+	switch backend := os.Getenv("PUBSUB_BACKEND"); backend {
+	case "", "local":
+		return events.NewLocalBroker(), nil
+	case "postgres":
+		return events.NewPostgresBroker(db, dsn), nil
+	default:
+		return nil, fmt.Errorf("unknown PUBSUB_BACKEND %q", backend)
+	}
+}
@@ -0,0 +1,157 @@
+package realtime
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	writeWait      = 10 * time.Second
+	pongWait       = 60 * time.Second
+	pingPeriod     = pongWait * 9 / 10
+	maxMessageSize = 1024
+	sendBuffer     = 64
+)
+
+// Client is a single WebSocket connection
+type Client struct {
+	hub       *Hub
+	conn      *websocket.Conn
+	userID    uint
+	authorize Authorizer
+	send      chan []byte
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// clientRequest is what clients send: {"action": "subscribe", "channel": "thread:12"}
+type clientRequest struct {
+	Action  string `json:"action"`
+	Channel string `json:"channel"`
+}
+
+// Serve runs the connection until the client disconnects
+func (h *Hub) Serve(conn *websocket.Conn, userID uint, authorize Authorizer) {
+	client := &Client{
+		hub:       h,
+		conn:      conn,
+		userID:    userID,
+		authorize: authorize,
+		send:      make(chan []byte, sendBuffer),
+	}
+	h.Connect(client, userID)
+	go client.writePump()
+	client.readPump()
+}
+
+// Deliver queues a message without blocking; a client that cannot keep up is disconnected
+func (c *Client) Deliver(message Message) {
+	payload := encode(message)
+	if payload == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.send <- payload:
+	default:
+		c.closeLocked()
+	}
+}
+
+// Close disconnects the client once the messages already queued are sent
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked()
+}
+
+func (c *Client) closeLocked() {
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+}
+
+func (c *Client) readPump() {
+	defer func() {
+		c.hub.Remove(c)
+		c.Close()
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, payload, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var request clientRequest
+		if err := json.Unmarshal(payload, &request); err != nil {
+			c.Deliver(Message{Type: "error", Message: "invalid message"})
+			continue
+		}
+
+		channel := strings.TrimSpace(request.Channel)
+		if channel == NotificationsChannel {
+			channel = UserChannel(c.userID)
+		}
+
+		switch request.Action {
+		case "subscribe":
+			if !c.authorize(channel) {
+				c.Deliver(Message{Type: "error", Channel: request.Channel, Message: "cannot subscribe to this channel"})
+				continue
+			}
+			c.hub.Subscribe(c, channel)
+			c.Deliver(Message{Type: "subscribed", Channel: request.Channel})
+		case "unsubscribe":
+			c.hub.Unsubscribe(c, channel)
+			c.Deliver(Message{Type: "unsubscribed", Channel: request.Channel})
+		default:
+			c.Deliver(Message{Type: "error", Message: "unknown action"})
+		}
+	}
+}
+
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case payload, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package realtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/damiancxliew/web-forum/events"
+)
+
+// Channel names clients can subscribe to
+func ThreadChannel(id uint) string   { return fmt.Sprintf("thread:%d", id) }
+func CategoryChannel(id uint) string { return fmt.Sprintf("category:%d", id) }
+func UserChannel(id uint) string     { return fmt.Sprintf("user:%d", id) }
+
+// NotificationsChannel is the alias clients use for their own user channel
+const NotificationsChannel = "notifications"
+
+// Message is everything the server sends to a connected client
+type Message struct {
+	Type    string        `json:"type"` // event, subscribed, unsubscribed or error
+	Channel string        `json:"channel,omitempty"`
+	Event   *events.Event `json:"event,omitempty"`
+	Message string        `json:"message,omitempty"`
+}
+
+// Authorizer decides whether a client may subscribe to a channel
+type Authorizer func(channel string) bool
+
+// Subscriber receives the events of the channels it is subscribed to.
+// Deliver must not block. Close ends the connection; it is safe to call more
+// than once.
+type Subscriber interface {
+	Deliver(message Message)
+	Close()
+}
+
+// Hub tracks connected subscribers, the channels they subscribed to and the
+// users they are signed in as
+type Hub struct {
+	mu            sync.RWMutex
+	channels      map[string]map[Subscriber]bool
+	subscriptions map[Subscriber]map[string]bool
+	users         map[uint]map[Subscriber]bool
+	owners        map[Subscriber]uint
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		channels:      map[string]map[Subscriber]bool{},
+		subscriptions: map[Subscriber]map[string]bool{},
+		users:         map[uint]map[Subscriber]bool{},
+		owners:        map[Subscriber]uint{},
+	}
+}
+
+// Channels lists the channels an event is published on: its thread and any
+// target thread, its category and the personal channel of each recipient
+func Channels(event events.Event) []string {
+	channels := []string{}
+	if event.ThreadID != 0 {
+		channels = append(channels, ThreadChannel(event.ThreadID))
+	}
+	if event.TargetThreadID != 0 {
+		channels = append(channels, ThreadChannel(event.TargetThreadID))
+	}
+	if event.CategoryID != 0 {
+		channels = append(channels, CategoryChannel(event.CategoryID))
+	}
+	for _, recipient := range event.Recipients {
+		channels = append(channels, UserChannel(recipient))
+	}
+	return channels
+}
+
+// EventMessage wraps an event for delivery on a channel. Recipients are for
+// routing only and never leave the server.
+func EventMessage(channel string, event events.Event) Message {
+	event.Recipients = nil
+	return Message{Type: "event", Channel: channel, Event: &event}
+}
+
+// Dispatch delivers an event to every subscriber of one of its channels.
+// A subscriber matching several channels receives the event once.
+func (h *Hub) Dispatch(event events.Event) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	delivered := map[Subscriber]bool{}
+	for _, channel := range Channels(event) {
+		for subscriber := range h.channels[channel] {
+			if delivered[subscriber] {
+				continue
+			}
+			delivered[subscriber] = true
+			subscriber.Deliver(EventMessage(channel, event))
+		}
+	}
+}
+
+func (h *Hub) Subscribe(subscriber Subscriber, channel string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.channels[channel] == nil {
+		h.channels[channel] = map[Subscriber]bool{}
+	}
+	h.channels[channel][subscriber] = true
+	if h.subscriptions[subscriber] == nil {
+		h.subscriptions[subscriber] = map[string]bool{}
+	}
+	h.subscriptions[subscriber][channel] = true
+}
+
+func (h *Hub) Unsubscribe(subscriber Subscriber, channel string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.unsubscribeLocked(subscriber, channel)
+}
+
+// Connect records which user a subscriber is signed in as, so Disconnect can
+// find it. Anonymous subscribers are not recorded.
+func (h *Hub) Connect(subscriber Subscriber, userID uint) {
+	if userID == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.users[userID] == nil {
+		h.users[userID] = map[Subscriber]bool{}
+	}
+	h.users[userID][subscriber] = true
+	h.owners[subscriber] = userID
+}
+
+// Disconnect closes every connection signed in as the user, for when they are
+// banned or deleted
+func (h *Hub) Disconnect(userID uint) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for subscriber := range h.users[userID] {
+		subscriber.Close()
+	}
+}
+
+// Remove drops a disconnected subscriber from every channel
+func (h *Hub) Remove(subscriber Subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for channel := range h.subscriptions[subscriber] {
+		h.unsubscribeLocked(subscriber, channel)
+	}
+	delete(h.subscriptions, subscriber)
+	if userID, ok := h.owners[subscriber]; ok {
+		delete(h.owners, subscriber)
+		delete(h.users[userID], subscriber)
+		if len(h.users[userID]) == 0 {
+			delete(h.users, userID)
+		}
+	}
+}
+
+func (h *Hub) unsubscribeLocked(subscriber Subscriber, channel string) {
+	delete(h.subscriptions[subscriber], channel)
+	if subscribers := h.channels[channel]; subscribers != nil {
+		delete(subscribers, subscriber)
+		if len(subscribers) == 0 {
+			delete(h.channels, channel)
+		}
+	}
+}
+
+func encode(message Message) []byte {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		log.Println("Realtime encode error:", err)
+		return nil
+	}
+	return payload
+}
@@ -0,0 +1,41 @@
+package realtime
+
+import (
+	"testing"
+
+	"github.com/damiancxliew/web-forum/events"
+)
+
+func TestDisconnectClosesOnlyThatUsersStreams(t *testing.T) {
+	hub := NewHub()
+	banned, other, anonymous := NewStream(4), NewStream(4), NewStream(4)
+	hub.Connect(banned, 1)
+	hub.Connect(other, 2)
+	hub.Connect(anonymous, 0)
+	for _, stream := range []*Stream{banned, other, anonymous} {
+		hub.Subscribe(stream, ThreadChannel(7))
+	}
+
+	hub.Dispatch(events.Event{Type: events.CommentCreated, ThreadID: 7})
+	hub.Disconnect(1)
+	hub.Dispatch(events.Event{Type: events.CommentCreated, ThreadID: 7})
+
+	// The banned user's stream drains what was queued, then ends
+	if _, ok := <-banned.Messages(); !ok {
+		t.Error("queued message was dropped on disconnect")
+	}
+	if _, ok := <-banned.Messages(); ok {
+		t.Error("disconnected stream is still open")
+	}
+	for name, stream := range map[string]*Stream{"other": other, "anonymous": anonymous} {
+		if got := len(stream.Messages()); got != 2 {
+			t.Errorf("%s stream has %d messages, want 2", name, got)
+		}
+	}
+
+	// Removing a closed stream forgets its user
+	hub.Remove(banned)
+	if len(hub.users[1]) != 0 || len(hub.owners) != 1 {
+		t.Errorf("hub still tracks removed stream: users %v, owners %v", hub.users, hub.owners)
+	}
+}
@@ -0,0 +1,67 @@
+package realtime
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Stream is a subscriber that buffers messages for a long-lived HTTP
+// response such as a Server-Sent Events feed
+type Stream struct {
+	messages chan Message
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func NewStream(buffer int) *Stream {
+	return &Stream{messages: make(chan Message, buffer)}
+}
+
+// Messages yields delivered messages; it is closed if the stream falls too far
+// behind or is closed
+func (s *Stream) Messages() <-chan Message {
+	return s.messages
+}
+
+// Deliver queues a message without blocking; a stream that cannot keep up is closed
+func (s *Stream) Deliver(message Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.messages <- message:
+	default:
+		s.closed = true
+		close(s.messages)
+	}
+}
+
+// Close ends the stream, letting the reader drain what is already queued
+func (s *Stream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.messages)
+	}
+}
+
+// WriteSSE writes a message in Server-Sent Events format. Event messages carry
+// their log ID so clients can resume with Last-Event-ID.
+func WriteSSE(w io.Writer, message Message) error {
+	name := message.Type
+	if message.Event != nil {
+		name = message.Event.Type
+		if message.Event.ID != 0 {
+			if _, err := fmt.Fprintf(w, "id: %d\n", message.Event.ID); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, encode(message))
+	return err
+}
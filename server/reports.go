@@ -0,0 +1,573 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/damiancxliew/web-forum/events"
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// reportReasons are the reasons a report may give
+var reportReasons = []string{
+	models.ReportSpam,
+	models.ReportHarassment,
+	models.ReportHate,
+	models.ReportInappropriate,
+	models.ReportOffTopic,
+	models.ReportOther,
+}
+
+const (
+	maxReportDetails           = 1000
+	defaultReportHideThreshold = 3
+)
+
+var (
+	errAlreadyReported = errors.New("already reported")
+	errQueueItemClosed = errors.New("queue item is closed")
+	errQueueItemTaken  = errors.New("queue item is claimed by another moderator")
+)
+
+// openQueueStatuses are the states of items still waiting for a decision
+var openQueueStatuses = []string{models.QueuePending, models.QueueClaimed}
+
+// reportHideThreshold is how many reports hide a post until a moderator
+// reviews it. It can be overridden with REPORT_HIDE_THRESHOLD, where 0 turns
+// hiding off.
+func reportHideThreshold() int {
+	threshold, err := strconv.Atoi(os.Getenv("REPORT_HIDE_THRESHOLD"))
+	if err != nil || threshold < 0 {
+		return defaultReportHideThreshold
+	}
+	return threshold
+}
+
+// canSeeHidden reports whether userID may see a hidden post by authorID: its
+// author and moderators can
+func (r *Repository) canSeeHidden(userID, authorID uint) bool {
+	return userID != 0 && (userID == authorID || r.hasRole(userID, models.RoleAdmin, models.RoleModerator))
+}
+
+// loadReportTarget finds the thread, comment or user named by the :id param
+func (r *Repository) loadReportTarget(c *gin.Context, targetType string) (reactionTarget, bool) {
+	if targetType != models.TargetUser {
+		return r.loadReactionTarget(c, targetType)
+	}
+	user := models.User{}
+	if err := r.DB.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return reactionTarget{}, false
+	}
+	return reactionTarget{Type: targetType, ID: user.ID, AuthorID: user.ID}, true
+}
+
+// queueTarget rebuilds the target of a queue item, or reports false if the
+// target is gone for good
+func (r *Repository) queueTarget(item models.QueueItem) (reactionTarget, bool) {
+	target := reactionTarget{Type: item.TargetType, ID: item.TargetID}
+	switch item.TargetType {
+	case models.TargetThread:
+		thread := models.Thread{}
+		if err := r.DB.Unscoped().First(&thread, item.TargetID).Error; err != nil {
+			return target, false
+		}
+		target.ThreadID, target.CategoryID, target.AuthorID = thread.ID, thread.CategoryID, thread.UserID
+	case models.TargetComment:
+		comment := models.Comment{}
+		if err := r.DB.Unscoped().First(&comment, item.TargetID).Error; err != nil {
+			return target, false
+		}
+		target.ThreadID, target.AuthorID = comment.ThreadID, comment.UserID
+		target.CategoryID = r.threadCategoryID(comment.ThreadID)
+	default:
+		target.AuthorID = item.TargetID
+	}
+	return target, true
+}
+
+// openQueueItem returns the target's open queue item, locked for update,
+// opening one from source if there is none. The partial unique index keeps one
+// open item per target, so concurrent callers end up on the same item.
+func openQueueItem(tx *gorm.DB, targetType string, targetID uint, source string) (models.QueueItem, error) {
+	item := models.QueueItem{TargetType: targetType, TargetID: targetID, Status: models.QueuePending, Source: source}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&item).Error; err != nil {
+		return item, err
+	}
+	item = models.QueueItem{}
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("target_type = ? AND target_id = ? AND status IN ?", targetType, targetID, openQueueStatuses).
+		First(&item).Error
+	return item, err
+}
+
+// queueForReview puts a post an automatic check caught in the moderation
+// queue, adding detail to what earlier checks noted on the open item
+func queueForReview(tx *gorm.DB, targetType string, targetID uint, source, detail string) error {
+	item, err := openQueueItem(tx, targetType, targetID, source)
+	if err != nil {
+		return err
+	}
+	if item.Detail != "" {
+		detail = item.Detail + "; " + detail
+	}
+	return tx.Model(&item).Update("detail", detail).Error
+}
+
+// setHidden hides or shows a post, reporting whether that changed anything.
+// A hidden comment stops being an accepted answer.
+func setHidden(tx *gorm.DB, target reactionTarget, hidden bool) (bool, error) {
+	result := tx.Table(target.table()).Where("id = ? AND hidden = ?", target.ID, !hidden).Update("hidden", hidden)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+	if hidden && target.Type == models.TargetComment {
+		return true, unacceptAnswers(tx, []uint{target.ID})
+	}
+	return true, nil
+}
+
+// lastDismissed reports whether the last closed queue item about the target
+// was dismissed, meaning a moderator found nothing wrong with it
+func lastDismissed(tx *gorm.DB, target reactionTarget) (bool, error) {
+	var statuses []string
+	err := tx.Model(&models.QueueItem{}).
+		Where("target_type = ? AND target_id = ? AND status IN ?", target.Type, target.ID,
+			[]string{models.QueueResolved, models.QueueDismissed}).
+		Order("resolved_at DESC, id DESC").Limit(1).Pluck("status", &statuses).Error
+	return len(statuses) > 0 && statuses[0] == models.QueueDismissed, err
+}
+
+// publishHidden announces that a post was hidden or shown again
+func (r *Repository) publishHidden(target reactionTarget, hidden bool, userID uint) {
+	event := events.Event{
+		Type:       events.ContentHidden,
+		ThreadID:   target.ThreadID,
+		CategoryID: target.CategoryID,
+		UserID:     userID,
+		AuthorID:   target.AuthorID,
+	}
+	if !hidden {
+		event.Type = events.ContentUnhidden
+	}
+	if target.Type == models.TargetComment {
+		event.CommentID = target.ID
+	}
+	r.Events.Publish(event)
+}
+
+// Report files a report about a thread, comment or user:
+// {"reason": "spam", "details": "..."}. Reports about the same target are
+// grouped into one queue item, and a post is hidden once enough of them
+// arrive. A post a moderator already cleared stays visible until a moderator
+// looks at the new reports, so reporting it again cannot hide it.
+func (r *Repository) Report(targetType string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var reportRequest struct {
+			Reason  string `json:"reason"`
+			Details string `json:"details"`
+		}
+		if err := c.ShouldBindJSON(&reportRequest); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Request failed"})
+			return
+		}
+		if !containsString(reportReasons, reportRequest.Reason) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Reason must be one of " + strings.Join(reportReasons, ", ")})
+			return
+		}
+		reportRequest.Details = strings.TrimSpace(reportRequest.Details)
+		if utf8.RuneCountInString(reportRequest.Details) > maxReportDetails {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Details must be at most 1000 characters"})
+			return
+		}
+
+		target, ok := r.loadReportTarget(c, targetType)
+		if !ok {
+			return
+		}
+		userID := currentUserID(c)
+		if target.AuthorID == userID {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "You cannot report yourself"})
+			return
+		}
+
+		report := models.Report{
+			ReporterID: userID,
+			TargetType: target.Type,
+			TargetID:   target.ID,
+			Reason:     reportRequest.Reason,
+			Details:    reportRequest.Details,
+		}
+		hidden := false
+		err := r.DB.Transaction(func(tx *gorm.DB) error {
+			item, err := openQueueItem(tx, target.Type, target.ID, models.QueueSourceReport)
+			if err != nil {
+				return err
+			}
+
+			report.QueueItemID = item.ID
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&report)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return errAlreadyReported
+			}
+			if err := tx.Model(&item).Update("reports", gorm.Expr("reports + 1")).Error; err != nil {
+				return err
+			}
+
+			threshold := reportHideThreshold()
+			if target.Type == models.TargetUser || threshold == 0 || item.Reports+1 < threshold {
+				return nil
+			}
+			if cleared, err := lastDismissed(tx, target); err != nil || cleared {
+				return err
+			}
+			hidden, err = setHidden(tx, target, true)
+			return err
+		})
+		if errors.Is(err, errAlreadyReported) {
+			c.JSON(http.StatusConflict, gin.H{"message": "You have already reported this " + targetType})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not submit report"})
+			return
+		}
+
+		// Reports stay between the reporter and the moderators, so the event
+		// is not published on the post's channels
+		r.Events.Publish(events.Event{
+			Type:     events.ReportCreated,
+			UserID:   userID,
+			AuthorID: target.AuthorID,
+			Detail:   target.Type,
+		})
+		if hidden {
+			r.publishHidden(target, true, 0)
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Report submitted successfully", "data": report})
+	}
+}
+
+// attachReasons counts the reasons given in each item's reports
+func (r *Repository) attachReasons(items []models.QueueItem) {
+	ids := make([]uint, len(items))
+	for i, item := range items {
+		ids[i] = item.ID
+		items[i].Reasons = map[string]int{}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	var counts []struct {
+		QueueItemID uint
+		Reason      string
+		Count       int
+	}
+	r.DB.Model(&models.Report{}).Select("queue_item_id, reason, COUNT(*) AS count").
+		Where("queue_item_id IN ?", ids).Group("queue_item_id, reason").Scan(&counts)
+	byID := map[uint]map[string]int{}
+	for _, count := range counts {
+		if byID[count.QueueItemID] == nil {
+			byID[count.QueueItemID] = map[string]int{}
+		}
+		byID[count.QueueItemID][count.Reason] = count.Count
+	}
+	for i := range items {
+		if reasons := byID[items[i].ID]; reasons != nil {
+			items[i].Reasons = reasons
+		}
+	}
+}
+
+// GetQueue lists the moderation queue, most reported first. It shows open
+// items unless ?status= asks for another state, and takes an optional
+// ?target_type= and ?source=.
+func (r *Repository) GetQueue(c *gin.Context) {
+	page, pageSize := pagination(c)
+
+	query := r.DB.Model(&models.QueueItem{})
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	} else {
+		query = query.Where("status IN ?", openQueueStatuses)
+	}
+	if targetType := c.Query("target_type"); targetType != "" {
+		query = query.Where("target_type = ?", targetType)
+	}
+	if source := c.Query("source"); source != "" {
+		query = query.Where("source = ?", source)
+	}
+	query = query.Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get moderation queue"})
+		return
+	}
+	items := []models.QueueItem{}
+	err := query.Order("reports DESC, created_at, id").Limit(pageSize).Offset((page - 1) * pageSize).Find(&items).Error
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get moderation queue"})
+		return
+	}
+	r.attachReasons(items)
+	c.JSON(http.StatusOK, paginated(items, page, pageSize, total))
+}
+
+// queueReport is one report as moderators see it
+type queueReport struct {
+	models.Report
+	Reporter string `json:"reporter"`
+}
+
+// GetQueueItem returns a queue item with its reports and the reported
+// thread, comment or user, even if it has since been deleted
+func (r *Repository) GetQueueItem(c *gin.Context) {
+	item := models.QueueItem{}
+	if err := r.DB.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Queue item not found"})
+		return
+	}
+	items := []models.QueueItem{item}
+	r.attachReasons(items)
+	item = items[0]
+
+	reports := []queueReport{}
+	r.DB.Model(&models.Report{}).
+		Select("reports.*, users.username AS reporter").
+		Joins("LEFT JOIN users ON users.id = reports.reporter_id").
+		Where("reports.queue_item_id = ?", item.ID).
+		Order("reports.created_at").
+		Scan(&reports)
+
+	var target interface{}
+	switch item.TargetType {
+	case models.TargetThread:
+		thread := models.Thread{}
+		if r.DB.Unscoped().First(&thread, item.TargetID).Error == nil {
+			target = thread
+		}
+	case models.TargetComment:
+		comment := models.Comment{}
+		if r.DB.Unscoped().First(&comment, item.TargetID).Error == nil {
+			target = comment
+		}
+	case models.TargetUser:
+		user := models.User{}
+		// Moderators see the public profile, never the email or other private fields
+		if r.DB.Unscoped().First(&user, item.TargetID).Error == nil {
+			target = r.publicProfile(user)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{"item": item, "reports": reports, "target": target}})
+}
+
+// ClaimQueueItem marks an open item as being handled by the current moderator
+func (r *Repository) ClaimQueueItem(c *gin.Context) {
+	userID := currentUserID(c)
+	now := time.Now()
+	result := r.DB.Model(&models.QueueItem{}).
+		Where("id = ? AND (status = ? OR (status = ? AND claimed_by = ?))", c.Param("id"), models.QueuePending, models.QueueClaimed, userID).
+		Updates(map[string]interface{}{"status": models.QueueClaimed, "claimed_by": userID, "claimed_at": now})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not claim queue item"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"message": "This item is closed or claimed by another moderator"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Queue item claimed successfully"})
+}
+
+// UnclaimQueueItem puts a claimed item back in the queue. Admins can release
+// other moderators' claims.
+func (r *Repository) UnclaimQueueItem(c *gin.Context) {
+	userID := currentUserID(c)
+	query := r.DB.Model(&models.QueueItem{}).Where("id = ? AND status = ?", c.Param("id"), models.QueueClaimed)
+	if !r.hasRole(userID, models.RoleAdmin) {
+		query = query.Where("claimed_by = ?", userID)
+	}
+	result := query.Updates(map[string]interface{}{"status": models.QueuePending, "claimed_by": nil, "claimed_at": nil})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not release queue item"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"message": "You have not claimed this item"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Queue item released successfully"})
+}
+
+// ResolveQueueItem closes an item after acting on it, optionally hiding or
+// deleting the reported post: {"note": "...", "action": "hide"}
+func (r *Repository) ResolveQueueItem(c *gin.Context) {
+	r.closeQueueItem(c, models.QueueResolved)
+}
+
+// DismissQueueItem closes an item without action and shows the post again
+// if reports had hidden it: {"note": "..."}
+func (r *Repository) DismissQueueItem(c *gin.Context) {
+	r.closeQueueItem(c, models.QueueDismissed)
+}
+
+func (r *Repository) closeQueueItem(c *gin.Context, status string) {
+	item := models.QueueItem{}
+	if err := r.DB.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Queue item not found"})
+		return
+	}
+	var closeRequest struct {
+		Note   string `json:"note"`
+		Action string `json:"action"`
+	}
+	// The body is optional
+	if err := c.ShouldBindJSON(&closeRequest); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Request failed"})
+		return
+	}
+	if status == models.QueueDismissed {
+		closeRequest.Action = ""
+	}
+	switch closeRequest.Action {
+	case "":
+	case "hide", "delete":
+		if item.TargetType == models.TargetUser {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Only posts can be hidden or deleted"})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Action must be hide, delete or empty"})
+		return
+	}
+	target, found := r.queueTarget(item)
+
+	userID := currentUserID(c)
+	admin := r.hasRole(userID, models.RoleAdmin)
+	var reporterIDs []uint
+	hiddenChanged, deleted := false, false
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		locked := models.QueueItem{}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&locked, item.ID).Error; err != nil {
+			return err
+		}
+		if !containsString(openQueueStatuses, locked.Status) {
+			return errQueueItemClosed
+		}
+		if locked.ClaimedBy != nil && *locked.ClaimedBy != userID && !admin {
+			return errQueueItemTaken
+		}
+
+		now := time.Now()
+		err := tx.Model(&locked).Updates(map[string]interface{}{
+			"status":      status,
+			"resolved_by": userID,
+			"resolved_at": now,
+			"note":        strings.TrimSpace(closeRequest.Note),
+		}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Report{}).Where("queue_item_id = ?", item.ID).Pluck("reporter_id", &reporterIDs).Error; err != nil {
+			return err
+		}
+		if !found || target.Type == models.TargetUser {
+			return nil
+		}
+
+		switch {
+		case status == models.QueueDismissed:
+			hiddenChanged, err = setHidden(tx, target, false)
+		case closeRequest.Action == "hide":
+			hiddenChanged, err = setHidden(tx, target, true)
+		case closeRequest.Action == "delete":
+			// Posts already in the trash are left as they are
+			fields := trashFields(userID, "Removed after reports", now)
+			if target.Type == models.TargetComment {
+				result := tx.Model(&models.Comment{}).Where("id = ?", target.ID).Updates(fields)
+				deleted, err = result.RowsAffected > 0, result.Error
+				if err == nil && deleted {
+					err = unacceptAnswers(tx, []uint{target.ID})
+				}
+				break
+			}
+			var live int64
+			if err = tx.Model(&models.Thread{}).Where("id = ?", target.ID).Count(&live).Error; err == nil && live > 0 {
+				deleted, err = true, trashThreads(tx, []uint{target.ID}, fields)
+			}
+		}
+		return err
+	})
+	if errors.Is(err, errQueueItemClosed) {
+		c.JSON(http.StatusConflict, gin.H{"message": "This item is already closed"})
+		return
+	}
+	if errors.Is(err, errQueueItemTaken) {
+		c.JSON(http.StatusConflict, gin.H{"message": "This item is claimed by another moderator"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not close queue item"})
+		return
+	}
+	action := models.AuditReportResolve
+	if status == models.QueueDismissed {
+		action = models.AuditReportDismiss
+	}
+	r.audit(c, action, models.TargetQueueItem, item.ID, item, gin.H{
+		"status":      status,
+		"action":      closeRequest.Action,
+		"note":        strings.TrimSpace(closeRequest.Note),
+		"target_type": item.TargetType,
+		"target_id":   item.TargetID,
+	})
+
+	if hiddenChanged {
+		r.publishHidden(target, status == models.QueueResolved, userID)
+	}
+	if deleted {
+		event := events.Event{
+			Type:       events.ThreadDeleted,
+			ThreadID:   target.ThreadID,
+			CategoryID: target.CategoryID,
+			UserID:     userID,
+			AuthorID:   target.AuthorID,
+			Detail:     "Removed after reports",
+		}
+		if target.Type == models.TargetComment {
+			event.Type, event.CommentID = events.CommentDeleted, target.ID
+		}
+		r.Events.Publish(event)
+	}
+	eventType := events.ReportResolved
+	if status == models.QueueDismissed {
+		eventType = events.ReportDismissed
+	}
+	r.Events.Publish(events.Event{
+		Type:       eventType,
+		UserID:     userID,
+		AuthorID:   target.AuthorID,
+		Detail:     item.TargetType,
+		Recipients: reporterIDs,
+	})
+
+	message := "Queue item resolved successfully"
+	if status == models.QueueDismissed {
+		message = "Queue item dismissed successfully"
+	}
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
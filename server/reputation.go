@@ -0,0 +1,363 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/damiancxliew/web-forum/events"
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// defaultReputationWeights is how many points one unit of each reason is worth
+var defaultReputationWeights = map[string]int{
+	models.ReputationHelpful:    10,
+	models.ReputationReply:      2,
+	models.ReputationModeration: -15,
+}
+
+// defaultPrivilegeThresholds is the reputation each privilege unlocks at
+var defaultPrivilegeThresholds = map[string]int{
+	models.PrivilegeCreateTags: 100,
+	models.PrivilegeEditPosts:  1000,
+}
+
+// envInts reads a list like "helpful=10,reply=2" from the environment over a
+// copy of fallback. Unknown names and malformed entries are ignored.
+func envInts(name string, fallback map[string]int) map[string]int {
+	values := map[string]int{}
+	for key, value := range fallback {
+		values[key] = value
+	}
+	for _, entry := range strings.Split(os.Getenv(name), ",") {
+		key, raw, found := strings.Cut(strings.TrimSpace(entry), "=")
+		value, err := strconv.Atoi(strings.TrimSpace(raw))
+		if _, known := fallback[key]; !found || !known || err != nil {
+			continue
+		}
+		values[key] = value
+	}
+	return values
+}
+
+// reputationWeights can be overridden with REPUTATION_WEIGHTS
+func reputationWeights() map[string]int {
+	return envInts("REPUTATION_WEIGHTS", defaultReputationWeights)
+}
+
+// privilegeThresholds can be overridden with REPUTATION_THRESHOLDS
+func privilegeThresholds() map[string]int {
+	return envInts("REPUTATION_THRESHOLDS", defaultPrivilegeThresholds)
+}
+
+// recordReputation adds an entry to the ledger and moves the user's total
+func recordReputation(tx *gorm.DB, entry models.ReputationEvent) error {
+	entry.Points = entry.Units * reputationWeights()[entry.Reason]
+	if err := tx.Create(&entry).Error; err != nil {
+		return err
+	}
+	return tx.Model(&models.User{}).Where("id = ?", entry.UserID).
+		Update("reputation", gorm.Expr("reputation + ?", entry.Points)).Error
+}
+
+// reverseReputation takes back whatever a comment still earns for the given
+// reasons, e.g. once the comment is deleted
+func reverseReputation(tx *gorm.DB, commentID uint, reasons ...string) error {
+	return reverseEntries(tx, tx.Where("comment_id = ?", commentID), &commentID, reasons)
+}
+
+// reverseThreadPenalty refunds the penalty for a thread a moderator deleted
+func reverseThreadPenalty(tx *gorm.DB, threadID uint) error {
+	return reverseEntries(tx, tx.Where("thread_id = ? AND comment_id IS NULL", threadID), nil, []string{models.ReputationModeration})
+}
+
+// reverseEntries cancels out the units still standing among the ledger
+// entries matching scope, per user and reason
+func reverseEntries(tx *gorm.DB, scope *gorm.DB, commentID *uint, reasons []string) error {
+	var earned []struct {
+		UserID   uint
+		Reason   string
+		ThreadID uint
+		Units    int
+	}
+	err := tx.Model(&models.ReputationEvent{}).
+		Select("user_id, reason, MAX(thread_id) AS thread_id, SUM(units) AS units").
+		Where(scope).Where("reason IN ?", reasons).
+		Group("user_id, reason").
+		Scan(&earned).Error
+	if err != nil {
+		return err
+	}
+	for _, entry := range earned {
+		if entry.Units <= 0 {
+			continue
+		}
+		err := recordReputation(tx, models.ReputationEvent{
+			UserID:    entry.UserID,
+			Reason:    entry.Reason,
+			Units:     -entry.Units,
+			ThreadID:  entry.ThreadID,
+			CommentID: commentID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasPrivilege reports whether the user's reputation has unlocked a privilege
+func (r *Repository) hasPrivilege(userID uint, privilege string) bool {
+	if userID == 0 {
+		return false
+	}
+	user := models.User{}
+	if err := r.DB.Select("reputation").First(&user, userID).Error; err != nil {
+		return false
+	}
+	return user.Reputation >= privilegeThresholds()[privilege]
+}
+
+// privilegesOf lists the privileges a reputation has unlocked
+func privilegesOf(reputation int) []string {
+	privileges := []string{}
+	for privilege, threshold := range privilegeThresholds() {
+		if reputation >= threshold {
+			privileges = append(privileges, privilege)
+		}
+	}
+	return privileges
+}
+
+// SubscribeReputation keeps the ledger up to date with replies and moderation.
+// Restoring a post from the trash gives back what deleting it took away.
+func (r *Repository) SubscribeReputation() {
+	r.Events.Subscribe("reputation", func(event events.Event) {
+		var err error
+		switch event.Type {
+		case events.CommentCreated:
+			err = r.replyReputation(event)
+		case events.CommentRestored:
+			err = r.DB.Transaction(func(tx *gorm.DB) error {
+				if err := reverseReputation(tx, event.CommentID, models.ReputationModeration); err != nil {
+					return err
+				}
+				return r.restoredReputation(tx, event)
+			})
+		case events.ThreadRestored:
+			err = reverseThreadPenalty(r.DB, event.ThreadID)
+		case events.ThreadDeleted, events.CommentDeleted:
+			err = r.DB.Transaction(func(tx *gorm.DB) error {
+				if event.Type == events.CommentDeleted {
+					if err := reverseReputation(tx, event.CommentID, models.ReputationHelpful, models.ReputationReply); err != nil {
+						return err
+					}
+				}
+				return r.moderationPenalty(tx, event)
+			})
+		}
+		if err != nil {
+			log.Printf("Reputation error on %s: %v", event.Type, err)
+		}
+	}, events.CommentCreated, events.ThreadDeleted, events.CommentDeleted,
+		events.CommentRestored, events.ThreadRestored)
+}
+
+// replyReputation rewards a thread's author when someone else replies
+func (r *Repository) replyReputation(event events.Event) error {
+	thread := models.Thread{}
+	if err := r.DB.Select("id", "user_id").First(&thread, event.ThreadID).Error; err != nil {
+		return nil
+	}
+	if thread.UserID == 0 || thread.UserID == event.AuthorID {
+		return nil
+	}
+	commentID := event.CommentID
+	return recordReputation(r.DB, models.ReputationEvent{
+		UserID:    thread.UserID,
+		Reason:    models.ReputationReply,
+		Units:     1,
+		ActorID:   event.AuthorID,
+		ThreadID:  thread.ID,
+		CommentID: &commentID,
+	})
+}
+
+// restoredReputation rewards a restored comment again for the reply and any
+// helpful mark its deletion took back
+func (r *Repository) restoredReputation(tx *gorm.DB, event events.Event) error {
+	comment := models.Comment{}
+	if err := tx.First(&comment, event.CommentID).Error; err != nil {
+		return nil
+	}
+	thread := models.Thread{}
+	if err := tx.Select("id", "user_id").First(&thread, comment.ThreadID).Error; err != nil {
+		return nil
+	}
+	if thread.UserID == 0 || thread.UserID == comment.UserID {
+		return nil
+	}
+	if err := recordReputation(tx, models.ReputationEvent{
+		UserID:    thread.UserID,
+		Reason:    models.ReputationReply,
+		Units:     1,
+		ActorID:   comment.UserID,
+		ThreadID:  thread.ID,
+		CommentID: &comment.ID,
+	}); err != nil {
+		return err
+	}
+	if !comment.Helpful {
+		return nil
+	}
+	return recordReputation(tx, models.ReputationEvent{
+		UserID:    comment.UserID,
+		Reason:    models.ReputationHelpful,
+		Units:     1,
+		ActorID:   thread.UserID,
+		ThreadID:  thread.ID,
+		CommentID: &comment.ID,
+	})
+}
+
+// moderationPenalty docks an author whose post a moderator deleted
+func (r *Repository) moderationPenalty(tx *gorm.DB, event events.Event) error {
+	if event.UserID == 0 || event.AuthorID == 0 || event.UserID == event.AuthorID {
+		return nil
+	}
+	if !r.hasRole(event.UserID, models.RoleAdmin, models.RoleModerator) {
+		return nil
+	}
+	entry := models.ReputationEvent{
+		UserID:   event.AuthorID,
+		Reason:   models.ReputationModeration,
+		Units:    1,
+		ActorID:  event.UserID,
+		ThreadID: event.ThreadID,
+	}
+	if event.CommentID != 0 {
+		commentID := event.CommentID
+		entry.CommentID = &commentID
+	}
+	return recordReputation(tx, entry)
+}
+
+// MarkHelpful lets a thread's author mark a reply as helpful, rewarding the
+// reply's author
+func (r *Repository) MarkHelpful(c *gin.Context) {
+	r.setHelpful(c, true)
+}
+
+// UnmarkHelpful takes a helpful mark back along with the points it earned
+func (r *Repository) UnmarkHelpful(c *gin.Context) {
+	r.setHelpful(c, false)
+}
+
+func (r *Repository) setHelpful(c *gin.Context, helpful bool) {
+	comment := models.Comment{}
+	if err := r.DB.First(&comment, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Comment not found"})
+		return
+	}
+	thread := models.Thread{}
+	if err := r.DB.First(&thread, comment.ThreadID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Thread not found"})
+		return
+	}
+	userID := currentUserID(c)
+	if thread.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"message": "Only the thread's author can mark replies helpful"})
+		return
+	}
+	if comment.UserID == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "You cannot mark your own reply helpful"})
+		return
+	}
+	if thread.Archived {
+		c.JSON(http.StatusForbidden, gin.H{"message": "This thread is archived"})
+		return
+	}
+
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		// Only a change of state touches the ledger, so repeats are harmless
+		result := tx.Model(&models.Comment{}).Where("id = ? AND helpful = ?", comment.ID, !helpful).Update("helpful", helpful)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		if !helpful {
+			return reverseReputation(tx, comment.ID, models.ReputationHelpful)
+		}
+		return recordReputation(tx, models.ReputationEvent{
+			UserID:    comment.UserID,
+			Reason:    models.ReputationHelpful,
+			Units:     1,
+			ActorID:   userID,
+			ThreadID:  thread.ID,
+			CommentID: &comment.ID,
+		})
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not update comment"})
+		return
+	}
+
+	comment.Helpful = helpful
+	message := "Comment marked helpful"
+	if !helpful {
+		message = "Helpful mark removed"
+	}
+	c.JSON(http.StatusOK, gin.H{"message": message, "data": comment})
+}
+
+// GetReputation returns a user's reputation and the ledger behind it, newest first
+func (r *Repository) GetReputation(c *gin.Context) {
+	user := models.User{}
+	if err := r.DB.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+	page, pageSize := pagination(c)
+
+	query := r.DB.Model(&models.ReputationEvent{}).Where("user_id = ?", user.ID).Session(&gorm.Session{})
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get reputation"})
+		return
+	}
+	ledger := []models.ReputationEvent{}
+	err := query.Order("created_at DESC, id DESC").Limit(pageSize).Offset((page - 1) * pageSize).Find(&ledger).Error
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get reputation"})
+		return
+	}
+
+	response := paginated(ledger, page, pageSize, total)
+	response["reputation"] = user.Reputation
+	c.JSON(http.StatusOK, response)
+}
+
+// RecomputeReputation reweighs the whole ledger with the current weights and
+// rebuilds every user's total from it
+func (r *Repository) RecomputeReputation(c *gin.Context) {
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		for reason, weight := range reputationWeights() {
+			err := tx.Model(&models.ReputationEvent{}).Where("reason = ?", reason).
+				Update("points", gorm.Expr("units * ?", weight)).Error
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Model(&models.User{}).Where("1 = 1").Update("reputation",
+			gorm.Expr("COALESCE((SELECT SUM(points) FROM reputation_events WHERE reputation_events.user_id = users.id), 0)")).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not recompute reputation"})
+		return
+	}
+	r.audit(c, models.AuditReputation, models.TargetSystem, 0, nil, gin.H{"weights": reputationWeights()})
+	c.JSON(http.StatusOK, gin.H{"message": "Reputation recomputed successfully"})
+}
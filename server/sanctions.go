@@ -0,0 +1,457 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/damiancxliew/web-forum/events"
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// loginSanctions are the sanctions that keep a user from logging in
+var loginSanctions = []string{models.SanctionBan, models.SanctionSuspension}
+
+const maxAppealMessage = 2000
+
+var (
+	errAppealReviewed = errors.New("appeal already reviewed")
+	errSanctionLifted = errors.New("sanction already lifted")
+)
+
+// activeSanction returns the user's longest-lasting sanction of the given
+// types that has neither expired nor been lifted
+func (r *Repository) activeSanction(userID uint, types ...string) (models.Sanction, bool) {
+	sanction := models.Sanction{}
+	err := r.DB.Where("user_id = ? AND type IN ? AND lifted_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", userID, types, time.Now()).
+		Order("expires_at DESC NULLS FIRST").
+		First(&sanction).Error
+	return sanction, err == nil
+}
+
+// sanctionMessage tells a user what a sanction means for them and why
+func sanctionMessage(sanction models.Sanction) string {
+	message := "Your account is banned"
+	switch sanction.Type {
+	case models.SanctionSuspension:
+		message = "Your account is suspended"
+	case models.SanctionSilence:
+		message = "Your account is silenced"
+	}
+	if sanction.ExpiresAt != nil {
+		message += " until " + sanction.ExpiresAt.UTC().Format("2006-01-02 15:04 UTC")
+	}
+	if sanction.Reason != "" {
+		message += ": " + sanction.Reason
+	}
+	return message
+}
+
+// checkAccount stops requests from users who were deleted, banned or
+// suspended after their token was issued. It responds and aborts the request
+// if they may not continue.
+func (r *Repository) checkAccount(c *gin.Context) bool {
+	userID := currentUserID(c)
+	user := models.User{}
+	if err := r.DB.Select("id").First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Account no longer exists"})
+		c.Abort()
+		return false
+	}
+	if sanction, found := r.activeSanction(userID, loginSanctions...); found {
+		c.JSON(http.StatusForbidden, gin.H{"message": sanctionMessage(sanction), "sanction": sanction})
+		c.Abort()
+		return false
+	}
+	return true
+}
+
+// postingBlocked explains why userID may not post, or returns "" if they may
+func (r *Repository) postingBlocked(userID uint) string {
+	if sanction, found := r.activeSanction(userID, models.SanctionBan, models.SanctionSuspension, models.SanctionSilence); found {
+		return sanctionMessage(sanction)
+	}
+	return ""
+}
+
+// NotSilenced only lets through users who may post. It must run after
+// JWTMiddleware.
+func (r *Repository) NotSilenced(c *gin.Context) {
+	if message := r.postingBlocked(currentUserID(c)); message != "" {
+		c.JSON(http.StatusForbidden, gin.H{"message": message})
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// SanctionUser bans, suspends or silences a user, e.g.
+// {"type": "suspension", "reason": "...", "expires_at": "2025-01-01T00:00:00Z"}
+// or {"type": "silence", "reason": "...", "duration_hours": 24}. Bans never
+// expire and suspensions must. Only admins may ban or sanction staff.
+func (r *Repository) SanctionUser(c *gin.Context) {
+	var sanctionRequest struct {
+		Type          string     `json:"type"`
+		Reason        string     `json:"reason"`
+		ExpiresAt     *time.Time `json:"expires_at"`
+		DurationHours int        `json:"duration_hours"`
+	}
+	if err := c.ShouldBindJSON(&sanctionRequest); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Request failed"})
+		return
+	}
+	switch sanctionRequest.Type {
+	case models.SanctionBan, models.SanctionSuspension, models.SanctionSilence:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Type must be ban, suspension or silence"})
+		return
+	}
+	sanctionRequest.Reason = strings.TrimSpace(sanctionRequest.Reason)
+	if sanctionRequest.Reason == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "A reason is required"})
+		return
+	}
+
+	expiresAt := sanctionRequest.ExpiresAt
+	if sanctionRequest.DurationHours > 0 {
+		at := time.Now().Add(time.Duration(sanctionRequest.DurationHours) * time.Hour)
+		expiresAt = &at
+	}
+	if sanctionRequest.Type == models.SanctionBan {
+		expiresAt = nil
+	} else if expiresAt != nil && !expiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Expiry must be in the future"})
+		return
+	}
+	if sanctionRequest.Type == models.SanctionSuspension && expiresAt == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Suspensions need an expiry or duration_hours"})
+		return
+	}
+
+	user := models.User{}
+	if err := r.DB.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+	moderatorID := currentUserID(c)
+	if user.ID == moderatorID {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "You cannot sanction yourself"})
+		return
+	}
+	staff := user.Role == models.RoleAdmin || user.Role == models.RoleModerator
+	if (staff || sanctionRequest.Type == models.SanctionBan) && !r.hasRole(moderatorID, models.RoleAdmin) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "Only admins can ban users or sanction staff"})
+		return
+	}
+
+	sanction := models.Sanction{
+		UserID:    user.ID,
+		Type:      sanctionRequest.Type,
+		Reason:    sanctionRequest.Reason,
+		ExpiresAt: expiresAt,
+		IssuedBy:  moderatorID,
+	}
+	if err := r.DB.Create(&sanction).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not sanction user"})
+		return
+	}
+	r.audit(c, models.AuditUserSanction, models.TargetUser, user.ID, nil, sanction)
+
+	r.Events.Publish(events.Event{
+		Type:     events.UserSanctioned,
+		UserID:   moderatorID,
+		AuthorID: user.ID,
+		Detail:   sanctionMessage(sanction),
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "User sanctioned successfully", "data": sanction})
+}
+
+// listSanctions responds with the user's sanctions, newest first
+func (r *Repository) listSanctions(c *gin.Context, userID uint) {
+	sanctions := []models.Sanction{}
+	if err := r.DB.Where("user_id = ?", userID).Order("id DESC").Find(&sanctions).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get sanctions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": sanctions})
+}
+
+// GetUserSanctions lists every sanction a user has received
+func (r *Repository) GetUserSanctions(c *gin.Context) {
+	user := models.User{}
+	if err := r.DB.Unscoped().First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+	r.listSanctions(c, user.ID)
+}
+
+// GetMySanctions lists the current user's sanctions, so silenced users can
+// see why and appeal
+func (r *Repository) GetMySanctions(c *gin.Context) {
+	r.listSanctions(c, currentUserID(c))
+}
+
+// liftSanction ends a sanction early and closes its pending appeal, if any
+func liftSanction(tx *gorm.DB, sanctionID, moderatorID uint, now time.Time) error {
+	result := tx.Model(&models.Sanction{}).
+		Where("id = ? AND lifted_at IS NULL", sanctionID).
+		Updates(map[string]interface{}{"lifted_at": now, "lifted_by": moderatorID})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errSanctionLifted
+	}
+	return tx.Model(&models.Appeal{}).
+		Where("sanction_id = ? AND status = ?", sanctionID, models.AppealPending).
+		Updates(map[string]interface{}{"status": models.AppealAccepted, "reviewed_by": moderatorID, "reviewed_at": now}).Error
+}
+
+// LiftSanction ends a sanction before it expires. Only admins may lift bans.
+func (r *Repository) LiftSanction(c *gin.Context) {
+	sanction := models.Sanction{}
+	if err := r.DB.First(&sanction, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Sanction not found"})
+		return
+	}
+	moderatorID := currentUserID(c)
+	if sanction.Type == models.SanctionBan && !r.hasRole(moderatorID, models.RoleAdmin) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "Only admins can lift bans"})
+		return
+	}
+
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		return liftSanction(tx, sanction.ID, moderatorID, time.Now())
+	})
+	if errors.Is(err, errSanctionLifted) {
+		c.JSON(http.StatusConflict, gin.H{"message": "This sanction was already lifted"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not lift sanction"})
+		return
+	}
+	r.audit(c, models.AuditSanctionLift, models.TargetSanction, sanction.ID, sanction, gin.H{"lifted_by": moderatorID})
+
+	r.Events.Publish(events.Event{
+		Type:     events.SanctionLifted,
+		UserID:   moderatorID,
+		AuthorID: sanction.UserID,
+		Detail:   fmt.Sprintf("Your %s was lifted", sanction.Type),
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "Sanction lifted successfully"})
+}
+
+// appellant identifies who is appealing. Banned and suspended users cannot
+// get a token, so they may send their email and password instead.
+func (r *Repository) appellant(c *gin.Context, email, password string) (uint, bool) {
+	if claims, err := parseToken(c); err == nil {
+		setClaims(c, claims)
+		return currentUserID(c), currentUserID(c) != 0
+	}
+	user := models.User{}
+	if email == "" || r.DB.Where("email = ?", email).First(&user).Error != nil {
+		return 0, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+		return 0, false
+	}
+	return user.ID, true
+}
+
+// CreateAppeal asks for one of the user's active sanctions to be lifted:
+// {"sanction_id": 1, "message": "...", "email": "...", "password": "..."}.
+// The email and password are only needed without a token.
+func (r *Repository) CreateAppeal(c *gin.Context) {
+	var appealRequest struct {
+		SanctionID uint   `json:"sanction_id"`
+		Message    string `json:"message"`
+		Email      string `json:"email"`
+		Password   string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&appealRequest); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Request failed"})
+		return
+	}
+	userID, ok := r.appellant(c, appealRequest.Email, appealRequest.Password)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Invalid token or email and password"})
+		return
+	}
+	appealRequest.Message = strings.TrimSpace(appealRequest.Message)
+	if appealRequest.Message == "" || utf8.RuneCountInString(appealRequest.Message) > maxAppealMessage {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Message must be between 1 and 2000 characters"})
+		return
+	}
+
+	sanction := models.Sanction{}
+	err := r.DB.Where("id = ? AND user_id = ? AND lifted_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", appealRequest.SanctionID, userID, time.Now()).
+		First(&sanction).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "No active sanction to appeal"})
+		return
+	}
+
+	appeal := models.Appeal{
+		SanctionID: sanction.ID,
+		UserID:     userID,
+		Message:    appealRequest.Message,
+		Status:     models.AppealPending,
+	}
+	result := r.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&appeal)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not submit appeal"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"message": "This sanction already has an appeal waiting for review"})
+		return
+	}
+
+	r.Events.Publish(events.Event{
+		Type:     events.AppealCreated,
+		UserID:   userID,
+		AuthorID: userID,
+		Detail:   sanction.Type,
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "Appeal submitted successfully", "data": appeal})
+}
+
+// appealEntry is an appeal with the sanction it is about
+type appealEntry struct {
+	models.Appeal
+	Sanction models.Sanction `json:"sanction"`
+}
+
+// GetAppeals lists appeals, pending ones by default, oldest first so they are
+// reviewed in order. Filter with ?status=.
+func (r *Repository) GetAppeals(c *gin.Context) {
+	page, pageSize := pagination(c)
+	status := c.DefaultQuery("status", models.AppealPending)
+	query := r.DB.Model(&models.Appeal{}).Where("status = ?", status).Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get appeals"})
+		return
+	}
+	appeals := []models.Appeal{}
+	if err := query.Order("id").Limit(pageSize).Offset((page - 1) * pageSize).Find(&appeals).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get appeals"})
+		return
+	}
+
+	ids := make([]uint, len(appeals))
+	for i, appeal := range appeals {
+		ids[i] = appeal.SanctionID
+	}
+	sanctions := []models.Sanction{}
+	if len(ids) > 0 {
+		r.DB.Where("id IN ?", ids).Find(&sanctions)
+	}
+	byID := make(map[uint]models.Sanction, len(sanctions))
+	for _, sanction := range sanctions {
+		byID[sanction.ID] = sanction
+	}
+	entries := make([]appealEntry, len(appeals))
+	for i, appeal := range appeals {
+		entries[i] = appealEntry{Appeal: appeal, Sanction: byID[appeal.SanctionID]}
+	}
+	c.JSON(http.StatusOK, paginated(entries, page, pageSize, total))
+}
+
+// ReviewAppeal accepts or rejects a pending appeal:
+// {"status": "accepted", "response": "..."}. Accepting lifts the sanction.
+// Only admins may review appeals against bans.
+func (r *Repository) ReviewAppeal(c *gin.Context) {
+	var reviewRequest struct {
+		Status   string `json:"status"`
+		Response string `json:"response"`
+	}
+	if err := c.ShouldBindJSON(&reviewRequest); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Request failed"})
+		return
+	}
+	if reviewRequest.Status != models.AppealAccepted && reviewRequest.Status != models.AppealRejected {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Status must be accepted or rejected"})
+		return
+	}
+
+	appeal := models.Appeal{}
+	if err := r.DB.First(&appeal, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Appeal not found"})
+		return
+	}
+	sanction := models.Sanction{}
+	if err := r.DB.First(&sanction, appeal.SanctionID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Sanction not found"})
+		return
+	}
+	moderatorID := currentUserID(c)
+	if sanction.Type == models.SanctionBan && !r.hasRole(moderatorID, models.RoleAdmin) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "Only admins can review appeals against bans"})
+		return
+	}
+
+	now := time.Now()
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Appeal{}).
+			Where("id = ? AND status = ?", appeal.ID, models.AppealPending).
+			Updates(map[string]interface{}{
+				"status":      reviewRequest.Status,
+				"reviewed_by": moderatorID,
+				"reviewed_at": now,
+				"response":    strings.TrimSpace(reviewRequest.Response),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errAppealReviewed
+		}
+		if reviewRequest.Status != models.AppealAccepted {
+			return nil
+		}
+		// The sanction may have expired or been lifted in the meantime
+		if err := liftSanction(tx, sanction.ID, moderatorID, now); err != nil && !errors.Is(err, errSanctionLifted) {
+			return err
+		}
+		return nil
+	})
+	if errors.Is(err, errAppealReviewed) {
+		c.JSON(http.StatusConflict, gin.H{"message": "This appeal was already reviewed"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not review appeal"})
+		return
+	}
+	r.audit(c, models.AuditAppealReview, models.TargetAppeal, appeal.ID, appeal, gin.H{
+		"status":      reviewRequest.Status,
+		"response":    strings.TrimSpace(reviewRequest.Response),
+		"sanction_id": sanction.ID,
+	})
+
+	message := fmt.Sprintf("Your appeal against your %s was rejected", sanction.Type)
+	if reviewRequest.Status == models.AppealAccepted {
+		message = fmt.Sprintf("Your appeal was accepted and your %s was lifted", sanction.Type)
+	}
+	if response := strings.TrimSpace(reviewRequest.Response); response != "" {
+		message += ": " + response
+	}
+	r.Events.Publish(events.Event{
+		Type:     events.AppealReviewed,
+		UserID:   moderatorID,
+		AuthorID: appeal.UserID,
+		Detail:   message,
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "Appeal reviewed successfully"})
+}
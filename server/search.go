@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/damiancxliew/web-forum/search"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// isoTimestamp matches the format the client stores created_at in, which keeps
+// string comparisons on those columns chronological
+const isoTimestamp = "2006-01-02T15:04:05.000Z"
+
+// parseSearchDate accepts a plain date or an RFC3339 timestamp. Plain dates used
+// as an upper bound include the whole day.
+func parseSearchDate(value string, endOfDay bool) (string, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC().Format(isoTimestamp), nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return "", err
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Millisecond)
+	}
+	return t.Format(isoTimestamp), nil
+}
+
+// Search runs a full-text query over threads and comments. The q param follows
+// web search syntax: "quoted phrases", OR and -excluded terms.
+func (r *Repository) Search(c *gin.Context) {
+	text := strings.TrimSpace(c.Query("q"))
+	if text == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Search query cannot be empty"})
+		return
+	}
+
+	page, pageSize := pagination(c)
+	query := search.Query{Text: text, Page: page, PageSize: pageSize}
+
+	switch searchType := c.DefaultQuery("type", "all"); searchType {
+	case "all":
+	case search.TypeThread, search.TypeComment:
+		query.Type = searchType
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Type must be all, thread or comment"})
+		return
+	}
+
+	if author := c.Query("author"); author != "" {
+		var user models.User
+		if err := r.DB.Where("username = ?", author).First(&user).Error; err != nil {
+			c.JSON(http.StatusOK, paginated([]search.Result{}, page, pageSize, 0))
+			return
+		}
+		query.AuthorID = user.ID
+	}
+	if category := c.Query("category"); category != "" {
+		categoryID, err := strconv.Atoi(category)
+		if err != nil || categoryID < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid category"})
+			return
+		}
+		query.CategoryID = uint(categoryID)
+	}
+	query.Tag = c.Query("tag")
+	if from := c.Query("from"); from != "" {
+		value, err := parseSearchDate(from, false)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid from date"})
+			return
+		}
+		query.From = value
+	}
+	if to := c.Query("to"); to != "" {
+		value, err := parseSearchDate(to, true)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid to date"})
+			return
+		}
+		query.To = value
+	}
+	query.ExcludeCategories = r.restrictedCategoryIDs(currentUserID(c), "can_view")
+
+	results, total, err := r.Index.Search(query)
+	if err != nil {
+		log.Println("Search error:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not run search"})
+		return
+	}
+
+	c.JSON(http.StatusOK, paginated(results, page, pageSize, total))
+}
+
+// ReindexSearch rebuilds the search index from the database
+func (r *Repository) ReindexSearch(c *gin.Context) {
+	threads, comments, err := search.Rebuild(r.DB, r.Index)
+	if err != nil {
+		log.Println("Search rebuild error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not rebuild search index"})
+		return
+	}
+	r.audit(c, models.AuditSearchReindex, models.TargetSystem, 0, nil, gin.H{"threads": threads, "comments": comments})
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Search index rebuilt successfully",
+		"data":    gin.H{"threads": threads, "comments": comments},
+	})
+}
+
+// newSearchIndexer picks the search backend from SEARCH_BACKEND: "postgres"
+// (the default) or "bleve", which keeps its index at SEARCH_INDEX_PATH
+func newSearchIndexer(db *gorm.DB) (search.Indexer, error) {
+	switch backend := os.Getenv("SEARCH_BACKEND"); backend {
+	case "", "postgres":
+		return search.NewPostgresIndexer(db), nil
+	case "bleve":
+		path := os.Getenv("SEARCH_INDEX_PATH")
+		if path == "" {
+			path = "data/search.bleve"
+		}
+		return search.NewBleveIndexer(path)
+	default:
+		return nil, fmt.Errorf("unknown SEARCH_BACKEND %q", backend)
+	}
+}
@@ -0,0 +1,343 @@
+package search
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/lang/en"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+// BleveIndexer keeps an embedded on-disk index, so small deployments and
+// tests can search without any Postgres extensions or indexes
+type BleveIndexer struct {
+	path  string
+	mu    sync.RWMutex
+	index bleve.Index
+}
+
+// bleveDocument is the shape stored in the index
+type bleveDocument struct {
+	Type     string `json:"type"`
+	ThreadID uint   `json:"thread_id"`
+	Title    string `json:"title,omitempty"`
+	// ThreadTitle is stored for display only, so comments never match on their thread's title
+	ThreadTitle string   `json:"thread_title"`
+	Content     string   `json:"content"`
+	UserID      uint     `json:"user_id"`
+	CategoryID  uint     `json:"category_id"`
+	Tags        []string `json:"tags"`
+	CreatedAt   string   `json:"created_at"`
+}
+
+// NewBleveIndexer opens the index at path, creating it if it does not exist yet
+func NewBleveIndexer(path string) (*BleveIndexer, error) {
+	index, err := bleve.Open(path)
+	if err == bleve.ErrorIndexPathDoesNotExist {
+		index, err = bleve.New(path, bleveMapping())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open search index at %s: %v", path, err)
+	}
+	return &BleveIndexer{path: path, index: index}, nil
+}
+
+func bleveMapping() mapping.IndexMapping {
+	text := bleve.NewTextFieldMapping()
+	text.Analyzer = en.AnalyzerName
+
+	keyword := bleve.NewKeywordFieldMapping()
+	numeric := bleve.NewNumericFieldMapping()
+
+	stored := bleve.NewTextFieldMapping()
+	stored.Index = false
+	stored.IncludeInAll = false
+
+	doc := bleve.NewDocumentMapping()
+	doc.AddFieldMappingsAt("type", keyword)
+	doc.AddFieldMappingsAt("thread_id", numeric)
+	doc.AddFieldMappingsAt("title", text)
+	doc.AddFieldMappingsAt("thread_title", stored)
+	doc.AddFieldMappingsAt("content", text)
+	doc.AddFieldMappingsAt("user_id", numeric)
+	doc.AddFieldMappingsAt("category_id", numeric)
+	doc.AddFieldMappingsAt("tags", keyword)
+	// created_at is an ISO string, so keyword ranges sort chronologically
+	doc.AddFieldMappingsAt("created_at", keyword)
+
+	indexMapping := bleve.NewIndexMapping()
+	indexMapping.DefaultMapping = doc
+	indexMapping.DefaultAnalyzer = en.AnalyzerName
+	return indexMapping
+}
+
+func documentID(docType string, id uint) string {
+	return fmt.Sprintf("%s:%d", docType, id)
+}
+
+func (b *BleveIndexer) Index(doc Document) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	indexed := bleveDocument{
+		Type:        doc.Type,
+		ThreadID:    doc.ThreadID,
+		ThreadTitle: doc.Title,
+		Content:     doc.Content,
+		UserID:      doc.UserID,
+		CategoryID:  doc.CategoryID,
+		Tags:        doc.Tags,
+		CreatedAt:   doc.CreatedAt,
+	}
+	if doc.Type == TypeThread {
+		indexed.Title = doc.Title
+	}
+	return b.index.Index(documentID(doc.Type, doc.ID), indexed)
+}
+
+func (b *BleveIndexer) Delete(docType string, id uint) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if docType == TypeComment {
+		return b.index.Delete(documentID(docType, id))
+	}
+
+	// Drop the thread together with every comment indexed under it
+	threadQuery := numericTerm("thread_id", id)
+	for {
+		request := bleve.NewSearchRequestOptions(threadQuery, 1000, 0, false)
+		result, err := b.index.Search(request)
+		if err != nil {
+			return err
+		}
+		if len(result.Hits) == 0 {
+			return nil
+		}
+		batch := b.index.NewBatch()
+		for _, hit := range result.Hits {
+			batch.Delete(hit.ID)
+		}
+		if err := b.index.Batch(batch); err != nil {
+			return err
+		}
+	}
+}
+
+// Reset deletes the on-disk index and starts an empty one
+func (b *BleveIndexer) Reset() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.index.Close(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(b.path); err != nil {
+		return err
+	}
+	index, err := bleve.New(b.path, bleveMapping())
+	if err != nil {
+		return err
+	}
+	b.index = index
+	return nil
+}
+
+func (b *BleveIndexer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.index.Close()
+}
+
+func (b *BleveIndexer) Search(q Query) ([]Result, int64, error) {
+	textQuery, err := parseText(q.Text)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	filtered := bleve.NewBooleanQuery()
+	filtered.AddMust(textQuery)
+	if q.Type != "" {
+		filtered.AddMust(keywordTerm("type", q.Type))
+	}
+	if q.AuthorID != 0 {
+		filtered.AddMust(numericTerm("user_id", q.AuthorID))
+	}
+	if q.CategoryID != 0 {
+		filtered.AddMust(numericTerm("category_id", q.CategoryID))
+	}
+	if q.Tag != "" {
+		filtered.AddMust(keywordTerm("tags", q.Tag))
+	}
+	if q.From != "" || q.To != "" {
+		inclusive := true
+		dates := bleve.NewTermRangeInclusiveQuery(q.From, q.To, &inclusive, &inclusive)
+		dates.SetField("created_at")
+		filtered.AddMust(dates)
+	}
+	for _, categoryID := range q.ExcludeCategories {
+		filtered.AddMustNot(numericTerm("category_id", categoryID))
+	}
+
+	request := bleve.NewSearchRequestOptions(filtered, q.PageSize, q.offset(), false)
+	request.Fields = []string{"type", "thread_id", "thread_title", "user_id", "category_id", "created_at"}
+	request.SortBy([]string{"-_score", "-created_at"})
+	request.Highlight = bleve.NewHighlightWithStyle("html")
+	request.Highlight.AddField("content")
+	request.Highlight.AddField("title")
+
+	b.mu.RLock()
+	result, err := b.index.Search(request)
+	b.mu.RUnlock()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	results := make([]Result, 0, len(result.Hits))
+	for _, hit := range result.Hits {
+		var docType string
+		var id uint
+		if _, err := fmt.Sscanf(strings.Replace(hit.ID, ":", " ", 1), "%s %d", &docType, &id); err != nil {
+			continue
+		}
+
+		snippet := strings.Join(hit.Fragments["content"], " … ")
+		if snippet == "" {
+			snippet = strings.Join(hit.Fragments["title"], " … ")
+		}
+
+		results = append(results, Result{
+			Type:       docType,
+			ID:         id,
+			ThreadID:   fieldUint(hit.Fields, "thread_id"),
+			Title:      fieldString(hit.Fields, "thread_title"),
+			UserID:     fieldUint(hit.Fields, "user_id"),
+			CategoryID: fieldUint(hit.Fields, "category_id"),
+			CreatedAt:  fieldString(hit.Fields, "created_at"),
+			Rank:       hit.Score,
+			Snippet:    snippet,
+		})
+	}
+	return results, int64(result.Total), nil
+}
+
+func keywordTerm(field, value string) query.Query {
+	term := bleve.NewTermQuery(value)
+	term.SetField(field)
+	return term
+}
+
+func numericTerm(field string, value uint) query.Query {
+	v := float64(value)
+	inclusive := true
+	term := bleve.NewNumericRangeInclusiveQuery(&v, &v, &inclusive, &inclusive)
+	term.SetField(field)
+	return term
+}
+
+func fieldString(fields map[string]interface{}, name string) string {
+	value, _ := fields[name].(string)
+	return value
+}
+
+func fieldUint(fields map[string]interface{}, name string) uint {
+	value, _ := fields[name].(float64)
+	return uint(value)
+}
+
+// textMatch matches a word or phrase against the title and content
+func textMatch(text string, phrase bool) query.Query {
+	fields := []query.Query{}
+	for _, field := range []string{"title", "content"} {
+		if phrase {
+			match := bleve.NewMatchPhraseQuery(text)
+			match.SetField(field)
+			fields = append(fields, match)
+		} else {
+			match := bleve.NewMatchQuery(text)
+			match.SetField(field)
+			fields = append(fields, match)
+		}
+	}
+	return bleve.NewDisjunctionQuery(fields...)
+}
+
+// parseText turns web search syntax into a bleve query: every term must match,
+// "quoted phrases" match as phrases, -term excludes and OR joins its neighbours
+func parseText(text string) (query.Query, error) {
+	type token struct {
+		text    string
+		phrase  bool
+		exclude bool
+	}
+
+	tokens := []token{}
+	for rest := strings.TrimSpace(text); rest != ""; rest = strings.TrimSpace(rest) {
+		t := token{}
+		if strings.HasPrefix(rest, "-") {
+			t.exclude = true
+			rest = rest[1:]
+		}
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			t.text, t.phrase = rest[1:end+1], true
+			rest = rest[min(end+2, len(rest)):]
+		} else {
+			end := strings.IndexAny(rest, " \t\n")
+			if end < 0 {
+				end = len(rest)
+			}
+			t.text = rest[:end]
+			rest = rest[end:]
+		}
+		if strings.TrimSpace(t.text) != "" {
+			tokens = append(tokens, t)
+		}
+	}
+
+	root := bleve.NewBooleanQuery()
+	required := 0
+	var pending []query.Query // alternatives being joined by OR
+	flush := func() {
+		switch len(pending) {
+		case 0:
+			return
+		case 1:
+			root.AddMust(pending[0])
+		default:
+			root.AddMust(bleve.NewDisjunctionQuery(pending...))
+		}
+		required++
+		pending = nil
+	}
+
+	joinNext := false
+	for _, t := range tokens {
+		if !t.phrase && !t.exclude && t.text == "OR" {
+			joinNext = len(pending) > 0
+			continue
+		}
+		match := textMatch(t.text, t.phrase)
+		if t.exclude {
+			root.AddMustNot(match)
+			continue
+		}
+		if !joinNext {
+			flush()
+		}
+		pending = append(pending, match)
+		joinNext = false
+	}
+	flush()
+
+	if required == 0 {
+		return nil, fmt.Errorf("search query has no terms to match")
+	}
+	return root, nil
+}
@@ -0,0 +1,74 @@
+package search
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+func TestParseText(t *testing.T) {
+	index, err := bleve.NewMemOnly(bleveMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	docs := map[string]bleveDocument{
+		"1": {Type: "thread", Title: "Go generics", Content: "type parameters in go"},
+		"2": {Type: "thread", Title: "Rust traits", Content: "ownership and borrowing"},
+		"3": {Type: "thread", Title: "Go channels", Content: "concurrency with goroutines and channels"},
+		"4": {Type: "comment", Content: "parameters of a type"},
+	}
+	for id, doc := range docs {
+		if err := index.Index(id, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		text string
+		want string // matching document IDs, or "error"
+	}{
+		{"go", "1 3"},
+		{"go channels", "3"},
+		{"go OR rust", "1 2 3"},
+		{"ownership OR generics channels", ""},
+		{`"type parameters"`, "1"},
+		{`"type parameters`, "1"},
+		{`parameters "`, "1 4"},
+		{"go -channels", "1"},
+		{`go -"type parameters"`, "3"},
+		{"OR go", "1 3"},
+		{"go OR", "1 3"},
+		{`"OR"`, ""},
+		{"-go", "error"},
+		{`""`, "error"},
+		{"   ", "error"},
+	}
+	for _, test := range tests {
+		q, err := parseText(test.text)
+		if err != nil {
+			if test.want != "error" {
+				t.Errorf("parseText(%q) failed: %v", test.text, err)
+			}
+			continue
+		}
+		if test.want == "error" {
+			t.Errorf("parseText(%q) succeeded, want an error", test.text)
+			continue
+		}
+		result, err := index.Search(bleve.NewSearchRequest(q))
+		if err != nil {
+			t.Fatalf("search %q: %v", test.text, err)
+		}
+		ids := []string{}
+		for _, hit := range result.Hits {
+			ids = append(ids, hit.ID)
+		}
+		sort.Strings(ids)
+		if got := strings.Join(ids, " "); got != test.want {
+			t.Errorf("parseText(%q) matched %q, want %q", test.text, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package search
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// ts_headline marks matched terms with these private-use characters rather
+// than <mark> tags, so the snippet can be escaped before the tags go in.
+// They are stripped from the content first so posts cannot forge them.
+const (
+	markStart = "\uE000"
+	markStop  = "\uE001"
+)
+
+// headlineOptions marks matched terms and keeps snippets short
+const headlineOptions = "StartSel=" + markStart + ", StopSel=" + markStop + ", MaxWords=35, MinWords=15, MaxFragments=2, FragmentDelimiter=\" … \""
+
+// markSnippet HTML-escapes a snippet from ts_headline and wraps the marked
+// terms in <mark> tags, matching what the Bleve highlighter returns
+func markSnippet(snippet string) string {
+	return strings.NewReplacer(markStart, "<mark>", markStop, "</mark>").Replace(html.EscapeString(snippet))
+}
+
+// PostgresIndexer searches the generated tsvector columns added by
+// models.MigrateSearch. Postgres keeps those columns current itself, so
+// Index and Delete have nothing to do.
+type PostgresIndexer struct {
+	DB *gorm.DB
+}
+
+func NewPostgresIndexer(db *gorm.DB) *PostgresIndexer {
+	return &PostgresIndexer{DB: db}
+}
+
+func (p *PostgresIndexer) Index(doc Document) error {
+	return nil
+}
+
+func (p *PostgresIndexer) Delete(docType string, id uint) error {
+	return nil
+}
+
+// Reset rebuilds the GIN indexes from the generated columns
+func (p *PostgresIndexer) Reset() error {
+	if err := p.DB.Exec("REINDEX INDEX idx_threads_search_vector").Error; err != nil {
+		return err
+	}
+	return p.DB.Exec("REINDEX INDEX idx_comments_search_vector").Error
+}
+
+func (p *PostgresIndexer) Close() error {
+	return nil
+}
+
+func (p *PostgresIndexer) Search(q Query) ([]Result, int64, error) {
+	args := map[string]interface{}{"query": q.Text}
+	// Deleted threads and comments wait in the trash, and hidden ones wait
+	// for review, so neither is searchable
+	itemFilters := []string{"%[1]s.deleted_at IS NULL", "%[1]s.hidden = false"}
+	threadFilters := []string{}
+
+	if q.AuthorID != 0 {
+		args["author"] = q.AuthorID
+		itemFilters = append(itemFilters, "%[1]s.user_id = @author")
+	}
+	if q.CategoryID != 0 {
+		args["category"] = q.CategoryID
+		threadFilters = append(threadFilters, "t.category_id = @category")
+	}
+	if q.Tag != "" {
+		args["tag"] = q.Tag
+		threadFilters = append(threadFilters,
+			"t.id IN (SELECT thread_tags.thread_id FROM thread_tags JOIN tags ON tags.id = thread_tags.tag_id WHERE tags.name = @tag)")
+	}
+	if q.From != "" {
+		args["from"] = q.From
+		itemFilters = append(itemFilters, "%[1]s.created_at >= @from")
+	}
+	if q.To != "" {
+		args["to"] = q.To
+		itemFilters = append(itemFilters, "%[1]s.created_at <= @to")
+	}
+	if len(q.ExcludeCategories) > 0 {
+		args["denied"] = q.ExcludeCategories
+		threadFilters = append(threadFilters, "t.category_id NOT IN @denied")
+	}
+
+	// where builds the condition list for the thread or comment half of the query
+	where := func(alias string) string {
+		conditions := []string{alias + ".search_vector @@ q.query"}
+		for _, filter := range itemFilters {
+			conditions = append(conditions, fmt.Sprintf(filter, alias))
+		}
+		conditions = append(conditions, threadFilters...)
+		return strings.Join(conditions, " AND ")
+	}
+
+	selects := []string{}
+	if q.Type != TypeComment {
+		selects = append(selects, `SELECT 'thread' AS type, t.id, t.id AS thread_id, t.title, t.user_id, t.category_id,
+				t.created_at, t.content, ts_rank_cd(t.search_vector, q.query) AS rank
+			FROM threads t, q WHERE t.merged_into_id IS NULL AND `+where("t"))
+	}
+	if q.Type != TypeThread {
+		selects = append(selects, `SELECT 'comment' AS type, cm.id, cm.thread_id, t.title, cm.user_id, t.category_id,
+				cm.created_at, cm.content, ts_rank_cd(cm.search_vector, q.query) AS rank
+			FROM comments cm JOIN threads t ON t.id = cm.thread_id AND t.deleted_at IS NULL AND t.hidden = false, q WHERE `+where("cm"))
+	}
+	matches := `WITH q AS (SELECT websearch_to_tsquery('english', @query) AS query),
+		matches AS (` + strings.Join(selects, " UNION ALL ") + `)`
+
+	var total int64
+	if err := p.DB.Raw(matches+" SELECT count(*) FROM matches", args).Scan(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	args["limit"] = q.PageSize
+	args["offset"] = q.offset()
+	args["headline"] = headlineOptions
+	args["markers"] = markStart + markStop
+
+	// Snippets are only generated for the rows on the requested page
+	results := []Result{}
+	err := p.DB.Raw(matches+`,
+		page AS (SELECT * FROM matches ORDER BY rank DESC, created_at DESC LIMIT @limit OFFSET @offset)
+		SELECT page.type, page.id, page.thread_id, page.title, page.user_id, page.category_id, page.created_at, page.rank,
+			ts_headline('english', translate(page.content, @markers, ''), q.query, @headline) AS snippet
+		FROM page, q ORDER BY page.rank DESC, page.created_at DESC`, args).Scan(&results).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range results {
+		results[i].Snippet = markSnippet(results[i].Snippet)
+	}
+	return results, total, nil
+}
@@ -0,0 +1,26 @@
+package search
+
+import "testing"
+
+func TestMarkSnippet(t *testing.T) {
+	tests := []struct {
+		name    string
+		snippet string
+		want    string
+	}{
+		{"plain", "no matches here", "no matches here"},
+		{"marked term", "a " + markStart + "forum" + markStop + " post", "a <mark>forum</mark> post"},
+		{
+			"script in content",
+			`<script>alert("x")</script> ` + markStart + "forum" + markStop,
+			`&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt; <mark>forum</mark>`,
+		},
+		{"tag inside a match", markStart + "<b>bold</b>" + markStop, "<mark>&lt;b&gt;bold&lt;/b&gt;</mark>"},
+		{"ampersand", "fish & chips", "fish &amp; chips"},
+	}
+	for _, test := range tests {
+		if got := markSnippet(test.snippet); got != test.want {
+			t.Errorf("%s: markSnippet(%q) = %q, want %q", test.name, test.snippet, got, test.want)
+		}
+	}
+}
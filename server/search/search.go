@@ -0,0 +1,266 @@
+package search
+
+import (
+	"log"
+
+	"github.com/damiancxliew/web-forum/events"
+	"github.com/damiancxliew/web-forum/models"
+	"gorm.io/gorm"
+)
+
+// Document types
+const (
+	TypeThread  = "thread"
+	TypeComment = "comment"
+)
+
+// Document is a thread or comment as seen by a search backend
+type Document struct {
+	Type       string
+	ID         uint
+	ThreadID   uint
+	Title      string
+	Content    string
+	UserID     uint
+	CategoryID uint
+	Tags       []string
+	CreatedAt  string
+}
+
+// Query describes a search request. Text follows web search syntax:
+// "quoted phrases", OR and -excluded terms. Empty filters are ignored.
+type Query struct {
+	Text              string
+	Type              string // TypeThread, TypeComment or empty for both
+	AuthorID          uint
+	CategoryID        uint
+	Tag               string
+	From              string // inclusive created_at bounds in ISO format
+	To                string
+	ExcludeCategories []uint
+	Page              int
+	PageSize          int
+}
+
+func (q Query) offset() int {
+	return (q.Page - 1) * q.PageSize
+}
+
+// Result is a single thread or comment matching a query
+type Result struct {
+	Type       string  `json:"type"`
+	ID         uint    `json:"id"`
+	ThreadID   uint    `json:"thread_id"`
+	Title      string  `json:"title"`
+	UserID     uint    `json:"user_id"`
+	CategoryID uint    `json:"category_id"`
+	CreatedAt  string  `json:"created_at"`
+	Rank       float64 `json:"rank"`
+	Snippet    string  `json:"snippet"`
+}
+
+// Indexer is a search backend. Backends that derive their index from the
+// database directly may treat Index and Delete as no-ops.
+type Indexer interface {
+	// Index adds or replaces a document
+	Index(doc Document) error
+	// Delete removes a document; deleting a thread also removes its comments
+	Delete(docType string, id uint) error
+	// Search returns one page of results and the total number of matches
+	Search(q Query) ([]Result, int64, error)
+	// Reset drops everything indexed so far, ahead of a rebuild
+	Reset() error
+	Close() error
+}
+
+// threadTags returns the tag names attached to a thread
+func threadTags(db *gorm.DB, threadID uint) []string {
+	tags := []string{}
+	db.Model(&models.Tag{}).
+		Joins("JOIN thread_tags ON thread_tags.tag_id = tags.id").
+		Where("thread_tags.thread_id = ?", threadID).
+		Pluck("tags.name", &tags)
+	return tags
+}
+
+func threadDocument(db *gorm.DB, thread models.Thread) Document {
+	return Document{
+		Type:       TypeThread,
+		ID:         thread.ID,
+		ThreadID:   thread.ID,
+		Title:      thread.Title,
+		Content:    thread.Content,
+		UserID:     thread.UserID,
+		CategoryID: thread.CategoryID,
+		Tags:       threadTags(db, thread.ID),
+		CreatedAt:  thread.CreatedAt,
+	}
+}
+
+func commentDocument(db *gorm.DB, comment models.Comment, thread models.Thread) Document {
+	return Document{
+		Type:       TypeComment,
+		ID:         comment.ID,
+		ThreadID:   comment.ThreadID,
+		Title:      thread.Title,
+		Content:    comment.Content,
+		UserID:     comment.UserID,
+		CategoryID: thread.CategoryID,
+		Tags:       threadTags(db, thread.ID),
+		CreatedAt:  comment.CreatedAt,
+	}
+}
+
+// indexThread indexes a thread, or drops it from the index while it is
+// hidden pending review
+func indexThread(db *gorm.DB, indexer Indexer, thread models.Thread) error {
+	if thread.Hidden {
+		return indexer.Delete(TypeThread, thread.ID)
+	}
+	return indexer.Index(threadDocument(db, thread))
+}
+
+// indexComment indexes a comment unless it or its thread is hidden
+func indexComment(db *gorm.DB, indexer Indexer, comment models.Comment, thread models.Thread) error {
+	if comment.Hidden || thread.Hidden {
+		return indexer.Delete(TypeComment, comment.ID)
+	}
+	return indexer.Index(commentDocument(db, comment, thread))
+}
+
+// IndexThread loads a thread and (re)indexes it
+func IndexThread(db *gorm.DB, indexer Indexer, threadID uint) error {
+	thread := models.Thread{}
+	if err := db.First(&thread, threadID).Error; err != nil {
+		return err
+	}
+	return indexThread(db, indexer, thread)
+}
+
+// IndexComment loads a comment and (re)indexes it
+func IndexComment(db *gorm.DB, indexer Indexer, commentID uint) error {
+	comment := models.Comment{}
+	if err := db.First(&comment, commentID).Error; err != nil {
+		return err
+	}
+	thread := models.Thread{}
+	if err := db.First(&thread, comment.ThreadID).Error; err != nil {
+		return err
+	}
+	return indexComment(db, indexer, comment, thread)
+}
+
+// IndexThreadWithComments re-indexes a thread and every comment in it, such
+// as after it moved category or gained comments from another thread
+func IndexThreadWithComments(db *gorm.DB, indexer Indexer, threadID uint) error {
+	thread := models.Thread{}
+	if err := db.First(&thread, threadID).Error; err != nil {
+		return err
+	}
+	if err := indexThread(db, indexer, thread); err != nil {
+		return err
+	}
+	comments := []models.Comment{}
+	if err := db.Where("thread_id = ?", threadID).Find(&comments).Error; err != nil {
+		return err
+	}
+	for _, comment := range comments {
+		if err := indexComment(db, indexer, comment, thread); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Subscribe keeps the index current by feeding it thread and comment lifecycle events
+func Subscribe(bus *events.Bus, db *gorm.DB, indexer Indexer) {
+	bus.Subscribe("search", func(event events.Event) {
+		var err error
+		switch event.Type {
+		case events.ThreadCreated, events.ThreadUpdated:
+			err = IndexThread(db, indexer, event.ThreadID)
+		case events.ThreadDeleted:
+			err = indexer.Delete(TypeThread, event.ThreadID)
+		case events.CommentCreated, events.CommentUpdated:
+			err = IndexComment(db, indexer, event.CommentID)
+		case events.CommentDeleted:
+			err = indexer.Delete(TypeComment, event.CommentID)
+		case events.ThreadMoved, events.ThreadRestored:
+			err = IndexThreadWithComments(db, indexer, event.ThreadID)
+		case events.CommentRestored:
+			err = IndexComment(db, indexer, event.CommentID)
+		case events.ThreadMerged:
+			// Merged threads are redirects and no longer searchable
+			if err = indexer.Delete(TypeThread, event.ThreadID); err == nil {
+				err = IndexThreadWithComments(db, indexer, event.TargetThreadID)
+			}
+		case events.ThreadSplit:
+			err = IndexThreadWithComments(db, indexer, event.TargetThreadID)
+		case events.ContentHidden, events.ContentUnhidden:
+			// Reindexing drops hidden posts and brings back ones shown again
+			if event.CommentID != 0 {
+				err = IndexComment(db, indexer, event.CommentID)
+			} else {
+				err = IndexThreadWithComments(db, indexer, event.ThreadID)
+			}
+		}
+		if err != nil {
+			log.Printf("Search index error on %s: %v", event.Type, err)
+		}
+	}, events.ThreadCreated, events.ThreadUpdated, events.ThreadDeleted,
+		events.CommentCreated, events.CommentUpdated, events.CommentDeleted,
+		events.ThreadMoved, events.ThreadMerged, events.ThreadSplit,
+		events.ThreadRestored, events.CommentRestored,
+		events.ContentHidden, events.ContentUnhidden)
+}
+
+// rebuildBatchSize is how many rows are loaded at a time while rebuilding
+const rebuildBatchSize = 500
+
+// Rebuild resets the index and re-indexes every thread and comment in the database
+func Rebuild(db *gorm.DB, indexer Indexer) (threads, comments int, err error) {
+	if err := indexer.Reset(); err != nil {
+		return 0, 0, err
+	}
+
+	batch := []models.Thread{}
+	err = db.Where("merged_into_id IS NULL AND hidden = ?", false).FindInBatches(&batch, rebuildBatchSize, func(tx *gorm.DB, _ int) error {
+		for _, thread := range batch {
+			if err := indexer.Index(threadDocument(db, thread)); err != nil {
+				return err
+			}
+			threads++
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return threads, comments, err
+	}
+
+	// Comments whose thread no longer exists or is hidden are not searchable
+	commentBatch := []models.Comment{}
+	err = db.Where("hidden = ? AND thread_id IN (?)", false, db.Model(&models.Thread{}).Select("id").Where("hidden = ?", false)).
+		FindInBatches(&commentBatch, rebuildBatchSize, func(tx *gorm.DB, _ int) error {
+			threadIDs := []uint{}
+			for _, comment := range commentBatch {
+				threadIDs = append(threadIDs, comment.ThreadID)
+			}
+			parents := []models.Thread{}
+			if err := db.Where("id IN ?", threadIDs).Find(&parents).Error; err != nil {
+				return err
+			}
+			byID := make(map[uint]models.Thread, len(parents))
+			for _, thread := range parents {
+				byID[thread.ID] = thread
+			}
+
+			for _, comment := range commentBatch {
+				if err := indexer.Index(commentDocument(db, comment, byID[comment.ThreadID])); err != nil {
+					return err
+				}
+				comments++
+			}
+			return nil
+		}).Error
+	return threads, comments, err
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// linkPattern finds the links in a post, with or without a scheme
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"'()\[\]]+`)
+
+// duplicateWindow is how far back duplicate_content looks for the same text
+const duplicateWindow = 24 * time.Hour
+
+// duplicateMinLength keeps short replies like "Thanks!" from counting as
+// duplicates
+const duplicateMinLength = 30
+
+// spamPost is what the spam heuristics see of a new or edited post
+type spamPost struct {
+	UserID   uint
+	ThreadID uint // the thread the post belongs to, 0 for a new thread
+	Title    string
+	Content  string
+	Hosts    []string // the host of each link in the title and content
+}
+
+// spamHeuristic scores how much a post looks like spam. The scores of all
+// heuristics add up, and a post is held once the total reaches the hold score.
+type spamHeuristic func(db *gorm.DB, post spamPost) int
+
+// spamHeuristics are the built-in checks, by the name they are reported under
+var spamHeuristics = map[string]spamHeuristic{
+	// A post that is half links scores the full 100
+	"link_density": func(db *gorm.DB, post spamPost) int {
+		words := len(strings.Fields(post.Title + " " + post.Content))
+		if len(post.Hosts) == 0 || words == 0 {
+			return 0
+		}
+		return min(100, len(post.Hosts)*200/words)
+	},
+	// The same text posted in other threads, by anyone, scores 50 per copy
+	"duplicate_content": func(db *gorm.DB, post spamPost) int {
+		content := strings.TrimSpace(post.Content)
+		if utf8.RuneCountInString(content) < duplicateMinLength {
+			return 0
+		}
+		since := time.Now().Add(-duplicateWindow).UTC().Format(isoTimestamp)
+		var threads, comments int64
+		db.Unscoped().Model(&models.Thread{}).
+			Where("content = ? AND id <> ? AND created_at > ?", content, post.ThreadID, since).Count(&threads)
+		db.Unscoped().Model(&models.Comment{}).
+			Where("content = ? AND thread_id <> ? AND created_at > ?", content, post.ThreadID, since).Count(&comments)
+		return min(100, int(threads+comments)*50)
+	},
+	// Any link to a domain in SPAM_DOMAINS, or one of its subdomains, holds
+	// the post
+	"bad_domain": func(db *gorm.DB, post spamPost) int {
+		for _, host := range post.Hosts {
+			for _, domain := range spamDomains() {
+				if host == domain || strings.HasSuffix(host, "."+domain) {
+					return 100
+				}
+			}
+		}
+		return 0
+	},
+}
+
+// spamDomains lists the known bad domains from SPAM_DOMAINS, comma separated
+func spamDomains() []string {
+	domains := []string{}
+	for _, domain := range strings.Split(os.Getenv("SPAM_DOMAINS"), ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// spamHoldScore is the total score that holds a post; SPAM_HOLD_SCORE
+// overrides the default of 100
+func spamHoldScore() int {
+	score, err := strconv.Atoi(os.Getenv("SPAM_HOLD_SCORE"))
+	if err != nil || score < 1 {
+		return 100
+	}
+	return score
+}
+
+// linkHosts returns the lowercased host of each link in text
+func linkHosts(text string) []string {
+	hosts := []string{}
+	for _, link := range linkPattern.FindAllString(text, -1) {
+		// Punctuation ending a sentence is not part of the link
+		link = strings.TrimRight(link, ".,;:!?")
+		if !strings.Contains(link, "://") {
+			link = "http://" + link
+		}
+		if parsed, err := url.Parse(link); err == nil && parsed.Hostname() != "" {
+			hosts = append(hosts, strings.ToLower(parsed.Hostname()))
+		}
+	}
+	return hosts
+}
+
+// spamResult is what the spam heuristics made of a post
+type spamResult struct {
+	Score  int
+	Scores map[string]int // by heuristic, leaving out those that scored 0
+	Held   bool
+}
+
+// detail describes the scores for the moderation queue
+func (result spamResult) detail() string {
+	names := make([]string, 0, len(result.Scores))
+	for name := range result.Scores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s %d", name, result.Scores[name])
+	}
+	return fmt.Sprintf("Spam score %d (%s)", result.Score, strings.Join(parts, ", "))
+}
+
+// screenSpam applies the new-user limits to a post and scores it if its
+// author is below the member trust level. Moderators and admins are never
+// checked. It responds and returns false if a limit rejects the post;
+// creating is false for edits, which are not rate limited.
+func (r *Repository) screenSpam(c *gin.Context, post spamPost, creating bool) (spamResult, bool) {
+	result := spamResult{Scores: map[string]int{}}
+	if r.hasRole(post.UserID, models.RoleAdmin, models.RoleModerator) {
+		return result, true
+	}
+	level := r.trustLevel(post.UserID)
+	post.Hosts = linkHosts(post.Title + "\n" + post.Content)
+	if level == models.TrustNew && !r.checkNewUserLimits(c, post.UserID, len(post.Hosts), creating) {
+		return result, false
+	}
+	if level >= models.TrustMember {
+		return result, true
+	}
+
+	for name, heuristic := range spamHeuristics {
+		if score := heuristic(r.DB, post); score > 0 {
+			result.Scores[name] = score
+			result.Score += score
+		}
+	}
+	result.Held = result.Score >= spamHoldScore()
+	return result, true
+}
+
+// queueSpam puts a post the spam heuristics held in the moderation queue
+func queueSpam(tx *gorm.DB, targetType string, targetID uint, result spamResult) error {
+	if !result.Held {
+		return nil
+	}
+	return queueForReview(tx, targetType, targetID, models.QueueSourceSpam, result.detail())
+}
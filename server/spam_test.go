@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/damiancxliew/web-forum/models"
+)
+
+func TestLinkHosts(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"no links here", []string{}},
+		{"see https://Example.com/path?q=1", []string{"example.com"}},
+		{"www.spam.example, then http://a.org.", []string{"www.spam.example", "a.org"}},
+		{"[text](https://md.example) and <http://angle.example>", []string{"md.example", "angle.example"}},
+		{"HTTP://user@evil.example:8080/x", []string{"evil.example"}},
+		{"bare https:// and example.com", []string{}},
+		{"mailto:someone@example.com", []string{}},
+	}
+	for _, test := range tests {
+		if got := linkHosts(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("linkHosts(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestSpamHeuristics(t *testing.T) {
+	t.Setenv("SPAM_DOMAINS", " Spam.example ,,bad.test")
+	tests := []struct {
+		heuristic string
+		title     string
+		content   string
+		want      int
+	}{
+		{"link_density", "", "no links at all", 0},
+		{"link_density", "Hi", "read https://a.example", 66},
+		{"link_density", "", "https://a.example https://b.example", 100},
+		{"link_density", "A long post", "with one link https://a.example among many other ordinary words here", 15},
+		{"bad_domain", "", "https://spam.example/offer", 100},
+		{"bad_domain", "", "https://www.SPAM.example", 100},
+		{"bad_domain", "", "https://notspam.example and bad.test.evil.example", 0},
+		{"bad_domain", "", "see www.bad.test, now", 100},
+	}
+	for _, test := range tests {
+		post := spamPost{Title: test.title, Content: test.content}
+		post.Hosts = linkHosts(test.title + "\n" + test.content)
+		if got := spamHeuristics[test.heuristic](nil, post); got != test.want {
+			t.Errorf("%s(%q, %q) = %d, want %d", test.heuristic, test.title, test.content, got, test.want)
+		}
+	}
+}
+
+func TestSpamResultDetail(t *testing.T) {
+	result := spamResult{Score: 150, Scores: map[string]int{"link_density": 50, "bad_domain": 100}}
+	if got, want := result.detail(), "Spam score 150 (bad_domain 100, link_density 50)"; got != want {
+		t.Errorf("detail() = %q, want %q", got, want)
+	}
+}
+
+func TestEarnedTrustLevel(t *testing.T) {
+	t.Setenv("TRUST_REQUIREMENTS", "")
+	day := 24 * time.Hour
+	tests := []struct {
+		age   time.Duration // negative for an unknown join date
+		posts int64
+		want  int
+	}{
+		{0, 0, models.TrustNew},
+		{0, 50, models.TrustNew},
+		{2 * day, 2, models.TrustNew},
+		{2 * day, 3, models.TrustBasic},
+		{30 * day, 19, models.TrustBasic},
+		{13 * day, 50, models.TrustBasic},
+		{14*day + time.Hour, 20, models.TrustMember},
+		{-1, 0, models.TrustNew},
+		{-1, 3, models.TrustBasic},
+		{-1, 20, models.TrustMember},
+	}
+	for _, test := range tests {
+		var joinedAt *time.Time
+		if test.age >= 0 {
+			joined := time.Now().Add(-test.age)
+			joinedAt = &joined
+		}
+		if got := earnedTrustLevel(joinedAt, test.posts); got != test.want {
+			t.Errorf("earnedTrustLevel(%v old, %d posts) = %d, want %d", test.age, test.posts, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/damiancxliew/web-forum/realtime"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// sseBacklogLimit caps how many missed events are replayed on reconnect
+	sseBacklogLimit = 500
+	sseHeartbeat    = 25 * time.Second
+	sseBuffer       = 256
+)
+
+// StreamEvents is a Server-Sent Events feed of the same events the WebSocket
+// endpoint carries, for clients behind proxies that block WebSockets.
+// Subscribe with ?channels=thread:1,category:2,notifications. Reconnecting
+// clients send Last-Event-ID (or ?last_event_id=) to replay what they missed;
+// if those events are no longer in the log a "reset" event tells the client to
+// refetch instead. The feed ends with an "expired" event when the token does,
+// and is closed if the user is banned or deleted.
+func (r *Repository) StreamEvents(c *gin.Context) {
+	// EventSource cannot set headers, so the JWT may come as a query param
+	if token := c.Query("token"); token != "" && c.GetHeader("Authorization") == "" {
+		c.Request.Header.Set("Authorization", "Bearer "+token)
+	}
+	// A nil channel never fires, so anonymous feeds do not expire
+	var expired <-chan time.Time
+	if c.GetHeader("Authorization") != "" {
+		claims, err := parseToken(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"message": "Invalid token"})
+			return
+		}
+		setClaims(c, claims)
+		if !r.checkAccount(c) {
+			return
+		}
+		if exp, ok := claims["exp"].(float64); ok {
+			timer := time.NewTimer(time.Until(time.Unix(int64(exp), 0)))
+			defer timer.Stop()
+			expired = timer.C
+		}
+	}
+	userID := currentUserID(c)
+
+	authorize := r.channelAuthorizer(userID)
+	channels := map[string]bool{}
+	for _, channel := range strings.Split(c.Query("channels"), ",") {
+		channel = strings.TrimSpace(channel)
+		if channel == "" {
+			continue
+		}
+		if channel == realtime.NotificationsChannel {
+			channel = realtime.UserChannel(userID)
+		}
+		if !authorize(channel) {
+			c.JSON(http.StatusForbidden, gin.H{"message": fmt.Sprintf("Cannot subscribe to %s", channel)})
+			return
+		}
+		channels[channel] = true
+	}
+	if len(channels) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "At least one channel is required"})
+		return
+	}
+
+	lastID, _ := strconv.ParseUint(c.GetHeader("Last-Event-ID"), 10, 64)
+	if lastID == 0 {
+		lastID, _ = strconv.ParseUint(c.Query("last_event_id"), 10, 64)
+	}
+
+	// Subscribe before reading the backlog so nothing slips through in between
+	stream := realtime.NewStream(sseBuffer)
+	r.Hub.Connect(stream, userID)
+	for channel := range channels {
+		r.Hub.Subscribe(stream, channel)
+	}
+	defer r.Hub.Remove(stream)
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	fmt.Fprint(c.Writer, "retry: 3000\n\n")
+	c.Writer.Flush()
+
+	sent := lastID
+	if lastID > 0 {
+		backlog, complete, err := r.EventLog.Since(lastID, sseBacklogLimit)
+		if err != nil || !complete || len(backlog) == sseBacklogLimit {
+			realtime.WriteSSE(c.Writer, realtime.Message{Type: "reset", Message: "missed events are no longer available"})
+		}
+		for _, event := range backlog {
+			for _, channel := range realtime.Channels(event) {
+				if channels[channel] {
+					realtime.WriteSSE(c.Writer, realtime.EventMessage(channel, event))
+					break
+				}
+			}
+			sent = event.ID
+		}
+		c.Writer.Flush()
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case message, ok := <-stream.Messages():
+			if !ok {
+				return
+			}
+			// Skip live events already replayed from the backlog
+			if message.Event != nil && message.Event.ID != 0 && message.Event.ID <= sent {
+				continue
+			}
+			if err := realtime.WriteSSE(c.Writer, message); err != nil {
+				return
+			}
+			if message.Event != nil && message.Event.ID != 0 {
+				sent = message.Event.ID
+			}
+			c.Writer.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-expired:
+			realtime.WriteSSE(c.Writer, realtime.Message{Type: "expired", Message: "token expired, sign in again"})
+			c.Writer.Flush()
+			return
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
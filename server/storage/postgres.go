@@ -50,12 +50,16 @@ func ParseURL(databaseURL string) (*Config, error) {
 	}, nil
 }
 
-func NewConnection(config *Config) (*gorm.DB, error) {
-	dsn := fmt.Sprintf(
+// DSN builds the connection string for the config
+func (config *Config) DSN() string {
+	return fmt.Sprintf(
 		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
 		config.Host, config.Port, config.User, config.Password, config.DBName, config.SSLMode,
 	)
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+}
+
+func NewConnection(config *Config) (*gorm.DB, error) {
+	db, err := gorm.Open(postgres.Open(config.DSN()), &gorm.Config{})
 	if err != nil {
 		return db, err
 	}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/damiancxliew/web-forum/events"
+	"github.com/damiancxliew/web-forum/markup"
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errThreadMerged  = errors.New("thread was merged")
+	errCommentsMoved = errors.New("comments moved")
+)
+
+// logModeration records a moderator's action on a thread
+func logModeration(tx *gorm.DB, entry models.ModerationLog) error {
+	return tx.Create(&entry).Error
+}
+
+// moveComments moves comments from one thread to another along with the
+// mentions, attachments and notifications recorded against them, and returns
+// how many comments were still there to move. Timestamps are left as they were.
+func moveComments(tx *gorm.DB, commentIDs []uint, fromID, toID uint) (int64, error) {
+	if len(commentIDs) == 0 {
+		return 0, nil
+	}
+	result := tx.Unscoped().Model(&models.Comment{}).Where("id IN ? AND thread_id = ?", commentIDs, fromID).UpdateColumn("thread_id", toID)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	for _, model := range []interface{}{&models.Mention{}, &models.GroupMention{}, &models.Attachment{}, &models.Notification{}} {
+		if err := tx.Model(model).Where("comment_id IN ?", commentIDs).UpdateColumn("thread_id", toID).Error; err != nil {
+			return 0, err
+		}
+	}
+	return result.RowsAffected, nil
+}
+
+// loadMovableThread finds the thread named by the :id param, refusing threads
+// that were already merged away
+func (r *Repository) loadMovableThread(c *gin.Context) (models.Thread, bool) {
+	thread := models.Thread{}
+	if err := r.DB.First(&thread, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Thread not found"})
+		return thread, false
+	}
+	if thread.MergedIntoID != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "This thread was merged into another"})
+		return thread, false
+	}
+	return thread, true
+}
+
+// MoveThread moves a thread to another category: {"category_id": 2}
+func (r *Repository) MoveThread(c *gin.Context) {
+	thread, ok := r.loadMovableThread(c)
+	if !ok {
+		return
+	}
+	var moveRequest struct {
+		CategoryID uint `json:"category_id"`
+	}
+	if err := c.ShouldBindJSON(&moveRequest); err != nil || moveRequest.CategoryID == 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Provide the category_id to move to"})
+		return
+	}
+	if moveRequest.CategoryID == thread.CategoryID {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "The thread is already in this category"})
+		return
+	}
+	category := models.Category{}
+	if err := r.DB.First(&category, moveRequest.CategoryID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Category not found"})
+		return
+	}
+
+	userID := currentUserID(c)
+	from := thread.CategoryID
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Thread{}).Where("id = ? AND merged_into_id IS NULL", thread.ID).
+			Update("category_id", category.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errThreadMerged
+		}
+		return logModeration(tx, models.ModerationLog{
+			ModeratorID: userID,
+			Action:      models.ModerationMove,
+			ThreadID:    thread.ID,
+			Detail:      fmt.Sprintf("category %d to %d", from, category.ID),
+		})
+	})
+	if errors.Is(err, errThreadMerged) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "This thread was merged into another"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not move thread"})
+		return
+	}
+	thread.CategoryID = category.ID
+	r.audit(c, models.AuditThreadMove, models.TargetThread, thread.ID, gin.H{"category_id": from}, gin.H{"category_id": category.ID})
+
+	r.Events.Publish(events.Event{
+		Type:       events.ThreadMoved,
+		ThreadID:   thread.ID,
+		CategoryID: thread.CategoryID,
+		UserID:     userID,
+		AuthorID:   thread.UserID,
+		Detail:     fmt.Sprint(from),
+	})
+	threads := []models.Thread{thread}
+	r.attachQuestionState(threads)
+	c.JSON(http.StatusOK, gin.H{"message": "Thread moved successfully", "data": threads[0]})
+}
+
+// MergeThread moves every comment of a thread into another one and leaves the
+// thread behind as a locked redirect: {"target_thread_id": 2}
+func (r *Repository) MergeThread(c *gin.Context) {
+	thread, ok := r.loadMovableThread(c)
+	if !ok {
+		return
+	}
+	var mergeRequest struct {
+		TargetThreadID uint `json:"target_thread_id"`
+	}
+	if err := c.ShouldBindJSON(&mergeRequest); err != nil || mergeRequest.TargetThreadID == 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Provide the target_thread_id to merge into"})
+		return
+	}
+	if mergeRequest.TargetThreadID == thread.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "A thread cannot be merged into itself"})
+		return
+	}
+	target := models.Thread{}
+	if err := r.DB.First(&target, mergeRequest.TargetThreadID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Target thread not found"})
+		return
+	}
+	if thread.Archived || target.Archived {
+		c.JSON(http.StatusForbidden, gin.H{"message": "Archived threads cannot be merged"})
+		return
+	}
+
+	userID := currentUserID(c)
+	var commentIDs []uint
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		// Both threads are locked in id order, so opposing merges cannot
+		// deadlock and neither thread can be merged away underneath us
+		locked := []models.Thread{}
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id IN ?", []uint{thread.ID, target.ID}).Order("id").Find(&locked).Error
+		if err != nil {
+			return err
+		}
+		for _, each := range locked {
+			if each.MergedIntoID != nil {
+				return errThreadMerged
+			}
+		}
+
+		// Deleted comments move too, so their tombstones stay in place
+		if err := tx.Unscoped().Model(&models.Comment{}).Where("thread_id = ?", thread.ID).Pluck("id", &commentIDs).Error; err != nil {
+			return err
+		}
+		if _, err := moveComments(tx, commentIDs, thread.ID, target.ID); err != nil {
+			return err
+		}
+		err = tx.Model(&models.Thread{}).Where("id = ?", thread.ID).Updates(map[string]interface{}{
+			"merged_into_id":      target.ID,
+			"locked":              true,
+			"accepted_comment_id": nil,
+		}).Error
+		if err != nil {
+			return err
+		}
+		// Earlier redirects to this thread now lead straight to the target
+		err = tx.Model(&models.Thread{}).Where("merged_into_id = ?", thread.ID).Update("merged_into_id", target.ID).Error
+		if err != nil {
+			return err
+		}
+		return logModeration(tx, models.ModerationLog{
+			ModeratorID:    userID,
+			Action:         models.ModerationMerge,
+			ThreadID:       thread.ID,
+			TargetThreadID: &target.ID,
+			Detail:         fmt.Sprintf("%d comments", len(commentIDs)),
+		})
+	})
+	if errors.Is(err, errThreadMerged) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "One of the threads was merged into another"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not merge threads"})
+		return
+	}
+	r.audit(c, models.AuditThreadMerge, models.TargetThread, thread.ID, thread,
+		gin.H{"merged_into_id": target.ID, "comment_ids": commentIDs})
+
+	r.Events.Publish(events.Event{
+		Type:           events.ThreadMerged,
+		ThreadID:       thread.ID,
+		TargetThreadID: target.ID,
+		CategoryID:     target.CategoryID,
+		UserID:         userID,
+		AuthorID:       thread.UserID,
+		Detail:         fmt.Sprint(len(commentIDs)),
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Threads merged successfully",
+		"data":    gin.H{"thread_id": target.ID, "comments": len(commentIDs)},
+	})
+}
+
+// SplitThread moves the chosen comments out into a new thread, started by the
+// moderator in the same category unless another is given:
+// {"comment_ids": [4, 5], "title": "Off-topic discussion", "content": "", "category_id": 0}
+func (r *Repository) SplitThread(c *gin.Context) {
+	thread, ok := r.loadMovableThread(c)
+	if !ok {
+		return
+	}
+	if thread.Archived {
+		c.JSON(http.StatusForbidden, gin.H{"message": "This thread is archived"})
+		return
+	}
+	var splitRequest struct {
+		CommentIDs []uint `json:"comment_ids"`
+		Title      string `json:"title"`
+		Content    string `json:"content"`
+		CategoryID uint   `json:"category_id"`
+	}
+	if err := c.ShouldBindJSON(&splitRequest); err != nil || len(splitRequest.CommentIDs) == 0 || splitRequest.Title == "" {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Provide a title and the comment_ids to split off"})
+		return
+	}
+	chosen := map[uint]bool{}
+	for _, id := range splitRequest.CommentIDs {
+		chosen[id] = true
+	}
+	commentIDs := make([]uint, 0, len(chosen))
+	for id := range chosen {
+		commentIDs = append(commentIDs, id)
+	}
+	var count int64
+	r.DB.Model(&models.Comment{}).Where("id IN ? AND thread_id = ?", commentIDs, thread.ID).Count(&count)
+	if int(count) != len(commentIDs) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Comment not found in this thread"})
+		return
+	}
+	if splitRequest.CategoryID == 0 {
+		splitRequest.CategoryID = thread.CategoryID
+	} else if err := r.DB.First(&models.Category{}, splitRequest.CategoryID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Category not found"})
+		return
+	}
+	if splitRequest.Content == "" {
+		splitRequest.Content = fmt.Sprintf("Split from [%s](%s)", thread.Title, threadLink(thread.ID))
+	}
+	html, err := markup.Render(splitRequest.Content)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not render content"})
+		return
+	}
+
+	userID := currentUserID(c)
+	now := time.Now().UTC().Format(isoTimestamp)
+	split := models.Thread{
+		Title:       splitRequest.Title,
+		Content:     splitRequest.Content,
+		ContentHTML: html,
+		UserID:      userID,
+		CategoryID:  splitRequest.CategoryID,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		locked := models.Thread{}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&locked, thread.ID).Error; err != nil {
+			return err
+		}
+		if locked.MergedIntoID != nil {
+			return errThreadMerged
+		}
+		if err := tx.Create(&split).Error; err != nil {
+			return err
+		}
+
+		// The comments must all still be in the thread when they move
+		moved, err := moveComments(tx, commentIDs, thread.ID, split.ID)
+		if err != nil {
+			return err
+		}
+		if int(moved) != len(commentIDs) {
+			return errCommentsMoved
+		}
+
+		// Replies never point across threads, so links cut by the split are dropped
+		err = tx.Unscoped().Model(&models.Comment{}).
+			Where("(thread_id = ? AND parent_id IN ?) OR (thread_id = ? AND parent_id NOT IN ?)", thread.ID, commentIDs, split.ID, commentIDs).
+			UpdateColumn("parent_id", nil).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&models.Thread{}).Where("id = ? AND accepted_comment_id IN ?", thread.ID, commentIDs).
+			Update("accepted_comment_id", nil).Error
+		if err != nil {
+			return err
+		}
+		return logModeration(tx, models.ModerationLog{
+			ModeratorID:    userID,
+			Action:         models.ModerationSplit,
+			ThreadID:       thread.ID,
+			TargetThreadID: &split.ID,
+			Detail:         fmt.Sprintf("%d comments", len(commentIDs)),
+		})
+	})
+	if errors.Is(err, errThreadMerged) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "This thread was merged into another"})
+		return
+	}
+	if errors.Is(err, errCommentsMoved) {
+		c.JSON(http.StatusConflict, gin.H{"message": "Some comments are no longer in this thread"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not split thread"})
+		return
+	}
+	r.audit(c, models.AuditThreadSplit, models.TargetThread, thread.ID, gin.H{"comment_ids": commentIDs},
+		gin.H{"thread_id": split.ID, "comment_ids": commentIDs})
+
+	r.Events.Publish(events.Event{
+		Type:           events.ThreadSplit,
+		ThreadID:       thread.ID,
+		TargetThreadID: split.ID,
+		CategoryID:     thread.CategoryID,
+		UserID:         userID,
+		AuthorID:       thread.UserID,
+		Detail:         fmt.Sprint(len(commentIDs)),
+	})
+	split.Mentions = []models.Mention{}
+	split.Reactions, split.MyReactions = map[string]int{}, []string{}
+	threads := []models.Thread{split}
+	r.attachQuestionState(threads)
+	c.JSON(http.StatusOK, gin.H{"message": "Thread split successfully", "data": threads[0]})
+}
+
+// GetModerationLog lists moderation actions, newest first, optionally those
+// touching one ?thread_id= or of one ?action=
+func (r *Repository) GetModerationLog(c *gin.Context) {
+	page, pageSize := pagination(c)
+
+	query := r.DB.Model(&models.ModerationLog{})
+	if threadID := c.Query("thread_id"); threadID != "" {
+		query = query.Where("thread_id = ? OR target_thread_id = ?", threadID, threadID)
+	}
+	if action := c.Query("action"); action != "" {
+		query = query.Where("action = ?", action)
+	}
+	query = query.Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get moderation log"})
+		return
+	}
+	entries := []models.ModerationLog{}
+	err := query.Order("created_at DESC, id DESC").Limit(pageSize).Offset((page - 1) * pageSize).Find(&entries).Error
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get moderation log"})
+		return
+	}
+	c.JSON(http.StatusOK, paginated(entries, page, pageSize, total))
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/damiancxliew/web-forum/events"
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// pinOrder sorts global pins first and, when listing one category, that
+// category's pins next. Recently pinned threads come first among pins.
+func pinOrder(query *gorm.DB, categoryFiltered bool) *gorm.DB {
+	// The pin values are constants, so they are safe to write into the SQL
+	rank := fmt.Sprintf("CASE pin WHEN '%s' THEN 0 ELSE 1 END", models.PinGlobal)
+	if categoryFiltered {
+		rank = fmt.Sprintf("CASE pin WHEN '%s' THEN 0 WHEN '%s' THEN 1 ELSE 2 END", models.PinGlobal, models.PinCategory)
+	}
+	return query.Order(rank).Order("pinned_at DESC NULLS LAST").Order("id")
+}
+
+// replyBlocked explains why userID may not reply to or change a thread, or
+// returns "" if they may. Archived threads are read-only for everyone, while
+// moderators can still reply to locked ones.
+func (r *Repository) replyBlocked(thread models.Thread, userID uint) string {
+	if thread.MergedIntoID != nil {
+		return "This thread was merged into another"
+	}
+	if thread.Archived {
+		return "This thread is archived"
+	}
+	if thread.Locked && !r.hasRole(userID, models.RoleAdmin, models.RoleModerator) {
+		return "This thread is locked"
+	}
+	return ""
+}
+
+// isArchived reports whether a thread is read-only
+func (r *Repository) isArchived(threadID uint) bool {
+	thread := models.Thread{}
+	return r.DB.Select("archived").First(&thread, threadID).Error == nil && thread.Archived
+}
+
+// ModerateThread changes a thread's pin, lock, archive and announcement
+// states. Omitted fields are left unchanged, except that sending announcement
+// also replaces its expiry, e.g.
+// {"pin": "global", "locked": true, "announcement": true, "announcement_expires_at": "2025-01-01T00:00:00Z"}
+func (r *Repository) ModerateThread(c *gin.Context) {
+	thread := models.Thread{}
+	if err := r.DB.First(&thread, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Thread not found"})
+		return
+	}
+
+	var moderateRequest struct {
+		Pin                   *string    `json:"pin"`
+		Locked                *bool      `json:"locked"`
+		Archived              *bool      `json:"archived"`
+		Announcement          *bool      `json:"announcement"`
+		AnnouncementExpiresAt *time.Time `json:"announcement_expires_at"`
+	}
+	if err := c.ShouldBindJSON(&moderateRequest); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Request failed"})
+		return
+	}
+
+	before := thread
+	changes := []string{}
+	if pin := moderateRequest.Pin; pin != nil && *pin != thread.Pin {
+		if *pin != "" && *pin != models.PinCategory && *pin != models.PinGlobal {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "pin must be empty, category or global"})
+			return
+		}
+		thread.Pin = *pin
+		thread.PinnedAt = nil
+		if *pin != "" {
+			now := time.Now()
+			thread.PinnedAt = &now
+		}
+		changes = append(changes, "pin")
+	}
+	if locked := moderateRequest.Locked; locked != nil && *locked != thread.Locked {
+		thread.Locked = *locked
+		changes = append(changes, "locked")
+	}
+	if archived := moderateRequest.Archived; archived != nil && *archived != thread.Archived {
+		thread.Archived = *archived
+		changes = append(changes, "archived")
+	}
+	if announcement := moderateRequest.Announcement; announcement != nil && *announcement != thread.Announcement {
+		thread.Announcement = *announcement
+		changes = append(changes, "announcement")
+	}
+	if moderateRequest.AnnouncementExpiresAt != nil || moderateRequest.Announcement != nil {
+		thread.AnnouncementExpiresAt = moderateRequest.AnnouncementExpiresAt
+		changes = append(changes, "announcement_expires_at")
+	}
+	if !thread.Announcement {
+		thread.AnnouncementExpiresAt = nil
+	}
+
+	if len(changes) > 0 {
+		err := r.DB.Transaction(func(tx *gorm.DB) error {
+			err := tx.Model(&thread).
+				Select("pin", "pinned_at", "locked", "archived", "announcement", "announcement_expires_at").
+				Updates(&thread).Error
+			if err != nil {
+				return err
+			}
+			return logModeration(tx, models.ModerationLog{
+				ModeratorID: currentUserID(c),
+				Action:      models.ModerationState,
+				ThreadID:    thread.ID,
+				Detail:      strings.Join(changes, ","),
+			})
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not update thread"})
+			return
+		}
+		r.audit(c, models.AuditThreadModerate, models.TargetThread, thread.ID, before, thread)
+		r.Events.Publish(events.Event{
+			Type:       events.ThreadModerated,
+			ThreadID:   thread.ID,
+			CategoryID: thread.CategoryID,
+			UserID:     currentUserID(c),
+			AuthorID:   thread.UserID,
+			Detail:     strings.Join(changes, ","),
+		})
+	}
+
+	threads := []models.Thread{thread}
+	r.attachQuestionState(threads)
+	c.JSON(http.StatusOK, gin.H{"message": "Thread updated successfully", "data": threads[0]})
+}
+
+// GetAnnouncements lists the announcements that have not expired, newest first
+func (r *Repository) GetAnnouncements(c *gin.Context) {
+	query := r.DB.Where("announcement = ? AND (announcement_expires_at IS NULL OR announcement_expires_at > ?) AND merged_into_id IS NULL AND hidden = ?", true, time.Now(), false)
+	if denied := r.restrictedCategoryIDs(currentUserID(c), "can_view"); len(denied) > 0 {
+		query = query.Where("category_id NOT IN ?", denied)
+	}
+
+	threads := []models.Thread{}
+	if err := query.Order("id DESC").Find(&threads).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get announcements"})
+		return
+	}
+	r.attachThreadMentions(threads)
+	r.attachThreadReactions(threads, currentUserID(c))
+	r.attachQuestionState(threads)
+	c.JSON(http.StatusOK, threads)
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/damiancxliew/web-forum/events"
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Deleted threads, comments and users stay in the trash, where moderators can
+// restore them, until the purge job removes them for good. Rows deleted
+// together share one deleted_at, which is how restoring a thread or user
+// finds what went with it.
+
+const (
+	defaultTrashRetentionDays = 30
+	trashPurgeInterval        = time.Hour
+)
+
+// trashRetentionDays can be overridden with TRASH_RETENTION_DAYS
+func trashRetentionDays() int {
+	days, err := strconv.Atoi(os.Getenv("TRASH_RETENTION_DAYS"))
+	if err != nil || days < 1 {
+		return defaultTrashRetentionDays
+	}
+	return days
+}
+
+// trashFields marks rows as deleted by userID at the given time
+func trashFields(userID uint, reason string, at time.Time) map[string]interface{} {
+	var deletedBy *uint
+	if userID != 0 {
+		deletedBy = &userID
+	}
+	return map[string]interface{}{"deleted_at": at, "deleted_by": deletedBy, "delete_reason": reason}
+}
+
+// restoreFields takes rows out of the trash
+var restoreFields = map[string]interface{}{"deleted_at": nil, "deleted_by": nil, "delete_reason": ""}
+
+// trashThreads moves threads to the trash with every comment still in them
+func trashThreads(tx *gorm.DB, threadIDs []uint, fields map[string]interface{}) error {
+	if len(threadIDs) == 0 {
+		return nil
+	}
+	if err := tx.Model(&models.Comment{}).Where("thread_id IN ?", threadIDs).Updates(fields).Error; err != nil {
+		return err
+	}
+	return tx.Model(&models.Thread{}).Where("id IN ?", threadIDs).Updates(fields).Error
+}
+
+// threadTombstone is what non-moderators see of a deleted thread
+func threadTombstone(thread models.Thread) models.Thread {
+	return models.Thread{
+		ID:          thread.ID,
+		CategoryID:  thread.CategoryID,
+		CreatedAt:   thread.CreatedAt,
+		DeletedAt:   thread.DeletedAt,
+		Mentions:    []models.Mention{},
+		Reactions:   map[string]int{},
+		MyReactions: []string{},
+	}
+}
+
+// commentTombstone is what non-moderators see of a deleted or hidden comment:
+// where it was and when, but not what it said or who wrote it
+func commentTombstone(comment models.Comment) models.Comment {
+	return models.Comment{
+		ID:          comment.ID,
+		ThreadID:    comment.ThreadID,
+		ParentID:    comment.ParentID,
+		CreatedAt:   comment.CreatedAt,
+		DeletedAt:   comment.DeletedAt,
+		Hidden:      comment.Hidden,
+		Mentions:    []models.Mention{},
+		Reactions:   map[string]int{},
+		MyReactions: []string{},
+	}
+}
+
+// listTrash responds with one page of the deleted rows of query's model,
+// most recently deleted first
+func listTrash(c *gin.Context, query *gorm.DB, items interface{}) {
+	page, pageSize := pagination(c)
+	query = query.Where("deleted_at IS NOT NULL").Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get trash"})
+		return
+	}
+	err := query.Order("deleted_at DESC, id DESC").Limit(pageSize).Offset((page - 1) * pageSize).Find(items).Error
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not get trash"})
+		return
+	}
+
+	response := paginated(items, page, pageSize, total)
+	response["retention_days"] = trashRetentionDays()
+	c.JSON(http.StatusOK, response)
+}
+
+// GetTrashedThreads lists deleted threads
+func (r *Repository) GetTrashedThreads(c *gin.Context) {
+	listTrash(c, r.DB.Unscoped().Model(&models.Thread{}), &[]models.Thread{})
+}
+
+// GetTrashedComments lists deleted comments, leaving out those that went with
+// a deleted thread, which come back when the thread is restored
+func (r *Repository) GetTrashedComments(c *gin.Context) {
+	query := r.DB.Unscoped().Model(&models.Comment{}).
+		Where("thread_id IN (?)", r.DB.Model(&models.Thread{}).Select("id"))
+	listTrash(c, query, &[]models.Comment{})
+}
+
+// GetTrashedUsers lists deleted users
+func (r *Repository) GetTrashedUsers(c *gin.Context) {
+	listTrash(c, r.DB.Unscoped().Model(&models.User{}), &[]models.User{})
+}
+
+// RestoreThread takes a thread out of the trash along with the comments that
+// were deleted with it
+func (r *Repository) RestoreThread(c *gin.Context) {
+	thread := models.Thread{}
+	if err := r.DB.Unscoped().First(&thread, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Thread not found"})
+		return
+	}
+	if !thread.DeletedAt.Valid {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "This thread is not in the trash"})
+		return
+	}
+
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Model(&models.Comment{}).
+			Where("thread_id = ? AND deleted_at = ?", thread.ID, thread.DeletedAt.Time).
+			Updates(restoreFields).Error
+		if err != nil {
+			return err
+		}
+		return tx.Unscoped().Model(&thread).Updates(restoreFields).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not restore thread"})
+		return
+	}
+	r.audit(c, models.AuditThreadRestore, models.TargetThread, thread.ID, thread, restoreFields)
+
+	r.Events.Publish(events.Event{
+		Type:       events.ThreadRestored,
+		ThreadID:   thread.ID,
+		CategoryID: thread.CategoryID,
+		UserID:     currentUserID(c),
+		AuthorID:   thread.UserID,
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "Thread restored successfully"})
+}
+
+// RestoreComment takes a comment out of the trash. Comments deleted with
+// their thread come back by restoring the thread instead.
+func (r *Repository) RestoreComment(c *gin.Context) {
+	comment := models.Comment{}
+	if err := r.DB.Unscoped().First(&comment, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Comment not found"})
+		return
+	}
+	if !comment.DeletedAt.Valid {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "This comment is not in the trash"})
+		return
+	}
+	thread := models.Thread{}
+	if err := r.DB.First(&thread, comment.ThreadID).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Restore the comment's thread first"})
+		return
+	}
+
+	if err := r.DB.Unscoped().Model(&comment).Updates(restoreFields).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not restore comment"})
+		return
+	}
+	r.audit(c, models.AuditCommentRestore, models.TargetComment, comment.ID, comment, restoreFields)
+
+	r.Events.Publish(events.Event{
+		Type:       events.CommentRestored,
+		ThreadID:   comment.ThreadID,
+		CommentID:  comment.ID,
+		CategoryID: thread.CategoryID,
+		UserID:     currentUserID(c),
+		AuthorID:   comment.UserID,
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "Comment restored successfully"})
+}
+
+// RestoreUser takes a user out of the trash along with the threads and
+// comments deleted with them
+func (r *Repository) RestoreUser(c *gin.Context) {
+	user := models.User{}
+	if err := r.DB.Unscoped().First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+	if !user.DeletedAt.Valid {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "This user is not in the trash"})
+		return
+	}
+
+	before, deletedAt := user, user.DeletedAt.Time
+	threads := []models.Thread{}
+	comments := []models.Comment{}
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Where("user_id = ? AND deleted_at = ?", user.ID, deletedAt).Find(&threads).Error
+		if err != nil {
+			return err
+		}
+		threadIDs := []uint{}
+		for _, thread := range threads {
+			threadIDs = append(threadIDs, thread.ID)
+		}
+		err = tx.Unscoped().Where("user_id = ? AND deleted_at = ?", user.ID, deletedAt).Find(&comments).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Unscoped().Model(&models.Comment{}).
+			Where("deleted_at = ? AND (user_id = ? OR thread_id IN ?)", deletedAt, user.ID, threadIDs).
+			Updates(restoreFields).Error
+		if err != nil {
+			return err
+		}
+		if len(threadIDs) > 0 {
+			if err := tx.Unscoped().Model(&models.Thread{}).Where("id IN ?", threadIDs).Updates(restoreFields).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Unscoped().Model(&user).Updates(restoreFields).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not restore user"})
+		return
+	}
+	r.audit(c, models.AuditUserRestore, models.TargetUser, user.ID, before,
+		gin.H{"threads": len(threads), "comments": len(comments)})
+
+	for _, comment := range comments {
+		r.Events.Publish(events.Event{
+			Type:       events.CommentRestored,
+			ThreadID:   comment.ThreadID,
+			CommentID:  comment.ID,
+			CategoryID: r.threadCategoryID(comment.ThreadID),
+			AuthorID:   comment.UserID,
+		})
+	}
+	for _, thread := range threads {
+		r.Events.Publish(events.Event{
+			Type:       events.ThreadRestored,
+			ThreadID:   thread.ID,
+			CategoryID: thread.CategoryID,
+			AuthorID:   thread.UserID,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User, threads, and comments restored successfully"})
+}
+
+// purgeComments permanently deletes comments and what hangs off them.
+// Replies and accepted answers that pointed at them are unlinked.
+func purgeComments(tx *gorm.DB, commentIDs []uint) error {
+	if len(commentIDs) == 0 {
+		return nil
+	}
+	for _, model := range []interface{}{&models.Mention{}, &models.GroupMention{}} {
+		if err := tx.Where("comment_id IN ?", commentIDs).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	if err := deleteReactions(tx, models.TargetComment, commentIDs); err != nil {
+		return err
+	}
+	if err := tx.Model(&models.Notification{}).Where("comment_id IN ?", commentIDs).Update("comment_id", nil).Error; err != nil {
+		return err
+	}
+	if err := tx.Unscoped().Model(&models.Comment{}).Where("parent_id IN ?", commentIDs).Update("parent_id", nil).Error; err != nil {
+		return err
+	}
+	err := tx.Unscoped().Model(&models.Thread{}).Where("accepted_comment_id IN ?", commentIDs).Update("accepted_comment_id", nil).Error
+	if err != nil {
+		return err
+	}
+	return tx.Unscoped().Where("id IN ?", commentIDs).Delete(&models.Comment{}).Error
+}
+
+// purgeThreads permanently deletes threads, every comment in them and what
+// hangs off both
+func purgeThreads(tx *gorm.DB, threadIDs []uint) error {
+	if len(threadIDs) == 0 {
+		return nil
+	}
+	var commentIDs []uint
+	if err := tx.Unscoped().Model(&models.Comment{}).Where("thread_id IN ?", threadIDs).Pluck("id", &commentIDs).Error; err != nil {
+		return err
+	}
+	if err := purgeComments(tx, commentIDs); err != nil {
+		return err
+	}
+	for _, model := range []interface{}{&models.Mention{}, &models.GroupMention{}, &models.ThreadTag{}, &models.Follow{}} {
+		if err := tx.Where("thread_id IN ?", threadIDs).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	if err := deleteReactions(tx, models.TargetThread, threadIDs); err != nil {
+		return err
+	}
+	if err := deletePolls(tx, threadIDs); err != nil {
+		return err
+	}
+	if err := tx.Model(&models.Notification{}).Where("thread_id IN ?", threadIDs).Update("thread_id", nil).Error; err != nil {
+		return err
+	}
+	return tx.Unscoped().Where("id IN ?", threadIDs).Delete(&models.Thread{}).Error
+}
+
+// purgeUserReactions takes back the reactions the users left on posts,
+// moving the denormalized counters and scores of those posts to match
+func purgeUserReactions(tx *gorm.DB, userIDs []uint) error {
+	type reactionTally struct {
+		TargetType string
+		TargetID   uint
+		Type       string
+		Count      int
+	}
+	tallies := []reactionTally{}
+	err := tx.Model(&models.Reaction{}).
+		Select("target_type, target_id, type, count(*) AS count").
+		Where("user_id IN ?", userIDs).
+		Group("target_type, target_id, type").
+		Order("target_type, target_id").
+		Scan(&tallies).Error
+	if err != nil {
+		return err
+	}
+	for _, tally := range tallies {
+		target := reactionTarget{Type: tally.TargetType, ID: tally.TargetID}
+		if err := lockTarget(tx, target); err != nil {
+			return err
+		}
+		if err := adjustReactionCount(tx, target, tally.Type, -tally.Count); err != nil {
+			return err
+		}
+		if err := adjustScore(tx, target, -scoreDelta(tally.Type)*tally.Count); err != nil {
+			return err
+		}
+	}
+	return tx.Where("user_id IN ?", userIDs).Delete(&models.Reaction{}).Error
+}
+
+// purgeUserVotes takes back the users' poll votes, moving the option and
+// voter counters to match
+func purgeUserVotes(tx *gorm.DB, userIDs []uint) error {
+	type voteTally struct {
+		PollID   uint
+		OptionID uint
+		Count    int
+	}
+	tallies := []voteTally{}
+	err := tx.Model(&models.PollVote{}).
+		Select("poll_id, option_id, count(*) AS count").
+		Where("user_id IN ?", userIDs).
+		Group("poll_id, option_id").
+		Scan(&tallies).Error
+	if err != nil {
+		return err
+	}
+	pollIDs := map[uint]bool{}
+	for _, tally := range tallies {
+		if !pollIDs[tally.PollID] {
+			// Votes are cast with the poll locked, so take it back the same way
+			pollIDs[tally.PollID] = true
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&models.Poll{}, tally.PollID).Error; err != nil {
+				return err
+			}
+		}
+		err := tx.Model(&models.PollOption{}).Where("id = ?", tally.OptionID).
+			Update("votes", gorm.Expr("votes - ?", tally.Count)).Error
+		if err != nil {
+			return err
+		}
+	}
+	for pollID := range pollIDs {
+		var voters int64
+		err := tx.Model(&models.PollVote{}).Where("poll_id = ? AND user_id IN ?", pollID, userIDs).
+			Distinct("user_id").Count(&voters).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&models.Poll{}).Where("id = ?", pollID).Update("voters", gorm.Expr("voters - ?", voters)).Error
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Where("user_id IN ?", userIDs).Delete(&models.PollVote{}).Error
+}
+
+// purgeUsers permanently deletes users and everything that belongs to them.
+// Their threads and comments must be purged first. Attachments keep their
+// rows until the attachments subscriber has removed the files.
+func purgeUsers(tx *gorm.DB, userIDs []uint) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	if err := purgeUserReactions(tx, userIDs); err != nil {
+		return err
+	}
+	if err := purgeUserVotes(tx, userIDs); err != nil {
+		return err
+	}
+	if err := tx.Where("user_id IN ? OR author_id IN ?", userIDs, userIDs).Delete(&models.Mention{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("author_id IN ?", userIDs).Delete(&models.GroupMention{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("user_id IN ? OR blocked_id IN ?", userIDs, userIDs).Delete(&models.UserBlock{}).Error; err != nil {
+		return err
+	}
+	owned := []interface{}{
+		&models.GroupMember{}, &models.Follow{}, &models.NotificationPreference{}, &models.DigestState{},
+		&models.Notification{}, &models.Profile{}, &models.UserBadge{}, &models.ReputationEvent{},
+		&models.Appeal{}, &models.Sanction{},
+	}
+	for _, model := range owned {
+		if err := tx.Where("user_id IN ?", userIDs).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Unscoped().Where("id IN ?", userIDs).Delete(&models.User{}).Error
+}
+
+// purgeResult counts what a purge removed
+type purgeResult struct {
+	Threads  int `json:"threads"`
+	Comments int `json:"comments"`
+	Users    int `json:"users"`
+}
+
+// purgeTrash permanently deletes everything that has been in the trash longer
+// than the retention period. Purging a user also purges all of their threads,
+// comments and other data, and takes back their reactions and votes. c is the request that asked for the purge, or nil for the
+// scheduled job.
+func (r *Repository) purgeTrash(c *gin.Context) (purgeResult, error) {
+	result := purgeResult{}
+	cutoff := time.Now().AddDate(0, 0, -trashRetentionDays())
+
+	var userIDs, threadIDs, commentIDs []uint
+	r.DB.Unscoped().Model(&models.User{}).Where("deleted_at < ?", cutoff).Pluck("id", &userIDs)
+	r.DB.Unscoped().Model(&models.Thread{}).Where("deleted_at < ? OR user_id IN ?", cutoff, userIDs).Pluck("id", &threadIDs)
+	commentQuery := r.DB.Unscoped().Model(&models.Comment{}).Where("deleted_at < ? OR user_id IN ?", cutoff, userIDs)
+	if len(threadIDs) > 0 {
+		commentQuery = commentQuery.Where("thread_id NOT IN ?", threadIDs)
+	}
+	commentQuery.Pluck("id", &commentIDs)
+	// Comment attachments are removed with their thread, so only comments
+	// purged on their own announce it
+	comments := []models.Comment{}
+	r.DB.Unscoped().Select("id", "thread_id").Where("id IN ?", commentIDs).Find(&comments)
+
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := purgeThreads(tx, threadIDs); err != nil {
+			return err
+		}
+		if err := purgeComments(tx, commentIDs); err != nil {
+			return err
+		}
+		return purgeUsers(tx, userIDs)
+	})
+	if err != nil {
+		return result, err
+	}
+
+	if len(userIDs)+len(threadIDs)+len(commentIDs) > 0 {
+		r.audit(c, models.AuditTrashPurge, models.TargetSystem, 0, nil,
+			gin.H{"user_ids": userIDs, "thread_ids": threadIDs, "comment_ids": commentIDs})
+	}
+	for _, threadID := range threadIDs {
+		r.Events.Publish(events.Event{Type: events.ThreadPurged, ThreadID: threadID})
+	}
+	for _, comment := range comments {
+		r.Events.Publish(events.Event{Type: events.CommentPurged, ThreadID: comment.ThreadID, CommentID: comment.ID})
+	}
+	for _, userID := range userIDs {
+		r.Events.Publish(events.Event{Type: events.UserPurged, AuthorID: userID})
+	}
+	result.Threads, result.Comments, result.Users = len(threadIDs), len(commentIDs), len(userIDs)
+	return result, nil
+}
+
+// StartTrashPurger periodically purges whatever has outlived the retention period
+func (r *Repository) StartTrashPurger(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(trashPurgeInterval)
+		defer ticker.Stop()
+		for {
+			if _, err := r.purgeTrash(nil); err != nil {
+				log.Println("Trash purge error:", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// PurgeTrash runs the purge job straight away
+func (r *Repository) PurgeTrash(c *gin.Context) {
+	result, err := r.purgeTrash(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not purge trash"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Trash purged successfully", "data": result})
+}
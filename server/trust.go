@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/damiancxliew/web-forum/models"
+	"github.com/gin-gonic/gin"
+)
+
+// trustCheckInterval is how often the batch job raises the trust level of
+// accounts that aged into a new level without posting
+const trustCheckInterval = time.Hour
+
+// defaultTrustRequirements is the account age in days and the number of
+// visible posts each trust level needs
+var defaultTrustRequirements = map[string]int{
+	"basic_days":   1,
+	"basic_posts":  3,
+	"member_days":  14,
+	"member_posts": 20,
+}
+
+// defaultNewUserLimits restrict users at the lowest trust level
+var defaultNewUserLimits = map[string]int{
+	"max_links":      2,
+	"posts_per_hour": 3,
+}
+
+// trustRequirements can be overridden with TRUST_REQUIREMENTS
+func trustRequirements() map[string]int {
+	return envInts("TRUST_REQUIREMENTS", defaultTrustRequirements)
+}
+
+// newUserLimits can be overridden with NEW_USER_LIMITS
+func newUserLimits() map[string]int {
+	return envInts("NEW_USER_LIMITS", defaultNewUserLimits)
+}
+
+// earnedTrustLevel is the trust level an account of the given age and number
+// of posts has earned. Accounts with an unknown join date (nil) predate join
+// dates being recorded, so they meet every age requirement.
+func earnedTrustLevel(joinedAt *time.Time, posts int64) int {
+	requirements := trustRequirements()
+	oldEnough := func(days int) bool {
+		return joinedAt == nil || time.Since(*joinedAt) >= time.Duration(days)*24*time.Hour
+	}
+	switch {
+	case oldEnough(requirements["member_days"]) && posts >= int64(requirements["member_posts"]):
+		return models.TrustMember
+	case oldEnough(requirements["basic_days"]) && posts >= int64(requirements["basic_posts"]):
+		return models.TrustBasic
+	default:
+		return models.TrustNew
+	}
+}
+
+// trustLevel returns the user's trust level, raising it first if the account
+// has earned more since it was last checked
+func (r *Repository) trustLevel(userID uint) int {
+	user := models.User{}
+	if err := r.DB.Select("id", "created_at", "trust_level").First(&user, userID).Error; err != nil {
+		return models.TrustNew
+	}
+	if user.TrustLevel >= models.TrustMember {
+		return user.TrustLevel
+	}
+
+	var threads, comments int64
+	r.DB.Model(&models.Thread{}).Where("user_id = ? AND hidden = ?", userID, false).Count(&threads)
+	r.DB.Model(&models.Comment{}).Where("user_id = ? AND hidden = ?", userID, false).Count(&comments)
+	level := earnedTrustLevel(user.CreatedAt, threads+comments)
+	if level <= user.TrustLevel {
+		return user.TrustLevel
+	}
+	// Levels only rise, so a concurrent check never lowers one
+	err := r.DB.Model(&models.User{}).Where("id = ? AND trust_level < ?", userID, level).
+		Update("trust_level", level).Error
+	if err != nil {
+		log.Println("Trust level update error:", err)
+	}
+	return level
+}
+
+// isNewUser reports whether the user is still at the lowest trust level.
+// Moderators and admins never are.
+func (r *Repository) isNewUser(userID uint) bool {
+	if r.hasRole(userID, models.RoleAdmin, models.RoleModerator) {
+		return false
+	}
+	return r.trustLevel(userID) == models.TrustNew
+}
+
+// checkNewUserLimits responds and returns false if a new user's post has too
+// many links or, when creating is set, if they already posted too often in
+// the last hour
+func (r *Repository) checkNewUserLimits(c *gin.Context, userID uint, links int, creating bool) bool {
+	limits := newUserLimits()
+	if links > limits["max_links"] {
+		c.JSON(http.StatusForbidden, gin.H{"message": fmt.Sprintf("New users can include at most %d links in a post", limits["max_links"])})
+		return false
+	}
+	if !creating {
+		return true
+	}
+
+	// Deleted posts count too, so removing them does not lift the limit
+	since := time.Now().Add(-time.Hour).UTC().Format(isoTimestamp)
+	var threads, comments int64
+	r.DB.Unscoped().Model(&models.Thread{}).Where("user_id = ? AND created_at > ?", userID, since).Count(&threads)
+	r.DB.Unscoped().Model(&models.Comment{}).Where("user_id = ? AND created_at > ?", userID, since).Count(&comments)
+	if threads+comments >= int64(limits["posts_per_hour"]) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"message": fmt.Sprintf("New users can post at most %d times an hour. Try again later", limits["posts_per_hour"])})
+		return false
+	}
+	return true
+}
+
+// StartTrustScheduler periodically raises the trust level of users who have
+// earned more since they last posted
+func (r *Repository) StartTrustScheduler(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(trustCheckInterval)
+		defer ticker.Stop()
+		for {
+			r.raiseTrustLevels()
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (r *Repository) raiseTrustLevels() {
+	oldEnough := time.Now().AddDate(0, 0, -trustRequirements()["basic_days"])
+	var userIDs []uint
+	err := r.DB.Model(&models.User{}).
+		Where("trust_level < ? AND (created_at <= ? OR created_at IS NULL)", models.TrustMember, oldEnough).
+		Pluck("id", &userIDs).Error
+	if err != nil {
+		log.Println("Trust level lookup error:", err)
+		return
+	}
+	for _, userID := range userIDs {
+		r.trustLevel(userID)
+	}
+}